@@ -11,7 +11,7 @@ func main() {
 	logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
 
 	if err := agent.Run(logger); err != nil {
-		logger.Fatal().Err(err)
+		logger.Fatal().Err(err).Send()
 	}
 	logger.Info().Msg("Graceful shutdown completed successfully. All connections closed, and resources released.")
 }
@@ -0,0 +1,308 @@
+// Package main provides a command-line tool for migrating, dumping and restoring metrics
+// between storage backends.
+//
+// Usage:
+//
+//	mstore copy    -from-file=/tmp/metrics-db.json -to-dsn=postgres://... [-dry-run] [-verify]
+//	mstore dump    -from-dsn=postgres://... -o=metrics.snapshot.gz
+//	mstore restore -i=metrics.snapshot.gz -to-file=/tmp/metrics-db.json [-dry-run] [-verify]
+//	mstore verify  -from-file=/tmp/metrics-db.json -to-redis=redis://localhost:6379/0
+//
+// copy and restore set the counters of the destination to the values of the source, so running
+// them again or on a populated destination does not count the counters twice. The metrics are
+// held in memory while they are transferred.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/storage"
+	storeConf "github.com/ospiem/mcollector/internal/storage/config"
+	"github.com/ospiem/mcollector/internal/storage/transfer"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// fileMode is the permission of the snapshot file created by dump.
+const fileMode = 0600
+
+// fileStoreInterval keeps the file backend from flushing on every write; it is flushed on close.
+const fileStoreInterval = time.Hour
+
+// errVerificationFailed is returned when the two sides differ after verification.
+var errVerificationFailed = errors.New("verification failed")
+
+// backendFlags holds the flags describing one storage backend.
+type backendFlags struct {
+	file  string
+	dsn   string
+	redis string
+}
+
+func main() {
+	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+
+	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelCtx()
+
+	if err := run(ctx, os.Args[1:], os.Stdout); err != nil {
+		cancelCtx()
+		log.Fatal().Err(err).Msg("mstore failed")
+	}
+}
+
+// run dispatches the subcommand given in args.
+func run(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("expected one of the subcommands: copy, dump, restore, verify")
+	}
+
+	switch args[0] {
+	case "copy":
+		return runCopy(ctx, args[1:], out)
+	case "dump":
+		return runDump(ctx, args[1:], out)
+	case "restore":
+		return runRestore(ctx, args[1:], out)
+	case "verify":
+		return runVerify(ctx, args[1:], out)
+	default:
+		return fmt.Errorf("unknown subcommand %q", args[0])
+	}
+}
+
+// runCopy copies all metrics from one backend to another.
+func runCopy(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("copy", flag.ContinueOnError)
+	var from, to backendFlags
+	from.register(fs, "from")
+	to.register(fs, "to")
+	batchSize := fs.Int("batch", 0, "number of metrics written per batch")
+	dryRun := fs.Bool("dry-run", false, "read the source without writing to the destination")
+	verify := fs.Bool("verify", false, "compare both sides after copying")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("failed to parse flags: %w", err)
+	}
+
+	src, err := from.open(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open source: %w", err)
+	}
+	defer closeStorage(ctx, src)
+
+	dst, err := to.open(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open destination: %w", err)
+	}
+	defer closeStorage(ctx, dst)
+
+	stats, err := transfer.Copy(ctx, src, dst, transfer.Options{BatchSize: *batchSize, DryRun: *dryRun})
+	if err != nil {
+		return fmt.Errorf("failed to copy metrics: %w", err)
+	}
+	printStats(out, "copied", stats, *dryRun)
+
+	if !*verify || *dryRun {
+		return nil
+	}
+	diffs, err := transfer.Verify(ctx, src, dst)
+	if err != nil {
+		return fmt.Errorf("failed to verify: %w", err)
+	}
+	return reportDiffs(out, diffs)
+}
+
+// runDump writes all metrics of a backend to a snapshot file.
+func runDump(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	var from backendFlags
+	from.register(fs, "from")
+	output := fs.String("o", "", "path to the snapshot file, '-' for stdout")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("failed to parse flags: %w", err)
+	}
+	if *output == "" {
+		return errors.New("the snapshot path must be set with -o")
+	}
+
+	src, err := from.open(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open source: %w", err)
+	}
+	defer closeStorage(ctx, src)
+
+	w := out
+	if *output != "-" {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileMode)
+		if err != nil {
+			return fmt.Errorf("failed to create snapshot file: %w", err)
+		}
+		defer func() {
+			if err := f.Close(); err != nil {
+				log.Error().Err(err).Msg("failed to close snapshot file")
+			}
+		}()
+		w = f
+	}
+
+	stats, err := transfer.Dump(ctx, src, w)
+	if err != nil {
+		return fmt.Errorf("failed to dump metrics: %w", err)
+	}
+	if *output != "-" {
+		printStats(out, "dumped", stats, false)
+	}
+	return nil
+}
+
+// runRestore writes the metrics of a snapshot file to a backend.
+func runRestore(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	var to backendFlags
+	to.register(fs, "to")
+	input := fs.String("i", "", "path to the snapshot file")
+	batchSize := fs.Int("batch", 0, "number of metrics written per batch")
+	dryRun := fs.Bool("dry-run", false, "validate the snapshot without writing to the destination")
+	verify := fs.Bool("verify", false, "compare the snapshot with the destination after restoring")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("failed to parse flags: %w", err)
+	}
+	if *input == "" {
+		return errors.New("the snapshot path must be set with -i")
+	}
+
+	f, err := os.Open(*input)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot file: %w", err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Error().Err(err).Msg("failed to close snapshot file")
+		}
+	}()
+
+	metrics, err := transfer.ReadSnapshot(f)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	dst, err := to.open(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open destination: %w", err)
+	}
+	defer closeStorage(ctx, dst)
+
+	stats, err := transfer.Copy(ctx, transfer.SnapshotStorage(metrics), dst,
+		transfer.Options{BatchSize: *batchSize, DryRun: *dryRun})
+	if err != nil {
+		return fmt.Errorf("failed to restore metrics: %w", err)
+	}
+	printStats(out, "restored", stats, *dryRun)
+
+	if !*verify || *dryRun {
+		return nil
+	}
+	diffs, err := transfer.Verify(ctx, transfer.SnapshotStorage(metrics), dst)
+	if err != nil {
+		return fmt.Errorf("failed to verify: %w", err)
+	}
+	return reportDiffs(out, diffs)
+}
+
+// runVerify compares the metrics of two backends.
+func runVerify(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	var from, to backendFlags
+	from.register(fs, "from")
+	to.register(fs, "to")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("failed to parse flags: %w", err)
+	}
+
+	left, err := from.open(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open source: %w", err)
+	}
+	defer closeStorage(ctx, left)
+
+	right, err := to.open(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open destination: %w", err)
+	}
+	defer closeStorage(ctx, right)
+
+	diffs, err := transfer.Verify(ctx, left, right)
+	if err != nil {
+		return fmt.Errorf("failed to verify: %w", err)
+	}
+	return reportDiffs(out, diffs)
+}
+
+// register adds the -<prefix>-file, -<prefix>-dsn and -<prefix>-redis flags to fs.
+func (b *backendFlags) register(fs *flag.FlagSet, prefix string) {
+	fs.StringVar(&b.file, prefix+"-file", "", "path to the JSON file storage")
+	fs.StringVar(&b.dsn, prefix+"-dsn", "", "postgres DSN")
+	fs.StringVar(&b.redis, prefix+"-redis", "", "redis URL")
+}
+
+// open opens the backend with storage.New. Exactly one of the file, DSN or redis URL must be set.
+func (b *backendFlags) open(ctx context.Context) (storage.Storage, error) {
+	set := 0
+	for _, v := range []string{b.file, b.dsn, b.redis} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, errors.New("exactly one of the file path, the DSN or the redis URL must be set")
+	}
+
+	s, err := storage.New(ctx, storeConf.Config{
+		FileStoragePath: b.file,
+		DatabaseDsn:     b.dsn,
+		RedisURL:        b.redis,
+		Restore:         true,
+		StoreInterval:   fileStoreInterval,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage: %w", err)
+	}
+	return s, nil
+}
+
+// closeStorage closes s and logs any error. The file backend is flushed on close.
+func closeStorage(ctx context.Context, s storage.Storage) {
+	if err := s.Close(ctx); err != nil {
+		log.Error().Err(err).Msg("failed to close storage")
+	}
+}
+
+// printStats prints the number of processed metrics.
+func printStats(out io.Writer, action string, stats transfer.Stats, dryRun bool) {
+	suffix := ""
+	if dryRun {
+		suffix = " (dry run, nothing was written)"
+	}
+	fmt.Fprintf(out, "%s %d counters and %d gauges%s\n", action, stats.Counters, stats.Gauges, suffix)
+}
+
+// reportDiffs prints the differences and returns errVerificationFailed if there are any.
+func reportDiffs(out io.Writer, diffs []transfer.Diff) error {
+	if len(diffs) == 0 {
+		fmt.Fprintln(out, "verification passed: both sides are equal")
+		return nil
+	}
+
+	for _, d := range diffs {
+		fmt.Fprintf(out, "%s %s: %s != %s\n", d.MType, d.ID, d.Left, d.Right)
+	}
+	return fmt.Errorf("%w: %d metrics differ", errVerificationFailed, len(diffs))
+}
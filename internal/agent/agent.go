@@ -16,22 +16,38 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/ethereum/go-ethereum/crypto/ecies"
+	"github.com/ospiem/mcollector/internal/agent/balancer"
 	"github.com/ospiem/mcollector/internal/agent/config"
+	"github.com/ospiem/mcollector/internal/agent/push"
+	"github.com/ospiem/mcollector/internal/agent/sink"
 	"github.com/ospiem/mcollector/internal/helper"
+	"github.com/ospiem/mcollector/internal/logging"
 	"github.com/ospiem/mcollector/internal/models"
+	"github.com/ospiem/mcollector/internal/reload"
+	"github.com/ospiem/mcollector/internal/requestid"
+	"github.com/ospiem/mcollector/internal/retry"
+	"github.com/ospiem/mcollector/internal/tracing"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// tracer traces the sends to the servers.
+var tracer = otel.Tracer("github.com/ospiem/mcollector/internal/agent")
+
 const timeoutShutdown = 15 * time.Second
 
 var buildVersion string = "N/A"
@@ -53,11 +69,20 @@ const counter = "counter"
 // cannotCreateRequest is the error message when a request cannot be created.
 const cannotCreateRequest = "cannot create request"
 
-// retryAttempts specifies the number of retry attempts.
-const retryAttempts = 3
+// retryAttempts specifies the total number of attempts to send metrics.
+const retryAttempts = 4
+
+// retryInitialInterval specifies the wait before the first retry.
+const retryInitialInterval = 1 * time.Second
+
+// retryMultiplier specifies the factor for increasing sleep time between retries.
+const retryMultiplier = 2
 
-// repeatFactor specifies the factor for increasing sleep time between retries.
-const repeatFactor = 2
+// retryMaxInterval caps the sleep time between retries.
+const retryMaxInterval = 30 * time.Second
+
+// maxRetryAfter caps the wait asked by the Retry-After header of a server.
+const maxRetryAfter = 5 * time.Minute
 
 // errRetryableHTTPStatusCode is the error for retryable HTTP status codes.
 var errRetryableHTTPStatusCode = errors.New("got retryable status code")
@@ -82,10 +107,39 @@ func Run(logger zerolog.Logger) error {
 	if err != nil {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
+	if cfg.PrintConfig {
+		return cfg.Report.Print(os.Stdout)
+	}
 
-	helper.SetGlobalLogLevel(cfg.LogLevel)
+	logger, logs, err := logging.New(cfg.Log, "mcollector-agent")
+	if err != nil {
+		return fmt.Errorf("failed to open log output: %w", err)
+	}
+	defer func() {
+		if err := logs.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+	if err := helper.SetGlobalLogLevel(cfg.LogLevel); err != nil {
+		return err
+	}
+	for _, w := range cfg.Report.Warnings {
+		logger.Log().Str("warning", w).Msg("configuration warning")
+	}
+
+	shutdownTracing, err := tracing.Start(ctx, cfg.Tracing, "mcollector-agent")
+	if err != nil {
+		return fmt.Errorf("failed to start tracing: %w", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeoutShutdown)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error().Err(err).Send()
+		}
+	}()
 	logger.Info().Msgf("Start server\nPush to %s\nCollecting metrics every %v\n"+
-		"Send metrics every %v\n", cfg.Endpoint, cfg.PollInterval, cfg.ReportInterval)
+		"Send metrics every %v\n", cfg.ServerEndpoints(), cfg.PollInterval, cfg.ReportInterval)
 
 	context.AfterFunc(ctx, func() {
 		ctx, cancelCtx := context.WithTimeout(context.Background(), timeoutShutdown)
@@ -102,51 +156,125 @@ func Run(logger zerolog.Logger) error {
 	}()
 
 	mc := NewMetricsCollection()
-	collectTicker := time.NewTicker(cfg.PollInterval)
-	sendTicker := time.NewTicker(cfg.ReportInterval)
+	collectTicker := newJitteredTicker(cfg.PollInterval)
+	sendTicker := newJitteredTicker(cfg.ReportInterval)
 	defer collectTicker.Stop()
 	defer sendTicker.Stop()
 
-	jobs := make(chan map[string]string, cfg.RateLimit)
-
 	pubKey, err := parsePubKey(cfg.CryptoKey)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("failed to parse public key")
 	}
 
-	for i := 0; i < cfg.RateLimit; i++ {
-		wg.Add(1)
-		go Worker(ctx, wg, cfg, jobs, pubKey, logger)
+	b, err := balancer.New(balancer.Config{
+		Strategy:  balancer.Strategy(cfg.Balancing),
+		AgentID:   cfg.AgentID,
+		Endpoints: cfg.ServerEndpoints(),
+		MaxFails:  cfg.MaxFails,
+		EjectTime: cfg.EjectTime,
+	}, logger)
+	if err != nil {
+		return fmt.Errorf("failed to create balancer: %w", err)
+	}
+
+	keys := &atomic.Pointer[mcollectorKeys]{}
+	keys.Store(&mcollectorKeys{cfg: cfg, pubKey: pubKey})
+	outputs, err := newOutputs(cfg, b, keys, logger)
+	if err != nil {
+		return fmt.Errorf("failed to create outputs: %w", err)
+	}
+
+	cs, err := startCollectors(ctx, cfg, logger)
+	if err != nil {
+		return err
 	}
 
+	// Report the health of the agent along with the metrics and on the status endpoints.
+	st := newStatus(outputs, cs, cfg.ReportInterval, logger)
+	cs.sources = append(cs.sources, st.metrics)
+	if cfg.StatusListen != "" {
+		statusLog := logger.With().Str("component", "status").Logger()
+		srv, err := push.Listen(cfg.StatusListen, st.handler(), statusLog)
+		if err != nil {
+			cs.stop()
+			return fmt.Errorf("failed to start status endpoints: %w", err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), pushShutdownTimeout)
+			defer cancel()
+			if err := srv.Shutdown(ctx); err != nil {
+				logger.Error().Err(err).Msg("failed to close status endpoints")
+			}
+		}()
+	}
+
+	// Apply the config changed on SIGHUP or in the config file while running.
+	lv := &live{cfg: cfg, collect: collectTicker, send: sendTicker, outputs: outputs, keys: keys, st: st, log: logger}
+	reloads := reload.Watch(ctx, cfg.Config, reload.FileCheckInterval, logger)
+
 	for {
 		select {
 		case <-ctx.Done():
-			metrics := mc.Pop()
-			fmt.Println(metrics)
-			metrircsSlice := createMetricSlice(metrics, &logger)
-			if err := doRequestWithJSON(cfg, metrircsSlice, pubKey, &logger); err != nil {
+			cs.stop()
+			outputs.Send(newBatch(mc, cs.sources, &logger))
+
+			closeCtx, cancelClose := context.WithTimeout(context.Background(), outputsCloseTimeout)
+			defer cancelClose()
+			if err := outputs.Close(closeCtx); err != nil {
 				logger.Error().Err(err).Msg("failed to send last metrics")
 			}
 			return nil
 		case <-collectTicker.C:
+			collectTicker.ticked()
 			metrics, err := GetMetrics()
 			if err != nil {
 				logger.Error().Err(err).Msg("cannot get metrics")
+				st.runtimeErrors.Add(1)
 				continue
 			}
 			mc.Push(metrics)
 		case <-sendTicker.C:
-			metrics := mc.Pop()
-			select {
-			case jobs <- metrics:
-			default:
-				logger.Error().Msg("failed to send another job to workers, all workers are busy")
+			sendTicker.ticked()
+			outputs.Send(newBatch(mc, cs.sources, &logger))
+		case _, ok := <-reloads:
+			if !ok {
+				reloads = nil
+				continue
 			}
+			lv.reload(func() (config.Config, error) { return config.Load(os.Args[1:]) })
 		}
 	}
 }
 
+// jitteredTicker ticks on its interval after a random first delay shorter than the interval,
+// so the agents of a fleet restarted at once do not all poll and report at the same time.
+type jitteredTicker struct {
+	*time.Ticker
+	interval time.Duration
+	started  bool
+}
+
+func newJitteredTicker(interval time.Duration) *jitteredTicker {
+	first := max(time.Duration(rand.Int63n(int64(interval))), time.Millisecond)
+	return &jitteredTicker{Ticker: time.NewTicker(first), interval: interval}
+}
+
+// setInterval changes the interval from the next tick on.
+func (t *jitteredTicker) setInterval(interval time.Duration) {
+	t.interval = interval
+	if t.started {
+		t.Reset(interval)
+	}
+}
+
+// ticked must be called on every tick, it sets the interval after the first one.
+func (t *jitteredTicker) ticked() {
+	if !t.started {
+		t.started = true
+		t.Reset(t.interval)
+	}
+}
+
 // NewMetricsCollection creates a new MetricsCollection instance.
 func NewMetricsCollection() *MetricsCollection {
 	return &MetricsCollection{
@@ -169,54 +297,35 @@ func (mc *MetricsCollection) Pop() map[string]string {
 	return mc.coll
 }
 
-// Worker represents a worker that processes metrics.
-func Worker(ctx context.Context, wg *sync.WaitGroup, cfg config.Config,
-	dataChan chan map[string]string, pubKey *ecies.PublicKey, log zerolog.Logger) {
-	defer wg.Done()
-	l := log.With().Str("func", "worker").Logger()
-	reqTicker := time.NewTicker(cfg.ReportInterval)
-	defer reqTicker.Stop()
+// sendRetryPolicy returns the policy used to retry sending metrics to an output.
+// The sinks wrap the errors that must not be retried with retry.Permanent.
+func sendRetryPolicy(l zerolog.Logger) retry.Policy {
+	return retry.Policy{
+		InitialInterval: retryInitialInterval,
+		MaxInterval:     retryMaxInterval,
+		Multiplier:      retryMultiplier,
+		FullJitter:      true,
+		MaxAttempts:     retryAttempts,
+		OnRetry: func(err error, wait time.Duration) {
+			l.Error().Err(err).Dur("wait", wait).Msg(cannotCreateRequest + ", will retry")
+		},
+	}
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			l.Info().Msg("Stopping worker")
-			return
-		case <-reqTicker.C:
-
-			metrics := <-dataChan
-			metricSlice := createMetricSlice(metrics, &log)
-			attempt := 0
-			sleepTime := 1 * time.Second
-
-			for {
-				select {
-				case <-ctx.Done():
-					l.Info().Msg("Stopping worker")
-					return
-				default:
-				}
-
-				var opError *net.OpError
-				l.Debug().Msg("Sending metrics to the server")
-				err := doRequestWithJSON(cfg, metricSlice, pubKey, &log)
-				if err == nil {
-					break
-				}
-				if errors.As(err, &opError) || errors.Is(err, errRetryableHTTPStatusCode) {
-					l.Error().Err(err).Msgf("%s, will retry in %v", cannotCreateRequest, sleepTime)
-					time.Sleep(sleepTime)
-					attempt++
-					sleepTime += repeatFactor * time.Second
-					if attempt < retryAttempts {
-						continue
-					}
-					break
-				}
-				l.Error().Err(err).Msgf("cannot do request, failed %d times", retryAttempts)
-			}
-		}
+// isRetryable checks if a failed request may be retried.
+func isRetryable(err error) bool {
+	return retry.IsNetworkError(err) || errors.Is(err, errRetryableHTTPStatusCode) ||
+		errors.Is(err, balancer.ErrAllEjected)
+}
+
+// newBatch builds the batch to report from the collected runtime metrics and the metrics
+// flushed from the other sources.
+func newBatch(mc *MetricsCollection, sources []func() []models.Metrics, l *zerolog.Logger) sink.Batch {
+	metrics := createMetricSlice(mc.Pop(), l)
+	for _, flush := range sources {
+		metrics = append(metrics, flush()...)
 	}
+	return sink.Batch{Time: time.Now(), Metrics: metrics}
 }
 
 // createMetricSlice creates a slice of metrics from a map.
@@ -240,41 +349,98 @@ func createMetricSlice(metrics map[string]string, l *zerolog.Logger) []models.Me
 	return metricSlice
 }
 
-// doRequestWithJSON sends a request with JSON data.
-func doRequestWithJSON(cfg config.Config, metrics []models.Metrics, pubKey *ecies.PublicKey, l *zerolog.Logger) error {
+// sendMetrics sends the metrics to the servers in the order picked by the balancer
+// until one of them accepts them. If every server is ejected, the retry waits for the
+// first one to be probed. The requests carry the request ID of ctx, so the logs of the agent and
+// of the servers about the batch can be matched.
+func sendMetrics(ctx context.Context, cfg config.Config, b *balancer.Balancer, metrics []models.Metrics,
+	pubKey *ecies.PublicKey, l *zerolog.Logger) error {
+	endpoints := b.Endpoints()
+	if len(endpoints) == 0 {
+		return retry.After(balancer.ErrAllEjected, b.NextProbe())
+	}
+
+	// Every request about the batch carries the same ID, generated if the caller has none.
+	if requestid.FromContext(ctx) == "" {
+		ctx = requestid.NewContext(ctx, requestid.New())
+	}
+	log := requestid.Logger(ctx, *l)
+
+	var errs []error
+	for _, ep := range endpoints {
+		err := doRequestWithJSON(ctx, cfg, ep, metrics, pubKey, &log)
+		if err == nil {
+			b.Success(ep)
+			return nil
+		}
+		if !isRetryable(err) {
+			return err
+		}
+
+		b.Failure(ep)
+		log.Warn().Err(err).Str("endpoint", ep).Msg("failed to send metrics, trying the next server")
+		errs = append(errs, fmt.Errorf("%s: %w", ep, err))
+	}
+	return errors.Join(errs...)
+}
+
+// doRequestWithJSON sends a request with JSON data to the server endpoint. Every step is traced
+// in a span of its own, and the trace goes on in the server through the request headers.
+func doRequestWithJSON(ctx context.Context, cfg config.Config, endpoint string, metrics []models.Metrics,
+	pubKey *ecies.PublicKey, l *zerolog.Logger) (err error) {
 	const wrapError = "do request error"
 
+	ctx, span := tracer.Start(ctx, "send metrics", trace.WithAttributes(attribute.String("server.address", endpoint), attribute.Int("metrics", len(metrics))))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	_, step := tracer.Start(ctx, "marshal")
 	jsonData, err := json.Marshal(metrics)
+	step.End()
 	if err != nil {
 		return fmt.Errorf("error marshaling JSON: %w", err)
 	}
 
+	_, step = tracer.Start(ctx, "encrypt")
 	encryptedData, err := encryptData(jsonData, pubKey)
+	step.End()
 	if err != nil {
 		return fmt.Errorf("cannot encrypt data: %w", err)
 	}
 
+	_, step = tracer.Start(ctx, "gzip")
 	var buf bytes.Buffer
 	g := gzip.NewWriter(&buf)
-	if _, err = g.Write(encryptedData); err != nil {
-		return fmt.Errorf("create gzip in %s: %w", wrapError, err)
+	_, err = g.Write(encryptedData)
+	if err == nil {
+		err = g.Close()
 	}
-	if err = g.Close(); err != nil {
-		return fmt.Errorf("close gzip in %s: %w", wrapError, err)
+	step.End()
+	if err != nil {
+		return fmt.Errorf("gzip in %s: %w", wrapError, err)
 	}
 
-	ep := fmt.Sprintf("%v%v%v", defaultSchema, cfg.Endpoint, updatePath)
+	ep := fmt.Sprintf("%v%v%v", defaultSchema, endpoint, updatePath)
 
-	request, err := http.NewRequest(http.MethodPost, ep, &buf)
+	ctx, step = tracer.Start(ctx, "POST "+updatePath, trace.WithSpanKind(trace.SpanKindClient))
+	defer step.End()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, ep, &buf)
 	if err != nil {
 		return fmt.Errorf("generate request %s: %w", wrapError, err)
 	}
 
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("Content-Encoding", "gzip")
+	request.Header.Set(requestid.Header, requestid.FromContext(ctx))
 	if cfg.Key != "" {
 		request.Header.Set("HashSHA256", generateHash(cfg.Key, encryptedData, *l))
 	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(request.Header))
 
 	client := &http.Client{}
 	r, err := client.Do(request)
@@ -285,14 +451,38 @@ func doRequestWithJSON(cfg config.Config, metrics []models.Metrics, pubKey *ecie
 	if err != nil {
 		return fmt.Errorf("body close %s: %w", wrapError, err)
 	}
+	step.SetAttributes(attribute.Int("http.response.status_code", r.StatusCode))
 
 	if isStatusCodeRetryable(r.StatusCode) {
-		return errRetryableHTTPStatusCode
+		err := fmt.Errorf("%w %d", errRetryableHTTPStatusCode, r.StatusCode)
+		if wait, ok := parseRetryAfter(r.Header.Get("Retry-After"), time.Now()); ok {
+			return retry.After(err, wait)
+		}
+		return err
+	}
+	if r.StatusCode < http.StatusOK || r.StatusCode >= http.StatusMultipleChoices {
+		return retry.Permanent(fmt.Errorf("unexpected status %d", r.StatusCode))
 	}
 
 	return nil
 }
 
+// parseRetryAfter returns the wait asked by a Retry-After header, given in seconds or as an HTTP date.
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(header); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		wait = date.Sub(now)
+	} else {
+		return 0, false
+	}
+	return min(max(wait, 0), maxRetryAfter), true
+}
+
 // parsePubKey reads a PEM-encoded public key from a file, decodes it,
 // parses it into and ECDSA public key and then imports it into an ECIES public key.
 func parsePubKey(path string) (*ecies.PublicKey, error) {
@@ -345,6 +535,7 @@ func encryptData(data []byte, publicKey *ecies.PublicKey) ([]byte, error) {
 func isStatusCodeRetryable(code int) bool {
 	switch code {
 	case
+		http.StatusTooManyRequests,
 		http.StatusInternalServerError,
 		http.StatusBadGateway,
 		http.StatusServiceUnavailable,
@@ -1,14 +1,42 @@
 package agent
 
 import (
+	"context"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/ospiem/mcollector/internal/agent/balancer"
+	"github.com/ospiem/mcollector/internal/agent/config"
+	"github.com/ospiem/mcollector/internal/requestid"
+	"github.com/ospiem/mcollector/internal/retry"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
+// testCertPEM is a certificate with an ECDSA public key.
+const testCertPEM = `-----BEGIN CERTIFICATE-----
+MIIBUzCB2qADAgECAgEBMAoGCCqGSM49BAMCMBUxEzARBgNVBAoTCm1jb2xsZWN0
+b3IwHhcNMjQwMzMxMTM1ODU1WhcNMzQwMzMxMTM1ODU1WjAVMRMwEQYDVQQKEwpt
+Y29sbGVjdG9yMHYwEAYHKoZIzj0CAQYFK4EEACIDYgAEQ08QQSIFpW5S+sxDm1/4
+/hG4UJrPd3SY4m/MN0PKdrscZncrzS6cmiJ0JErxOle06bQSRRA/CgIV6qPDKtS4
+thJEFEqLzIsr+3SJvDmX4xGutdJQmcj3AQSlS2R38CBsMAoGCCqGSM49BAMCA2gA
+MGUCMQCNAqIjkUlhQUuyaKOuO2gJbr92lxIL5tYkIJ6johEi4aRjCLPOLKf2Lnb4
+IoZJD6oCMDuhQlLu3fV4BLuSiHIXGp56mHG9FpWdFvNq5i7g3bkxt4bbwMdLCeyf
+t0IlJDQqiw==
+-----END CERTIFICATE-----
+`
+
 func TestMetricsCollection_PushAndPop(t *testing.T) {
 	mc := NewMetricsCollection()
 	metrics := map[string]string{
@@ -33,6 +61,11 @@ func TestIsStatusCodeRetryable(t *testing.T) {
 			code: http.StatusInternalServerError,
 			want: true,
 		},
+		{
+			name: "Too many requests",
+			code: http.StatusTooManyRequests,
+			want: true,
+		},
 		{
 			name: "Non-retryable status code",
 			code: http.StatusOK,
@@ -48,6 +81,31 @@ func TestIsStatusCodeRetryable(t *testing.T) {
 	}
 }
 
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{name: "seconds", header: "120", want: 2 * time.Minute, ok: true},
+		{name: "date", header: "Mon, 01 Jan 2024 00:00:30 GMT", want: 30 * time.Second, ok: true},
+		{name: "past date", header: "Sun, 31 Dec 2023 23:00:00 GMT", want: 0, ok: true},
+		{name: "capped", header: "86400", want: maxRetryAfter, ok: true},
+		{name: "missing", header: "", ok: false},
+		{name: "invalid", header: "soon", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.header, now)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
 func TestGenerateHash(t *testing.T) {
 	key := "fiok120uo8i3rhfkw"
 	data := []byte("testData")
@@ -90,17 +148,7 @@ func TestEncryptDataWithInvalidCertificate(t *testing.T) {
 }
 
 func TestEncryptDataWithValidCertificate(t *testing.T) {
-	err := os.WriteFile("/tmp/valid.pem", []byte(`-----BEGIN CERTIFICATE-----
-MIIBUzCB2qADAgECAgEBMAoGCCqGSM49BAMCMBUxEzARBgNVBAoTCm1jb2xsZWN0
-b3IwHhcNMjQwMzMxMTM1ODU1WhcNMzQwMzMxMTM1ODU1WjAVMRMwEQYDVQQKEwpt
-Y29sbGVjdG9yMHYwEAYHKoZIzj0CAQYFK4EEACIDYgAEQ08QQSIFpW5S+sxDm1/4
-/hG4UJrPd3SY4m/MN0PKdrscZncrzS6cmiJ0JErxOle06bQSRRA/CgIV6qPDKtS4
-thJEFEqLzIsr+3SJvDmX4xGutdJQmcj3AQSlS2R38CBsMAoGCCqGSM49BAMCA2gA
-MGUCMQCNAqIjkUlhQUuyaKOuO2gJbr92lxIL5tYkIJ6johEi4aRjCLPOLKf2Lnb4
-IoZJD6oCMDuhQlLu3fV4BLuSiHIXGp56mHG9FpWdFvNq5i7g3bkxt4bbwMdLCeyf
-t0IlJDQqiw==
------END CERTIFICATE-----
-`), 0600)
+	err := os.WriteFile("/tmp/valid.pem", []byte(testCertPEM), 0600)
 	assert.NoError(t, err)
 	pubKey, err := parsePubKey("/tmp/valid.pem")
 	assert.NoError(t, err)
@@ -108,3 +156,158 @@ t0IlJDQqiw==
 	assert.NoError(t, err)
 	os.Remove("/tmp/valid.pem")
 }
+
+func TestSendMetricsFailsOver(t *testing.T) {
+	certPath := filepath.Join(t.TempDir(), "cert.pem")
+	require.NoError(t, os.WriteFile(certPath, []byte(testCertPEM), 0600))
+	pubKey, err := parsePubKey(certPath)
+	require.NoError(t, err)
+
+	var primaryHits, backupHits atomic.Int32
+	primaryDown := atomic.Bool{}
+	primaryDown.Store(true)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryHits.Add(1)
+		if primaryDown.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer primary.Close()
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backupHits.Add(1)
+	}))
+	defer backup.Close()
+
+	primaryAddr, backupAddr := strings.TrimPrefix(primary.URL, "http://"), strings.TrimPrefix(backup.URL, "http://")
+	b, err := balancer.New(balancer.Config{
+		Endpoints: []string{primaryAddr, backupAddr},
+		MaxFails:  2,
+		EjectTime: 100 * time.Millisecond,
+	}, zerolog.Nop())
+	require.NoError(t, err)
+
+	l := zerolog.Nop()
+	metrics := createMetricSlice(map[string]string{"Alloc": "1"}, &l)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, sendMetrics(context.Background(), config.Config{}, b, metrics, pubKey, &l))
+	}
+	// The primary is ejected after two failures.
+	assert.Equal(t, int32(2), primaryHits.Load())
+	assert.Equal(t, int32(3), backupHits.Load())
+
+	// Sends return to the primary once it recovers.
+	primaryDown.Store(false)
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, sendMetrics(context.Background(), config.Config{}, b, metrics, pubKey, &l))
+	assert.Equal(t, int32(3), primaryHits.Load())
+	assert.Equal(t, int32(3), backupHits.Load())
+	assert.Equal(t, []string{primaryAddr, backupAddr}, b.Endpoints())
+}
+
+func TestSendMetricsWaitsForEjectedServers(t *testing.T) {
+	certPath := filepath.Join(t.TempDir(), "cert.pem")
+	require.NoError(t, os.WriteFile(certPath, []byte(testCertPEM), 0600))
+	pubKey, err := parsePubKey(certPath)
+	require.NoError(t, err)
+
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Retry-After", "3")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	b, err := balancer.New(balancer.Config{
+		Endpoints: []string{strings.TrimPrefix(srv.URL, "http://")},
+		MaxFails:  1,
+		EjectTime: time.Minute,
+	}, zerolog.Nop())
+	require.NoError(t, err)
+
+	l := zerolog.Nop()
+	metrics := createMetricSlice(nil, &l)
+	// Waiting the 3s asked by the server exceeds the elapsed time allowed, so there is no retry.
+	p := retry.Policy{
+		InitialInterval: time.Millisecond,
+		MaxElapsedTime:  2 * time.Second,
+		FullJitter:      true,
+		Retryable:       isRetryable,
+	}
+	err = p.Do(context.Background(), func(ctx context.Context) error {
+		return sendMetrics(context.Background(), config.Config{}, b, metrics, pubKey, &l)
+	})
+	assert.ErrorIs(t, err, errRetryableHTTPStatusCode)
+	assert.Equal(t, int32(1), hits.Load())
+
+	// The ejected server gets no request until it is probed.
+	err = sendMetrics(context.Background(), config.Config{}, b, metrics, pubKey, &l)
+	assert.ErrorIs(t, err, balancer.ErrAllEjected)
+	assert.Equal(t, int32(1), hits.Load())
+}
+
+func TestSendMetricsPropagatesTrace(t *testing.T) {
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	defer otel.SetTextMapPropagator(otel.GetTextMapPropagator())
+	rec := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	certPath := filepath.Join(t.TempDir(), "cert.pem")
+	require.NoError(t, os.WriteFile(certPath, []byte(testCertPEM), 0600))
+	pubKey, err := parsePubKey(certPath)
+	require.NoError(t, err)
+
+	var traceparent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer srv.Close()
+	b, err := balancer.New(balancer.Config{Endpoints: []string{strings.TrimPrefix(srv.URL, "http://")}}, zerolog.Nop())
+	require.NoError(t, err)
+
+	l := zerolog.Nop()
+	metrics := createMetricSlice(map[string]string{"Alloc": "1"}, &l)
+	require.NoError(t, sendMetrics(context.Background(), config.Config{}, b, metrics, pubKey, &l))
+
+	var names []string
+	for _, s := range rec.Ended() {
+		names = append(names, s.Name())
+	}
+	assert.Equal(t, []string{"marshal", "encrypt", "gzip", "POST /updates/", "send metrics"}, names)
+	request := rec.Ended()[3].SpanContext()
+	assert.Equal(t, "00-"+request.TraceID().String()+"-"+request.SpanID().String()+"-01", traceparent)
+}
+
+func TestSendMetricsKeepsRequestID(t *testing.T) {
+	certPath := filepath.Join(t.TempDir(), "cert.pem")
+	require.NoError(t, os.WriteFile(certPath, []byte(testCertPEM), 0600))
+	pubKey, err := parsePubKey(certPath)
+	require.NoError(t, err)
+
+	ids := make(chan string, 3)
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids <- r.Header.Get(requestid.Header)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids <- r.Header.Get(requestid.Header)
+	}))
+	defer up.Close()
+
+	b, err := balancer.New(balancer.Config{Endpoints: []string{
+		strings.TrimPrefix(down.URL, "http://"), strings.TrimPrefix(up.URL, "http://"),
+	}}, zerolog.Nop())
+	require.NoError(t, err)
+
+	l := zerolog.Nop()
+	metrics := createMetricSlice(map[string]string{"Alloc": "1"}, &l)
+	ctx := requestid.NewContext(context.Background(), "batch-1")
+	require.NoError(t, sendMetrics(ctx, config.Config{}, b, metrics, pubKey, &l))
+	assert.Equal(t, "batch-1", <-ids)
+	assert.Equal(t, "batch-1", <-ids)
+
+	require.NoError(t, sendMetrics(context.Background(), config.Config{}, b, metrics, pubKey, &l))
+	assert.NotEmpty(t, <-ids)
+}
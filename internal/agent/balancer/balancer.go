@@ -0,0 +1,253 @@
+// Package balancer picks the server endpoints the agent sends metrics to.
+//
+// Every endpoint is guarded by a circuit breaker tracked passively: an endpoint that fails
+// MaxFails sends in a row is ejected and no send goes to it for EjectTime. Once the ejection
+// ends a single send probes it: a success brings it back and a failure ejects it again, for
+// twice as long each time up to maxEjectTime. With the failover strategy the first endpoint is
+// the primary, so sends return to it as soon as it recovers.
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Strategy defines the order endpoints are tried in.
+type Strategy string
+
+const (
+	// Failover sends to the first healthy endpoint in the configured order.
+	Failover Strategy = "failover"
+	// RoundRobin rotates the healthy endpoints on every send.
+	RoundRobin Strategy = "round-robin"
+	// Hash sends to the endpoint chosen by rendezvous hashing of the agent ID,
+	// so an agent sticks to one endpoint and only moves when it is ejected.
+	Hash Strategy = "hash"
+)
+
+// defaultMaxFails is the number of failed sends in a row that eject an endpoint.
+const defaultMaxFails = 3
+
+// defaultEjectTime is the time an ejected endpoint is skipped.
+const defaultEjectTime = 30 * time.Second
+
+// maxEjectTime caps the ejection of an endpoint failing its probes, unless EjectTime is longer.
+const maxEjectTime = 5 * time.Minute
+
+// ErrAllEjected is returned by the senders when every endpoint is ejected.
+var ErrAllEjected = errors.New("all server endpoints are ejected")
+
+// Config holds the balancer settings.
+type Config struct {
+	Strategy  Strategy      // Strategy is the order endpoints are tried in, Failover by default.
+	AgentID   string        // AgentID is hashed by the Hash strategy.
+	Endpoints []string      // Endpoints lists the host:port of the servers.
+	MaxFails  int           // MaxFails is the number of failed sends in a row that eject an endpoint.
+	EjectTime time.Duration // EjectTime is the time an ejected endpoint is skipped.
+}
+
+// endpoint is the health of a server endpoint.
+type endpoint struct {
+	ejectedUntil time.Time
+	addr         string
+	fails        int
+	// ejections is the number of ejections in a row, it doubles the ejection time.
+	ejections int
+	score     uint64
+	// probing is set while a send probes the endpoint after its ejection.
+	probing bool
+}
+
+// Balancer orders the endpoints for every send and tracks their health.
+type Balancer struct {
+	now       func() time.Time
+	mux       *sync.Mutex
+	log       zerolog.Logger
+	strategy  Strategy
+	endpoints []*endpoint
+	next      int
+	maxFails  int
+	ejectTime time.Duration
+}
+
+// ParseStrategy returns the strategy with the name, an empty name is Failover.
+func ParseStrategy(name string) (Strategy, error) {
+	switch s := Strategy(strings.TrimSpace(name)); s {
+	case "":
+		return Failover, nil
+	case Failover, RoundRobin, Hash:
+		return s, nil
+	default:
+		return "", fmt.Errorf("unknown balancing strategy %q", name)
+	}
+}
+
+// New creates a Balancer for the endpoints.
+func New(cfg Config, log zerolog.Logger) (*Balancer, error) {
+	strategy, err := ParseStrategy(string(cfg.Strategy))
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Balancer{
+		now:       time.Now,
+		mux:       &sync.Mutex{},
+		log:       log.With().Str("component", "balancer").Logger(),
+		strategy:  strategy,
+		maxFails:  cfg.MaxFails,
+		ejectTime: cfg.EjectTime,
+	}
+	if b.maxFails <= 0 {
+		b.maxFails = defaultMaxFails
+	}
+	if b.ejectTime <= 0 {
+		b.ejectTime = defaultEjectTime
+	}
+
+	seen := make(map[string]bool)
+	for _, addr := range cfg.Endpoints {
+		addr = strings.TrimSpace(addr)
+		if addr == "" || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		b.endpoints = append(b.endpoints, &endpoint{addr: addr, score: score(cfg.AgentID, addr)})
+	}
+	if len(b.endpoints) == 0 {
+		return nil, errors.New("no server endpoints configured")
+	}
+
+	if strategy == Hash {
+		sort.SliceStable(b.endpoints, func(i, j int) bool { return b.endpoints[i].score > b.endpoints[j].score })
+	}
+	return b, nil
+}
+
+// Endpoints returns the endpoints to try for one send, in order. An endpoint whose ejection
+// ended comes first to be probed by this send only; the ejected endpoints are left out, so the
+// result is empty when they all are.
+func (b *Balancer) Endpoints() []string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	now := b.now()
+	var probes, healthy []*endpoint
+	for _, e := range b.endpoints {
+		switch {
+		case e.ejectedUntil.IsZero():
+			healthy = append(healthy, e)
+		case !e.ejectedUntil.After(now):
+			// Until the probe completes, the other sends skip the endpoint. If it never does,
+			// e.g. the error did not tell about the endpoint, it is probed again after the ejection.
+			e.probing = true
+			e.ejectedUntil = now.Add(b.ejection(e))
+			probes = append(probes, e)
+		}
+	}
+
+	if b.strategy == RoundRobin && len(healthy) > 0 {
+		start := b.next % len(healthy)
+		b.next++
+		healthy = append(healthy[start:len(healthy):len(healthy)], healthy[:start]...)
+	}
+
+	res := make([]string, 0, len(b.endpoints))
+	for _, e := range append(probes, healthy...) {
+		res = append(res, e.addr)
+	}
+	return res
+}
+
+// NextProbe returns the time until an ejected endpoint can be probed, 0 if an endpoint is not
+// ejected.
+func (b *Balancer) NextProbe() time.Duration {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	now := b.now()
+	var next time.Duration
+	for i, e := range b.endpoints {
+		wait := max(e.ejectedUntil.Sub(now), 0)
+		if i == 0 || wait < next {
+			next = wait
+		}
+	}
+	return next
+}
+
+// Success records a successful send to the endpoint.
+func (b *Balancer) Success(addr string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	e := b.find(addr)
+	if e == nil {
+		return
+	}
+	if !e.ejectedUntil.IsZero() {
+		b.log.Info().Str("endpoint", addr).Msg("endpoint recovered")
+	}
+	e.fails = 0
+	e.ejections = 0
+	e.probing = false
+	e.ejectedUntil = time.Time{}
+}
+
+// Failure records a failed send to the endpoint and ejects it after too many failures in a row.
+// An endpoint failing its probe is ejected again at once.
+func (b *Balancer) Failure(addr string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	e := b.find(addr)
+	if e == nil {
+		return
+	}
+	e.fails++
+	if !e.ejectedUntil.IsZero() && !e.probing {
+		// A send started before the ejection failed too.
+		return
+	}
+	if e.fails < b.maxFails && !e.probing {
+		return
+	}
+
+	e.ejections++
+	e.probing = false
+	eject := b.ejection(e)
+	e.ejectedUntil = b.now().Add(eject)
+	b.log.Warn().Str("endpoint", addr).Int("fails", e.fails).Dur("for", eject).Msg("endpoint ejected")
+}
+
+// ejection returns the time the endpoint is ejected for, doubled by every ejection in a row.
+func (b *Balancer) ejection(e *endpoint) time.Duration {
+	limit := max(b.ejectTime, maxEjectTime)
+	eject := b.ejectTime
+	for i := 1; i < e.ejections && eject < limit; i++ {
+		eject *= 2
+	}
+	return min(eject, limit)
+}
+
+func (b *Balancer) find(addr string) *endpoint {
+	for _, e := range b.endpoints {
+		if e.addr == addr {
+			return e
+		}
+	}
+	return nil
+}
+
+// score is the rendezvous hash of the agent and the endpoint.
+func score(agentID, addr string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(agentID + "/" + addr))
+	return h.Sum64()
+}
@@ -0,0 +1,115 @@
+package balancer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestBalancer returns a balancer with a clock the test moves.
+func newTestBalancer(t *testing.T, cfg Config) (*Balancer, *time.Time) {
+	t.Helper()
+	b, err := New(cfg, zerolog.Nop())
+	require.NoError(t, err)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+func TestFailoverReturnsToPrimary(t *testing.T) {
+	b, now := newTestBalancer(t, Config{
+		Endpoints: []string{"a:1", "b:1", "c:1"},
+		MaxFails:  2,
+		EjectTime: time.Minute,
+	})
+	assert.Equal(t, []string{"a:1", "b:1", "c:1"}, b.Endpoints())
+
+	b.Failure("a:1")
+	assert.Equal(t, []string{"a:1", "b:1", "c:1"}, b.Endpoints(), "one failure does not eject")
+
+	b.Failure("a:1")
+	assert.Equal(t, []string{"b:1", "c:1"}, b.Endpoints(), "no send goes to an ejected endpoint")
+
+	// A single send probes the primary once the ejection ends, it is ejected again if it still fails.
+	*now = now.Add(time.Minute)
+	assert.Equal(t, []string{"a:1", "b:1", "c:1"}, b.Endpoints())
+	assert.Equal(t, []string{"b:1", "c:1"}, b.Endpoints(), "the endpoint is probed by one send only")
+	b.Failure("a:1")
+	assert.Equal(t, []string{"b:1", "c:1"}, b.Endpoints())
+
+	*now = now.Add(2 * time.Minute)
+	assert.Equal(t, []string{"a:1", "b:1", "c:1"}, b.Endpoints())
+	b.Success("a:1")
+	b.Failure("a:1")
+	assert.Equal(t, []string{"a:1", "b:1", "c:1"}, b.Endpoints(), "a recovered endpoint starts over")
+}
+
+func TestEjectionBackoff(t *testing.T) {
+	b, now := newTestBalancer(t, Config{Endpoints: []string{"a:1"}, MaxFails: 1, EjectTime: time.Minute})
+
+	var ejections []time.Duration
+	for i := 0; i < 5; i++ {
+		b.Failure("a:1")
+		ejections = append(ejections, b.NextProbe())
+		*now = now.Add(b.NextProbe())
+		require.Equal(t, []string{"a:1"}, b.Endpoints())
+	}
+	assert.Equal(t, []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute},
+		ejections)
+}
+
+func TestEveryEndpointEjected(t *testing.T) {
+	b, now := newTestBalancer(t, Config{Endpoints: []string{"a:1", "b:1"}, MaxFails: 1, EjectTime: time.Minute})
+	assert.Equal(t, time.Duration(0), b.NextProbe())
+
+	b.Failure("b:1")
+	*now = now.Add(time.Second)
+	b.Failure("a:1")
+	assert.Empty(t, b.Endpoints())
+	assert.Equal(t, 59*time.Second, b.NextProbe(), "the endpoint recovering first is probed first")
+
+	*now = now.Add(59 * time.Second)
+	assert.Equal(t, []string{"b:1"}, b.Endpoints())
+}
+
+func TestRoundRobin(t *testing.T) {
+	b, _ := newTestBalancer(t, Config{Strategy: RoundRobin, Endpoints: []string{"a:1", "b:1", "c:1"}, MaxFails: 1})
+
+	assert.Equal(t, []string{"a:1", "b:1", "c:1"}, b.Endpoints())
+	assert.Equal(t, []string{"b:1", "c:1", "a:1"}, b.Endpoints())
+
+	b.Failure("c:1")
+	assert.Equal(t, []string{"a:1", "b:1"}, b.Endpoints())
+	assert.Equal(t, []string{"b:1", "a:1"}, b.Endpoints())
+}
+
+func TestHash(t *testing.T) {
+	endpoints := []string{"a:1", "b:1", "c:1", "d:1"}
+	first := make(map[string]int)
+	for _, id := range []string{"agent-1", "agent-2", "agent-3", "agent-4", "agent-5", "agent-6", "agent-7", "agent-8"} {
+		b, _ := newTestBalancer(t, Config{Strategy: Hash, AgentID: id, Endpoints: endpoints, MaxFails: 1})
+		order := b.Endpoints()
+		assert.Equal(t, order, b.Endpoints(), "an agent sticks to its endpoint")
+		first[order[0]]++
+
+		// Only the agents of an ejected endpoint move, to their next choice.
+		b.Failure(order[0])
+		assert.Equal(t, order[1:], b.Endpoints())
+	}
+	assert.Greater(t, len(first), 1, "agents are spread over the endpoints")
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(Config{}, zerolog.Nop())
+	assert.Error(t, err)
+
+	_, err = New(Config{Strategy: "random", Endpoints: []string{"a:1"}}, zerolog.Nop())
+	assert.Error(t, err)
+
+	b, err := New(Config{Endpoints: []string{" a:1", "a:1", "", "b:1"}}, zerolog.Nop())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a:1", "b:1"}, b.Endpoints())
+}
@@ -0,0 +1,272 @@
+// Package cgroup reads the resource usage of the control groups of the cgroup v2 unified
+// hierarchy, i.e. of the containers and the systemd units running on the host.
+//
+// The metrics of a cgroup are tagged with its path relative to the root of the hierarchy, e.g.
+// "cgroup.memory.current_bytes;cgroup=system.slice/nginx.service". A metric is skipped if its
+// controller is not enabled for the cgroup.
+package cgroup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/rs/zerolog"
+)
+
+// DefaultRoot is where the cgroup v2 hierarchy is mounted.
+const DefaultRoot = "/sys/fs/cgroup"
+
+// Collector reads the metrics of the cgroups.
+type Collector struct {
+	log     zerolog.Logger
+	root    string
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+	errors  atomic.Uint64
+}
+
+// New creates a Collector walking the hierarchy at root. A cgroup is reported if its path
+// matches one of the include patterns, or if there are none, and no exclude pattern.
+func New(root string, include, exclude []string, log zerolog.Logger) (*Collector, error) {
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("%s is not a cgroup v2 hierarchy: %w", root, err)
+	}
+
+	c := &Collector{
+		log:  log.With().Str("component", "cgroup").Logger(),
+		root: root,
+	}
+	var err error
+	if c.include, err = compile(include); err != nil {
+		return nil, fmt.Errorf("invalid include pattern: %w", err)
+	}
+	if c.exclude, err = compile(exclude); err != nil {
+		return nil, fmt.Errorf("invalid exclude pattern: %w", err)
+	}
+	return c, nil
+}
+
+func compile(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// Collect returns the metrics of the selected cgroups.
+func (c *Collector) Collect() []models.Metrics {
+	var metrics []models.Metrics
+	err := filepath.WalkDir(c.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// The cgroup has been removed since its parent was read.
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(c.root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			rel = "/"
+		}
+		if !c.selected(rel) {
+			return nil
+		}
+		metrics = append(metrics, c.read(path, rel)...)
+		return nil
+	})
+	if err != nil {
+		c.log.Error().Err(err).Msg("failed to walk cgroups")
+		c.errors.Add(1)
+	}
+	return metrics
+}
+
+// Errors returns the number of failures to walk the hierarchy or to read a cgroup file.
+func (c *Collector) Errors() uint64 {
+	return c.errors.Load()
+}
+
+// selected checks the cgroup path against the patterns.
+func (c *Collector) selected(path string) bool {
+	for _, re := range c.exclude {
+		if re.MatchString(path) {
+			return false
+		}
+	}
+	if len(c.include) == 0 {
+		return true
+	}
+	for _, re := range c.include {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// read returns the metrics of the cgroup in the directory.
+func (c *Collector) read(dir, path string) []models.Metrics {
+	var metrics []models.Metrics
+	add := func(name string, v float64) {
+		id := "cgroup." + name + ";cgroup=" + path
+		metrics = append(metrics, models.Metrics{ID: id, MType: models.Gauge, Value: &v})
+	}
+	log := c.log.With().Str("cgroup", path).Logger()
+
+	cpu, err := readFlatKeyed(filepath.Join(dir, "cpu.stat"))
+	switch {
+	case err == nil:
+		for key, name := range map[string]string{
+			"usage_usec":     "cpu.usage_seconds",
+			"user_usec":      "cpu.user_seconds",
+			"system_usec":    "cpu.system_seconds",
+			"throttled_usec": "cpu.throttled_seconds",
+		} {
+			if v, ok := cpu[key]; ok {
+				add(name, float64(v)/1e6)
+			}
+		}
+		for key, name := range map[string]string{
+			"nr_periods":   "cpu.periods",
+			"nr_throttled": "cpu.throttled_periods",
+		} {
+			if v, ok := cpu[key]; ok {
+				add(name, float64(v))
+			}
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		log.Debug().Err(err).Msg("failed to read cpu.stat")
+		c.errors.Add(1)
+	}
+
+	for file, name := range map[string]string{
+		"memory.current": "memory.current_bytes",
+		"memory.max":     "memory.max_bytes",
+		"pids.current":   "pids.current",
+	} {
+		v, ok, err := readSingle(filepath.Join(dir, file))
+		switch {
+		case err == nil && ok:
+			add(name, float64(v))
+		case err != nil && !errors.Is(err, fs.ErrNotExist):
+			log.Debug().Err(err).Str("file", file).Msg("failed to read cgroup file")
+			c.errors.Add(1)
+		}
+	}
+
+	io, err := readIOStat(filepath.Join(dir, "io.stat"))
+	switch {
+	case err == nil:
+		for key, name := range map[string]string{
+			"rbytes": "io.read_bytes",
+			"wbytes": "io.write_bytes",
+			"rios":   "io.read_ops",
+			"wios":   "io.write_ops",
+		} {
+			add(name, float64(io[key]))
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		log.Debug().Err(err).Msg("failed to read io.stat")
+		c.errors.Add(1)
+	}
+	return metrics
+}
+
+// readSingle reads a file holding a single value. It returns false for "max", i.e. no limit.
+func readSingle(path string) (uint64, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false, err
+	}
+	s := strings.TrimSpace(string(data))
+	if s == "max" {
+		return 0, false, nil
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid value %q: %w", s, err)
+	}
+	return v, true, nil
+}
+
+// readFlatKeyed reads a file of "key value" lines like cpu.stat.
+func readFlatKeyed(path string) (map[string]uint64, error) {
+	res := make(map[string]uint64)
+	err := scanLines(path, func(line string) error {
+		key, value, ok := strings.Cut(line, " ")
+		if !ok {
+			return fmt.Errorf("invalid line %q", line)
+		}
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid line %q: %w", line, err)
+		}
+		res[key] = v
+		return nil
+	})
+	return res, err
+}
+
+// readIOStat reads the "MAJ:MIN key=value ..." lines of io.stat and sums the devices.
+func readIOStat(path string) (map[string]uint64, error) {
+	res := make(map[string]uint64)
+	err := scanLines(path, func(line string) error {
+		fields := strings.Fields(line)
+		for _, f := range fields[1:] {
+			key, value, ok := strings.Cut(f, "=")
+			if !ok {
+				return fmt.Errorf("invalid line %q", line)
+			}
+			v, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid line %q: %w", line, err)
+			}
+			res[key] += v
+		}
+		return nil
+	})
+	return res, err
+}
+
+// scanLines calls fn for every line of the file that is not empty.
+func scanLines(path string, fn func(line string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			if err := fn(line); err != nil {
+				return err
+			}
+		}
+	}
+	return sc.Err()
+}
@@ -0,0 +1,96 @@
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func byID(metrics []models.Metrics) map[string]float64 {
+	res := make(map[string]float64, len(metrics))
+	for _, m := range metrics {
+		res[m.ID] = *m.Value
+	}
+	return res
+}
+
+// writeCgroup creates the files of a fake cgroup.
+func writeCgroup(t *testing.T, root, path string, files map[string]string) {
+	t.Helper()
+	dir := filepath.Join(root, path)
+	require.NoError(t, os.MkdirAll(dir, 0700))
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+}
+
+func TestCollect(t *testing.T) {
+	root := t.TempDir()
+	writeCgroup(t, root, "", map[string]string{"cgroup.controllers": "cpu io memory pids\n"})
+	writeCgroup(t, root, "system.slice/nginx.service", map[string]string{
+		"cpu.stat": "usage_usec 2500000\nuser_usec 2000000\nsystem_usec 500000\n" +
+			"nr_periods 10\nnr_throttled 2\nthrottled_usec 300000\n",
+		"memory.current": "1048576\n",
+		"memory.max":     "max\n",
+		"pids.current":   "5\n",
+		"io.stat":        "8:0 rbytes=100 wbytes=200 rios=1 wios=2 dbytes=0 dios=0\n8:16 rbytes=1 wbytes=2 rios=3 wios=4\n",
+	})
+	writeCgroup(t, root, "kubepods.slice/pod1/container1", map[string]string{
+		"memory.current": "2048\n",
+		"memory.max":     "4096\n",
+	})
+	writeCgroup(t, root, "user.slice", map[string]string{"memory.current": "1\n"})
+
+	c, err := New(root, []string{`\.service$`, `^kubepods\.slice/[^/]+/[^/]+$`}, []string{`^user\.slice`}, zerolog.Nop())
+	require.NoError(t, err)
+	got := byID(c.Collect())
+
+	const nginx = ";cgroup=system.slice/nginx.service"
+	assert.Equal(t, 2.5, got["cgroup.cpu.usage_seconds"+nginx])
+	assert.Equal(t, 0.5, got["cgroup.cpu.system_seconds"+nginx])
+	assert.Equal(t, 0.3, got["cgroup.cpu.throttled_seconds"+nginx])
+	assert.Equal(t, float64(2), got["cgroup.cpu.throttled_periods"+nginx])
+	assert.Equal(t, float64(1048576), got["cgroup.memory.current_bytes"+nginx])
+	assert.NotContains(t, got, "cgroup.memory.max_bytes"+nginx, "no limit")
+	assert.Equal(t, float64(5), got["cgroup.pids.current"+nginx])
+	assert.Equal(t, float64(101), got["cgroup.io.read_bytes"+nginx])
+	assert.Equal(t, float64(6), got["cgroup.io.write_ops"+nginx])
+
+	const container = ";cgroup=kubepods.slice/pod1/container1"
+	assert.Equal(t, float64(4096), got["cgroup.memory.max_bytes"+container])
+	assert.NotContains(t, got, "cgroup.cpu.usage_seconds"+container, "cpu controller not enabled")
+
+	for id := range got {
+		assert.NotContains(t, id, "user.slice")
+		assert.NotContains(t, id, "cgroup=kubepods.slice/pod1;")
+	}
+}
+
+func TestCollectAll(t *testing.T) {
+	root := t.TempDir()
+	writeCgroup(t, root, "", map[string]string{"cgroup.controllers": "memory pids\n", "memory.current": "10\n"})
+	writeCgroup(t, root, "init.scope", map[string]string{"pids.current": "1\n"})
+
+	c, err := New(root, nil, nil, zerolog.Nop())
+	require.NoError(t, err)
+	got := byID(c.Collect())
+	assert.Equal(t, float64(10), got["cgroup.memory.current_bytes;cgroup=/"])
+	assert.Equal(t, float64(1), got["cgroup.pids.current;cgroup=init.scope"])
+}
+
+func TestNewErrors(t *testing.T) {
+	root := t.TempDir()
+	_, err := New(root, nil, nil, zerolog.Nop())
+	assert.Error(t, err, "cgroup v1")
+
+	writeCgroup(t, root, "", map[string]string{"cgroup.controllers": "memory\n"})
+	_, err = New(root, []string{"("}, nil, zerolog.Nop())
+	assert.Error(t, err)
+	_, err = New(root, nil, []string{"("}, zerolog.Nop())
+	assert.Error(t, err)
+}
@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/agent/cgroup"
+	"github.com/ospiem/mcollector/internal/agent/config"
+	"github.com/ospiem/mcollector/internal/agent/logtail"
+	"github.com/ospiem/mcollector/internal/agent/procstat"
+	"github.com/ospiem/mcollector/internal/agent/push"
+	"github.com/ospiem/mcollector/internal/agent/script"
+	"github.com/ospiem/mcollector/internal/agent/statsd"
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/rs/zerolog"
+)
+
+// logPollInterval is the interval the log files are read on.
+const logPollInterval = time.Second
+
+// pushShutdownTimeout is the time to wait for the pushes in progress on shutdown.
+const pushShutdownTimeout = 2 * time.Second
+
+// collectors are the sources of the metrics reported along with the runtime metrics.
+type collectors struct {
+	// errors returns the number of errors of every collector by name.
+	errors  map[string]func() uint64
+	sources []func() []models.Metrics
+	stops   []func()
+}
+
+// add registers a source of metrics.
+func (cs *collectors) add(name string, source func() []models.Metrics, errors func() uint64) {
+	cs.sources = append(cs.sources, source)
+	cs.errors[name] = errors
+}
+
+// stop stops the collectors running in the background, so that the last batch has all
+// the metrics they received.
+func (cs *collectors) stop() {
+	for _, stop := range cs.stops {
+		stop()
+	}
+}
+
+// startCollectors starts the collectors enabled in the configuration.
+func startCollectors(ctx context.Context, cfg config.Config, logger zerolog.Logger) (*collectors, error) {
+	cs := &collectors{errors: make(map[string]func() uint64)}
+	if err := cs.start(ctx, cfg, logger); err != nil {
+		cs.stop()
+		return nil, err
+	}
+	return cs, nil
+}
+
+func (cs *collectors) start(ctx context.Context, cfg config.Config, logger zerolog.Logger) error {
+	// Receive the StatsD metrics of the local applications.
+	if len(cfg.StatsdListen) > 0 {
+		agg := statsd.NewAggregator()
+		srv, err := statsd.Listen(cfg.StatsdListen, agg, logger)
+		if err != nil {
+			return fmt.Errorf("failed to start statsd listener: %w", err)
+		}
+		cs.add("statsd", agg.Flush, func() uint64 { return uint64(agg.Invalid()) })
+		cs.stops = append(cs.stops, func() {
+			if err := srv.Close(); err != nil {
+				logger.Error().Err(err).Msg("failed to close statsd listener")
+			}
+		})
+	}
+
+	// Receive the metrics pushed by the local applications.
+	if cfg.PushListen != "" {
+		buf := push.NewBuffer()
+		pushLog := logger.With().Str("component", "push").Logger()
+		srv, err := push.Listen(cfg.PushListen, push.Handler(buf, pushLog), pushLog)
+		if err != nil {
+			return fmt.Errorf("failed to start push API: %w", err)
+		}
+		cs.add("push", buf.Flush, buf.Rejected)
+		cs.stops = append(cs.stops, func() {
+			ctx, cancel := context.WithTimeout(context.Background(), pushShutdownTimeout)
+			defer cancel()
+			if err := srv.Shutdown(ctx); err != nil {
+				logger.Error().Err(err).Msg("failed to close push API")
+			}
+		})
+	}
+
+	// Run the checks configured by the user.
+	if len(cfg.Checks) > 0 {
+		checks := make([]script.Check, 0, len(cfg.Checks))
+		for _, c := range cfg.Checks {
+			checks = append(checks, script.Check(c))
+		}
+		collector, err := script.New(checks, logger)
+		if err != nil {
+			return fmt.Errorf("failed to create checks: %w", err)
+		}
+		collector.Start(ctx)
+		cs.add("script", collector.Flush, collector.Errors)
+		cs.stops = append(cs.stops, collector.Stop)
+	}
+
+	// Follow the log files configured by the user.
+	if len(cfg.LogFiles) > 0 {
+		files := make([]logtail.File, 0, len(cfg.LogFiles))
+		for _, lf := range cfg.LogFiles {
+			f := logtail.File{Path: lf.Path}
+			for _, r := range lf.Rules {
+				f.Rules = append(f.Rules, logtail.Rule(r))
+			}
+			files = append(files, f)
+		}
+		tailer, err := logtail.New(files, cfg.LogState, logPollInterval, logger)
+		if err != nil {
+			return fmt.Errorf("failed to create log tailer: %w", err)
+		}
+		tailer.Start(ctx)
+		cs.add("logtail", tailer.Flush, tailer.Errors)
+		cs.stops = append(cs.stops, tailer.Stop)
+	}
+
+	// Read the metrics of the processes selected by the user.
+	if len(cfg.Processes) > 0 {
+		groups := make([]procstat.Group, 0, len(cfg.Processes))
+		for _, pg := range cfg.Processes {
+			groups = append(groups, procstat.Group(pg))
+		}
+		processes, err := procstat.New(groups, procstat.DefaultProcRoot, logger)
+		if err != nil {
+			return fmt.Errorf("failed to create process collector: %w", err)
+		}
+		cs.add("procstat", processes.Collect, processes.Errors)
+	}
+
+	// Read the resource usage of the containers and the systemd units.
+	if cfg.Cgroups {
+		root := cfg.CgroupRoot
+		if root == "" {
+			root = cgroup.DefaultRoot
+		}
+		cgroups, err := cgroup.New(root, cfg.CgroupInclude, cfg.CgroupExclude, logger)
+		if err != nil {
+			return fmt.Errorf("failed to create cgroup collector: %w", err)
+		}
+		cs.add("cgroup", cgroups.Collect, cgroups.Errors)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/configfile"
+)
+
+// defaultCheckInterval is the interval in seconds between two runs of a check.
+const defaultCheckInterval = 60
+
+// Check is a command the agent runs periodically to collect the metrics it prints.
+type Check struct {
+	Name     string        // Name prefixes the metrics of the check.
+	Command  string        // Command is run with sh -c.
+	Format   string        // Format of the output: plain, nagios or json.
+	Interval time.Duration // Interval between two runs, 60s by default.
+	Timeout  time.Duration // Timeout kills the command, defaults to the interval.
+}
+
+// UnmarshalText parses the short form "name=command" used by the flag.
+func (c *Check) UnmarshalText(text []byte) error {
+	name, command, ok := strings.Cut(string(text), "=")
+	if !ok || strings.TrimSpace(name) == "" || strings.TrimSpace(command) == "" {
+		return fmt.Errorf("invalid check %q, want name=command", text)
+	}
+	*c = Check{Name: strings.TrimSpace(name), Command: command, Interval: defaultCheckInterval * time.Second}
+	return nil
+}
+
+// UnmarshalJSON parses the check object, the interval and the timeout are durations like "30s".
+func (c *Check) UnmarshalJSON(data []byte) error {
+	var tmp struct {
+		Name     string `json:"name"`
+		Command  string `json:"command"`
+		Format   string `json:"format"`
+		Interval string `json:"interval"`
+		Timeout  string `json:"timeout"`
+	}
+	if err := configfile.Strict(data, &tmp); err != nil {
+		return fmt.Errorf("failed to parse check: %w", err)
+	}
+	if tmp.Name == "" || tmp.Command == "" {
+		return fmt.Errorf("check %q needs a name and a command", tmp.Name)
+	}
+
+	*c = Check{Name: tmp.Name, Command: tmp.Command, Format: tmp.Format, Interval: defaultCheckInterval * time.Second}
+	var err error
+	if tmp.Interval != "" {
+		if c.Interval, err = time.ParseDuration(tmp.Interval); err != nil {
+			return fmt.Errorf("failed to parse interval of check %s: %w", c.Name, err)
+		}
+	}
+	if tmp.Timeout != "" {
+		if c.Timeout, err = time.ParseDuration(tmp.Timeout); err != nil {
+			return fmt.Errorf("failed to parse timeout of check %s: %w", c.Name, err)
+		}
+	}
+	return nil
+}
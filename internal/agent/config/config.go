@@ -2,134 +2,122 @@
 package config
 
 import (
-	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
 	"os"
 	"time"
 
-	"github.com/caarlos0/env/v9"
-	"github.com/rs/zerolog/log"
+	"github.com/ospiem/mcollector/internal/configload"
+	"github.com/ospiem/mcollector/internal/logging"
+	"github.com/ospiem/mcollector/internal/tracing"
 )
 
 // Config represents the configuration settings.
 type Config struct {
-	Endpoint       string        `env:"ADDRESS"`    // Endpoint for sending metrics.
-	CryptoKey      string        `env:"CRYPTO_KEY"` // CRYPTO_KEY is used to encrypt the request
-	Config         string        `env:"CONFIG"`     // Config is path to the config file.
-	Key            string        `env:"KEY"`        // Key is used for hashing func.
-	LogLevel       string        `env:"LOG_LEVEL"`  // LogLevel is the logging level.
+	Endpoint       string        // Endpoint for sending metrics.
+	CryptoKey      string        // CryptoKey is the path of the certificate encrypting the requests.
+	Config         string        // Config is path to the config file.
+	Key            string        // Key is used for hashing func.
+	LogLevel       string        // LogLevel is the logging level.
 	ReportInterval time.Duration // Time interval for reporting metrics
 	PollInterval   time.Duration // Time interval for polling metrics
-	RateLimit      int           `env:"RATE_LIMIT"` // Rate limit for sending metrics
+	RateLimit      int           // Rate limit for sending metrics
+	// Endpoints lists several servers to send metrics to, it overrides Endpoint.
+	Endpoints []string
+	// Balancing is the strategy to pick one of the Endpoints: failover, round-robin or hash.
+	Balancing string
+	// AgentID identifies the agent for the hash strategy, defaults to the hostname.
+	AgentID string
+	// MaxFails is the number of failed sends in a row that eject an endpoint.
+	MaxFails int
+	// EjectTime is the time an ejected endpoint is skipped.
+	EjectTime time.Duration
+	// Outputs lists the systems metrics are sent to, the mcollector server by default.
+	Outputs []Output
+	// StatsdListen lists the addresses to receive StatsD metrics on, e.g. udp://:8125. Empty disables StatsD.
+	StatsdListen []string
+	// PushListen is the address of the local push API, e.g. unix:///run/mcollector.sock. Empty disables it.
+	PushListen string
+	// Checks lists the commands run periodically to collect the metrics they print.
+	Checks []Check
+	// LogFiles lists the log files followed to derive metrics from their lines.
+	LogFiles []LogFile
+	// LogState is the file the read offsets of the log files are saved to.
+	LogState string
+	// Processes lists the groups of processes whose metrics are reported.
+	Processes []ProcessGroup
+	// Cgroups enables the metrics of the cgroups, i.e. of the containers and the systemd units.
+	Cgroups bool
+	// CgroupRoot is where the cgroup v2 hierarchy is mounted, /sys/fs/cgroup by default.
+	CgroupRoot string
+	// CgroupInclude lists the regular expressions selecting the cgroup paths, all by default.
+	CgroupInclude []string
+	// CgroupExclude lists the regular expressions of the cgroup paths to skip.
+	CgroupExclude []string
+	// StatusListen is the address of the local /status and /healthz endpoints. Empty disables them.
+	StatusListen string
+	// Log configures the format and the output of the logs.
+	Log logging.Config
+	// Tracing configures the export of the traces.
+	Tracing tracing.Config
+	// PrintConfig asks to print the Report instead of running the agent.
+	PrintConfig bool
+	// Report is the effective value of every setting and where it comes from.
+	Report configload.Report
 }
 
-// JSONConfig represents the configuration settings in JSON format.
-type JSONConfig struct {
-	Endpoint       string `json:"address"`
-	ReportInterval string `json:"report_interval"`
-	PollInterval   string `json:"poll_interval"`
-	CryptoKey      string `json:"crypto_key"`
+// New creates a new configuration instance from the command line, the environment variables
+// and the configuration file (if provided).
+func New() (Config, error) {
+	return load(os.Args[1:], flag.ExitOnError)
 }
 
-// tmpDurations represents temporary durations for parsing environment variables.
-type tmpDurations struct {
-	ReportInterval int `env:"REPORT_INTERVAL"`
-	PollInterval   int `env:"POLL_INTERVAL"`
+// Load creates a new configuration instance like New, from the arguments instead of the command line.
+func Load(args []string) (Config, error) {
+	return load(args, flag.ContinueOnError)
 }
 
-// New creates a new configuration instance.
-// It parses the environment variables and the configuration file (if provided).
-func New() (Config, error) {
-	tmp := tmpDurations{
-		ReportInterval: -1,
-		PollInterval:   -1,
-	}
-	var c Config
-	ParseFlag(&c)
-
-	// Parse the environment variables into the temporary and main configuration structs
-	err := env.Parse(&tmp)
-	if err != nil {
-		wrapErr := fmt.Errorf("parse tmp error: %w", err)
-		return c, wrapErr
-	}
-
-	err = env.Parse(&c)
-	if err != nil {
-		wrapErr := fmt.Errorf("parse config error: %w", err)
-		return c, wrapErr
+func load(args []string, handling flag.ErrorHandling) (Config, error) {
+	c := Config{
+		Endpoint:       "localhost:8080",
+		LogLevel:       "error",
+		ReportInterval: defaultReportInterval * time.Second,
+		PollInterval:   defaultPollInterval * time.Second,
+		RateLimit:      defaultRateLimit,
+		MaxFails:       defaultMaxFails,
+		EjectTime:      defaultEjectTime * time.Second,
+		Log:            logging.Defaults(),
+		Tracing:        tracing.Defaults(),
 	}
+	hostname, hostErr := os.Hostname()
+	c.AgentID = hostname
 
-	// Convert the temporary durations to time.Duration and assign them to the main configuration
-	if tmp.PollInterval > 0 {
-		c.ReportInterval = time.Duration(tmp.ReportInterval) * time.Second
-	}
-	if tmp.ReportInterval > 0 {
-		c.PollInterval = time.Duration(tmp.PollInterval) * time.Second
+	l := configload.New("agent", handling, c.settings())
+	if err := l.Load(args); err != nil {
+		return Config{}, err
 	}
-
-	// Parse the configuration file (if provided)
-	err = c.parseConfigFileJSON()
-	if err != nil {
-		return Config{}, fmt.Errorf("failed to parse config file: %w", err)
+	if c.AgentID == "" && hostErr != nil {
+		return Config{}, fmt.Errorf("failed to get hostname for agent id: %w", hostErr)
 	}
 
+	c.Config = l.File()
+	c.PrintConfig = l.PrintRequested()
+	c.Report = l.Report()
 	return c, nil
 }
 
-// parseConfigFileJSON parses the configuration file and updates the configuration settings.
-// It only updates a setting if it has not been set by an environment variable.
-func (c *Config) parseConfigFileJSON() error {
-	if c.Config == "" {
-		return nil
-	}
-
-	// Open the configuration file
-	f, err := os.Open(c.Config)
-	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
-	}
-	defer func() {
-		if closeErr := f.Close(); closeErr != nil {
-			log.Printf("failed to close the file: %v", closeErr)
-		}
-	}()
-
-	// Read the configuration file
-	confFile, err := io.ReadAll(f)
-	if err != nil {
-		return fmt.Errorf("failed to read file: %w", err)
-	}
-
-	// Parse the configuration file into a temporary JSON configuration struct
-	tmp := JSONConfig{}
-	err = json.Unmarshal(confFile, &tmp)
-	if err != nil {
-		return fmt.Errorf("failed to parse json: %w", err)
+// EnabledOutputs returns the systems to send metrics to.
+func (c Config) EnabledOutputs() []Output {
+	if len(c.Outputs) > 0 {
+		return c.Outputs
 	}
+	return []Output{{Type: OutputMcollector}}
+}
 
-	// Update the main configuration settings with the settings from the configuration file
-	if c.Endpoint == "" {
-		c.Endpoint = tmp.Endpoint
+// ServerEndpoints returns the servers to send metrics to.
+func (c Config) ServerEndpoints() []string {
+	if len(c.Endpoints) > 0 {
+		return c.Endpoints
 	}
-	if c.CryptoKey == "" {
-		c.CryptoKey = tmp.CryptoKey
-	}
-	if c.ReportInterval == defaultReportInterval*time.Second {
-		interval, err := time.ParseDuration(tmp.ReportInterval)
-		if err != nil {
-			return fmt.Errorf("failed to parse store interval: %w", err)
-		}
-		c.ReportInterval = interval
-	}
-	if c.PollInterval == defaultPollInterval*time.Second {
-		interval, err := time.ParseDuration(tmp.PollInterval)
-		if err != nil {
-			return fmt.Errorf("failed to parse store interval: %w", err)
-		}
-		c.PollInterval = interval
-	}
-
-	return nil
+	return []string{c.Endpoint}
 }
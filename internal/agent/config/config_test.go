@@ -2,6 +2,8 @@ package config
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -10,7 +12,7 @@ import (
 )
 
 func TestNewConfigWithDefaultValues(t *testing.T) {
-	c, err := New()
+	c, err := Load(nil)
 	assert.NoError(t, err)
 	assert.Equal(t, "localhost:8080", c.Endpoint)
 	assert.Equal(t, "", c.Key)
@@ -29,7 +31,7 @@ func TestNewConfigWithEnvironmentVariables(t *testing.T) {
 	t.Setenv("RATE_LIMIT", "100")
 	t.Setenv("CRYPTO_KEY", "testkey")
 
-	c, err := New()
+	c, err := Load(nil)
 	assert.NoError(t, err)
 	assert.Equal(t, "localhost:9090", c.Endpoint)
 	assert.Equal(t, "testkey", c.Key)
@@ -44,7 +46,7 @@ func TestNewConfigWithInvalidEnvironmentVariables(t *testing.T) {
 	t.Setenv("REPORT_INTERVAL", "invalid")
 	t.Setenv("POLL_INTERVAL", "invalid")
 	t.Setenv("RATE_LIMIT", "invalid")
-	_, err := New()
+	_, err := Load(nil)
 	assert.Error(t, err)
 }
 
@@ -78,7 +80,7 @@ func TestConfigFileWithEnvironmentVariables(t *testing.T) {
 	t.Setenv("CONFIG", tmpfile.Name())
 
 	// Call the New function to get the config
-	c, err := New()
+	c, err := Load(nil)
 	assert.NoError(t, err)
 
 	// Check that the address from the environment variable is used, not the one from the config file
@@ -87,3 +89,307 @@ func TestConfigFileWithEnvironmentVariables(t *testing.T) {
 	assert.Equal(t, 335*time.Second, c.PollInterval)
 	assert.Equal(t, "/crypto/foo_crypto", c.CryptoKey)
 }
+
+func TestOutputsFromEnvironmentVariables(t *testing.T) {
+	t.Setenv("OUTPUTS", "mcollector,graphite=localhost:2003,file=/tmp/metrics.jsonl")
+
+	c, err := Load(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []Output{
+		{Type: OutputMcollector},
+		{Type: OutputGraphite, Address: "localhost:2003"},
+		{Type: OutputFile, Path: "/tmp/metrics.jsonl"},
+	}, c.EnabledOutputs())
+}
+
+func TestStatsdListenFromEnvironmentVariables(t *testing.T) {
+	t.Setenv("STATSD_LISTEN", "udp://:8125,unix:///tmp/statsd.sock")
+
+	c, err := Load(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"udp://:8125", "unix:///tmp/statsd.sock"}, c.StatsdListen)
+}
+
+func TestPushListenFromConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	text := `{"report_interval": "1s", "poll_interval": "1s", "collectors": {"push_listen": "unix:///run/mcollector.sock"}}`
+	assert.NoError(t, os.WriteFile(path, []byte(text), 0600))
+	t.Setenv("CONFIG", path)
+
+	c, err := Load(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "unix:///run/mcollector.sock", c.PushListen)
+}
+
+func TestStatusListenFromEnvironmentVariables(t *testing.T) {
+	t.Setenv("STATUS_ADDRESS", "localhost:8082")
+
+	c, err := Load(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "localhost:8082", c.StatusListen)
+}
+
+func TestChecksFromConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	text := `{"report_interval": "1s", "poll_interval": "1s", "collectors": {"checks": [
+		{"name": "queue", "command": "queue-depth", "interval": "30s", "timeout": "10s"},
+		{"name": "disk", "command": "check_disk -w 10%", "format": "nagios"}
+	]}}`
+	assert.NoError(t, os.WriteFile(path, []byte(text), 0600))
+	t.Setenv("CONFIG", path)
+
+	c, err := Load(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []Check{
+		{Name: "queue", Command: "queue-depth", Interval: 30 * time.Second, Timeout: 10 * time.Second},
+		{Name: "disk", Command: "check_disk -w 10%", Format: "nagios", Interval: time.Minute},
+	}, c.Checks)
+
+	var check Check
+	assert.NoError(t, check.UnmarshalText([]byte("load=cat /proc/loadavg | awk '{print \"load gauge\", $1}'")))
+	assert.Equal(t, "load", check.Name)
+	assert.Error(t, check.UnmarshalText([]byte("load")))
+}
+
+func TestLogFilesFromConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	text := `{"report_interval": "1s", "poll_interval": "1s", "collectors": {"log_state_file": "/tmp/offsets.json",
+		"log_files": [{"path": "/var/log/app.log", "rules": [{"name": "errors", "pattern": "level=error"}]}]}}`
+	assert.NoError(t, os.WriteFile(path, []byte(text), 0600))
+	t.Setenv("CONFIG", path)
+
+	c, err := Load(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "/tmp/offsets.json", c.LogState)
+	assert.Equal(t, []LogFile{
+		{Path: "/var/log/app.log", Rules: []LogRule{{Name: "errors", Pattern: "level=error"}}},
+	}, c.LogFiles)
+}
+
+func TestProcessesFromConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	text := `{"report_interval": "1s", "poll_interval": "1s", "collectors": {"processes": [
+		{"name": "nginx", "process": "nginx"},
+		{"name": "app", "cmdline": "app\\.jar", "tagged": true}
+	]}}`
+	assert.NoError(t, os.WriteFile(path, []byte(text), 0600))
+	t.Setenv("CONFIG", path)
+
+	c, err := Load(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []ProcessGroup{
+		{Name: "nginx", Process: "nginx"},
+		{Name: "app", Cmdline: `app\.jar`, Tagged: true},
+	}, c.Processes)
+}
+
+func TestCgroupsFromEnvironmentVariables(t *testing.T) {
+	t.Setenv("CGROUPS", "true")
+	t.Setenv("CGROUP_INCLUDE", `\.service$,^docker/`)
+
+	c, err := Load(nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Cgroups)
+	assert.Equal(t, []string{`\.service$`, "^docker/"}, c.CgroupInclude)
+	assert.Empty(t, c.CgroupExclude)
+}
+
+func TestOutputsFromConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	text := `{"report_interval": "1s", "poll_interval": "1s", "outputs": [
+		"mcollector",
+		{"type": "influxdb", "url": "http://localhost:8086/api/v2/write?bucket=m", "token": "t", "batch_size": 100}
+	]}`
+	assert.NoError(t, os.WriteFile(path, []byte(text), 0600))
+	t.Setenv("CONFIG", path)
+
+	c, err := Load(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []Output{
+		{Type: OutputMcollector},
+		{Type: OutputInfluxDB, URL: "http://localhost:8086/api/v2/write?bucket=m", Token: "t", BatchSize: 100},
+	}, c.EnabledOutputs())
+}
+
+func TestParseOutputsErrors(t *testing.T) {
+	for _, spec := range []string{"kafka=localhost:9092", "graphite", "file="} {
+		_, err := parseOutputs(spec)
+		assert.Error(t, err, spec)
+	}
+
+	outputs, err := parseOutputs("")
+	assert.NoError(t, err)
+	assert.Empty(t, outputs)
+	assert.Equal(t, []Output{{Type: OutputMcollector}}, Config{}.EnabledOutputs())
+}
+
+func TestYAMLConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.yaml")
+	text := `
+address: localhost:9090
+report_interval: 5s
+poll_interval: 1s
+rate_limit: 4
+log_level: info
+outputs:
+  - mcollector
+  - {type: graphite, address: "localhost:2003"}
+security:
+  key: secret
+  crypto_key: /etc/mcollector/cert.pem
+collectors:
+  checks:
+    - {name: queue, command: queue-depth, interval: 30s}
+  cgroups:
+    enabled: true
+    include: ['\.service$']
+`
+	assert.NoError(t, os.WriteFile(path, []byte(text), 0600))
+	t.Setenv("CONFIG", path)
+
+	c, err := Load(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", c.Key)
+	assert.Equal(t, "/etc/mcollector/cert.pem", c.CryptoKey)
+	assert.Equal(t, "info", c.LogLevel)
+	assert.Equal(t, []Output{{Type: OutputMcollector}, {Type: OutputGraphite, Address: "localhost:2003"}}, c.Outputs)
+	assert.Equal(t, []Check{{Name: "queue", Command: "queue-depth", Interval: 30 * time.Second}}, c.Checks)
+	assert.True(t, c.Cgroups)
+	assert.Equal(t, []string{`\.service$`}, c.CgroupInclude)
+}
+
+func TestTOMLConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.toml")
+	text := `
+addresses = ["a:8080", "b:8080"]
+balancing = "round-robin"
+eject_time = "1m"
+
+[security]
+key = "secret"
+
+[[collectors.processes]]
+name = "nginx"
+process = "nginx"
+`
+	assert.NoError(t, os.WriteFile(path, []byte(text), 0600))
+	t.Setenv("CONFIG", path)
+
+	c, err := Load(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a:8080", "b:8080"}, c.Endpoints)
+	assert.Equal(t, "round-robin", c.Balancing)
+	assert.Equal(t, "secret", c.Key)
+	assert.Equal(t, []ProcessGroup{{Name: "nginx", Process: "nginx"}}, c.Processes)
+}
+
+func TestConfigFileUnknownKeys(t *testing.T) {
+	for name, text := range map[string]string{
+		"moved key":    `{"crypto_key": "/a.pem", "security": {"crypto_key": "/b.pem"}}`,
+		"output key":   `{"outputs": [{"type": "graphite", "adress": "localhost:2003"}]}`,
+		"check key":    `{"collectors": {"checks": [{"name": "q", "command": "q", "every": "1s"}]}}`,
+		"section key":  `{"collectors": {"cgroups": {"enable": true}}}`,
+		"invalid type": `{"report_interval": 10}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			assert.NoError(t, os.WriteFile(path, []byte(text), 0600))
+			t.Setenv("CONFIG", path)
+
+			_, err := Load(nil)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestConfigFileDeprecatedKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	text := `{"address": "localhost:8080", "report_interval": "1s", "poll_interval": "1s", "crypto_key": "/path/to/key.pem"}`
+	assert.NoError(t, os.WriteFile(path, []byte(text), 0600))
+	t.Setenv("CONFIG", path)
+
+	c, err := Load(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "/path/to/key.pem", c.CryptoKey)
+	assert.Equal(t, []string{"crypto_key in file " + path + " is deprecated, use security.crypto_key"}, c.Report.Warnings)
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.yaml")
+	text := `
+address: file:8080
+report_interval: 20s
+poll_interval: 5s
+rate_limit: 4
+security:
+  key: file-secret
+`
+	assert.NoError(t, os.WriteFile(path, []byte(text), 0600))
+	t.Setenv("REPORT_INTERVAL", "30")
+	t.Setenv("RATE_LIMIT", "8")
+
+	c, err := Load([]string{"-config", path, "-l", "16", "-eject-time", "1m"})
+	assert.NoError(t, err)
+	assert.Equal(t, "file:8080", c.Endpoint)
+	assert.Equal(t, 30*time.Second, c.ReportInterval)
+	assert.Equal(t, 5*time.Second, c.PollInterval)
+	assert.Equal(t, 16, c.RateLimit)
+	assert.Equal(t, time.Minute, c.EjectTime)
+	assert.Equal(t, defaultMaxFails, c.MaxFails)
+	assert.Equal(t, path, c.Config)
+
+	origins := make(map[string]string)
+	values := make(map[string]string)
+	for _, e := range c.Report.Entries {
+		origins[e.Key], values[e.Key] = e.Origin.String(), e.Value
+	}
+	assert.Equal(t, "file "+path, origins["address"])
+	assert.Equal(t, "env REPORT_INTERVAL", origins["report_interval"])
+	assert.Equal(t, "flag -l", origins["rate_limit"])
+	assert.Equal(t, "default", origins["max_fails"])
+	assert.Equal(t, "<redacted>", values["security.key"])
+}
+
+func TestPrintConfigRedactsTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.json")
+	text := `{"outputs": [{"type": "influxdb", "url": "http://localhost:8086/api/v2/write", "token": "s3cr3t"}]}`
+	assert.NoError(t, os.WriteFile(path, []byte(text), 0600))
+
+	c, err := Load([]string{"-config", path, "-print-config"})
+	assert.NoError(t, err)
+	assert.True(t, c.PrintConfig)
+
+	var out strings.Builder
+	assert.NoError(t, c.Report.Print(&out))
+	assert.Contains(t, out.String(), "outputs")
+	assert.Contains(t, out.String(), "<redacted>")
+	assert.NotContains(t, out.String(), "s3cr3t")
+}
+
+func TestConfigValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{name: "flag", args: []string{"-p", "0"}, want: "invalid poll_interval from flag -p: must be positive, got 0s"},
+		{name: "env", env: map[string]string{"BALANCING": "random"},
+			want: `invalid balancing from env BALANCING: unknown balancing strategy "random"`},
+		{name: "log level", args: []string{"-log", "verbose"}, want: "invalid log_level from flag -log"},
+		{name: "log format", env: map[string]string{"LOG_FORMAT": "xml"}, want: "invalid log.format from env LOG_FORMAT"},
+		{name: "regexp", args: []string{"-cgroup-exclude", "(user"}, want: "invalid collectors.cgroups.exclude"},
+		{name: "parse", env: map[string]string{"RATE_LIMIT": "many"},
+			want: `invalid value "many" for env RATE_LIMIT: want an integer`},
+		{name: "file only", env: map[string]string{"OUTPUTS": "kafka"}, want: "for env OUTPUTS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			_, err := Load(tt.args)
+			assert.ErrorContains(t, err, tt.want)
+		})
+	}
+}
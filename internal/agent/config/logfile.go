@@ -0,0 +1,15 @@
+package config
+
+// LogFile is a log file the agent follows to derive metrics from its lines.
+type LogFile struct {
+	Path  string    `json:"path"`
+	Rules []LogRule `json:"rules"`
+}
+
+// LogRule derives a metric from the lines matching the pattern.
+type LogRule struct {
+	Name    string `json:"name"`    // Name is the ID of the metric.
+	Pattern string `json:"pattern"` // Pattern is the regular expression matched against every line.
+	Type    string `json:"type"`    // Type is counter (default), gauge or histogram.
+	Field   string `json:"field"`   // Field is the name or number of the group capturing the value.
+}
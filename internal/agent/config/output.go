@@ -0,0 +1,103 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ospiem/mcollector/internal/configfile"
+)
+
+// Types of the outputs the agent sends metrics to.
+const (
+	OutputMcollector  = "mcollector"
+	OutputPushgateway = "pushgateway"
+	OutputGraphite    = "graphite"
+	OutputInfluxDB    = "influxdb"
+	OutputFile        = "file"
+)
+
+// Output is a system the agent sends metrics to.
+type Output struct {
+	Type      string `json:"type"`                 // Type is one of mcollector, pushgateway, graphite, influxdb or file.
+	URL       string `json:"url,omitempty"`        // URL is the Pushgateway base URL or the InfluxDB write URL.
+	Address   string `json:"address,omitempty"`    // Address is the Graphite host:port.
+	Path      string `json:"path,omitempty"`       // Path is the file metrics are appended to.
+	Job       string `json:"job,omitempty"`        // Job is the Pushgateway job, "mcollector" by default.
+	Prefix    string `json:"prefix,omitempty"`     // Prefix is prepended to the Graphite paths.
+	Token     string `json:"token,omitempty"`      // Token authenticates to InfluxDB.
+	BatchSize int    `json:"batch_size,omitempty"` // BatchSize is the maximum number of metrics sent at once.
+	QueueSize int    `json:"queue_size,omitempty"` // QueueSize is the number of batches buffered while the output is busy.
+	Retries   int    `json:"retries,omitempty"`    // Retries is the number of attempts to send a batch.
+}
+
+// UnmarshalText parses the short form "type" or "type=target" used by the flag and the
+// environment, where the target is the URL, the address or the path depending on the type.
+func (o *Output) UnmarshalText(text []byte) error {
+	typ, target, _ := strings.Cut(strings.TrimSpace(string(text)), "=")
+	*o = Output{Type: typ}
+	switch typ {
+	case OutputPushgateway, OutputInfluxDB:
+		o.URL = target
+	case OutputGraphite:
+		o.Address = target
+	case OutputFile:
+		o.Path = target
+	}
+	return o.validate()
+}
+
+// UnmarshalJSON accepts both the short form as a string and the full object.
+func (o *Output) UnmarshalJSON(data []byte) error {
+	var short string
+	if err := json.Unmarshal(data, &short); err == nil {
+		return o.UnmarshalText([]byte(short))
+	}
+
+	type plain Output
+	var p plain
+	if err := configfile.Strict(data, &p); err != nil {
+		return fmt.Errorf("failed to parse output: %w", err)
+	}
+	*o = Output(p)
+	return o.validate()
+}
+
+// validate checks that the output has a known type and the target it needs.
+func (o *Output) validate() error {
+	switch o.Type {
+	case OutputMcollector:
+		return nil
+	case OutputPushgateway, OutputInfluxDB:
+		if o.URL == "" {
+			return fmt.Errorf("output %s needs a url", o.Type)
+		}
+	case OutputGraphite:
+		if o.Address == "" {
+			return fmt.Errorf("output %s needs an address", o.Type)
+		}
+	case OutputFile:
+		if o.Path == "" {
+			return fmt.Errorf("output %s needs a path", o.Type)
+		}
+	default:
+		return fmt.Errorf("unknown output type %q", o.Type)
+	}
+	return nil
+}
+
+// parseOutputs parses a comma-separated list of outputs in the short form.
+func parseOutputs(s string) ([]Output, error) {
+	var outputs []Output
+	for _, part := range strings.Split(s, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		var o Output
+		if err := o.UnmarshalText([]byte(part)); err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, o)
+	}
+	return outputs, nil
+}
@@ -0,0 +1,12 @@
+package config
+
+// ProcessGroup selects the processes on the host whose metrics the agent reports.
+// Exactly one of Process, Pidfile and Cmdline is set.
+type ProcessGroup struct {
+	Name    string `json:"name"`    // Name identifies the group.
+	Process string `json:"process"` // Process selects the processes by name.
+	Pidfile string `json:"pidfile"` // Pidfile selects the process whose pid is in the file.
+	Cmdline string `json:"cmdline"` // Cmdline selects the processes whose command line matches the regular expression.
+	Prefix  string `json:"prefix"`  // Prefix of the metric IDs, "process.<name>" by default.
+	Tagged  bool   `json:"tagged"`  // Tagged names the metrics "process.<metric>;group=<name>".
+}
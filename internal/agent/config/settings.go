@@ -0,0 +1,120 @@
+package config
+
+import (
+	"slices"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/agent/balancer"
+	"github.com/ospiem/mcollector/internal/configload"
+	"github.com/ospiem/mcollector/internal/helper"
+	"github.com/ospiem/mcollector/internal/logging"
+	"github.com/ospiem/mcollector/internal/tracing"
+)
+
+const defaultReportInterval = 10
+const defaultPollInterval = 2
+const defaultMaxFails = 3
+const defaultEjectTime = 30
+const defaultRateLimit = 1
+
+// settings declares every setting of the agent with its key in the file, its flag and its
+// environment variable. The current values of c are the defaults.
+func (c *Config) settings() []*configload.Setting {
+	settings := []*configload.Setting{
+		{Key: "address", Flag: "a", Env: "ADDRESS", Value: configload.String(&c.Endpoint),
+			Usage: "Configure the server's host:port"},
+		{Key: "addresses", Flag: "addresses", Env: "ADDRESSES", Value: configload.List(&c.Endpoints),
+			Usage: "Configure a comma-separated host:port list of servers, overrides -a"},
+		{Key: "balancing", Flag: "balancing", Env: "BALANCING", Value: configload.String(&c.Balancing),
+			Usage: "Configure the strategy to pick one of the servers: failover (default), round-robin or hash",
+			Check: func() error {
+				_, err := balancer.ParseStrategy(c.Balancing)
+				return err
+			}},
+		{Key: "agent_id", Flag: "agent-id", Env: "AGENT_ID", Value: configload.String(&c.AgentID),
+			Usage: "Configure the agent's ID used by the hash strategy, defaults to the hostname"},
+		{Key: "max_fails", Flag: "max-fails", Env: "MAX_FAILS", Value: configload.Int(&c.MaxFails),
+			Usage: "Configure the number of failed sends in a row that eject a server",
+			Check: func() error { return configload.Positive(c.MaxFails) }},
+		{Key: "eject_time", Flag: "eject-time", Env: "EJECT_TIME", Value: configload.Duration(&c.EjectTime, time.Second),
+			Usage: "Configure the time in seconds an ejected server is skipped",
+			Check: func() error { return configload.Positive(c.EjectTime) }},
+		{Key: "report_interval", Flag: "r", Env: "REPORT_INTERVAL",
+			Value: configload.Duration(&c.ReportInterval, time.Second),
+			Usage: "Configure the agent's report interval in seconds",
+			Check: func() error { return configload.Positive(c.ReportInterval) }},
+		{Key: "poll_interval", Flag: "p", Env: "POLL_INTERVAL", Value: configload.Duration(&c.PollInterval, time.Second),
+			Usage: "Configure the agent's poll interval in seconds",
+			Check: func() error { return configload.Positive(c.PollInterval) }},
+		{Key: "rate_limit", Flag: "l", Env: "RATE_LIMIT", Value: configload.Int(&c.RateLimit),
+			Usage: "define the number of workers to send metrics",
+			Check: func() error { return configload.Positive(c.RateLimit) }},
+		{Key: "log_level", Flag: "log", Env: "LOG_LEVEL", Value: configload.String(&c.LogLevel),
+			Usage: "Configure the agent's log level: trace, debug, info, warn, error, fatal or panic",
+			Check: func() error { return configload.OneOf(c.LogLevel, helper.LogLevels...) }},
+		{Key: "status_address", Flag: "status", Env: "STATUS_ADDRESS", Value: configload.String(&c.StatusListen),
+			Usage: "Configure the address of the local status endpoints, e.g. localhost:8082 or unix:///run/mcollector-status.sock"},
+		{Key: "outputs", Flag: "outputs", Env: "OUTPUTS", Value: outputsValue{
+			Value: configload.Func(&c.Outputs, func(s string) error {
+				outputs, err := parseOutputs(s)
+				c.Outputs = append(c.Outputs, outputs...)
+				return err
+			}),
+			outputs: &c.Outputs,
+		}, Usage: "Configure a comma-separated list of outputs as type or type=target, " +
+			"e.g. mcollector,graphite=localhost:2003,file=/tmp/metrics.jsonl"},
+
+		{Key: "security.key", Flag: "k", Env: "KEY", Value: configload.String(&c.Key), Secret: true,
+			Usage: "Set key for hash function"},
+		{Key: "security.crypto_key", Flag: "crypto-key", Env: "CRYPTO_KEY", Value: configload.String(&c.CryptoKey),
+			Deprecated: []string{"crypto_key"}, Usage: "define the public key"},
+
+		{Key: "collectors.statsd_listen", Flag: "statsd", Env: "STATSD_LISTEN", Value: configload.List(&c.StatsdListen),
+			Usage: "Configure a comma-separated list of addresses to receive StatsD metrics on, " +
+				"e.g. udp://:8125,unix:///run/statsd.sock"},
+		{Key: "collectors.push_listen", Flag: "push", Env: "PUSH_LISTEN", Value: configload.String(&c.PushListen),
+			Usage: "Configure the address of the local push API, e.g. localhost:8081 or unix:///run/mcollector.sock"},
+		{Key: "collectors.checks", Flag: "check", Value: configload.Func(&c.Checks, func(s string) error {
+			var check Check
+			if err := check.UnmarshalText([]byte(s)); err != nil {
+				return err
+			}
+			c.Checks = append(c.Checks, check)
+			return nil
+		}), Usage: "Configure a command run every minute to collect the metrics it prints as name=command, can be repeated"},
+		{Key: "collectors.log_files", Value: configload.Func(&c.LogFiles, nil)},
+		{Key: "collectors.log_state_file", Flag: "log-state", Env: "LOG_STATE_FILE", Value: configload.String(&c.LogState),
+			Usage: "Configure the file the read offsets of the log files are saved to"},
+		{Key: "collectors.processes", Value: configload.Func(&c.Processes, nil)},
+		{Key: "collectors.cgroups.enabled", Flag: "cgroups", Env: "CGROUPS", Value: configload.Bool(&c.Cgroups),
+			Usage: "Enable the metrics of the cgroups, i.e. of the containers and the systemd units"},
+		{Key: "collectors.cgroups.root", Flag: "cgroup-root", Env: "CGROUP_ROOT", Value: configload.String(&c.CgroupRoot),
+			Usage: "Configure where the cgroup v2 hierarchy is mounted, /sys/fs/cgroup by default"},
+		{Key: "collectors.cgroups.include", Flag: "cgroup-include", Env: "CGROUP_INCLUDE",
+			Value: configload.List(&c.CgroupInclude),
+			Usage: "Configure a comma-separated list of regular expressions selecting the cgroup paths, all by default",
+			Check: func() error { return configload.Regexps(c.CgroupInclude) }},
+		{Key: "collectors.cgroups.exclude", Flag: "cgroup-exclude", Env: "CGROUP_EXCLUDE",
+			Value: configload.List(&c.CgroupExclude),
+			Usage: "Configure a comma-separated list of regular expressions of the cgroup paths to skip",
+			Check: func() error { return configload.Regexps(c.CgroupExclude) }},
+	}
+	settings = append(settings, logging.Settings(&c.Log)...)
+	return append(settings, tracing.Settings(&c.Tracing)...)
+}
+
+// outputsValue prints the outputs without their tokens.
+type outputsValue struct {
+	configload.Value
+	outputs *[]Output
+}
+
+func (v outputsValue) Redacted() string {
+	outputs := slices.Clone(*v.outputs)
+	for i := range outputs {
+		if outputs[i].Token != "" {
+			outputs[i].Token = "<redacted>"
+		}
+	}
+	return configload.FormatJSON(outputs)
+}
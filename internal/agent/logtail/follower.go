@@ -0,0 +1,164 @@
+package logtail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/ospiem/mcollector/internal/agent/statsd"
+	"github.com/rs/zerolog"
+)
+
+// readSize is the size of the chunks the files are read in.
+const readSize = 64 * 1024
+
+// maxLineSize is the size a line is dropped at if it still has no end of line.
+const maxLineSize = 1024 * 1024
+
+// follower reads the lines appended to a file.
+type follower struct {
+	log     zerolog.Logger
+	agg     *statsd.Aggregator
+	f       *os.File
+	path    string
+	partial []byte
+	rules   []rule
+	// offset is the position after the last complete line.
+	offset int64
+	// skipping is true while the rest of an overlong line is dropped.
+	skipping bool
+	// started is true after the first poll, the files opened later are read from the start.
+	started bool
+}
+
+// poll reads the new lines of the file, following its rotation and truncation.
+func (f *follower) poll(st *state) error {
+	if f.f == nil {
+		opened, err := f.open(st)
+		f.started = true
+		if err != nil || !opened {
+			return err
+		}
+	}
+
+	fi, err := f.f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	if fi.Size() < f.offset+int64(len(f.partial)) {
+		f.log.Info().Msg("log file truncated, reading from the start")
+		f.reset(0)
+	}
+	if err := f.read(); err != nil {
+		return err
+	}
+
+	// The old file is read to its end before following the new one.
+	cur, err := os.Stat(f.path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		// The file is moved and the new one is not created yet.
+	case err != nil:
+		return fmt.Errorf("failed to stat path: %w", err)
+	case !os.SameFile(fi, cur):
+		f.log.Info().Msg("log file rotated, reading the new file")
+		f.close()
+		if opened, err := f.open(st); err != nil || !opened {
+			return err
+		}
+		if err := f.read(); err != nil {
+			return err
+		}
+	}
+	st.set(f.path, f.f, f.offset)
+	return nil
+}
+
+// open opens the file. On the first poll, the file is read from the saved offset if it is the
+// file the offset was saved for and from its end if no offset was saved. It returns false if
+// the file does not exist.
+func (f *follower) open(st *state) (bool, error) {
+	file, err := os.Open(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to open file: %w", err)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return false, fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	f.f = file
+	offset := int64(0)
+	if !f.started {
+		saved, ok := st.offset(f.path, file, fi.Size())
+		offset = fi.Size()
+		if ok {
+			offset = saved
+		}
+	}
+	f.reset(offset)
+	st.set(f.path, f.f, f.offset)
+	return true, nil
+}
+
+// reset moves the read position to the offset.
+func (f *follower) reset(offset int64) {
+	f.offset = offset
+	f.partial = f.partial[:0]
+	f.skipping = false
+}
+
+// read processes the lines between the read position and the end of the file.
+func (f *follower) read() error {
+	buf := make([]byte, readSize)
+	for {
+		n, err := f.f.ReadAt(buf, f.offset+int64(len(f.partial)))
+		f.consume(buf[:n])
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+	}
+}
+
+// consume processes the complete lines of the chunk and keeps the rest as a partial line.
+func (f *follower) consume(chunk []byte) {
+	for len(chunk) > 0 {
+		i := bytes.IndexByte(chunk, '\n')
+		if i < 0 {
+			f.partial = append(f.partial, chunk...)
+			if len(f.partial) > maxLineSize {
+				f.log.Warn().Int("size", maxLineSize).Msg("line too long, dropping it")
+				f.offset += int64(len(f.partial))
+				f.partial = f.partial[:0]
+				f.skipping = true
+			}
+			return
+		}
+
+		line := append(f.partial, chunk[:i]...)
+		if !f.skipping {
+			match(f.agg, f.rules, string(bytes.TrimSuffix(line, []byte("\r"))), f.log)
+		}
+		f.offset += int64(len(line)) + 1
+		f.partial = line[:0]
+		f.skipping = false
+		chunk = chunk[i+1:]
+	}
+}
+
+func (f *follower) close() {
+	if f.f != nil {
+		_ = f.f.Close()
+		f.f = nil
+	}
+}
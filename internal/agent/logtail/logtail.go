@@ -0,0 +1,215 @@
+// Package logtail follows log files and derives metrics from the lines matching regular
+// expressions.
+//
+// The files are polled, so a rotated file is read to its end before the new one is opened and
+// a truncated file is read again from the start. The read offsets are saved to a state file,
+// so the lines read before a restart are not counted again.
+package logtail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/agent/statsd"
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/rs/zerolog"
+)
+
+// Types of the metrics derived from the matching lines.
+const (
+	TypeCounter   = "counter"   // TypeCounter counts the matching lines.
+	TypeGauge     = "gauge"     // TypeGauge reports the last captured value.
+	TypeHistogram = "histogram" // TypeHistogram summarizes the captured values like a StatsD timer.
+)
+
+// Rule derives a metric from the lines matching the pattern.
+type Rule struct {
+	Name    string // Name is the ID of the metric.
+	Pattern string // Pattern is the regular expression matched against every line.
+	Type    string // Type is counter (default), gauge or histogram.
+	Field   string // Field is the name or number of the group capturing the value, 1 by default.
+}
+
+// File is a log file and the rules applied to its lines.
+type File struct {
+	Path  string
+	Rules []Rule
+}
+
+// rule is a compiled Rule.
+type rule struct {
+	name  string
+	re    *regexp.Regexp
+	typ   string
+	group int
+}
+
+// Tailer follows the files and aggregates the derived metrics until Flush.
+type Tailer struct {
+	log       zerolog.Logger
+	agg       *statsd.Aggregator
+	wg        *sync.WaitGroup
+	cancel    context.CancelFunc
+	state     *state
+	followers []*follower
+	interval  time.Duration
+	errors    atomic.Uint64
+}
+
+// New compiles the rules of the files. The offsets are loaded from and saved to the state
+// file if its path is not empty. The files are polled on the interval.
+func New(files []File, statePath string, interval time.Duration, log zerolog.Logger) (*Tailer, error) {
+	if interval <= 0 {
+		return nil, errors.New("poll interval must be positive")
+	}
+	st, err := loadState(statePath)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Tailer{
+		log:      log.With().Str("component", "logtail").Logger(),
+		agg:      statsd.NewAggregator(),
+		wg:       &sync.WaitGroup{},
+		state:    st,
+		interval: interval,
+	}
+	for _, f := range files {
+		if f.Path == "" {
+			return nil, errors.New("log file needs a path")
+		}
+		rules := make([]rule, 0, len(f.Rules))
+		for _, r := range f.Rules {
+			compiled, err := compile(r)
+			if err != nil {
+				return nil, fmt.Errorf("log file %s: %w", f.Path, err)
+			}
+			rules = append(rules, compiled)
+		}
+		t.followers = append(t.followers, &follower{
+			path:  f.Path,
+			rules: rules,
+			agg:   t.agg,
+			log:   t.log.With().Str("path", f.Path).Logger(),
+		})
+	}
+	return t, nil
+}
+
+// compile checks the rule and compiles its pattern.
+func compile(r Rule) (rule, error) {
+	if r.Name == "" {
+		return rule{}, errors.New("rule needs a name")
+	}
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return rule{}, fmt.Errorf("rule %s: %w", r.Name, err)
+	}
+
+	res := rule{name: r.Name, re: re, typ: r.Type}
+	switch r.Type {
+	case "":
+		res.typ = TypeCounter
+	case TypeCounter:
+	case TypeGauge, TypeHistogram:
+		res.group = 1
+		if r.Field != "" {
+			if res.group, err = strconv.Atoi(r.Field); err != nil {
+				res.group = re.SubexpIndex(r.Field)
+			}
+		}
+		if res.group < 1 || res.group > re.NumSubexp() {
+			return rule{}, fmt.Errorf("rule %s: pattern has no group %q", r.Name, r.Field)
+		}
+	default:
+		return rule{}, fmt.Errorf("rule %s: unknown type %q", r.Name, r.Type)
+	}
+	return res, nil
+}
+
+// Start follows the files until Stop is called.
+func (t *Tailer) Start(ctx context.Context) {
+	ctx, t.cancel = context.WithCancel(ctx)
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		ticker := time.NewTicker(t.interval)
+		defer ticker.Stop()
+		for {
+			t.poll()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops following the files, closes them and saves their offsets.
+func (t *Tailer) Stop() {
+	if t.cancel != nil {
+		t.cancel()
+	}
+	t.wg.Wait()
+	for _, f := range t.followers {
+		f.close()
+	}
+}
+
+// Flush returns the metrics derived since the previous flush.
+func (t *Tailer) Flush() []models.Metrics {
+	return t.agg.Flush()
+}
+
+// Errors returns the number of failures to read the files or to save their offsets.
+func (t *Tailer) Errors() uint64 {
+	return t.errors.Load()
+}
+
+// poll reads the new lines of every file and saves the offsets.
+func (t *Tailer) poll() {
+	for _, f := range t.followers {
+		if err := f.poll(t.state); err != nil {
+			f.log.Error().Err(err).Msg("failed to read log file")
+			t.errors.Add(1)
+		}
+	}
+	if err := t.state.save(); err != nil {
+		t.log.Error().Err(err).Msg("failed to save log offsets")
+		t.errors.Add(1)
+	}
+}
+
+// match adds the metrics of the rules matching the line.
+func match(agg *statsd.Aggregator, rules []rule, line string, log zerolog.Logger) {
+	for _, r := range rules {
+		if r.typ == TypeCounter {
+			if r.re.MatchString(line) {
+				agg.Add(statsd.Metric{Name: r.name, Type: "c", Value: 1, Rate: 1})
+			}
+			continue
+		}
+
+		groups := r.re.FindStringSubmatch(line)
+		if groups == nil {
+			continue
+		}
+		v, err := strconv.ParseFloat(groups[r.group], 64)
+		if err != nil {
+			log.Debug().Err(err).Str("rule", r.name).Msg("captured value is not a number")
+			continue
+		}
+		typ := "g"
+		if r.typ == TypeHistogram {
+			typ = "h"
+		}
+		agg.Add(statsd.Metric{Name: r.name, Type: typ, Value: v, Rate: 1})
+	}
+}
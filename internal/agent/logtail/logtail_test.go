@@ -0,0 +1,151 @@
+package logtail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testRules = []Rule{
+	{Name: "errors", Pattern: `level=error`},
+	{Name: "latency", Pattern: `latency=(?P<ms>[0-9.]+)ms`, Type: TypeHistogram, Field: "ms"},
+	{Name: "queue", Pattern: `queue=(\d+)`, Type: TypeGauge},
+}
+
+func byID(metrics []models.Metrics) map[string]models.Metrics {
+	res := make(map[string]models.Metrics, len(metrics))
+	for _, m := range metrics {
+		res[m.ID] = m
+	}
+	return res
+}
+
+// errorCount returns the number of error lines counted since the last flush.
+func errorCount(t *Tailer) int64 {
+	if m, ok := byID(t.Flush())["errors"]; ok {
+		return *m.Delta
+	}
+	return 0
+}
+
+func appendLines(t *testing.T, path, lines string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteString(lines)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func TestTailer(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	appendLines(t, path, "level=error old line\n")
+
+	tl, err := New([]File{{Path: path, Rules: testRules}}, "", time.Second, zerolog.Nop())
+	require.NoError(t, err)
+	defer tl.Stop()
+
+	// The lines written before the first start are skipped.
+	tl.poll()
+	assert.Zero(t, errorCount(tl))
+
+	appendLines(t, path, "level=error a\nlatency=10ms queue=3\nlatency=30ms queue=5\nlevel=error b")
+	tl.poll()
+	got := byID(tl.Flush())
+	assert.Equal(t, int64(1), *got["errors"].Delta, "the partial line is not counted")
+	assert.Equal(t, float64(2), *got["latency.count"].Value)
+	assert.Equal(t, float64(20), *got["latency.mean"].Value)
+	assert.Equal(t, float64(5), *got["queue"].Value)
+
+	appendLines(t, path, " end\n")
+	tl.poll()
+	assert.Equal(t, int64(1), errorCount(tl))
+
+	// Truncation.
+	require.NoError(t, os.Truncate(path, 0))
+	appendLines(t, path, "level=error c\n")
+	tl.poll()
+	assert.Equal(t, int64(1), errorCount(tl))
+
+	// Rotation: the lines written to the old file after the move are read too.
+	require.NoError(t, os.Rename(path, path+".1"))
+	appendLines(t, path+".1", "level=error d\n")
+	tl.poll()
+	appendLines(t, path, "level=error e\nlevel=error f\n")
+	tl.poll()
+	assert.Equal(t, int64(3), errorCount(tl))
+}
+
+func TestTailerResumesFromState(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	statePath := filepath.Join(dir, "offsets.json")
+	appendLines(t, path, "level=error a\n")
+
+	tl, err := New([]File{{Path: path, Rules: testRules}}, statePath, time.Second, zerolog.Nop())
+	require.NoError(t, err)
+	tl.poll()
+	appendLines(t, path, "level=error b\n")
+	tl.poll()
+	assert.Equal(t, int64(1), errorCount(tl))
+	tl.Stop()
+
+	// The lines written while the agent is down are counted once.
+	appendLines(t, path, "level=error c\nlevel=error d\n")
+	tl, err = New([]File{{Path: path, Rules: testRules}}, statePath, time.Second, zerolog.Nop())
+	require.NoError(t, err)
+	tl.poll()
+	assert.Equal(t, int64(2), errorCount(tl))
+	tl.Stop()
+
+	// A file replaced while the agent is down is read from the start.
+	require.NoError(t, os.Remove(path))
+	appendLines(t, path, "level=info new file\nlevel=error e\n")
+	tl, err = New([]File{{Path: path, Rules: testRules}}, statePath, time.Second, zerolog.Nop())
+	require.NoError(t, err)
+	tl.poll()
+	assert.Equal(t, int64(1), errorCount(tl))
+	tl.Stop()
+}
+
+func TestTailerStart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	tl, err := New([]File{{Path: path, Rules: testRules}}, "", 10*time.Millisecond, zerolog.Nop())
+	require.NoError(t, err)
+	tl.poll()
+	tl.Start(context.Background())
+	defer tl.Stop()
+
+	// A file created after the first poll is read from its start.
+	appendLines(t, path, "level=error a\n")
+	total := int64(0)
+	require.Eventually(t, func() bool {
+		total += errorCount(tl)
+		return total == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestNewErrors(t *testing.T) {
+	for _, r := range []Rule{
+		{Pattern: "x"},
+		{Name: "a", Pattern: "("},
+		{Name: "a", Pattern: "x", Type: "summary"},
+		{Name: "a", Pattern: "x", Type: TypeGauge},
+		{Name: "a", Pattern: "(x)", Type: TypeGauge, Field: "value"},
+		{Name: "a", Pattern: "(x)", Type: TypeHistogram, Field: "2"},
+	} {
+		_, err := New([]File{{Path: "app.log", Rules: []Rule{r}}}, "", time.Second, zerolog.Nop())
+		assert.Error(t, err, r)
+	}
+
+	_, err := New([]File{{Path: "app.log"}}, "", 0, zerolog.Nop())
+	assert.Error(t, err)
+}
@@ -0,0 +1,114 @@
+package logtail
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// fingerprintSize is the number of bytes at the start of a file identifying it.
+const fingerprintSize = 256
+
+// entry is the saved offset of a file.
+type entry struct {
+	Offset      int64  `json:"offset"`
+	Fingerprint string `json:"fingerprint"` // Fingerprint is the hex of the first bytes of the file.
+}
+
+// state keeps the offsets of the files in a JSON file. It is only used by the poll goroutine.
+type state struct {
+	entries map[string]entry
+	path    string
+	dirty   bool
+}
+
+// loadState reads the state file. A missing file is an empty state, an empty path disables
+// saving the state.
+func loadState(path string) (*state, error) {
+	st := &state{entries: make(map[string]entry), path: path}
+	if path == "" {
+		return st, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read log offsets: %w", err)
+	}
+	if err := json.Unmarshal(data, &st.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse log offsets: %w", err)
+	}
+	return st, nil
+}
+
+// offset returns the saved offset of the path and true if there is one. The offset is 0 if
+// the file has changed since it was saved.
+func (st *state) offset(path string, f *os.File, size int64) (int64, bool) {
+	e, ok := st.entries[path]
+	if !ok {
+		return 0, false
+	}
+	if size < e.Offset || fingerprint(f, len(e.Fingerprint)/2) != e.Fingerprint {
+		return 0, true
+	}
+	return e.Offset, true
+}
+
+// set records the offset of the file at the path.
+func (st *state) set(path string, f *os.File, offset int64) {
+	e, ok := st.entries[path]
+	if ok && e.Offset == offset && len(e.Fingerprint) == 2*fingerprintSize {
+		return
+	}
+	st.entries[path] = entry{Offset: offset, Fingerprint: fingerprint(f, fingerprintSize)}
+	st.dirty = true
+}
+
+// save writes the state file if an offset has changed.
+func (st *state) save() error {
+	if st.path == "" || !st.dirty {
+		return nil
+	}
+	data, err := json.Marshal(st.entries)
+	if err != nil {
+		return fmt.Errorf("failed to marshal log offsets: %w", err)
+	}
+
+	// Replace the file at once, so a crash does not leave a partial state.
+	tmp, err := os.CreateTemp(filepath.Dir(st.path), filepath.Base(st.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create log offsets: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write log offsets: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("failed to close log offsets: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), st.path); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("failed to replace log offsets: %w", err)
+	}
+	st.dirty = false
+	return nil
+}
+
+// fingerprint returns the hex of the first n bytes of the file, fewer if the file is shorter.
+func fingerprint(f *os.File, n int) string {
+	buf := make([]byte, n)
+	read, err := f.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return ""
+	}
+	return hex.EncodeToString(buf[:read])
+}
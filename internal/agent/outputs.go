@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto/ecies"
+	"github.com/ospiem/mcollector/internal/agent/balancer"
+	"github.com/ospiem/mcollector/internal/agent/config"
+	"github.com/ospiem/mcollector/internal/agent/sink"
+	"github.com/ospiem/mcollector/internal/requestid"
+	"github.com/ospiem/mcollector/internal/retry"
+	"github.com/rs/zerolog"
+)
+
+// outputsCloseTimeout is the time the outputs get to send the queued metrics on shutdown.
+const outputsCloseTimeout = 10 * time.Second
+
+// defaultPushgatewayJob is the Pushgateway job the metrics are pushed to.
+const defaultPushgatewayJob = "mcollector"
+
+// mcollectorKeys sign and encrypt the requests to the mcollector servers, a reload of the
+// config replaces them.
+type mcollectorKeys struct {
+	cfg    config.Config
+	pubKey *ecies.PublicKey
+}
+
+// mcollectorSink sends metrics to the mcollector servers picked by the balancer.
+type mcollectorSink struct {
+	b    *balancer.Balancer
+	keys *atomic.Pointer[mcollectorKeys]
+	log  zerolog.Logger
+}
+
+func (s *mcollectorSink) Write(ctx context.Context, b sink.Batch) error {
+	keys := s.keys.Load()
+	ctx = requestid.NewContext(ctx, b.ID)
+	err := sendMetrics(ctx, keys.cfg, s.b, b.Metrics, keys.pubKey, &s.log)
+	if err != nil && !isRetryable(err) {
+		return retry.Permanent(err)
+	}
+	return err
+}
+
+func (s *mcollectorSink) Close() error {
+	return nil
+}
+
+// newOutputs starts an output for every configured system.
+func newOutputs(cfg config.Config, b *balancer.Balancer, keys *atomic.Pointer[mcollectorKeys],
+	log zerolog.Logger) (sink.Fanout, error) {
+	var outputs sink.Fanout
+	for _, oc := range cfg.EnabledOutputs() {
+		opts := sink.Options{
+			Name:      oc.Type,
+			BatchSize: oc.BatchSize,
+			QueueSize: oc.QueueSize,
+			Workers:   1,
+		}
+
+		var s sink.Sink
+		switch oc.Type {
+		case config.OutputMcollector:
+			s = &mcollectorSink{b: b, keys: keys, log: log}
+			opts.Workers = cfg.RateLimit
+		case config.OutputPushgateway:
+			job := oc.Job
+			if job == "" {
+				job = defaultPushgatewayJob
+			}
+			s = sink.NewPushgateway(oc.URL, job, cfg.AgentID)
+			opts.Name += "=" + oc.URL
+			opts.Cumulative = true
+		case config.OutputGraphite:
+			s = sink.NewGraphite(oc.Address, oc.Prefix)
+			opts.Name += "=" + oc.Address
+			opts.Cumulative = true
+		case config.OutputInfluxDB:
+			s = sink.NewInflux(oc.URL, oc.Token, cfg.AgentID)
+			opts.Name += "=" + oc.URL
+			opts.Cumulative = true
+		case config.OutputFile:
+			f, err := sink.NewFile(oc.Path)
+			if err != nil {
+				_ = outputs.Close(context.Background())
+				return nil, fmt.Errorf("failed to create file output: %w", err)
+			}
+			s = f
+			opts.Name += "=" + oc.Path
+		default:
+			_ = outputs.Close(context.Background())
+			return nil, fmt.Errorf("unknown output type %q", oc.Type)
+		}
+
+		opts.Retry = sendRetryPolicy(log.With().Str("output", opts.Name).Logger())
+		if oc.Retries > 0 {
+			opts.Retry.MaxAttempts = oc.Retries
+		}
+		outputs = append(outputs, sink.NewOutput(s, opts, log))
+	}
+	return outputs, nil
+}
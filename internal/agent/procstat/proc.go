@@ -0,0 +1,169 @@
+package procstat
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ospiem/mcollector/internal/models"
+)
+
+// stats are the metrics of a process or the sum of a group.
+type stats struct {
+	processes  int
+	startTime  uint64
+	cpuSeconds float64
+	cpuPercent float64
+	rssBytes   uint64
+	threads    uint64
+	fds        uint64
+	readBytes  uint64
+	writeBytes uint64
+}
+
+func (s *stats) add(o stats) {
+	s.cpuSeconds += o.cpuSeconds
+	s.rssBytes += o.rssBytes
+	s.threads += o.threads
+	s.fds += o.fds
+	s.readBytes += o.readBytes
+	s.writeBytes += o.writeBytes
+}
+
+// metrics returns the gauges of the group.
+func (s *stats) metrics(g group) []models.Metrics {
+	if s.processes == 0 {
+		return []models.Metrics{metric(g, "processes", 0)}
+	}
+	return []models.Metrics{
+		metric(g, "processes", float64(s.processes)),
+		metric(g, "cpu_seconds", s.cpuSeconds),
+		metric(g, "cpu_percent", s.cpuPercent),
+		metric(g, "rss_bytes", float64(s.rssBytes)),
+		metric(g, "threads", float64(s.threads)),
+		metric(g, "fds", float64(s.fds)),
+		metric(g, "read_bytes", float64(s.readBytes)),
+		metric(g, "write_bytes", float64(s.writeBytes)),
+	}
+}
+
+func metric(g group, name string, v float64) models.Metrics {
+	id := g.Prefix + "." + name
+	if g.Tagged {
+		id = "process." + name + ";group=" + g.Name
+	}
+	return models.Metrics{ID: id, MType: models.Gauge, Value: &v}
+}
+
+// read reads the metrics of the process. The io file and the fd directory are only readable
+// for the processes of the same user without privileges, their metrics are 0 otherwise.
+func (c *Collector) read(pid int) (stats, error) {
+	dir := filepath.Join(c.root, strconv.Itoa(pid))
+
+	var st stats
+	if err := readStat(filepath.Join(dir, "stat"), &st); err != nil {
+		return stats{}, err
+	}
+	if err := readStatus(filepath.Join(dir, "status"), &st); err != nil {
+		return stats{}, err
+	}
+	if err := readIO(filepath.Join(dir, "io"), &st); err != nil && !errors.Is(err, os.ErrPermission) {
+		return stats{}, err
+	}
+	if fds, err := os.ReadDir(filepath.Join(dir, "fd")); err == nil {
+		st.fds = uint64(len(fds))
+	} else if !errors.Is(err, os.ErrPermission) {
+		return stats{}, fmt.Errorf("failed to read fds: %w", err)
+	}
+	return st, nil
+}
+
+// readStat reads the CPU times and the start time from /proc/[pid]/stat.
+func readStat(path string, st *stats) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read stat: %w", err)
+	}
+	// The command name in parentheses may contain spaces and parentheses.
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return fmt.Errorf("invalid stat %q", data)
+	}
+	// The fields start with the state, the 3rd field of the file.
+	fields := strings.Fields(string(data[i+1:]))
+	const utime, stime, starttime = 14 - 3, 15 - 3, 22 - 3
+	if len(fields) <= starttime {
+		return fmt.Errorf("invalid stat %q", data)
+	}
+
+	var ticks [3]uint64
+	for j, field := range []int{utime, stime, starttime} {
+		if ticks[j], err = strconv.ParseUint(fields[field], 10, 64); err != nil {
+			return fmt.Errorf("invalid stat field %d: %w", field+3, err)
+		}
+	}
+	st.cpuSeconds = float64(ticks[0]+ticks[1]) / clockTicks
+	st.startTime = ticks[2]
+	return nil
+}
+
+// readStatus reads the resident memory and the threads from /proc/[pid]/status.
+func readStatus(path string, st *stats) error {
+	return readKeyValues(path, func(key, value string) error {
+		var err error
+		switch key {
+		case "VmRSS":
+			kb, _, _ := strings.Cut(value, " ")
+			st.rssBytes, err = strconv.ParseUint(kb, 10, 64)
+			st.rssBytes *= 1024
+		case "Threads":
+			st.threads, err = strconv.ParseUint(value, 10, 64)
+		}
+		return err
+	})
+}
+
+// readIO reads the bytes read from and written to the storage from /proc/[pid]/io.
+func readIO(path string, st *stats) error {
+	return readKeyValues(path, func(key, value string) error {
+		var err error
+		switch key {
+		case "read_bytes":
+			st.readBytes, err = strconv.ParseUint(value, 10, 64)
+		case "write_bytes":
+			st.writeBytes, err = strconv.ParseUint(value, 10, 64)
+		}
+		return err
+	})
+}
+
+// readKeyValues calls fn for every "key: value" line of the file.
+func readKeyValues(path string, fn func(key, value string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", filepath.Base(path), err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		key, value, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			continue
+		}
+		if err := fn(key, strings.TrimSpace(value)); err != nil {
+			return fmt.Errorf("invalid %s in %s: %w", key, filepath.Base(path), err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+// Package procstat reads the metrics of the processes running on the host from /proc.
+//
+// The processes are selected in groups, by name, pidfile or command line, and the metrics of
+// the processes of a group are summed. A group reports the gauges processes, cpu_seconds,
+// cpu_percent, rss_bytes, threads, fds, read_bytes and write_bytes, named
+// "<prefix>.<metric>" or, with Tagged, "process.<metric>;group=<name>".
+package procstat
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/rs/zerolog"
+)
+
+// DefaultProcRoot is where the proc filesystem is mounted.
+const DefaultProcRoot = "/proc"
+
+// clockTicks is the number of clock ticks per second the CPU times in /proc/[pid]/stat are
+// counted in. It is 100 on all the common Linux platforms.
+const clockTicks = 100
+
+// Group selects the processes whose metrics are summed. Exactly one of Process, Pidfile and
+// Cmdline is set.
+type Group struct {
+	Name    string // Name identifies the group.
+	Process string // Process selects the processes by the name in /proc/[pid]/comm.
+	Pidfile string // Pidfile selects the process whose pid is in the file.
+	Cmdline string // Cmdline selects the processes whose command line matches the regular expression.
+	Prefix  string // Prefix of the metric IDs, "process.<name>" by default.
+	Tagged  bool   // Tagged names the metrics "process.<metric>;group=<name>" instead of using the prefix.
+}
+
+// group is a validated Group.
+type group struct {
+	Group
+	cmdline *regexp.Regexp
+}
+
+// sample is the CPU time of a process at the previous collection.
+type sample struct {
+	at        time.Time
+	startTime uint64
+	cpu       float64
+}
+
+// Collector reads the metrics of the process groups.
+type Collector struct {
+	log    zerolog.Logger
+	mux    *sync.Mutex
+	prev   map[int]sample
+	root   string
+	groups []group
+	errors atomic.Uint64
+}
+
+// New validates the groups and creates a Collector reading the proc filesystem at root.
+func New(groups []Group, root string, log zerolog.Logger) (*Collector, error) {
+	c := &Collector{
+		log:  log.With().Str("component", "procstat").Logger(),
+		mux:  &sync.Mutex{},
+		prev: make(map[int]sample),
+		root: root,
+	}
+	for _, g := range groups {
+		if g.Name == "" {
+			return nil, errors.New("process group needs a name")
+		}
+		selectors := 0
+		for _, s := range []string{g.Process, g.Pidfile, g.Cmdline} {
+			if s != "" {
+				selectors++
+			}
+		}
+		if selectors != 1 {
+			return nil, fmt.Errorf("process group %s needs one of process, pidfile or cmdline", g.Name)
+		}
+
+		compiled := group{Group: g}
+		if g.Cmdline != "" {
+			re, err := regexp.Compile(g.Cmdline)
+			if err != nil {
+				return nil, fmt.Errorf("process group %s: %w", g.Name, err)
+			}
+			compiled.cmdline = re
+		}
+		if compiled.Prefix == "" {
+			compiled.Prefix = "process." + g.Name
+		}
+		c.groups = append(c.groups, compiled)
+	}
+	return c, nil
+}
+
+// Collect returns the metrics of every group. A group without running processes only
+// reports processes as 0.
+func (c *Collector) Collect() []models.Metrics {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	pids, err := c.pids()
+	if err != nil {
+		c.log.Error().Err(err).Msg("failed to list processes")
+		c.errors.Add(1)
+		return nil
+	}
+
+	now := time.Now()
+	seen := make(map[int]sample)
+	var metrics []models.Metrics
+	for _, g := range c.groups {
+		var total stats
+		for _, pid := range c.match(g, pids) {
+			st, err := c.read(pid)
+			if err != nil {
+				// The process has exited since it was listed.
+				c.log.Debug().Err(err).Int("pid", pid).Msg("failed to read process")
+				continue
+			}
+			total.processes++
+			total.add(st)
+
+			cur := sample{at: now, startTime: st.startTime, cpu: st.cpuSeconds}
+			if p, ok := c.prev[pid]; ok && p.startTime == st.startTime && now.After(p.at) {
+				total.cpuPercent += 100 * (cur.cpu - p.cpu) / now.Sub(p.at).Seconds()
+			}
+			seen[pid] = cur
+		}
+		metrics = append(metrics, total.metrics(g)...)
+	}
+	c.prev = seen
+	return metrics
+}
+
+// Errors returns the number of failures to list the processes or to read a pidfile.
+func (c *Collector) Errors() uint64 {
+	return c.errors.Load()
+}
+
+// pids lists the running processes.
+func (c *Collector) pids() ([]int, error) {
+	entries, err := os.ReadDir(c.root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", c.root, err)
+	}
+	pids := make([]int, 0, len(entries))
+	for _, e := range entries {
+		if pid, err := strconv.Atoi(e.Name()); err == nil && e.IsDir() {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// match returns the pids of the group.
+func (c *Collector) match(g group, pids []int) []int {
+	if g.Pidfile != "" {
+		data, err := os.ReadFile(g.Pidfile)
+		if err != nil {
+			c.log.Debug().Err(err).Str("group", g.Name).Msg("failed to read pidfile")
+			return nil
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			c.log.Error().Err(err).Str("group", g.Name).Msg("invalid pidfile")
+			c.errors.Add(1)
+			return nil
+		}
+		return []int{pid}
+	}
+
+	var res []int
+	for _, pid := range pids {
+		dir := filepath.Join(c.root, strconv.Itoa(pid))
+		if g.Process != "" {
+			comm, err := os.ReadFile(filepath.Join(dir, "comm"))
+			if err == nil && strings.TrimSpace(string(comm)) == g.Process {
+				res = append(res, pid)
+			}
+			continue
+		}
+		cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline"))
+		if err == nil && g.cmdline.Match(bytesToArgs(cmdline)) {
+			res = append(res, pid)
+		}
+	}
+	return res
+}
+
+// bytesToArgs replaces the NUL separators of /proc/[pid]/cmdline with spaces.
+func bytesToArgs(cmdline []byte) []byte {
+	args := []byte(strings.TrimRight(string(cmdline), "\x00"))
+	for i, b := range args {
+		if b == 0 {
+			args[i] = ' '
+		}
+	}
+	return args
+}
@@ -0,0 +1,109 @@
+package procstat
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func byID(metrics []models.Metrics) map[string]float64 {
+	res := make(map[string]float64, len(metrics))
+	for _, m := range metrics {
+		res[m.ID] = *m.Value
+	}
+	return res
+}
+
+// writeProc creates the files of a fake process.
+func writeProc(t *testing.T, root string, pid int, comm, cmdline string, utime int) {
+	t.Helper()
+	dir := filepath.Join(root, strconv.Itoa(pid))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "fd"), 0700))
+	files := map[string]string{
+		"comm":    comm + "\n",
+		"cmdline": cmdline,
+		"stat": strconv.Itoa(pid) + " (" + comm + ") S 1 1 1 0 -1 4194560 100 0 0 0 " +
+			strconv.Itoa(utime) + " 50 0 0 20 0 4 0 1000 1000000 200 18446744073709551615\n",
+		"status": "Name:\t" + comm + "\nVmRSS:\t    2048 kB\nThreads:\t4\n",
+		"io":     "rchar: 10\nwchar: 20\nread_bytes: 4096\nwrite_bytes: 8192\n",
+	}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+	for i := 0; i < 3; i++ {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "fd", strconv.Itoa(i)), nil, 0600))
+	}
+}
+
+func TestCollect(t *testing.T) {
+	root := t.TempDir()
+	writeProc(t, root, 10, "nginx", "nginx: master process\x00", 100)
+	writeProc(t, root, 11, "nginx", "nginx: worker process\x00", 200)
+	writeProc(t, root, 20, "java", "java\x00-jar\x00/opt/app/app.jar\x00", 1000)
+	pidfile := filepath.Join(t.TempDir(), "java.pid")
+	require.NoError(t, os.WriteFile(pidfile, []byte("20\n"), 0600))
+
+	c, err := New([]Group{
+		{Name: "nginx", Process: "nginx"},
+		{Name: "app", Cmdline: `-jar \S+app\.jar`, Tagged: true},
+		{Name: "java", Pidfile: pidfile, Prefix: "jvm"},
+		{Name: "redis", Process: "redis-server"},
+	}, root, zerolog.Nop())
+	require.NoError(t, err)
+
+	got := byID(c.Collect())
+	assert.Equal(t, float64(2), got["process.nginx.processes"])
+	assert.Equal(t, 4.0, got["process.nginx.cpu_seconds"], "(100+50+200+50) ticks")
+	assert.Equal(t, float64(0), got["process.nginx.cpu_percent"])
+	assert.Equal(t, float64(2*2048*1024), got["process.nginx.rss_bytes"])
+	assert.Equal(t, float64(8), got["process.nginx.threads"])
+	assert.Equal(t, float64(6), got["process.nginx.fds"])
+	assert.Equal(t, float64(8192), got["process.nginx.read_bytes"])
+	assert.Equal(t, float64(16384), got["process.nginx.write_bytes"])
+
+	assert.Equal(t, float64(1), got["process.processes;group=app"])
+	assert.Equal(t, 10.5, got["process.cpu_seconds;group=app"])
+	assert.Equal(t, 10.5, got["jvm.cpu_seconds"])
+
+	assert.Equal(t, float64(0), got["process.redis.processes"])
+	assert.NotContains(t, got, "process.redis.cpu_seconds")
+
+	// The CPU usage is computed from the previous collection.
+	writeProc(t, root, 20, "java", "java\x00-jar\x00/opt/app/app.jar\x00", 1100)
+	got = byID(c.Collect())
+	assert.Greater(t, got["jvm.cpu_percent"], float64(0))
+}
+
+func TestCollectSelf(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("no proc filesystem")
+	}
+	pidfile := filepath.Join(t.TempDir(), "self.pid")
+	require.NoError(t, os.WriteFile(pidfile, []byte(strconv.Itoa(os.Getpid())), 0600))
+
+	c, err := New([]Group{{Name: "self", Pidfile: pidfile}}, DefaultProcRoot, zerolog.Nop())
+	require.NoError(t, err)
+	got := byID(c.Collect())
+	assert.Equal(t, float64(1), got["process.self.processes"])
+	assert.Greater(t, got["process.self.rss_bytes"], float64(0))
+	assert.Greater(t, got["process.self.threads"], float64(0))
+	assert.Greater(t, got["process.self.fds"], float64(0))
+}
+
+func TestNewErrors(t *testing.T) {
+	for _, g := range []Group{
+		{Process: "nginx"},
+		{Name: "a"},
+		{Name: "a", Process: "nginx", Pidfile: "/run/nginx.pid"},
+		{Name: "a", Cmdline: "("},
+	} {
+		_, err := New([]Group{g}, DefaultProcRoot, zerolog.Nop())
+		assert.Error(t, err, g)
+	}
+}
@@ -0,0 +1,204 @@
+// Package push provides a local HTTP API for applications on the same host to push metrics
+// to the agent. It accepts the same JSON as the /update/ and /updates/ routes of the server,
+// so the metrics are then signed, encrypted, compressed and retried by the agent.
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/ospiem/mcollector/internal/server/middleware/compress"
+	"github.com/rs/zerolog"
+)
+
+// maxBodySize limits the size of a pushed request body.
+const maxBodySize = 4 << 20
+
+// Buffer merges the pushed metrics between two reports of the agent.
+type Buffer struct {
+	mux      *sync.Mutex
+	counters map[string]int64
+	gauges   map[string]float64
+	rejected atomic.Uint64
+}
+
+// NewBuffer creates an empty Buffer.
+func NewBuffer() *Buffer {
+	return &Buffer{
+		mux:      &sync.Mutex{},
+		counters: make(map[string]int64),
+		gauges:   make(map[string]float64),
+	}
+}
+
+// Add validates the metrics and merges them into the buffer: counter deltas are summed and
+// a gauge keeps its last value. Nothing is added if one of the metrics is invalid.
+func (b *Buffer) Add(metrics []models.Metrics) error {
+	for _, m := range metrics {
+		if err := validate(m); err != nil {
+			return err
+		}
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	for _, m := range metrics {
+		if m.MType == models.Counter {
+			b.counters[m.ID] += *m.Delta
+		} else {
+			b.gauges[m.ID] = *m.Value
+		}
+	}
+	return nil
+}
+
+// Rejected returns the number of pushes rejected because they were invalid.
+func (b *Buffer) Rejected() uint64 {
+	return b.rejected.Load()
+}
+
+// Flush returns the merged metrics and empties the buffer.
+func (b *Buffer) Flush() []models.Metrics {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	metrics := make([]models.Metrics, 0, len(b.counters)+len(b.gauges))
+	for id, delta := range b.counters {
+		metrics = append(metrics, models.Metrics{ID: id, MType: models.Counter, Delta: &delta})
+	}
+	for id, value := range b.gauges {
+		metrics = append(metrics, models.Metrics{ID: id, MType: models.Gauge, Value: &value})
+	}
+	b.counters = make(map[string]int64)
+	b.gauges = make(map[string]float64)
+	return metrics
+}
+
+// validate checks the metric has an ID and the value of its type.
+func validate(m models.Metrics) error {
+	if m.ID == "" {
+		return errors.New("missing metric id")
+	}
+	switch m.MType {
+	case models.Counter:
+		if m.Delta == nil {
+			return fmt.Errorf("missing delta of counter %q", m.ID)
+		}
+	case models.Gauge:
+		if m.Value == nil {
+			return fmt.Errorf("missing value of gauge %q", m.ID)
+		}
+	default:
+		return fmt.Errorf("invalid type %q of metric %q", m.MType, m.ID)
+	}
+	return nil
+}
+
+// Handler returns the routes pushing metrics to the buffer.
+func Handler(b *Buffer, log zerolog.Logger) http.Handler {
+	r := chi.NewRouter()
+	r.Use(middleware.Recoverer)
+	r.Use(compress.DecompressRequest(log))
+
+	r.Post("/update/", func(w http.ResponseWriter, r *http.Request) {
+		var m models.Metrics
+		if !decode(w, r, &m) {
+			b.rejected.Add(1)
+			return
+		}
+		push(w, b, []models.Metrics{m})
+	})
+	r.Post("/updates/", func(w http.ResponseWriter, r *http.Request) {
+		var metrics []models.Metrics
+		if !decode(w, r, &metrics) {
+			b.rejected.Add(1)
+			return
+		}
+		push(w, b, metrics)
+	})
+	return r
+}
+
+// decode reads the JSON body into v. It replies with an error and returns false on failure.
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	if r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusBadRequest)
+		return false
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func push(w http.ResponseWriter, b *Buffer, metrics []models.Metrics) {
+	if err := b.Add(metrics); err != nil {
+		b.rejected.Add(1)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Server serves an HTTP handler of the agent, e.g. the push API.
+type Server struct {
+	srv  *http.Server
+	addr net.Addr
+	done chan struct{}
+}
+
+// Listen starts serving the handler on the address until Shutdown is called. The address has
+// the form tcp://host:port or unix:///path/to/socket. An address without a scheme is TCP.
+func Listen(addr string, h http.Handler, log zerolog.Logger) (*Server, error) {
+	network, address, ok := strings.Cut(addr, "://")
+	if !ok {
+		network, address = "tcp", addr
+	}
+	if network != "tcp" && network != "unix" {
+		return nil, fmt.Errorf("unknown network %q", network)
+	}
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	s := &Server{
+		srv:  &http.Server{Handler: h},
+		addr: l.Addr(),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		if err := s.srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Msg("HTTP server failed")
+		}
+	}()
+	log.Info().Str("address", addr).Msg("listening")
+	return s, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.addr
+}
+
+// Shutdown stops accepting requests and waits for the active ones to complete.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if err := s.srv.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to shutdown HTTP server: %w", err)
+	}
+	<-s.done
+	return nil
+}
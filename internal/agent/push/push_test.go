@@ -0,0 +1,99 @@
+package push
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	b := NewBuffer()
+	h := Handler(b, zerolog.Nop())
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{"batch", "/updates/", `[{"id":"hits","type":"counter","delta":2},{"id":"temp","type":"gauge","value":1.5}]`,
+			http.StatusOK},
+		{"single", "/update/", `{"id":"hits","type":"counter","delta":3}`, http.StatusOK},
+		{"last gauge", "/update/", `{"id":"temp","type":"gauge","value":2.5}`, http.StatusOK},
+		{"invalid type", "/updates/", `[{"id":"hits","type":"counter","delta":1},{"id":"x","type":"histogram"}]`,
+			http.StatusBadRequest},
+		{"missing value", "/update/", `{"id":"temp","type":"gauge"}`, http.StatusBadRequest},
+		{"invalid json", "/updates/", `{`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, tt.want, w.Code, w.Body.String())
+		})
+	}
+
+	got := byID(b.Flush())
+	assert.Equal(t, int64(5), *got["hits"].Delta)
+	assert.Equal(t, 2.5, *got["temp"].Value)
+	assert.Empty(t, b.Flush())
+}
+
+func TestListenUnixGzip(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "push.sock")
+	b := NewBuffer()
+	s, err := Listen("unix://"+sock, Handler(b, zerolog.Nop()), zerolog.Nop())
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, s.Shutdown(context.Background()))
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err = gz.Write([]byte(`[{"id":"hits","type":"counter","delta":7}]`))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	req, err := http.NewRequest(http.MethodPost, "http://agent/updates/", &buf)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	assert.Equal(t, int64(7), *byID(b.Flush())["hits"].Delta)
+}
+
+func TestListenUnknownNetwork(t *testing.T) {
+	_, err := Listen("udp://:8080", http.NotFoundHandler(), zerolog.Nop())
+	assert.Error(t, err)
+}
+
+func byID(metrics []models.Metrics) map[string]models.Metrics {
+	res := make(map[string]models.Metrics, len(metrics))
+	for _, m := range metrics {
+		res[m.ID] = m
+	}
+	return res
+}
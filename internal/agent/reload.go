@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"sync/atomic"
+
+	"github.com/ospiem/mcollector/internal/agent/config"
+	"github.com/ospiem/mcollector/internal/agent/sink"
+	"github.com/ospiem/mcollector/internal/configload"
+	"github.com/ospiem/mcollector/internal/helper"
+	"github.com/ospiem/mcollector/internal/reload"
+	"github.com/rs/zerolog"
+)
+
+// liveSettings are the settings a reload applies while the agent runs, the others need a restart.
+var liveSettings = []string{
+	"report_interval", "poll_interval", "rate_limit", "log_level", "security.key", "security.crypto_key",
+}
+
+// live is what a reload of the config changes while the agent runs.
+type live struct {
+	cfg     config.Config
+	collect *jitteredTicker
+	send    *jitteredTicker
+	outputs sink.Fanout
+	keys    *atomic.Pointer[mcollectorKeys]
+	st      *status
+	log     zerolog.Logger
+}
+
+// reload loads the config again and applies its live settings, logging what changed. An invalid
+// config is rejected and the running one is kept.
+func (l *live) reload(load func() (config.Config, error)) {
+	cfg, err := load()
+	if err != nil {
+		l.log.Error().Err(err).Msg("invalid config, keeping the running one")
+		return
+	}
+	// The certificate is read again even if its path is unchanged, to pick up a renewed one.
+	pubKey, err := parsePubKey(cfg.CryptoKey)
+	if err != nil {
+		l.log.Error().Err(err).Msg("invalid public key, keeping the running config")
+		return
+	}
+
+	reload.LogChanges(l.log, configload.Diff(l.cfg.Report, cfg.Report), liveSettings)
+
+	applied := l.cfg
+	applied.ReportInterval = cfg.ReportInterval
+	applied.PollInterval = cfg.PollInterval
+	applied.RateLimit = cfg.RateLimit
+	applied.LogLevel = cfg.LogLevel
+	applied.Key = cfg.Key
+	applied.CryptoKey = cfg.CryptoKey
+	applied.Report = configload.Merge(l.cfg.Report, cfg.Report, liveSettings)
+
+	if applied.LogLevel != l.cfg.LogLevel {
+		// Unchanged, it keeps the level set on the log level endpoint.
+		if err := helper.SetGlobalLogLevel(applied.LogLevel); err != nil {
+			l.log.Error().Err(err).Msg("failed to set log level")
+		}
+	}
+	l.collect.setInterval(applied.PollInterval)
+	l.send.setInterval(applied.ReportInterval)
+	l.st.interval.Store(int64(applied.ReportInterval))
+	for _, o := range l.outputs {
+		if o.Name() == config.OutputMcollector {
+			o.SetWorkers(applied.RateLimit)
+		}
+	}
+	l.keys.Store(&mcollectorKeys{cfg: applied, pubKey: pubKey})
+	l.cfg = applied
+}
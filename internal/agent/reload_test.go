@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/agent/config"
+	"github.com/ospiem/mcollector/internal/agent/sink"
+	"github.com/ospiem/mcollector/internal/configload"
+	"github.com/ospiem/mcollector/internal/helper"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLiveReload(t *testing.T) {
+	certPath := filepath.Join(t.TempDir(), "cert.pem")
+	require.NoError(t, os.WriteFile(certPath, []byte(testCertPEM), 0600))
+	t.Cleanup(func() { helper.SetGlobalLogLevel("info") })
+
+	cfg, err := config.Load([]string{"-crypto-key", certPath, "-k", "old"})
+	require.NoError(t, err)
+	pubKey, err := parsePubKey(certPath)
+	require.NoError(t, err)
+
+	keys := &atomic.Pointer[mcollectorKeys]{}
+	keys.Store(&mcollectorKeys{cfg: cfg, pubKey: pubKey})
+	l := &live{
+		cfg:     cfg,
+		collect: newJitteredTicker(cfg.PollInterval),
+		send:    newJitteredTicker(cfg.ReportInterval),
+		outputs: sink.Fanout{},
+		keys:    keys,
+		st:      newStatus(nil, &collectors{}, cfg.ReportInterval, zerolog.Nop()),
+		log:     zerolog.Nop(),
+	}
+	defer l.collect.Stop()
+	defer l.send.Stop()
+
+	t.Run("applies the live settings", func(t *testing.T) {
+		l.reload(func() (config.Config, error) {
+			return config.Load([]string{"-crypto-key", certPath, "-k", "new", "-r", "30", "-a", "example.com:80"})
+		})
+		assert.Equal(t, 30*time.Second, l.send.interval)
+		assert.Equal(t, int64(30*time.Second), l.st.interval.Load())
+		assert.Equal(t, "new", keys.Load().cfg.Key)
+		assert.Equal(t, cfg.Endpoint, l.cfg.Endpoint, "the address needs a restart")
+
+		var changed []string
+		for _, c := range configload.Diff(cfg.Report, l.cfg.Report) {
+			changed = append(changed, c.Key)
+		}
+		assert.Equal(t, []string{"report_interval", "security.key"}, changed, "the report keeps the running address")
+	})
+
+	t.Run("rejects an invalid config", func(t *testing.T) {
+		l.reload(func() (config.Config, error) { return config.Config{}, errors.New("invalid") })
+		assert.Equal(t, 30*time.Second, l.send.interval)
+
+		l.reload(func() (config.Config, error) {
+			return config.Load([]string{"-crypto-key", "invalid.pem", "-k", "other", "-r", "5"})
+		})
+		assert.Equal(t, 30*time.Second, l.send.interval)
+		assert.Equal(t, "new", keys.Load().cfg.Key)
+	})
+}
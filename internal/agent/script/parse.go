@@ -0,0 +1,171 @@
+package script
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/ospiem/mcollector/internal/models"
+)
+
+// Formats of the command output.
+const (
+	FormatPlain  = "plain"
+	FormatNagios = "nagios"
+	FormatJSON   = "json"
+)
+
+// Parse parses the output of a command in the format.
+//
+// The plain format has a "name type value" line per metric, where the type is gauge or counter.
+// Empty lines and lines starting with # are skipped.
+//
+// The nagios format is the plugin output "TEXT | label=value[UOM];warn;crit;min;max ...", every
+// performance data label becomes a gauge.
+//
+// The json format is either an object of gauge values by name or the array of metrics
+// accepted by the server.
+func Parse(format string, out []byte) ([]models.Metrics, error) {
+	switch format {
+	case FormatPlain, "":
+		return parsePlain(string(out))
+	case FormatNagios:
+		return parseNagios(string(out))
+	case FormatJSON:
+		return parseJSON(out)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func parsePlain(out string) ([]models.Metrics, error) {
+	var metrics []models.Metrics
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid line %q, want \"name type value\"", line)
+		}
+
+		name, typ, value := fields[0], fields[1], fields[2]
+		switch typ {
+		case models.Gauge:
+			v, err := parseFloat(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value in %q: %w", line, err)
+			}
+			metrics = append(metrics, models.Metrics{ID: name, MType: models.Gauge, Value: &v})
+		case models.Counter:
+			d, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid delta in %q: %w", line, err)
+			}
+			metrics = append(metrics, models.Metrics{ID: name, MType: models.Counter, Delta: &d})
+		default:
+			return nil, fmt.Errorf("invalid type in %q", line)
+		}
+	}
+	return metrics, nil
+}
+
+func parseNagios(out string) ([]models.Metrics, error) {
+	// Performance data follow the first | of every line.
+	var perf []string
+	for _, line := range strings.Split(out, "\n") {
+		if _, data, ok := strings.Cut(line, "|"); ok {
+			perf = append(perf, splitPerfData(data)...)
+		}
+	}
+
+	metrics := make([]models.Metrics, 0, len(perf))
+	for _, item := range perf {
+		label, rest, ok := strings.Cut(item, "=")
+		if !ok || label == "" {
+			return nil, fmt.Errorf("invalid performance data %q", item)
+		}
+		label = strings.Trim(label, "'")
+		value, _, _ := strings.Cut(rest, ";")
+		if value == "U" {
+			// The plugin could not determine the value.
+			continue
+		}
+		value = strings.TrimRightFunc(value, func(r rune) bool {
+			return (r < '0' || r > '9') && r != '.'
+		})
+		v, err := parseFloat(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value in %q: %w", item, err)
+		}
+		metrics = append(metrics, models.Metrics{ID: label, MType: models.Gauge, Value: &v})
+	}
+	return metrics, nil
+}
+
+// splitPerfData splits the performance data on spaces outside the quoted labels.
+func splitPerfData(data string) []string {
+	var items []string
+	var item strings.Builder
+	quoted := false
+	for _, r := range data {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+			item.WriteRune(r)
+		case r == ' ' && !quoted:
+			if item.Len() > 0 {
+				items = append(items, item.String())
+				item.Reset()
+			}
+		default:
+			item.WriteRune(r)
+		}
+	}
+	if item.Len() > 0 {
+		items = append(items, item.String())
+	}
+	return items
+}
+
+func parseJSON(out []byte) ([]models.Metrics, error) {
+	var gauges map[string]float64
+	if err := json.Unmarshal(out, &gauges); err == nil {
+		metrics := make([]models.Metrics, 0, len(gauges))
+		for name, v := range gauges {
+			metrics = append(metrics, models.Metrics{ID: name, MType: models.Gauge, Value: &v})
+		}
+		return metrics, nil
+	}
+
+	var metrics []models.Metrics
+	if err := json.Unmarshal(out, &metrics); err != nil {
+		return nil, fmt.Errorf("failed to parse json: %w", err)
+	}
+	for _, m := range metrics {
+		switch {
+		case m.ID == "":
+			return nil, errors.New("missing metric id")
+		case m.MType == models.Gauge && m.Value != nil, m.MType == models.Counter && m.Delta != nil:
+		default:
+			return nil, fmt.Errorf("invalid metric %q", m.ID)
+		}
+	}
+	return metrics, nil
+}
+
+// parseFloat parses a finite float.
+func parseFloat(s string) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, errors.New("value is not finite")
+	}
+	return v, nil
+}
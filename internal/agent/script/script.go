@@ -0,0 +1,224 @@
+// Package script runs the configured commands on their own intervals and collects the metrics
+// they print.
+//
+// The metrics of a check are prefixed with its name, e.g. "disk.used" for the metric "used"
+// printed by the check "disk". Every run also reports the gauges "<check>.exit_code" and
+// "<check>.duration_seconds", and a run skipped because the previous one is still in progress
+// increments the counter "<check>.skipped".
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/rs/zerolog"
+)
+
+// waitDelay is the time to wait for the output of a killed command.
+const waitDelay = time.Second
+
+// Check is a command run periodically.
+type Check struct {
+	Name     string        // Name prefixes the metrics of the check.
+	Command  string        // Command is run with sh -c.
+	Format   string        // Format of the output: plain (default), nagios or json.
+	Interval time.Duration // Interval between two runs.
+	Timeout  time.Duration // Timeout kills the command, defaults to the interval.
+}
+
+// Collector runs the checks and buffers their metrics until Flush.
+type Collector struct {
+	log      zerolog.Logger
+	mux      *sync.Mutex
+	wg       *sync.WaitGroup
+	cancel   context.CancelFunc
+	counters map[string]int64
+	gauges   map[string]float64
+	checks   []Check
+	errors   atomic.Uint64
+}
+
+// New validates the checks and creates a Collector for them.
+func New(checks []Check, log zerolog.Logger) (*Collector, error) {
+	checks = slices.Clone(checks)
+	names := make(map[string]struct{}, len(checks))
+	for i, c := range checks {
+		switch {
+		case c.Name == "":
+			return nil, errors.New("check needs a name")
+		case c.Command == "":
+			return nil, fmt.Errorf("check %s needs a command", c.Name)
+		case c.Interval <= 0:
+			return nil, fmt.Errorf("check %s needs a positive interval", c.Name)
+		}
+		switch c.Format {
+		case "", FormatPlain, FormatNagios, FormatJSON:
+		default:
+			return nil, fmt.Errorf("check %s has an unknown format %q", c.Name, c.Format)
+		}
+		if _, ok := names[c.Name]; ok {
+			return nil, fmt.Errorf("duplicate check %s", c.Name)
+		}
+		names[c.Name] = struct{}{}
+		if c.Timeout <= 0 {
+			checks[i].Timeout = c.Interval
+		}
+	}
+
+	return &Collector{
+		log:      log.With().Str("component", "script").Logger(),
+		mux:      &sync.Mutex{},
+		wg:       &sync.WaitGroup{},
+		counters: make(map[string]int64),
+		gauges:   make(map[string]float64),
+		checks:   checks,
+	}, nil
+}
+
+// Start runs every check right away and then on its interval until Stop is called.
+func (c *Collector) Start(ctx context.Context) {
+	ctx, c.cancel = context.WithCancel(ctx)
+	for _, check := range c.checks {
+		c.wg.Add(1)
+		go c.schedule(ctx, check)
+	}
+}
+
+// Stop kills the running commands and waits for the checks to return.
+func (c *Collector) Stop() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.wg.Wait()
+}
+
+// Flush returns the metrics collected since the previous flush. The counters are summed and
+// the gauges keep the value of the last run.
+func (c *Collector) Flush() []models.Metrics {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	metrics := make([]models.Metrics, 0, len(c.counters)+len(c.gauges))
+	for id, delta := range c.counters {
+		metrics = append(metrics, models.Metrics{ID: id, MType: models.Counter, Delta: &delta})
+	}
+	for id, value := range c.gauges {
+		metrics = append(metrics, models.Metrics{ID: id, MType: models.Gauge, Value: &value})
+	}
+	c.counters = make(map[string]int64)
+	c.gauges = make(map[string]float64)
+	return metrics
+}
+
+// Errors returns the number of runs that timed out, failed to start or printed an invalid output.
+func (c *Collector) Errors() uint64 {
+	return c.errors.Load()
+}
+
+// schedule runs the check on its interval. A run is skipped while the previous one is still
+// in progress.
+func (c *Collector) schedule(ctx context.Context, check Check) {
+	defer c.wg.Done()
+
+	running := &atomic.Bool{}
+	runs := &sync.WaitGroup{}
+	defer runs.Wait()
+
+	t := time.NewTicker(check.Interval)
+	defer t.Stop()
+	for {
+		if running.CompareAndSwap(false, true) {
+			runs.Add(1)
+			go func() {
+				defer runs.Done()
+				defer running.Store(false)
+				c.run(ctx, check)
+			}()
+		} else {
+			c.log.Warn().Str("check", check.Name).Msg("previous run still in progress, skipping")
+			c.add([]models.Metrics{counterMetric(check.Name+".skipped", 1)})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// run runs the command once and adds its metrics.
+func (c *Collector) run(ctx context.Context, check Check) {
+	log := c.log.With().Str("check", check.Name).Logger()
+
+	runCtx, cancel := context.WithTimeout(ctx, check.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(runCtx, "sh", "-c", check.Command)
+	cmd.WaitDelay = waitDelay
+
+	start := time.Now()
+	out, err := cmd.Output()
+	duration := time.Since(start)
+	if ctx.Err() != nil {
+		// The command was killed because the collector stopped.
+		return
+	}
+
+	exitCode := 0
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		// A killed command has the exit code -1.
+		exitCode = exitErr.ExitCode()
+		if runCtx.Err() != nil {
+			log.Error().Dur("timeout", check.Timeout).Msg("command timed out")
+			c.errors.Add(1)
+		}
+	case err != nil:
+		log.Error().Err(err).Msg("failed to run command")
+		c.errors.Add(1)
+		exitCode = -1
+	}
+
+	metrics := []models.Metrics{
+		gaugeMetric(check.Name+".exit_code", float64(exitCode)),
+		gaugeMetric(check.Name+".duration_seconds", duration.Seconds()),
+	}
+	parsed, err := Parse(check.Format, out)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to parse command output")
+		c.errors.Add(1)
+	}
+	for _, m := range parsed {
+		m.ID = check.Name + "." + m.ID
+		metrics = append(metrics, m)
+	}
+	c.add(metrics)
+}
+
+func (c *Collector) add(metrics []models.Metrics) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, m := range metrics {
+		if m.MType == models.Counter {
+			c.counters[m.ID] += *m.Delta
+		} else {
+			c.gauges[m.ID] = *m.Value
+		}
+	}
+}
+
+func gaugeMetric(id string, v float64) models.Metrics {
+	return models.Metrics{ID: id, MType: models.Gauge, Value: &v}
+}
+
+func counterMetric(id string, d int64) models.Metrics {
+	return models.Metrics{ID: id, MType: models.Counter, Delta: &d}
+}
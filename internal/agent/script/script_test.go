@@ -0,0 +1,119 @@
+package script
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func byID(metrics []models.Metrics) map[string]models.Metrics {
+	res := make(map[string]models.Metrics, len(metrics))
+	for _, m := range metrics {
+		res[m.ID] = m
+	}
+	return res
+}
+
+func TestParse(t *testing.T) {
+	got, err := Parse(FormatPlain, []byte("# comment\nqueue gauge 4.5\n\nerrors counter 3\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 4.5, *byID(got)["queue"].Value)
+	assert.Equal(t, int64(3), *byID(got)["errors"].Delta)
+
+	got, err = Parse(FormatNagios, []byte("DISK OK - free space: / 3326 MB | /=2643MB;5948;5958;0;5968 'in use'=41% load=U\n"))
+	require.NoError(t, err)
+	assert.Len(t, got, 2)
+	assert.Equal(t, float64(2643), *byID(got)["/"].Value)
+	assert.Equal(t, float64(41), *byID(got)["in use"].Value)
+
+	got, err = Parse(FormatJSON, []byte(`{"temp": 21.5}`))
+	require.NoError(t, err)
+	assert.Equal(t, 21.5, *byID(got)["temp"].Value)
+
+	got, err = Parse(FormatJSON, []byte(`[{"id":"hits","type":"counter","delta":2}]`))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), *byID(got)["hits"].Delta)
+
+	for _, tt := range []struct{ format, out string }{
+		{FormatPlain, "queue 4.5"},
+		{FormatPlain, "queue histogram 4.5"},
+		{FormatPlain, "errors counter 1.5"},
+		{FormatPlain, "queue gauge NaN"},
+		{FormatNagios, "OK | load"},
+		{FormatJSON, `[{"id":"x","type":"gauge"}]`},
+		{"xml", ""},
+	} {
+		_, err := Parse(tt.format, []byte(tt.out))
+		assert.Error(t, err, tt.out)
+	}
+}
+
+func TestCollector(t *testing.T) {
+	c, err := New([]Check{
+		{Name: "queue", Command: "echo 'depth gauge 7'; echo 'done counter 2'", Interval: 20 * time.Millisecond},
+		{Name: "disk", Command: "echo 'WARNING | used=90%'; exit 1", Format: FormatNagios, Interval: time.Hour},
+		{Name: "slow", Command: "sleep 5", Interval: time.Hour, Timeout: 50 * time.Millisecond},
+	}, zerolog.Nop())
+	require.NoError(t, err)
+	c.Start(context.Background())
+
+	// Merge the flushes like the server does.
+	got := make(map[string]models.Metrics)
+	merge := func() {
+		for _, m := range c.Flush() {
+			if prev, ok := got[m.ID]; ok && m.MType == models.Counter {
+				*m.Delta += *prev.Delta
+			}
+			got[m.ID] = m
+		}
+	}
+	require.Eventually(t, func() bool {
+		merge()
+		_, slow := got["slow.exit_code"]
+		return slow && got["queue.done"].Delta != nil && *got["queue.done"].Delta >= 4
+	}, 5*time.Second, 10*time.Millisecond)
+	c.Stop()
+	merge()
+
+	assert.Equal(t, float64(-1), *got["slow.exit_code"].Value)
+	assert.Equal(t, float64(7), *got["queue.depth"].Value)
+	assert.Equal(t, float64(0), *got["queue.exit_code"].Value)
+	assert.Contains(t, got, "queue.duration_seconds")
+	assert.Equal(t, float64(1), *got["disk.exit_code"].Value)
+	assert.Equal(t, float64(90), *got["disk.used"].Value)
+}
+
+func TestCollectorSkipsOverlappingRuns(t *testing.T) {
+	c, err := New([]Check{
+		{Name: "slow", Command: "sleep 0.3", Interval: 20 * time.Millisecond, Timeout: time.Second},
+	}, zerolog.Nop())
+	require.NoError(t, err)
+	c.Start(context.Background())
+
+	skipped := int64(0)
+	require.Eventually(t, func() bool {
+		if m, ok := byID(c.Flush())["slow.skipped"]; ok {
+			skipped += *m.Delta
+		}
+		return skipped >= 3
+	}, 5*time.Second, 10*time.Millisecond)
+	c.Stop()
+}
+
+func TestNewErrors(t *testing.T) {
+	for _, checks := range [][]Check{
+		{{Command: "true", Interval: time.Second}},
+		{{Name: "a", Interval: time.Second}},
+		{{Name: "a", Command: "true"}},
+		{{Name: "a", Command: "true", Interval: time.Second, Format: "xml"}},
+		{{Name: "a", Command: "true", Interval: time.Second}, {Name: "a", Command: "false", Interval: time.Second}},
+	} {
+		_, err := New(checks, zerolog.Nop())
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,62 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/ospiem/mcollector/internal/retry"
+)
+
+// File appends metrics to a local file as JSON lines.
+type File struct {
+	f   *os.File
+	mux *sync.Mutex
+}
+
+// fileRecord is a line of the file.
+type fileRecord struct {
+	Time time.Time `json:"time"`
+	models.Metrics
+}
+
+// NewFile opens the file for appending, creating it if needed.
+func NewFile(path string) (*File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	return &File{f: f, mux: &sync.Mutex{}}, nil
+}
+
+// Write appends a line per metric with the batch time.
+func (f *File) Write(ctx context.Context, b Batch) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	w := bufio.NewWriter(f.f)
+	enc := json.NewEncoder(w)
+	for _, m := range b.Metrics {
+		if err := enc.Encode(fileRecord{Time: b.Time, Metrics: m}); err != nil {
+			return retry.Permanent(fmt.Errorf("file: failed to encode metric %s: %w", m.ID, err))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("file: failed to write %s: %w", f.f.Name(), err)
+	}
+	return nil
+}
+
+func (f *File) Close() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.f.Close(); err != nil {
+		return fmt.Errorf("file: failed to close %s: %w", f.f.Name(), err)
+	}
+	return nil
+}
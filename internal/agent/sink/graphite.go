@@ -0,0 +1,109 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ospiem/mcollector/internal/models"
+)
+
+// Graphite writes metrics to Carbon with the plaintext protocol over TCP.
+// Counters must be cumulative, see Options.Cumulative.
+type Graphite struct {
+	conn   net.Conn
+	mux    *sync.Mutex
+	dialer *net.Dialer
+	addr   string
+	prefix string
+}
+
+// NewGraphite creates a sink writing to the Carbon host:port. The prefix is prepended to
+// every metric path.
+func NewGraphite(addr, prefix string) *Graphite {
+	return &Graphite{
+		mux:    &sync.Mutex{},
+		dialer: &net.Dialer{},
+		addr:   addr,
+		prefix: strings.Trim(prefix, "."),
+	}
+}
+
+// Write sends a "path value timestamp" line per metric. The connection is kept open between
+// writes and dialed again after an error.
+func (g *Graphite) Write(ctx context.Context, b Batch) error {
+	ts := strconv.FormatInt(b.Time.Unix(), 10)
+
+	var buf bytes.Buffer
+	for _, m := range b.Metrics {
+		var value string
+		switch {
+		case m.MType == models.Counter && m.Delta != nil:
+			value = strconv.FormatInt(*m.Delta, 10)
+		case m.MType == models.Gauge && m.Value != nil:
+			value = strconv.FormatFloat(*m.Value, 'f', -1, 64)
+		default:
+			continue
+		}
+		buf.WriteString(g.path(m.ID) + " " + value + " " + ts + "\n")
+	}
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	if g.conn == nil {
+		conn, err := g.dialer.DialContext(ctx, "tcp", g.addr)
+		if err != nil {
+			return fmt.Errorf("graphite: failed to connect to %s: %w", g.addr, err)
+		}
+		g.conn = conn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := g.conn.SetWriteDeadline(deadline); err != nil {
+			return g.reset(fmt.Errorf("graphite: failed to set deadline: %w", err))
+		}
+	}
+	if _, err := g.conn.Write(buf.Bytes()); err != nil {
+		return g.reset(fmt.Errorf("graphite: failed to write to %s: %w", g.addr, err))
+	}
+	return nil
+}
+
+func (g *Graphite) Close() error {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if g.conn == nil {
+		return nil
+	}
+	err := g.conn.Close()
+	g.conn = nil
+	return err
+}
+
+// reset drops the connection after an error, so the next write dials again.
+func (g *Graphite) reset(err error) error {
+	_ = g.conn.Close()
+	g.conn = nil
+	return err
+}
+
+// path returns the Graphite path of the metric ID. Tags in the "name;key=value" form are kept.
+func (g *Graphite) path(id string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-', r == '.',
+			r == ';', r == '=':
+			return r
+		default:
+			return '_'
+		}
+	}, id)
+	if g.prefix == "" {
+		return name
+	}
+	return g.prefix + "." + name
+}
@@ -0,0 +1,72 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ospiem/mcollector/internal/models"
+)
+
+// Influx writes metrics to InfluxDB in the line protocol over HTTP.
+type Influx struct {
+	client *http.Client
+	url    string
+	token  string
+	tags   string
+}
+
+// NewInflux creates a sink posting to the write endpoint url, for example
+// http://localhost:8086/api/v2/write?org=acme&bucket=metrics&precision=ns.
+// The token is sent in the Authorization header if set, the host tag is added to every point.
+func NewInflux(url, token, host string) *Influx {
+	i := &Influx{client: &http.Client{}, url: url, token: token}
+	if host != "" {
+		i.tags = ",host=" + tagEscaper.Replace(host)
+	}
+	return i
+}
+
+// Escapers of the special characters of the line protocol.
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+)
+
+// Write posts one point per metric with the value in the "value" field. Counters are written
+// as integers, timestamps have nanosecond precision. NaN and infinite gauges cannot be written
+// and are skipped.
+func (i *Influx) Write(ctx context.Context, b Batch) error {
+	ts := strconv.FormatInt(b.Time.UnixNano(), 10)
+
+	var buf bytes.Buffer
+	for _, m := range b.Metrics {
+		var value string
+		switch {
+		case m.MType == models.Counter && m.Delta != nil:
+			value = strconv.FormatInt(*m.Delta, 10) + "i"
+		case m.MType == models.Gauge && m.Value != nil && !math.IsNaN(*m.Value) && !math.IsInf(*m.Value, 0):
+			value = strconv.FormatFloat(*m.Value, 'g', -1, 64)
+		default:
+			continue
+		}
+		buf.WriteString(measurementEscaper.Replace(m.ID) + i.tags + " value=" + value + " " + ts + "\n")
+	}
+
+	header := http.Header{"Content-Type": {"text/plain; charset=utf-8"}}
+	if i.token != "" {
+		header.Set("Authorization", "Token "+i.token)
+	}
+	if err := post(ctx, i.client, http.MethodPost, i.url, buf.Bytes(), header); err != nil {
+		return fmt.Errorf("influxdb: %w", err)
+	}
+	return nil
+}
+
+func (i *Influx) Close() error {
+	return nil
+}
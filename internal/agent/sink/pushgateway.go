@@ -0,0 +1,88 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ospiem/mcollector/internal/models"
+)
+
+// Pushgateway pushes metrics to a Prometheus Pushgateway in the text exposition format.
+// Counters must be cumulative, see Options.Cumulative.
+type Pushgateway struct {
+	client *http.Client
+	url    string
+}
+
+// NewPushgateway creates a sink pushing to the group of the job and instance on the Pushgateway at baseURL.
+func NewPushgateway(baseURL, job, instance string) *Pushgateway {
+	u := strings.TrimSuffix(baseURL, "/") + "/metrics/job/" + url.PathEscape(job)
+	if instance != "" {
+		u += "/instance/" + url.PathEscape(instance)
+	}
+	return &Pushgateway{client: &http.Client{}, url: u}
+}
+
+// Write replaces the pushed metrics with the same names. The Pushgateway rejects timestamps,
+// so the batch time is not sent.
+func (p *Pushgateway) Write(ctx context.Context, b Batch) error {
+	// A metric may be sent once per push, the last value wins.
+	last := make(map[string]models.Metrics, len(b.Metrics))
+	for _, m := range b.Metrics {
+		last[promName(m.ID)] = m
+	}
+	names := make([]string, 0, len(last))
+	for name := range last {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		m := last[name]
+		switch {
+		case m.MType == models.Counter && m.Delta != nil:
+			fmt.Fprintf(&buf, "# TYPE %s counter\n%s %d\n", name, name, *m.Delta)
+		case m.MType == models.Gauge && m.Value != nil:
+			fmt.Fprintf(&buf, "# TYPE %s gauge\n%s %s\n", name, name, strconv.FormatFloat(*m.Value, 'g', -1, 64))
+		}
+	}
+
+	header := http.Header{"Content-Type": {"text/plain; version=0.0.4"}}
+	if err := post(ctx, p.client, http.MethodPost, p.url, buf.Bytes(), header); err != nil {
+		return fmt.Errorf("pushgateway: %w", err)
+	}
+	return nil
+}
+
+func (p *Pushgateway) Close() error {
+	return nil
+}
+
+// promName turns the metric ID into a valid Prometheus metric name.
+func promName(id string) string {
+	var sb strings.Builder
+	for i, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			sb.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				sb.WriteRune('_')
+			}
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune('_')
+		}
+	}
+	if sb.Len() == 0 {
+		return "_"
+	}
+	return sb.String()
+}
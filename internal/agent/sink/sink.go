@@ -0,0 +1,341 @@
+// Package sink sends the metrics collected by the agent to external systems.
+//
+// A Sink writes batches to one system. Every sink runs behind an Output that gives it its own
+// queue, batch size, retries and workers, so a slow or failing sink never holds the others back:
+// when its queue is full the oldest batch is dropped. Fanout sends every batch to all outputs.
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/ospiem/mcollector/internal/requestid"
+	"github.com/ospiem/mcollector/internal/retry"
+	"github.com/rs/zerolog"
+)
+
+// defaultQueueSize is the number of batches an output buffers.
+const defaultQueueSize = 10
+
+// defaultWriteTimeout is the timeout of a write to a sink.
+const defaultWriteTimeout = 10 * time.Second
+
+// Sink writes metrics to an external system.
+type Sink interface {
+	// Write sends the batch. Errors wrapped with retry.Permanent are not retried.
+	Write(ctx context.Context, b Batch) error
+	// Close releases the resources of the sink.
+	Close() error
+}
+
+// Batch is a set of metrics collected at the same time.
+type Batch struct {
+	Time    time.Time
+	Metrics []models.Metrics
+	// ID identifies the batch in the logs and in the requests, it is set when the batch is queued.
+	ID string
+}
+
+// Options configures an Output.
+type Options struct {
+	// Retry is the policy used to retry a failed write.
+	Retry retry.Policy
+	// Name identifies the output in logs.
+	Name string
+	// BatchSize is the maximum number of metrics written at once, 0 disables the limit.
+	BatchSize int
+	// QueueSize is the number of batches buffered while the sink is busy.
+	QueueSize int
+	// Workers is the number of concurrent writes.
+	Workers int
+	// WriteTimeout is the timeout of one write.
+	WriteTimeout time.Duration
+	// Cumulative makes the output send counter totals instead of deltas, for systems
+	// that expect counters to only grow.
+	Cumulative bool
+}
+
+// Stats describes the activity of an output.
+type Stats struct {
+	LastSuccess time.Time `json:"last_success"` // LastSuccess is the time of the last successful write.
+	LastError   string    `json:"last_error"`   // LastError is the error of the last failed write.
+	Sent        uint64    `json:"sent"`         // Sent is the number of metrics written.
+	Failed      uint64    `json:"failed"`       // Failed is the number of metrics not written after the retries.
+	Dropped     uint64    `json:"dropped"`      // Dropped is the number of metrics dropped from the full queue.
+	Retries     uint64    `json:"retries"`      // Retries is the number of retried writes.
+	Queued      int       `json:"queued"`       // Queued is the number of batches waiting in the queue.
+}
+
+// Output runs a sink in the background.
+type Output struct {
+	sink    Sink
+	ctx     context.Context
+	cancel  context.CancelFunc
+	queue   chan Batch
+	wg      *sync.WaitGroup
+	mux     *sync.Mutex
+	totals  map[string]int64
+	log     zerolog.Logger
+	opts    Options
+	sent    atomic.Uint64
+	failed  atomic.Uint64
+	dropped atomic.Uint64
+	retries atomic.Uint64
+	// last holds the time of the last success and the last error.
+	last    *sync.Mutex
+	lastOK  time.Time
+	lastErr string
+	closed  bool
+	// workers is the number of running workers, shrink stops one of them.
+	workers int
+	shrink  chan struct{}
+}
+
+// NewOutput starts the workers writing to the sink until Close is called.
+func NewOutput(s Sink, opts Options, log zerolog.Logger) *Output {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultQueueSize
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = defaultWriteTimeout
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	o := &Output{
+		sink:   s,
+		ctx:    ctx,
+		cancel: cancel,
+		queue:  make(chan Batch, opts.QueueSize),
+		wg:     &sync.WaitGroup{},
+		mux:    &sync.Mutex{},
+		last:   &sync.Mutex{},
+		totals: make(map[string]int64),
+		log:    log.With().Str("output", opts.Name).Logger(),
+		opts:   opts,
+		shrink: make(chan struct{}),
+	}
+	o.SetWorkers(opts.Workers)
+	return o
+}
+
+// SetWorkers changes the number of concurrent writes, at least one. The workers stopped finish
+// their current write first.
+func (o *Output) SetWorkers(n int) {
+	n = max(n, 1)
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if o.closed {
+		return
+	}
+
+	for ; o.workers < n; o.workers++ {
+		o.wg.Add(1)
+		go o.work()
+	}
+	if stop := o.workers - n; stop > 0 {
+		o.workers = n
+		go func() {
+			for i := 0; i < stop; i++ {
+				select {
+				case o.shrink <- struct{}{}:
+				case <-o.ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Name returns the name of the output.
+func (o *Output) Name() string {
+	return o.opts.Name
+}
+
+// Stats returns the activity of the output.
+func (o *Output) Stats() Stats {
+	o.last.Lock()
+	defer o.last.Unlock()
+	return Stats{
+		LastSuccess: o.lastOK,
+		LastError:   o.lastErr,
+		Sent:        o.sent.Load(),
+		Failed:      o.failed.Load(),
+		Dropped:     o.dropped.Load(),
+		Retries:     o.retries.Load(),
+		Queued:      len(o.queue),
+	}
+}
+
+// Enqueue queues the batch without blocking. If the queue is full, the oldest batch is dropped.
+func (o *Output) Enqueue(b Batch) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if o.closed || len(b.Metrics) == 0 {
+		return
+	}
+
+	if o.opts.Cumulative {
+		b = o.accumulate(b)
+	}
+
+	for _, part := range split(b, o.opts.BatchSize) {
+		part.ID = requestid.New()
+		for !o.offer(part) {
+		}
+	}
+}
+
+// offer queues the batch if there is room, otherwise it drops the oldest batch to make some.
+func (o *Output) offer(b Batch) bool {
+	select {
+	case o.queue <- b:
+		return true
+	default:
+	}
+
+	select {
+	case old := <-o.queue:
+		o.dropped.Add(uint64(len(old.Metrics)))
+		o.log.Warn().Str(requestid.LogField, old.ID).Int("metrics", len(old.Metrics)).
+			Msg("queue is full, dropped the oldest batch")
+	default:
+	}
+	return false
+}
+
+// Close stops accepting batches and writes the queued ones until ctx is done, then closes the sink.
+func (o *Output) Close(ctx context.Context) error {
+	o.mux.Lock()
+	if o.closed {
+		o.mux.Unlock()
+		return nil
+	}
+	o.closed = true
+	close(o.queue)
+	o.mux.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		o.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("output %s has not drained its queue: %w", o.opts.Name, ctx.Err())
+	}
+	o.cancel()
+	<-done
+
+	if closeErr := o.sink.Close(); closeErr != nil {
+		err = errors.Join(err, fmt.Errorf("failed to close output %s: %w", o.opts.Name, closeErr))
+	}
+	return err
+}
+
+// work writes the queued batches.
+func (o *Output) work() {
+	defer o.wg.Done()
+
+	for {
+		var b Batch
+		select {
+		case <-o.shrink:
+			return
+		case batch, ok := <-o.queue:
+			if !ok {
+				return
+			}
+			b = batch
+		}
+
+		attempts := 0
+		err := o.opts.Retry.Do(o.ctx, func(ctx context.Context) error {
+			if attempts++; attempts > 1 {
+				o.retries.Add(1)
+			}
+			ctx, cancel := context.WithTimeout(ctx, o.opts.WriteTimeout)
+			defer cancel()
+			return o.sink.Write(ctx, b)
+		})
+
+		o.last.Lock()
+		if err != nil {
+			o.lastErr = err.Error()
+		} else {
+			o.lastOK = time.Now()
+		}
+		o.last.Unlock()
+
+		if err != nil {
+			o.failed.Add(uint64(len(b.Metrics)))
+			o.log.Error().Err(err).Str(requestid.LogField, b.ID).Int("metrics", len(b.Metrics)).
+				Msg("failed to write metrics")
+			continue
+		}
+		o.sent.Add(uint64(len(b.Metrics)))
+	}
+}
+
+// accumulate replaces the counter deltas of the batch with their running totals.
+func (o *Output) accumulate(b Batch) Batch {
+	metrics := make([]models.Metrics, len(b.Metrics))
+	for i, m := range b.Metrics {
+		if m.MType == models.Counter && m.Delta != nil {
+			o.totals[m.ID] += *m.Delta
+			total := o.totals[m.ID]
+			m.Delta = &total
+		}
+		metrics[i] = m
+	}
+	return Batch{Time: b.Time, Metrics: metrics}
+}
+
+// split cuts the batch into parts of at most size metrics.
+func split(b Batch, size int) []Batch {
+	if size <= 0 || len(b.Metrics) <= size {
+		return []Batch{b}
+	}
+
+	parts := make([]Batch, 0, (len(b.Metrics)+size-1)/size)
+	for start := 0; start < len(b.Metrics); start += size {
+		end := min(start+size, len(b.Metrics))
+		parts = append(parts, Batch{Time: b.Time, Metrics: b.Metrics[start:end]})
+	}
+	return parts
+}
+
+// Fanout sends every batch to several outputs.
+type Fanout []*Output
+
+// Send queues the batch on every output.
+func (f Fanout) Send(b Batch) {
+	for _, o := range f {
+		o.Enqueue(b)
+	}
+}
+
+// Close closes all outputs in parallel.
+func (f Fanout) Close(ctx context.Context) error {
+	errs := make([]error, len(f))
+	wg := &sync.WaitGroup{}
+	for i, o := range f {
+		wg.Add(1)
+		go func(i int, o *Output) {
+			defer wg.Done()
+			errs[i] = o.Close(ctx)
+		}(i, o)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,255 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/logging"
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/ospiem/mcollector/internal/retry"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingSink records the batches it gets and fails the first fails writes.
+type recordingSink struct {
+	mux     *sync.Mutex
+	block   chan struct{}
+	batches []Batch
+	fails   int
+	closed  bool
+}
+
+func newRecordingSink(fails int) *recordingSink {
+	return &recordingSink{mux: &sync.Mutex{}, fails: fails}
+}
+
+func (s *recordingSink) Write(ctx context.Context, b Batch) error {
+	if s.block != nil {
+		select {
+		case <-s.block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.fails > 0 {
+		s.fails--
+		return errors.New("sink is down")
+	}
+	s.batches = append(s.batches, b)
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *recordingSink) written() []Batch {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]Batch(nil), s.batches...)
+}
+
+func counter(id string, delta int64) models.Metrics {
+	return models.Metrics{ID: id, MType: models.Counter, Delta: &delta}
+}
+
+func gauge(id string, value float64) models.Metrics {
+	return models.Metrics{ID: id, MType: models.Gauge, Value: &value}
+}
+
+func TestOutputRetriesAndSplits(t *testing.T) {
+	s := newRecordingSink(2)
+	o := NewOutput(s, Options{
+		Name:      "test",
+		BatchSize: 2,
+		Retry:     retry.Policy{InitialInterval: time.Millisecond, MaxAttempts: 3},
+	}, zerolog.Nop())
+
+	o.Enqueue(Batch{Time: time.Now(), Metrics: []models.Metrics{counter("a", 1), gauge("b", 2), gauge("c", 3)}})
+	require.NoError(t, o.Close(context.Background()))
+
+	batches := s.written()
+	require.Len(t, batches, 2)
+	assert.Len(t, batches[0].Metrics, 2)
+	assert.Len(t, batches[1].Metrics, 1)
+	assert.NotEmpty(t, batches[0].ID)
+	assert.NotEqual(t, batches[0].ID, batches[1].ID, "every part of a split batch has an ID of its own")
+	st := o.Stats()
+	assert.WithinDuration(t, time.Now(), st.LastSuccess, time.Second)
+	st.LastSuccess = time.Time{}
+	assert.Equal(t, Stats{Sent: 3, Retries: 2}, st)
+	assert.True(t, s.closed)
+}
+
+func TestOutputGivesUp(t *testing.T) {
+	s := newRecordingSink(10)
+	o := NewOutput(s, Options{Retry: retry.Policy{MaxAttempts: 2}}, zerolog.Nop())
+
+	o.Enqueue(Batch{Metrics: []models.Metrics{gauge("a", 1)}})
+	o.Enqueue(Batch{Metrics: []models.Metrics{gauge("a", 1)}})
+	require.NoError(t, o.Close(context.Background()))
+
+	st := o.Stats()
+	assert.Contains(t, st.LastError, "sink is down")
+	st.LastError = ""
+	assert.Equal(t, Stats{Failed: 2, Retries: 2}, st)
+}
+
+func TestOutputDropsOldestWhenFull(t *testing.T) {
+	s := newRecordingSink(0)
+	s.block = make(chan struct{})
+	o := NewOutput(s, Options{QueueSize: 2}, zerolog.Nop())
+
+	// The first batch is taken by the worker, the next ones fill the queue.
+	o.Enqueue(Batch{Metrics: []models.Metrics{gauge("first", 1)}})
+	require.Eventually(t, func() bool { return len(o.queue) == 0 }, time.Second, time.Millisecond)
+	for _, id := range []string{"second", "third", "fourth"} {
+		o.Enqueue(Batch{Metrics: []models.Metrics{gauge(id, 1)}})
+	}
+	close(s.block)
+	require.NoError(t, o.Close(context.Background()))
+
+	var ids []string
+	for _, b := range s.written() {
+		ids = append(ids, b.Metrics[0].ID)
+	}
+	assert.Equal(t, []string{"first", "third", "fourth"}, ids)
+	st := o.Stats()
+	st.LastSuccess = time.Time{}
+	assert.Equal(t, Stats{Sent: 3, Dropped: 1}, st)
+}
+
+func TestOutputFailuresAreSampled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.log")
+	cfg := logging.Defaults()
+	cfg.Output = path
+	cfg.SampleBurst = 1
+	log, closer, err := logging.New(cfg, "mcollector-agent")
+	require.NoError(t, err)
+	defer closer.Close()
+
+	s := newRecordingSink(10)
+	s.block = make(chan struct{})
+	o := NewOutput(s, Options{QueueSize: 1, Retry: retry.Policy{MaxAttempts: 1}}, log)
+	o.Enqueue(Batch{Metrics: []models.Metrics{gauge("first", 1)}})
+	require.Eventually(t, func() bool { return len(o.queue) == 0 }, time.Second, time.Millisecond)
+	for _, id := range []string{"second", "third", "fourth"} {
+		o.Enqueue(Batch{Metrics: []models.Metrics{gauge(id, 1)}})
+	}
+	close(s.block)
+	require.NoError(t, o.Close(context.Background()))
+	assert.Equal(t, uint64(2), o.Stats().Dropped)
+	assert.Equal(t, uint64(2), o.Stats().Failed)
+
+	logs, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(logs), "failed to write metrics"))
+	assert.Equal(t, 1, strings.Count(string(logs), "queue is full, dropped the oldest batch"))
+}
+
+func TestOutputCumulative(t *testing.T) {
+	s := newRecordingSink(0)
+	o := NewOutput(s, Options{Cumulative: true}, zerolog.Nop())
+
+	for i := 0; i < 3; i++ {
+		o.Enqueue(Batch{Metrics: []models.Metrics{counter("PollCount", 2), gauge("Alloc", 1)}})
+	}
+	require.NoError(t, o.Close(context.Background()))
+
+	var totals []int64
+	for _, b := range s.written() {
+		totals = append(totals, *b.Metrics[0].Delta)
+	}
+	assert.Equal(t, []int64{2, 4, 6}, totals)
+}
+
+func TestFanoutIsolatesFailingOutput(t *testing.T) {
+	stuck := newRecordingSink(0)
+	stuck.block = make(chan struct{})
+	healthy := newRecordingSink(0)
+
+	f := Fanout{
+		NewOutput(stuck, Options{Name: "stuck", QueueSize: 1}, zerolog.Nop()),
+		NewOutput(healthy, Options{Name: "healthy"}, zerolog.Nop()),
+	}
+	for i := 0; i < 5; i++ {
+		f.Send(Batch{Metrics: []models.Metrics{gauge("a", float64(i))}})
+	}
+
+	require.Eventually(t, func() bool { return len(healthy.written()) == 5 }, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, f.Close(ctx), "the stuck output cannot drain its queue")
+	assert.Empty(t, stuck.written())
+	assert.True(t, stuck.closed)
+}
+
+// gatedSink signals every write it starts and blocks it until released.
+type gatedSink struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *gatedSink) Write(ctx context.Context, b Batch) error {
+	s.started <- struct{}{}
+	select {
+	case <-s.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *gatedSink) Close() error {
+	return nil
+}
+
+func TestOutputSetWorkers(t *testing.T) {
+	s := &gatedSink{started: make(chan struct{}, 10), release: make(chan struct{})}
+	o := NewOutput(s, Options{Name: "gated", Workers: 1, WriteTimeout: time.Minute}, zerolog.Nop())
+	running := func() int {
+		n := 0
+		for {
+			select {
+			case <-s.started:
+				n++
+			case <-time.After(50 * time.Millisecond):
+				return n
+			}
+		}
+	}
+
+	o.SetWorkers(3)
+	for i := 0; i < 4; i++ {
+		o.Enqueue(Batch{Metrics: []models.Metrics{gauge("g", float64(i))}})
+	}
+	assert.Equal(t, 3, running(), "every worker writes at once")
+
+	o.SetWorkers(1)
+	for i := 0; i < 3; i++ {
+		s.release <- struct{}{}
+	}
+	assert.Equal(t, 1, running(), "the stopped workers finish their write first")
+
+	o.Enqueue(Batch{Metrics: []models.Metrics{gauge("g", 4)}})
+	assert.Equal(t, 0, running(), "a single worker is left")
+
+	close(s.release)
+	require.NoError(t, o.Close(context.Background()))
+	assert.Equal(t, uint64(5), o.Stats().Sent)
+}
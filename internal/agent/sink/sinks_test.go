@@ -0,0 +1,135 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/ospiem/mcollector/internal/retry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBatch is written by every sink test.
+var testBatch = Batch{
+	Time:    time.Unix(1700000000, 5),
+	Metrics: []models.Metrics{counter("PollCount", 7), gauge("Heap Alloc", 1.5), gauge("Alloc", 2)},
+}
+
+// recordRequest starts a server that stores the last request body and answers with status.
+func recordRequest(t *testing.T, status int) (*httptest.Server, chan *http.Request, chan string) {
+	t.Helper()
+	reqs, bodies := make(chan *http.Request, 1), make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		reqs <- r
+		bodies <- string(body)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, reqs, bodies
+}
+
+func TestPushgateway(t *testing.T) {
+	srv, reqs, bodies := recordRequest(t, http.StatusOK)
+
+	p := NewPushgateway(srv.URL+"/", "mcollector", "host 1")
+	require.NoError(t, p.Write(context.Background(), testBatch))
+
+	r := <-reqs
+	assert.Equal(t, http.MethodPost, r.Method)
+	assert.Equal(t, "/metrics/job/mcollector/instance/host%201", r.URL.EscapedPath())
+	assert.Equal(t, "# TYPE Alloc gauge\nAlloc 2\n"+
+		"# TYPE Heap_Alloc gauge\nHeap_Alloc 1.5\n"+
+		"# TYPE PollCount counter\nPollCount 7\n", <-bodies)
+}
+
+func TestClientErrorIsPermanent(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	p := NewPushgateway(srv.URL, "job", "")
+	err := retry.Policy{MaxAttempts: 3}.Do(context.Background(), func(ctx context.Context) error {
+		return p.Write(ctx, testBatch)
+	})
+	require.Error(t, err)
+	assert.Equal(t, int32(1), hits.Load())
+}
+
+func TestGraphite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	lines := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sc := bufio.NewScanner(conn)
+		for sc.Scan() {
+			lines <- sc.Text()
+		}
+	}()
+
+	g := NewGraphite(l.Addr().String(), "agents.host1.")
+	defer g.Close()
+	require.NoError(t, g.Write(context.Background(), testBatch))
+
+	assert.Equal(t, "agents.host1.PollCount 7 1700000000", <-lines)
+	assert.Equal(t, "agents.host1.Heap_Alloc 1.5 1700000000", <-lines)
+	assert.Equal(t, "agents.host1.Alloc 2 1700000000", <-lines)
+}
+
+func TestInflux(t *testing.T) {
+	srv, reqs, bodies := recordRequest(t, http.StatusNoContent)
+
+	batch := testBatch
+	batch.Metrics = append(batch.Metrics, gauge("NaN", math.NaN()))
+	i := NewInflux(srv.URL+"/api/v2/write?bucket=metrics", "secret", "host 1")
+	require.NoError(t, i.Write(context.Background(), batch))
+
+	r := <-reqs
+	assert.Equal(t, "Token secret", r.Header.Get("Authorization"))
+	assert.Equal(t, "metrics", r.URL.Query().Get("bucket"))
+	assert.Equal(t, "PollCount,host=host\\ 1 value=7i 1700000000000000005\n"+
+		"Heap\\ Alloc,host=host\\ 1 value=1.5 1700000000000000005\n"+
+		"Alloc,host=host\\ 1 value=2 1700000000000000005\n", <-bodies)
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.jsonl")
+	f, err := NewFile(path)
+	require.NoError(t, err)
+	require.NoError(t, f.Write(context.Background(), testBatch))
+	require.NoError(t, f.Close())
+
+	data, err := os.Open(path)
+	require.NoError(t, err)
+	defer data.Close()
+
+	dec := json.NewDecoder(data)
+	for _, want := range testBatch.Metrics {
+		var rec fileRecord
+		require.NoError(t, dec.Decode(&rec))
+		assert.True(t, testBatch.Time.Equal(rec.Time))
+		assert.Equal(t, want, rec.Metrics)
+	}
+}
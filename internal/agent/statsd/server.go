@@ -0,0 +1,179 @@
+package statsd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// maxPacketSize is the size of the buffer a datagram is read into.
+const maxPacketSize = 64 * 1024
+
+// Server receives StatsD metrics on several listeners and adds them to the aggregator.
+type Server struct {
+	agg     *Aggregator
+	wg      *sync.WaitGroup
+	mux     *sync.Mutex
+	conns   map[net.Conn]struct{}
+	log     zerolog.Logger
+	closers []func() error
+	addrs   []net.Addr
+	closed  bool
+}
+
+// Listen starts receiving metrics on the addresses until Close is called. An address has the
+// form scheme://address where the scheme is udp, tcp, unix (stream) or unixgram, for example
+// udp://:8125 or unix:///run/statsd.sock. An address without a scheme is UDP.
+func Listen(addrs []string, agg *Aggregator, log zerolog.Logger) (*Server, error) {
+	s := &Server{
+		agg:   agg,
+		wg:    &sync.WaitGroup{},
+		mux:   &sync.Mutex{},
+		conns: make(map[net.Conn]struct{}),
+		log:   log.With().Str("component", "statsd").Logger(),
+	}
+
+	for _, addr := range addrs {
+		network, address, ok := strings.Cut(addr, "://")
+		if !ok {
+			network, address = "udp", addr
+		}
+
+		var err error
+		switch network {
+		case "udp", "unixgram":
+			err = s.listenPacket(network, address)
+		case "tcp", "unix":
+			err = s.listenStream(network, address)
+		default:
+			err = fmt.Errorf("unknown network %q", network)
+		}
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("failed to listen on %s: %w", addr, err), s.Close())
+		}
+		s.log.Info().Str("address", addr).Msg("listening for statsd metrics")
+	}
+	return s, nil
+}
+
+// Addrs returns the addresses the server listens on.
+func (s *Server) Addrs() []net.Addr {
+	return s.addrs
+}
+
+// Close stops the listeners and waits for the received metrics to be added.
+func (s *Server) Close() error {
+	s.mux.Lock()
+	s.closed = true
+	var errs []error
+	for _, c := range s.closers {
+		if err := c(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mux.Unlock()
+
+	s.wg.Wait()
+	return errors.Join(errs...)
+}
+
+// listenPacket receives a packet of lines per datagram.
+func (s *Server) listenPacket(network, address string) error {
+	pc, err := net.ListenPacket(network, address)
+	if err != nil {
+		return err
+	}
+	s.addrs = append(s.addrs, pc.LocalAddr())
+	s.closers = append(s.closers, pc.Close)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					s.log.Error().Err(err).Msg("failed to read packet")
+				}
+				return
+			}
+			if err := s.agg.Process(buf[:n]); err != nil {
+				s.log.Debug().Err(err).Msg("invalid statsd lines")
+			}
+		}
+	}()
+	return nil
+}
+
+// listenStream receives newline-separated lines on every accepted connection.
+func (s *Server) listenStream(network, address string) error {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	s.addrs = append(s.addrs, l.Addr())
+	s.closers = append(s.closers, l.Close)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					s.log.Error().Err(err).Msg("failed to accept connection")
+				}
+				return
+			}
+			if !s.track(conn) {
+				_ = conn.Close()
+				return
+			}
+
+			s.wg.Add(1)
+			go s.serveConn(conn)
+		}
+	}()
+	return nil
+}
+
+// serveConn reads lines from the connection until it is closed.
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer s.untrack(conn)
+
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(make([]byte, 0, 4096), maxPacketSize)
+	for sc.Scan() {
+		if err := s.agg.Process(sc.Bytes()); err != nil {
+			s.log.Debug().Err(err).Msg("invalid statsd line")
+		}
+	}
+}
+
+// track registers the connection so Close can stop it. It returns false once the server is closed.
+func (s *Server) track(conn net.Conn) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.conns, conn)
+	_ = conn.Close()
+}
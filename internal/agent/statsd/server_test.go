@@ -0,0 +1,57 @@
+package statsd
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "statsd.sock")
+	agg := NewAggregator()
+	s, err := Listen([]string{"127.0.0.1:0", "tcp://127.0.0.1:0", "unix://" + sock}, agg, zerolog.Nop())
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, s.Close())
+	}()
+	addrs := s.Addrs()
+	require.Len(t, addrs, 3)
+
+	udp, err := net.Dial("udp", addrs[0].String())
+	require.NoError(t, err)
+	defer udp.Close()
+	_, err = udp.Write([]byte("hits:1|c\nhits:2|c"))
+	require.NoError(t, err)
+
+	for i, network := range []string{"tcp", "unix"} {
+		conn, err := net.Dial(network, addrs[i+1].String())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("hits:10|c\n"))
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	}
+
+	total := int64(0)
+	require.Eventually(t, func() bool {
+		for _, m := range agg.Flush() {
+			if m.ID == "hits" {
+				total += *m.Delta
+			}
+		}
+		return total == 23
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestListenErrors(t *testing.T) {
+	_, err := Listen([]string{"sctp://:8125"}, NewAggregator(), zerolog.Nop())
+	assert.Error(t, err)
+
+	// The listeners already started are closed when a later one fails.
+	_, err = Listen([]string{"tcp://127.0.0.1:0", "tcp://256.0.0.1:1"}, NewAggregator(), zerolog.Nop())
+	assert.Error(t, err)
+}
@@ -0,0 +1,259 @@
+// Package statsd receives StatsD metrics from local applications and aggregates them
+// between two reports of the agent.
+//
+// Counters, gauges (including "+N" and "-N" relative updates), timers, histograms,
+// distributions and sets are supported, with sample rates and DogStatsD tags. Tags are kept in
+// the metric ID in the Graphite tagged form "name;key=value", sorted by key.
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ospiem/mcollector/internal/models"
+)
+
+// Types of the StatsD metrics.
+const (
+	typeCounter      = "c"
+	typeGauge        = "g"
+	typeTimer        = "ms"
+	typeHistogram    = "h"
+	typeDistribution = "d"
+	typeSet          = "s"
+)
+
+// percentiles are reported for every timer.
+var percentiles = []float64{50, 90, 95, 99}
+
+// Metric is a parsed StatsD line.
+type Metric struct {
+	Name     string
+	Type     string
+	Member   string  // Member is the value of a set.
+	Value    float64 // Value is the value of the other types.
+	Rate     float64 // Rate is the sample rate in (0, 1].
+	Relative bool    // Relative is true for gauge updates with an explicit sign.
+	Tags     []string
+}
+
+// Parse parses a line in the format name:value|type[|@rate][|#tag:value,...].
+func Parse(line string) (Metric, error) {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return Metric{}, fmt.Errorf("missing metric name in %q", line)
+	}
+	fields := strings.Split(rest, "|")
+	if len(fields) < 2 {
+		return Metric{}, fmt.Errorf("missing metric type in %q", line)
+	}
+
+	m := Metric{Name: name, Type: fields[1], Rate: 1}
+	value := fields[0]
+	switch m.Type {
+	case typeSet:
+		m.Member = value
+	case typeCounter, typeGauge, typeTimer, typeHistogram, typeDistribution:
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return Metric{}, fmt.Errorf("invalid value in %q", line)
+		}
+		m.Value = v
+		m.Relative = m.Type == typeGauge && (value[0] == '+' || value[0] == '-')
+	default:
+		return Metric{}, fmt.Errorf("unknown metric type in %q", line)
+	}
+
+	for _, f := range fields[2:] {
+		switch {
+		case strings.HasPrefix(f, "@"):
+			rate, err := strconv.ParseFloat(f[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return Metric{}, fmt.Errorf("invalid sample rate in %q", line)
+			}
+			m.Rate = rate
+		case strings.HasPrefix(f, "#"):
+			for _, tag := range strings.Split(f[1:], ",") {
+				if tag != "" {
+					m.Tags = append(m.Tags, tag)
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+// timer holds the values of a timer during an interval.
+type timer struct {
+	values []float64
+	count  float64
+}
+
+// Aggregator aggregates the metrics received between two flushes.
+type Aggregator struct {
+	mux      *sync.Mutex
+	counters map[string]float64
+	gauges   map[string]float64
+	timers   map[string]*timer
+	sets     map[string]map[string]struct{}
+	invalid  int
+}
+
+// NewAggregator creates an empty Aggregator.
+func NewAggregator() *Aggregator {
+	return &Aggregator{
+		mux:      &sync.Mutex{},
+		counters: make(map[string]float64),
+		gauges:   make(map[string]float64),
+		timers:   make(map[string]*timer),
+		sets:     make(map[string]map[string]struct{}),
+	}
+}
+
+// Process parses the newline-separated lines of a packet and adds them. It returns an error
+// joining the lines that could not be parsed.
+func (a *Aggregator) Process(packet []byte) error {
+	var errs []error
+	for _, line := range strings.Split(string(packet), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		m, err := Parse(line)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		a.Add(m)
+	}
+
+	if len(errs) > 0 {
+		a.mux.Lock()
+		a.invalid += len(errs)
+		a.mux.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// Add adds the metric to the current interval.
+func (a *Aggregator) Add(m Metric) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	key := metricID(m.Name, m.Tags)
+	switch m.Type {
+	case typeCounter:
+		a.counters[key] += m.Value / m.Rate
+	case typeGauge:
+		if m.Relative {
+			a.gauges[key] += m.Value
+		} else {
+			a.gauges[key] = m.Value
+		}
+	case typeTimer, typeHistogram, typeDistribution:
+		t, ok := a.timers[key]
+		if !ok {
+			t = &timer{}
+			a.timers[key] = t
+		}
+		t.values = append(t.values, m.Value)
+		t.count += 1 / m.Rate
+	case typeSet:
+		s, ok := a.sets[key]
+		if !ok {
+			s = make(map[string]struct{})
+			a.sets[key] = s
+		}
+		s[m.Member] = struct{}{}
+	}
+}
+
+// Flush returns the aggregated metrics and starts a new interval. Counters are sent as deltas
+// rounded to integers. Gauges keep their value between intervals. Timers are sent as the
+// count, sum, mean, min, max and percentiles gauges, sets as the number of unique members.
+func (a *Aggregator) Flush() []models.Metrics {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	metrics := make([]models.Metrics, 0, len(a.counters)+len(a.gauges)+len(a.timers)*9+len(a.sets))
+	for k, v := range a.counters {
+		delta := int64(math.Round(v))
+		metrics = append(metrics, models.Metrics{ID: k, MType: models.Counter, Delta: &delta})
+	}
+	for k, v := range a.gauges {
+		metrics = append(metrics, gauge(k, "", v))
+	}
+	for k, t := range a.timers {
+		metrics = append(metrics, t.summary(k)...)
+	}
+	for k, s := range a.sets {
+		metrics = append(metrics, gauge(k, "", float64(len(s))))
+	}
+
+	a.counters = make(map[string]float64)
+	a.timers = make(map[string]*timer)
+	a.sets = make(map[string]map[string]struct{})
+	return metrics
+}
+
+// Invalid returns the number of lines that could not be parsed so far.
+func (a *Aggregator) Invalid() int {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.invalid
+}
+
+// summary returns the gauges describing the timer.
+func (t *timer) summary(key string) []models.Metrics {
+	sort.Float64s(t.values)
+	sum := 0.0
+	for _, v := range t.values {
+		sum += v
+	}
+
+	res := []models.Metrics{
+		gauge(key, ".count", t.count),
+		gauge(key, ".sum", sum),
+		gauge(key, ".mean", sum/float64(len(t.values))),
+		gauge(key, ".min", t.values[0]),
+		gauge(key, ".max", t.values[len(t.values)-1]),
+	}
+	for _, p := range percentiles {
+		// Nearest-rank percentile.
+		rank := int(math.Ceil(p / 100 * float64(len(t.values))))
+		res = append(res, gauge(key, ".p"+strconv.FormatFloat(p, 'f', -1, 64), t.values[max(rank-1, 0)]))
+	}
+	return res
+}
+
+// gauge returns a gauge for the key with the suffix inserted before the tags.
+func gauge(key, suffix string, v float64) models.Metrics {
+	if suffix != "" {
+		name, tags, _ := strings.Cut(key, ";")
+		key = name + suffix
+		if tags != "" {
+			key += ";" + tags
+		}
+	}
+	return models.Metrics{ID: key, MType: models.Gauge, Value: &v}
+}
+
+// metricID returns the ID of the metric with its tags sorted by key.
+func metricID(name string, tags []string) string {
+	if len(tags) == 0 {
+		return name
+	}
+
+	pairs := make([]string, len(tags))
+	for i, tag := range tags {
+		k, v, _ := strings.Cut(tag, ":")
+		pairs[i] = k + "=" + v
+	}
+	sort.Strings(pairs)
+	return name + ";" + strings.Join(pairs, ";")
+}
@@ -0,0 +1,78 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// byID indexes the flushed metrics by ID.
+func byID(metrics []models.Metrics) map[string]models.Metrics {
+	res := make(map[string]models.Metrics, len(metrics))
+	for _, m := range metrics {
+		res[m.ID] = m
+	}
+	return res
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		line string
+		want Metric
+	}{
+		{"hits:1|c", Metric{Name: "hits", Type: "c", Value: 1, Rate: 1}},
+		{"hits:2|c|@0.5", Metric{Name: "hits", Type: "c", Value: 2, Rate: 0.5}},
+		{"temp:-3.5|g", Metric{Name: "temp", Type: "g", Value: -3.5, Rate: 1, Relative: true}},
+		{"temp:3.5|g", Metric{Name: "temp", Type: "g", Value: 3.5, Rate: 1}},
+		{"users:alice|s", Metric{Name: "users", Type: "s", Member: "alice", Rate: 1}},
+		{"latency:12|ms|@0.1|#env:prod,region:eu", Metric{
+			Name: "latency", Type: "ms", Value: 12, Rate: 0.1, Tags: []string{"env:prod", "region:eu"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			m, err := Parse(tt.line)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, m)
+		})
+	}
+
+	for _, line := range []string{"hits", ":1|c", "hits:1", "hits:x|c", "hits:1|x", "hits:1|c|@2", "hits:NaN|g"} {
+		_, err := Parse(line)
+		assert.Error(t, err, line)
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	a := NewAggregator()
+	err := a.Process([]byte("hits:1|c\nhits:1|c|@0.5\nhits:1|c|#env:prod\n" +
+		"temp:10|g\ntemp:+5|g\ntemp:-2|g\n" +
+		"users:alice|s\nusers:bob|s\nusers:alice|s\n" +
+		"bad line\n"))
+	require.Error(t, err)
+	assert.Equal(t, 1, a.Invalid())
+
+	for i := 1; i <= 100; i++ {
+		a.Add(Metric{Name: "latency", Type: "ms", Value: float64(i), Rate: 0.5, Tags: []string{"region:eu", "env:prod"}})
+	}
+
+	got := byID(a.Flush())
+	assert.Equal(t, int64(3), *got["hits"].Delta)
+	assert.Equal(t, int64(1), *got["hits;env=prod"].Delta)
+	assert.Equal(t, float64(13), *got["temp"].Value)
+	assert.Equal(t, float64(2), *got["users"].Value)
+	assert.Equal(t, float64(200), *got["latency.count;env=prod;region=eu"].Value)
+	assert.Equal(t, float64(5050), *got["latency.sum;env=prod;region=eu"].Value)
+	assert.Equal(t, 50.5, *got["latency.mean;env=prod;region=eu"].Value)
+	assert.Equal(t, float64(1), *got["latency.min;env=prod;region=eu"].Value)
+	assert.Equal(t, float64(100), *got["latency.max;env=prod;region=eu"].Value)
+	assert.Equal(t, float64(50), *got["latency.p50;env=prod;region=eu"].Value)
+	assert.Equal(t, float64(99), *got["latency.p99;env=prod;region=eu"].Value)
+
+	// Only gauges survive the flush.
+	got = byID(a.Flush())
+	assert.Len(t, got, 1)
+	assert.Equal(t, float64(13), *got["temp"].Value)
+}
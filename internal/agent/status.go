@@ -0,0 +1,172 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ospiem/mcollector/internal/agent/sink"
+	"github.com/ospiem/mcollector/internal/logging"
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/rs/zerolog"
+)
+
+// staleReports is the number of report intervals without a successful send after which
+// an output makes the agent unhealthy.
+const staleReports = 3
+
+// Status describes the state of the agent.
+type Status struct {
+	Outputs         map[string]sink.Stats `json:"outputs"`
+	CollectorErrors map[string]uint64     `json:"collector_errors"`
+	Unhealthy       []string              `json:"unhealthy,omitempty"` // Unhealthy lists the outputs failing to send.
+	LastSuccess     time.Time             `json:"last_success"`        // LastSuccess is the last successful send.
+	Version         string                `json:"version"`
+	Date            string                `json:"date"`
+	Commit          string                `json:"commit"`
+	UptimeSeconds   float64               `json:"uptime_seconds"`
+	Healthy         bool                  `json:"healthy"`
+}
+
+// status tracks the health of the agent and reports it as metrics.
+type status struct {
+	start   time.Time
+	outputs sink.Fanout
+	cs      *collectors
+	log     zerolog.Logger
+	// interval is the report interval, it changes when the config is reloaded.
+	interval atomic.Int64
+	// runtimeErrors is the number of failures to read the runtime metrics.
+	runtimeErrors atomic.Uint64
+}
+
+func newStatus(outputs sink.Fanout, cs *collectors, reportInterval time.Duration, log zerolog.Logger) *status {
+	s := &status{
+		start:   time.Now(),
+		outputs: outputs,
+		cs:      cs,
+		log:     log,
+	}
+	s.interval.Store(int64(reportInterval))
+	return s
+}
+
+// snapshot returns the state of the agent. The agent is healthy if every output has sent
+// metrics in the last staleReports report intervals.
+func (s *status) snapshot() Status {
+	now := time.Now()
+	st := Status{
+		Outputs:         make(map[string]sink.Stats, len(s.outputs)),
+		CollectorErrors: make(map[string]uint64, len(s.cs.errors)+1),
+		Version:         buildVersion,
+		Date:            buildDate,
+		Commit:          buildCommit,
+		UptimeSeconds:   now.Sub(s.start).Seconds(),
+		Healthy:         true,
+	}
+
+	for _, o := range s.outputs {
+		stats := o.Stats()
+		st.Outputs[o.Name()] = stats
+		if stats.LastSuccess.After(st.LastSuccess) {
+			st.LastSuccess = stats.LastSuccess
+		}
+
+		since := stats.LastSuccess
+		if since.IsZero() {
+			since = s.start
+		}
+		if now.Sub(since) > staleReports*time.Duration(s.interval.Load()) {
+			st.Healthy = false
+			st.Unhealthy = append(st.Unhealthy, o.Name())
+		}
+	}
+
+	st.CollectorErrors["runtime"] = s.runtimeErrors.Load()
+	for name, errors := range s.cs.errors {
+		st.CollectorErrors[name] = errors()
+	}
+	return st
+}
+
+// handler serves the status as JSON on /status, the health on /healthz and the log level on /loglevel.
+func (s *status) handler() http.Handler {
+	r := chi.NewRouter()
+	r.Handle("/loglevel", logging.LevelHandler(s.log))
+	r.Get("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.snapshot()); err != nil {
+			s.log.Error().Err(err).Msg("cannot encode status")
+		}
+	})
+	r.Get("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		st := s.snapshot()
+		if !st.Healthy {
+			http.Error(w, "failing outputs: "+strings.Join(st.Unhealthy, ", "), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	return r
+}
+
+// metrics returns the status as gauges, sent along with PollCount.
+func (s *status) metrics() []models.Metrics {
+	st := s.snapshot()
+
+	metrics := []models.Metrics{
+		selfGauge("agent.uptime_seconds", st.UptimeSeconds),
+		selfGauge("agent.build_info;commit="+tagValue(st.Commit)+";date="+tagValue(st.Date)+
+			";version="+tagValue(st.Version), 1),
+		selfGauge("agent.healthy", boolValue(st.Healthy)),
+	}
+	if !st.LastSuccess.IsZero() {
+		metrics = append(metrics, selfGauge("agent.last_success_timestamp", float64(st.LastSuccess.Unix())))
+	}
+
+	for _, name := range sortedKeys(st.Outputs) {
+		stats := st.Outputs[name]
+		tag := ";output=" + tagValue(name)
+		metrics = append(metrics,
+			selfGauge("agent.output.sent"+tag, float64(stats.Sent)),
+			selfGauge("agent.output.failed"+tag, float64(stats.Failed)),
+			selfGauge("agent.output.dropped"+tag, float64(stats.Dropped)),
+			selfGauge("agent.output.retries"+tag, float64(stats.Retries)),
+			selfGauge("agent.output.queued"+tag, float64(stats.Queued)),
+		)
+	}
+	for _, name := range sortedKeys(st.CollectorErrors) {
+		metrics = append(metrics,
+			selfGauge("agent.collector.errors;collector="+tagValue(name), float64(st.CollectorErrors[name])))
+	}
+	return metrics
+}
+
+func selfGauge(id string, v float64) models.Metrics {
+	return models.Metrics{ID: id, MType: models.Gauge, Value: &v}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// tagValue replaces the characters separating the tags in a metric ID.
+func tagValue(s string) string {
+	return strings.NewReplacer(";", "_", "=", "_", " ", "_").Replace(s)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/agent/balancer"
+	"github.com/ospiem/mcollector/internal/agent/sink"
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/ospiem/mcollector/internal/retry"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// funcSink writes the batches with a function.
+type funcSink func(b sink.Batch) error
+
+func (f funcSink) Write(_ context.Context, b sink.Batch) error { return f(b) }
+func (f funcSink) Close() error                                { return nil }
+
+func newTestStatus(t *testing.T, write funcSink, interval time.Duration) *status {
+	t.Helper()
+	out := sink.NewOutput(write, sink.Options{Name: "main server", Retry: retry.Policy{MaxAttempts: 1}}, zerolog.Nop())
+	t.Cleanup(func() { _ = out.Close(context.Background()) })
+
+	cs := &collectors{errors: map[string]func() uint64{"script": func() uint64 { return 2 }}}
+	st := newStatus(sink.Fanout{out}, cs, interval, zerolog.Nop())
+
+	out.Enqueue(sink.Batch{Metrics: createMetricSlice(nil, &zerolog.Logger{})})
+	require.Eventually(t, func() bool {
+		stats := out.Stats()
+		return stats.Sent+stats.Failed > 0
+	}, time.Second, 10*time.Millisecond)
+	return st
+}
+
+func TestStatusHandler(t *testing.T) {
+	st := newTestStatus(t, func(sink.Batch) error { return nil }, time.Minute)
+	h := st.handler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var got Status
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+	assert.True(t, got.Healthy)
+	assert.Equal(t, buildVersion, got.Version)
+	assert.False(t, got.LastSuccess.IsZero())
+	assert.Equal(t, uint64(2), got.Outputs["main server"].Sent)
+	assert.Equal(t, map[string]uint64{"runtime": 0, "script": 2}, got.CollectorErrors)
+}
+
+func TestStatusUnhealthy(t *testing.T) {
+	st := newTestStatus(t, func(sink.Batch) error { return errors.New("connection refused") }, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	st.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), "main server")
+
+	got := st.snapshot()
+	assert.False(t, got.Healthy)
+	assert.Contains(t, got.Outputs["main server"].LastError, "connection refused")
+}
+
+func TestStatusRejectedByServer(t *testing.T) {
+	certPath := filepath.Join(t.TempDir(), "cert.pem")
+	require.NoError(t, os.WriteFile(certPath, []byte(testCertPEM), 0600))
+	pubKey, err := parsePubKey(certPath)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	b, err := balancer.New(balancer.Config{Endpoints: []string{strings.TrimPrefix(srv.URL, "http://")}}, zerolog.Nop())
+	require.NoError(t, err)
+	keys := &atomic.Pointer[mcollectorKeys]{}
+	keys.Store(&mcollectorKeys{pubKey: pubKey})
+	s := &mcollectorSink{b: b, keys: keys, log: zerolog.Nop()}
+
+	st := newTestStatus(t, func(b sink.Batch) error { return s.Write(context.Background(), b) }, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	st.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	got := st.snapshot()
+	assert.False(t, got.Healthy)
+	assert.True(t, got.LastSuccess.IsZero())
+	assert.Equal(t, uint64(0), got.Outputs["main server"].Sent)
+	assert.Equal(t, uint64(2), got.Outputs["main server"].Failed)
+	assert.Contains(t, got.Outputs["main server"].LastError, "unexpected status 400")
+}
+
+func TestStatusMetrics(t *testing.T) {
+	st := newTestStatus(t, func(sink.Batch) error { return nil }, time.Minute)
+	st.runtimeErrors.Add(1)
+
+	values := make(map[string]float64)
+	for _, m := range st.metrics() {
+		assert.Equal(t, models.Gauge, m.MType)
+		values[m.ID] = *m.Value
+	}
+
+	assert.Contains(t, values, "agent.uptime_seconds")
+	assert.Contains(t, values, "agent.last_success_timestamp")
+	assert.Equal(t, 1.0, values["agent.build_info;commit=N/A;date=N/A;version=N/A"])
+	assert.Equal(t, 1.0, values["agent.healthy"])
+	assert.Equal(t, 2.0, values["agent.output.sent;output=main_server"])
+	assert.Equal(t, 0.0, values["agent.output.dropped;output=main_server"])
+	assert.Equal(t, 1.0, values["agent.collector.errors;collector=runtime"])
+	assert.Equal(t, 2.0, values["agent.collector.errors;collector=script"])
+}
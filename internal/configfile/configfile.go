@@ -0,0 +1,116 @@
+// Package configfile decodes the configuration files of the agent and the server.
+//
+// The format is picked by the extension of the file: .yaml or .yml for YAML, .toml for TOML
+// and JSON otherwise. Whatever the format, the document is decoded into the json tags of the
+// schema, so the custom JSON decoding of a type applies to all of them, and a key unknown to
+// the schema is an error instead of being ignored.
+package configfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats of the configuration files.
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// Format returns the format of the file by its extension.
+func Format(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	default:
+		return FormatJSON
+	}
+}
+
+// Load decodes the file into v.
+func Load(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	format := Format(path)
+	if err := Decode(format, data, v); err != nil {
+		return fmt.Errorf("failed to parse %s file %s: %w", format, path, err)
+	}
+	return nil
+}
+
+// Decode decodes the document in the format into v.
+func Decode(format string, data []byte, v any) error {
+	var doc any
+	switch format {
+	case FormatJSON:
+		return Strict(data, v)
+	case FormatYAML:
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("invalid yaml: %w", err)
+		}
+	case FormatTOML:
+		var table map[string]any
+		if _, err := toml.Decode(string(data), &table); err != nil {
+			return fmt.Errorf("invalid toml: %w", err)
+		}
+		doc = table
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+
+	if doc == nil {
+		// An empty document sets nothing.
+		return nil
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("failed to convert %s: %w", format, err)
+	}
+	return Strict(data, v)
+}
+
+// Strict decodes JSON into v, failing on the keys unknown to v. The custom JSON decoding of
+// the types of the schema use it, so that their keys are checked too.
+func Strict(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("unexpected data after the document")
+	}
+	return nil
+}
+
+// Duration is a duration written as a string, e.g. "1m30s".
+type Duration time.Duration
+
+// UnmarshalText parses the duration.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid duration: %w", err)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalText formats the duration.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
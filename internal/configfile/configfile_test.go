@@ -0,0 +1,108 @@
+package configfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testSection struct {
+	Peers []string `json:"peers"`
+	Port  int      `json:"port"`
+}
+
+type testConfig struct {
+	Address  string      `json:"address"`
+	Interval Duration    `json:"interval"`
+	Section  testSection `json:"section"`
+	Enabled  bool        `json:"enabled"`
+}
+
+func TestFormat(t *testing.T) {
+	assert.Equal(t, FormatYAML, Format("/etc/mcollector/agent.yaml"))
+	assert.Equal(t, FormatYAML, Format("agent.YML"))
+	assert.Equal(t, FormatTOML, Format("agent.toml"))
+	assert.Equal(t, FormatJSON, Format("agent.json"))
+	assert.Equal(t, FormatJSON, Format("agent.conf"))
+}
+
+func TestLoad(t *testing.T) {
+	want := testConfig{
+		Address:  "localhost:8080",
+		Interval: Duration(90 * time.Second),
+		Section:  testSection{Peers: []string{"a:1", "b:1"}, Port: 2003},
+		Enabled:  true,
+	}
+	files := map[string]string{
+		"config.json": `{"address": "localhost:8080", "interval": "1m30s", "enabled": true,
+			"section": {"peers": ["a:1", "b:1"], "port": 2003}}`,
+		"config.yaml": `
+address: localhost:8080
+interval: 1m30s
+enabled: true
+section:
+  peers: [a:1, b:1]
+  port: 2003
+`,
+		"config.toml": `
+address = "localhost:8080"
+interval = "1m30s"
+enabled = true
+
+[section]
+peers = ["a:1", "b:1"]
+port = 2003
+`,
+	}
+
+	dir := t.TempDir()
+	for name, text := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			require.NoError(t, os.WriteFile(path, []byte(text), 0600))
+
+			var got testConfig
+			require.NoError(t, Load(path, &got))
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	files := map[string]string{
+		"unknown.json":        `{"address": "localhost:8080", "adress": "localhost:8081"}`,
+		"unknown-nested.yaml": "section:\n  prot: 2003\n",
+		"unknown.toml":        "[sections]\nport = 2003\n",
+		"duration.yaml":       "interval: 90\n",
+		"syntax.toml":         "address = \n",
+		"trailing.json":       `{"address": "localhost:8080"} {}`,
+	}
+
+	dir := t.TempDir()
+	for name, text := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			require.NoError(t, os.WriteFile(path, []byte(text), 0600))
+
+			var got testConfig
+			err := Load(path, &got)
+			assert.ErrorContains(t, err, path)
+		})
+	}
+
+	var got testConfig
+	assert.Error(t, Load(filepath.Join(dir, "missing.yaml"), &got))
+}
+
+func TestLoadEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.yaml")
+	require.NoError(t, os.WriteFile(path, nil, 0600))
+
+	var got testConfig
+	assert.NoError(t, Load(path, &got))
+	assert.Equal(t, testConfig{}, got)
+}
@@ -0,0 +1,44 @@
+package configload
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+// Positive checks that the value is above zero.
+func Positive[T cmp.Ordered](v T) error {
+	var zero T
+	if v <= zero {
+		return fmt.Errorf("must be positive, got %v", v)
+	}
+	return nil
+}
+
+// NotNegative checks that the value is zero or above.
+func NotNegative[T cmp.Ordered](v T) error {
+	var zero T
+	if v < zero {
+		return fmt.Errorf("must not be negative, got %v", v)
+	}
+	return nil
+}
+
+// OneOf checks that the value is one of the values.
+func OneOf[T comparable](v T, values ...T) error {
+	if !slices.Contains(values, v) {
+		return fmt.Errorf("%v is not one of %v", v, values)
+	}
+	return nil
+}
+
+// Regexps checks that every regular expression compiles.
+func Regexps(exprs []string) error {
+	for _, expr := range exprs {
+		if _, err := regexp.Compile(expr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
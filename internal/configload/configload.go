@@ -0,0 +1,319 @@
+// Package configload loads the configuration of the agent and the server.
+//
+// Every setting is declared once, with its key in the configuration file, its flag and its
+// environment variable. The effective value comes from, in increasing precedence, the default,
+// the configuration file, the environment variable and the flag, and the loader remembers
+// where every value comes from to print it with -print-config.
+package configload
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/ospiem/mcollector/internal/configfile"
+)
+
+// Source is where a value comes from, in increasing precedence.
+type Source int
+
+// Sources of the values.
+const (
+	SourceDefault Source = iota
+	SourceFile
+	SourceEnv
+	SourceFlag
+)
+
+var sourceNames = [...]string{"default", "file", "env", "flag"}
+
+func (s Source) String() string {
+	return sourceNames[s]
+}
+
+// Origin is where the effective value of a setting comes from.
+type Origin struct {
+	Source Source
+	Name   string // Name is the flag, the environment variable or the path of the file.
+}
+
+func (o Origin) String() string {
+	switch o.Source {
+	case SourceDefault:
+		return o.Source.String()
+	case SourceFlag:
+		return "flag -" + o.Name
+	default:
+		return o.Source.String() + " " + o.Name
+	}
+}
+
+// Setting is a setting of the configuration.
+type Setting struct {
+	Key    string // Key is the dotted path of the setting in the file, e.g. "storage.interval".
+	Flag   string // Flag is the name of the command line flag, empty if there is none.
+	Env    string // Env is the environment variable, empty if there is none.
+	Usage  string // Usage describes the setting in the help of the flag.
+	Secret bool   // Secret values are redacted when printed.
+	Value  Value  // Value is the destination of the setting, it holds the default until loaded.
+	// Deprecated lists the former keys of the setting, still accepted in the file with a warning.
+	Deprecated []string
+	// Check validates the loaded value, nil accepts any value.
+	Check func() error
+}
+
+// Loader loads the settings of a program.
+type Loader struct {
+	name     string
+	handling flag.ErrorHandling
+	settings []*Setting
+	origins  map[string]Origin
+	file     Origin
+	print    bool
+	warnings []string
+}
+
+// New returns a loader of the settings, handling the errors of the flags like flag.FlagSet.
+func New(name string, handling flag.ErrorHandling, settings []*Setting) *Loader {
+	return &Loader{name: name, handling: handling, settings: settings, origins: make(map[string]Origin)}
+}
+
+// Load loads the settings from the arguments, the environment and the configuration file set by
+// the -config flag or the CONFIG environment variable, then validates them.
+func (l *Loader) Load(args []string) error {
+	flags, err := l.parseFlags(args)
+	if err != nil {
+		return err
+	}
+	var file map[string][]byte
+	if l.file.Name != "" {
+		if file, err = l.readFile(l.file.Name); err != nil {
+			return err
+		}
+	}
+
+	var errs []error
+	for _, s := range l.settings {
+		if err := l.apply(s, flags[s.Flag], file); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	for _, s := range l.settings {
+		if s.Check == nil {
+			continue
+		}
+		if err := s.Check(); err != nil {
+			errs = append(errs, l.Invalid(s.Key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// parseFlags parses the arguments, returning the texts of every flag set in the order they are set.
+func (l *Loader) parseFlags(args []string) (map[string][]string, error) {
+	fs := flag.NewFlagSet(l.name, l.handling)
+	flags := make(map[string][]string)
+	for _, s := range l.settings {
+		if s.Flag != "" {
+			fs.Var(&recorder{setting: s, flags: flags}, s.Flag, s.Usage)
+		}
+	}
+	fs.StringVar(&l.file.Name, "config", "", "Configure the config file in JSON, YAML or TOML format")
+	fs.BoolVar(&l.print, "print-config", false, "Print the effective configuration and where every setting comes from")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	l.file.Source = SourceFlag
+	if l.file.Name == "" {
+		l.file = Origin{Source: SourceEnv, Name: os.Getenv("CONFIG")}
+	}
+	return flags, nil
+}
+
+// readFile reads the configuration file, returning the JSON value of every setting it sets.
+func (l *Loader) readFile(path string) (map[string][]byte, error) {
+	var doc map[string]json.RawMessage
+	if err := configfile.Load(path, &doc); err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte)
+	renamed := make(map[string][]byte)
+	if err := l.walk("", doc, values, renamed); err != nil {
+		return nil, fmt.Errorf("invalid file %s: %w", path, err)
+	}
+
+	old := make([]string, 0, len(renamed))
+	for k := range renamed {
+		old = append(old, k)
+	}
+	slices.Sort(old)
+	for _, k := range old {
+		key := l.renamedTo(k).Key
+		if _, ok := values[key]; ok {
+			return nil, fmt.Errorf("invalid file %s: %s is deprecated and set along with %s, remove it", path, k, key)
+		}
+		values[key] = renamed[k]
+		l.warnings = append(l.warnings, fmt.Sprintf("%s in file %s is deprecated, use %s", k, path, key))
+	}
+	return values, nil
+}
+
+// walk collects the values of the settings in the section, and the values of the deprecated keys
+// in renamed, failing on the unknown keys.
+func (l *Loader) walk(section string, doc map[string]json.RawMessage, values, renamed map[string][]byte) error {
+	keys := make([]string, 0, len(doc))
+	for k := range doc {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		key, data := k, doc[k]
+		if section != "" {
+			key = section + "." + k
+		}
+		switch {
+		case l.setting(key) != nil:
+			if string(data) != "null" {
+				values[key] = data
+			}
+		case l.renamedTo(key) != nil:
+			if string(data) != "null" {
+				renamed[key] = data
+			}
+		case l.isSection(key):
+			var sub map[string]json.RawMessage
+			if err := json.Unmarshal(data, &sub); err != nil {
+				return fmt.Errorf("%s must be a section", key)
+			}
+			if err := l.walk(key, sub, values, renamed); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown key %q", key)
+		}
+	}
+	return nil
+}
+
+// apply sets the value of the setting from its source of highest precedence.
+func (l *Loader) apply(s *Setting, flags []string, file map[string][]byte) error {
+	if len(flags) > 0 {
+		origin := Origin{Source: SourceFlag, Name: s.Flag}
+		for _, text := range flags {
+			if err := s.Value.Set(text); err != nil {
+				return fmt.Errorf("invalid value %q for %s: %w", text, origin, err)
+			}
+		}
+		l.origins[s.Key] = origin
+		return nil
+	}
+	if text, ok := os.LookupEnv(s.Env); ok && s.Env != "" {
+		origin := Origin{Source: SourceEnv, Name: s.Env}
+		if err := s.Value.Set(text); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %w", text, origin, err)
+		}
+		l.origins[s.Key] = origin
+		return nil
+	}
+	if data, ok := file[s.Key]; ok {
+		if err := s.Value.Decode(data); err != nil {
+			return fmt.Errorf("invalid %s in file %s: %w", s.Key, l.file.Name, err)
+		}
+		l.origins[s.Key] = Origin{Source: SourceFile, Name: l.file.Name}
+		return nil
+	}
+	l.origins[s.Key] = Origin{Source: SourceDefault}
+	return nil
+}
+
+// setting returns the setting with the key, nil if there is none.
+func (l *Loader) setting(key string) *Setting {
+	for _, s := range l.settings {
+		if s.Key == key {
+			return s
+		}
+	}
+	return nil
+}
+
+// renamedTo returns the setting formerly known as the key, nil if there is none.
+func (l *Loader) renamedTo(key string) *Setting {
+	for _, s := range l.settings {
+		if slices.Contains(s.Deprecated, key) {
+			return s
+		}
+	}
+	return nil
+}
+
+// isSection reports whether the key is a section of the file, holding other settings.
+func (l *Loader) isSection(key string) bool {
+	return slices.ContainsFunc(l.settings, func(s *Setting) bool {
+		return strings.HasPrefix(s.Key, key+".")
+	})
+}
+
+// Origin returns where the value of the setting comes from.
+func (l *Loader) Origin(key string) Origin {
+	return l.origins[key]
+}
+
+// Invalid returns an error naming the setting and where its value comes from.
+func (l *Loader) Invalid(key string, err error) error {
+	return fmt.Errorf("invalid %s from %s: %w", key, l.Origin(key), err)
+}
+
+// File returns the path of the configuration file, empty if there is none.
+func (l *Loader) File() string {
+	return l.file.Name
+}
+
+// Warnings returns the problems of the configuration that do not prevent loading it, e.g. the
+// deprecated keys of the file.
+func (l *Loader) Warnings() []string {
+	return l.warnings
+}
+
+// PrintRequested reports whether -print-config is set.
+func (l *Loader) PrintRequested() bool {
+	return l.print
+}
+
+// recorder is the flag of a setting, it records the texts until the flags are applied.
+type recorder struct {
+	setting *Setting
+	flags   map[string][]string
+}
+
+func (r *recorder) Set(text string) error {
+	r.flags[r.setting.Flag] = append(r.flags[r.setting.Flag], text)
+	return nil
+}
+
+// String returns the default for the help of the flag, empty for the zero values.
+func (r *recorder) String() string {
+	if r == nil || r.setting == nil || r.setting.Secret {
+		return ""
+	}
+	switch def := r.setting.Value.String(); def {
+	case "0", "0s", "false":
+		return ""
+	default:
+		return def
+	}
+}
+
+func (r *recorder) IsBoolFlag() bool {
+	b, ok := r.setting.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
@@ -0,0 +1,166 @@
+package configload
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testConfig struct {
+	Address  string
+	Interval time.Duration
+	Peers    []string
+	Enabled  bool
+	Rate     float64
+	Token    string
+}
+
+func (c *testConfig) settings() []*Setting {
+	return []*Setting{
+		{Key: "address", Flag: "a", Env: "TEST_ADDRESS", Value: String(&c.Address)},
+		{Key: "section.interval", Flag: "i", Env: "TEST_INTERVAL", Value: Duration(&c.Interval, time.Second),
+			Deprecated: []string{"interval"},
+			Check:      func() error { return Positive(c.Interval) }},
+		{Key: "section.peers", Flag: "peers", Env: "TEST_PEERS", Value: List(&c.Peers)},
+		{Key: "enabled", Flag: "enabled", Value: Bool(&c.Enabled)},
+		{Key: "rate", Env: "TEST_RATE", Value: Float(&c.Rate)},
+		{Key: "token", Env: "TEST_TOKEN", Value: String(&c.Token), Secret: true},
+	}
+}
+
+func load(t *testing.T, file string, args ...string) (testConfig, *Loader, error) {
+	t.Helper()
+	if file != "" {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(file), 0600))
+		args = append([]string{"-config", path}, args...)
+	}
+	c := testConfig{Address: "localhost:8080", Interval: time.Minute}
+	l := New("test", flag.ContinueOnError, c.settings())
+	err := l.Load(args)
+	return c, l, err
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	t.Setenv("TEST_INTERVAL", "30")
+	t.Setenv("TEST_PEERS", "env:1")
+	t.Setenv("TEST_RATE", "2.5")
+
+	c, l, err := load(t, `
+address: file:8080
+section:
+  interval: 10s
+  peers: [file:1, file:2]
+rate: 1
+`, "-peers", "flag:1", "-peers", "flag:2,flag:3", "-enabled")
+	require.NoError(t, err)
+
+	assert.Equal(t, testConfig{
+		Address:  "file:8080",
+		Interval: 30 * time.Second,
+		Peers:    []string{"flag:1", "flag:2", "flag:3"},
+		Enabled:  true,
+		Rate:     2.5,
+	}, c)
+	assert.Equal(t, Origin{Source: SourceFile, Name: l.File()}, l.Origin("address"))
+	assert.Equal(t, "env TEST_INTERVAL", l.Origin("section.interval").String())
+	assert.Equal(t, "flag -peers", l.Origin("section.peers").String())
+	assert.Equal(t, "default", l.Origin("token").String())
+}
+
+func TestLoadDuration(t *testing.T) {
+	c, _, err := load(t, "", "-i", "1m30s")
+	require.NoError(t, err)
+	assert.Equal(t, 90*time.Second, c.Interval)
+
+	_, _, err = load(t, "section:\n  interval: 90\n")
+	assert.ErrorContains(t, err, `invalid section.interval in file`)
+
+	_, _, err = load(t, "", "-i", "soon")
+	assert.EqualError(t, err, `invalid value "soon" for flag -i: want a number of seconds or a duration like "1m30s"`)
+
+	_, _, err = load(t, "", "-i", "0")
+	assert.EqualError(t, err, "invalid section.interval from flag -i: must be positive, got 0s")
+}
+
+func TestLoadUnknownKeys(t *testing.T) {
+	for text, want := range map[string]string{
+		"adress: x\n":                   `unknown key "adress"`,
+		"section:\n  peer: [a]\n":       `unknown key "section.peer"`,
+		"section: 10s\n":                "section must be a section",
+		"address:\n  host: localhost\n": "invalid address in file",
+	} {
+		_, _, err := load(t, text)
+		assert.ErrorContains(t, err, want, text)
+	}
+}
+
+func TestLoadDeprecatedKeys(t *testing.T) {
+	c, l, err := load(t, "interval: 10s\n")
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Second, c.Interval)
+	assert.Equal(t, Origin{Source: SourceFile, Name: l.File()}, l.Origin("section.interval"))
+	assert.Equal(t, []string{"interval in file " + l.File() + " is deprecated, use section.interval"}, l.Warnings())
+
+	var out strings.Builder
+	require.NoError(t, l.Report().Print(&out))
+	assert.Contains(t, out.String(), "# warning: interval in file")
+
+	_, _, err = load(t, "interval: 10s\nsection:\n  interval: 20s\n")
+	assert.ErrorContains(t, err, "interval is deprecated and set along with section.interval, remove it")
+}
+
+func TestLoadHelp(t *testing.T) {
+	_, _, err := load(t, "", "-h")
+	assert.True(t, errors.Is(err, flag.ErrHelp))
+}
+
+func TestReport(t *testing.T) {
+	t.Setenv("TEST_TOKEN", "s3cr3t")
+	_, l, err := load(t, "", "-a", "localhost:9090", "-print-config")
+	require.NoError(t, err)
+	assert.True(t, l.PrintRequested())
+
+	r := l.Report()
+	assert.Equal(t, "address", r.Entries[0].Key)
+	assert.Equal(t, "localhost:9090", r.Entries[0].Value)
+	assert.Equal(t, Origin{Source: SourceFlag, Name: "a"}, r.Entries[0].Origin)
+	assert.Equal(t, "token", r.Entries[5].Key)
+	assert.Equal(t, "<redacted>", r.Entries[5].Value)
+	assert.Equal(t, Origin{Source: SourceEnv, Name: "TEST_TOKEN"}, r.Entries[5].Origin)
+
+	var out strings.Builder
+	require.NoError(t, r.Print(&out))
+	assert.Contains(t, out.String(), "section.interval")
+	assert.NotContains(t, out.String(), "s3cr3t")
+}
+
+func TestDiff(t *testing.T) {
+	_, l, err := load(t, "")
+	require.NoError(t, err)
+	old := l.Report()
+
+	t.Setenv("TEST_TOKEN", "s3cr3t")
+	_, l, err = load(t, "", "-i", "2m", "-i", "1m")
+	require.NoError(t, err)
+	assert.Equal(t, []Change{{Key: "token", Old: "", New: "<redacted>"}}, Diff(old, l.Report()),
+		"the interval set to its default is not a change")
+
+	prev := l.Report()
+	t.Setenv("TEST_TOKEN", "0ther")
+	_, l, err = load(t, "")
+	require.NoError(t, err)
+	assert.Equal(t, []Change{{Key: "token", Old: "<redacted>", New: "<redacted>"}}, Diff(prev, l.Report()))
+	assert.Empty(t, Diff(l.Report(), l.Report()))
+
+	merged := Merge(old, l.Report(), []string{"address", "token"})
+	assert.Equal(t, []Change{{Key: "token", Old: "", New: "<redacted>"}}, Diff(old, merged))
+	assert.Empty(t, Diff(l.Report(), merged))
+}
@@ -0,0 +1,114 @@
+package configload
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"slices"
+	"text/tabwriter"
+)
+
+// redacted replaces the values of the secret settings.
+const redacted = "<redacted>"
+
+// Redactor is implemented by the values holding secrets among other settings, e.g. tokens in a list.
+type Redactor interface {
+	// Redacted formats the value without its secrets.
+	Redacted() string
+}
+
+// Entry is the effective value of a setting.
+type Entry struct {
+	Key    string
+	Value  string // Value is redacted for the secret settings.
+	Origin Origin
+	// digest tells the values apart without holding the secrets.
+	digest [sha256.Size]byte
+}
+
+// Report is the effective configuration.
+type Report struct {
+	File     string   // File is the path of the configuration file, empty if there is none.
+	Entries  []Entry  // Entries are in the order the settings are declared.
+	Warnings []string // Warnings are the problems of the configuration that did not prevent loading it.
+}
+
+// Report returns the effective value of every setting and where it comes from.
+func (l *Loader) Report() Report {
+	r := Report{File: l.file.Name, Entries: make([]Entry, 0, len(l.settings)), Warnings: l.Warnings()}
+	for _, s := range l.settings {
+		value := s.Value.String()
+		switch v := s.Value.(type) {
+		case Redactor:
+			value = v.Redacted()
+		default:
+			if s.Secret && value != "" {
+				value = redacted
+			}
+		}
+		r.Entries = append(r.Entries, Entry{
+			Key:    s.Key,
+			Value:  value,
+			Origin: l.Origin(s.Key),
+			digest: sha256.Sum256([]byte(s.Value.String())),
+		})
+	}
+	return r
+}
+
+// Print writes the report as a table.
+func (r Report) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if r.File != "" {
+		fmt.Fprintf(tw, "# config file %s\n", r.File)
+	}
+	for _, w := range r.Warnings {
+		fmt.Fprintf(tw, "# warning: %s\n", w)
+	}
+	fmt.Fprintln(tw, "KEY\tVALUE\tSOURCE")
+	for _, e := range r.Entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", e.Key, e.Value, e.Origin)
+	}
+	if err := tw.Flush(); err != nil {
+		return fmt.Errorf("failed to print config: %w", err)
+	}
+	return nil
+}
+
+// Change is a setting whose value differs between two reports.
+type Change struct {
+	Key string
+	Old string // Old is the previous value, redacted like in the report.
+	New string // New is the value in effect, redacted like in the report.
+}
+
+// Diff returns the settings whose value differs from the previous report, in the order they are declared.
+func Diff(old, cur Report) []Change {
+	previous := make(map[string]Entry, len(old.Entries))
+	for _, e := range old.Entries {
+		previous[e.Key] = e
+	}
+
+	var changes []Change
+	for _, e := range cur.Entries {
+		if p, ok := previous[e.Key]; !ok || p.digest != e.digest {
+			changes = append(changes, Change{Key: e.Key, Old: p.Value, New: e.Value})
+		}
+	}
+	return changes
+}
+
+// Merge returns the report with the entries of the keys taken from cur, the report of the
+// configuration once only the settings of the keys are applied.
+func Merge(old, cur Report, keys []string) Report {
+	merged := Report{File: cur.File, Entries: slices.Clone(old.Entries), Warnings: cur.Warnings}
+	for _, e := range cur.Entries {
+		if !slices.Contains(keys, e.Key) {
+			continue
+		}
+		if i := slices.IndexFunc(merged.Entries, func(m Entry) bool { return m.Key == e.Key }); i >= 0 {
+			merged.Entries[i] = e
+		}
+	}
+	return merged
+}
@@ -0,0 +1,181 @@
+package configload
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/configfile"
+)
+
+// Value is the destination of a setting.
+type Value interface {
+	// Set parses the text of a flag or an environment variable. A flag set several times
+	// calls it once per occurrence.
+	Set(text string) error
+	// Decode decodes the value in the configuration file, converted to JSON whatever the
+	// format of the file.
+	Decode(data []byte) error
+	// String formats the value.
+	String() string
+}
+
+type stringValue struct{ p *string }
+
+// String returns the value of a string setting.
+func String(p *string) Value { return stringValue{p} }
+
+func (v stringValue) Set(text string) error    { *v.p = text; return nil }
+func (v stringValue) Decode(data []byte) error { return json.Unmarshal(data, v.p) }
+func (v stringValue) String() string           { return *v.p }
+
+type intValue struct{ p *int }
+
+// Int returns the value of an int setting.
+func Int(p *int) Value { return intValue{p} }
+
+func (v intValue) Set(text string) error {
+	i, err := strconv.Atoi(strings.TrimSpace(text))
+	if err != nil {
+		return errors.New("want an integer")
+	}
+	*v.p = i
+	return nil
+}
+func (v intValue) Decode(data []byte) error { return json.Unmarshal(data, v.p) }
+func (v intValue) String() string           { return strconv.Itoa(*v.p) }
+
+type floatValue struct{ p *float64 }
+
+// Float returns the value of a float setting.
+func Float(p *float64) Value { return floatValue{p} }
+
+func (v floatValue) Set(text string) error {
+	f, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+	if err != nil {
+		return errors.New("want a number")
+	}
+	*v.p = f
+	return nil
+}
+func (v floatValue) Decode(data []byte) error { return json.Unmarshal(data, v.p) }
+func (v floatValue) String() string           { return strconv.FormatFloat(*v.p, 'g', -1, 64) }
+
+type boolValue struct{ p *bool }
+
+// Bool returns the value of a bool setting, its flag needs no argument.
+func Bool(p *bool) Value { return boolValue{p} }
+
+func (v boolValue) Set(text string) error {
+	b, err := strconv.ParseBool(strings.TrimSpace(text))
+	if err != nil {
+		return errors.New("want true or false")
+	}
+	*v.p = b
+	return nil
+}
+func (v boolValue) Decode(data []byte) error { return json.Unmarshal(data, v.p) }
+func (v boolValue) String() string           { return strconv.FormatBool(*v.p) }
+func (v boolValue) IsBoolFlag() bool         { return true }
+
+type durationValue struct {
+	p    *time.Duration
+	unit time.Duration
+}
+
+// Duration returns the value of a duration setting. The flag and the environment variable take
+// a number of units or a duration like "1m30s", the file takes a duration.
+func Duration(p *time.Duration, unit time.Duration) Value { return durationValue{p: p, unit: unit} }
+
+func (v durationValue) Set(text string) error {
+	text = strings.TrimSpace(text)
+	if n, err := strconv.Atoi(text); err == nil {
+		*v.p = time.Duration(n) * v.unit
+		return nil
+	}
+	d, err := time.ParseDuration(text)
+	if err != nil {
+		return fmt.Errorf("want a number of %s or a duration like \"1m30s\"", unitName(v.unit))
+	}
+	*v.p = d
+	return nil
+}
+
+func (v durationValue) Decode(data []byte) error {
+	var d configfile.Duration
+	if err := json.Unmarshal(data, &d); err != nil {
+		return errors.New("want a duration like \"1m30s\"")
+	}
+	*v.p = time.Duration(d)
+	return nil
+}
+
+func (v durationValue) String() string { return v.p.String() }
+
+func unitName(unit time.Duration) string {
+	if unit == time.Millisecond {
+		return "milliseconds"
+	}
+	return "seconds"
+}
+
+type listValue struct {
+	p   *[]string
+	set *bool
+}
+
+// List returns the value of a list setting. The flag and the environment variable take a
+// comma-separated list, a flag set several times adds to the list.
+func List(p *[]string) Value { return listValue{p: p, set: new(bool)} }
+
+func (v listValue) Set(text string) error {
+	if !*v.set {
+		*v.p, *v.set = nil, true
+	}
+	for _, item := range strings.Split(text, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*v.p = append(*v.p, item)
+		}
+	}
+	return nil
+}
+func (v listValue) Decode(data []byte) error { return json.Unmarshal(data, v.p) }
+func (v listValue) String() string           { return strings.Join(*v.p, ",") }
+
+type funcValue struct {
+	p   any
+	set func(string) error
+}
+
+// Func returns the value of a setting of any type. The file is decoded into p, rejecting the
+// keys unknown to it, the text of the flag and the environment variable is passed to set.
+// A nil set makes the setting available in the file only.
+func Func(p any, set func(string) error) Value { return funcValue{p: p, set: set} }
+
+func (v funcValue) Set(text string) error {
+	if v.set == nil {
+		return errors.New("only supported in the config file")
+	}
+	return v.set(text)
+}
+func (v funcValue) Decode(data []byte) error { return configfile.Strict(data, v.p) }
+
+func (v funcValue) String() string { return FormatJSON(v.p) }
+
+// FormatJSON formats a value of any type as JSON on a line, an empty value as an empty string.
+func FormatJSON(v any) string {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	s := strings.TrimSuffix(b.String(), "\n")
+	if s == "null" || s == "[]" {
+		return ""
+	}
+	return s
+}
@@ -0,0 +1,105 @@
+// Package health runs the checks behind the liveness and readiness endpoints.
+//
+// A check tests one dependency of the program. The checks run concurrently, each one with its
+// own timeout, and the endpoint answers with a JSON report of every check and its latency.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// DefaultTimeout is the timeout of a check.
+const DefaultTimeout = 2 * time.Second
+
+// Statuses of a check and of a report.
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// Check tests a dependency.
+type Check struct {
+	Name string
+	// Run returns nil when the dependency is ready, it stops when ctx is done.
+	Run func(ctx context.Context) error
+}
+
+// Result is the outcome of a check.
+type Result struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Latency string `json:"latency"`
+}
+
+// Report is the outcome of all the checks, failed if any check failed.
+type Report struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks"`
+}
+
+// Run runs the checks concurrently, giving each one the timeout. The results are in the order
+// of the checks.
+func Run(ctx context.Context, checks []Check, timeout time.Duration) Report {
+	report := Report{Status: StatusOK, Checks: make([]Result, len(checks))}
+	wg := &sync.WaitGroup{}
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c Check) {
+			defer wg.Done()
+			report.Checks[i] = run(ctx, c, timeout)
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, r := range report.Checks {
+		if r.Status != StatusOK {
+			report.Status = StatusFail
+		}
+	}
+	return report
+}
+
+// run runs one check.
+func run(ctx context.Context, c Check, timeout time.Duration) Result {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := c.Run(ctx)
+	r := Result{Name: c.Name, Status: StatusOK, Latency: time.Since(start).String()}
+	if err != nil {
+		r.Status, r.Error = StatusFail, err.Error()
+	}
+	return r
+}
+
+// Handler serves the report of the checks returned by checks, with 503 Service Unavailable if
+// any of them failed. The failed checks are logged.
+func Handler(checks func() []Check, timeout time.Duration, log zerolog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := Run(r.Context(), checks(), timeout)
+
+		code := http.StatusOK
+		if report.Status != StatusOK {
+			code = http.StatusServiceUnavailable
+			for _, c := range report.Checks {
+				if c.Status != StatusOK {
+					log.Warn().Str("check", c.Name).Str("error", c.Error).Msg("health check failed")
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Error().Err(err).Msg("cannot encode health report")
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	ok := Check{Name: "ok", Run: func(context.Context) error { return nil }}
+	failing := Check{Name: "failing", Run: func(context.Context) error { return errors.New("unreachable") }}
+	slow := Check{Name: "slow", Run: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+
+	report := Run(context.Background(), []Check{ok, failing, slow}, 10*time.Millisecond)
+	assert.Equal(t, StatusFail, report.Status)
+	require.Len(t, report.Checks, 3)
+	assert.Equal(t, Result{Name: "ok", Status: StatusOK, Latency: report.Checks[0].Latency}, report.Checks[0])
+	assert.Equal(t, "unreachable", report.Checks[1].Error)
+	assert.Equal(t, context.DeadlineExceeded.Error(), report.Checks[2].Error)
+
+	assert.Equal(t, StatusOK, Run(context.Background(), []Check{ok}, time.Second).Status)
+	assert.Equal(t, StatusOK, Run(context.Background(), nil, time.Second).Status)
+}
+
+func TestHandler(t *testing.T) {
+	var checks []Check
+	h := Handler(func() []Check { return checks }, time.Second, zerolog.Nop())
+
+	serve := func() (int, Report) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var report Report
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&report))
+		return rec.Code, report
+	}
+
+	checks = []Check{{Name: "storage", Run: func(context.Context) error { return nil }}}
+	code, report := serve()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, StatusOK, report.Status)
+	assert.NotEmpty(t, report.Checks[0].Latency)
+
+	checks = append(checks, Check{Name: "shutdown", Run: func(context.Context) error { return errors.New("shutting down") }})
+	code, report = serve()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, StatusFail, report.Status)
+	assert.Equal(t, "shutting down", report.Checks[1].Error)
+}
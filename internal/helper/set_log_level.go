@@ -2,26 +2,23 @@
 package helper
 
 import (
+	"fmt"
+
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
-func SetGlobalLogLevel(level string) {
-	switch level {
-	case "debug":
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
-		log.Log().Msg("Set debug logLevel")
-	case "info":
-		zerolog.SetGlobalLevel(zerolog.InfoLevel)
-		log.Log().Msg("Set info logLevel")
-	case "error":
-		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
-		log.Log().Msg("Set error logLevel")
-	case "fatal":
-		zerolog.SetGlobalLevel(zerolog.FatalLevel)
-		log.Log().Msg("Set fatal logLevel")
-	default:
-		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
-		log.Log().Msgf("Invalid log level %s, defaulting to error level", level)
+// LogLevels are the supported log levels, from the most verbose.
+var LogLevels = []string{"trace", "debug", "info", "warn", "error", "fatal", "panic"}
+
+// SetGlobalLogLevel sets the level of all loggers. An invalid level is rejected and the
+// current one is kept.
+func SetGlobalLogLevel(level string) error {
+	l, err := zerolog.ParseLevel(level)
+	if err != nil || level == "" {
+		return fmt.Errorf("invalid log level %q, expected one of %v", level, LogLevels)
 	}
+	zerolog.SetGlobalLevel(l)
+	log.Log().Msgf("Set %s logLevel", l)
+	return nil
 }
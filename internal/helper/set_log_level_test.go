@@ -11,16 +11,19 @@ func TestSetGlobalLogLevel(t *testing.T) {
 		name  string
 		level string
 	}{
+		{"TraceLevel", "trace"},
 		{"DebugLevel", "debug"},
 		{"InfoLevel", "info"},
+		{"WarnLevel", "warn"},
 		{"ErrorLevel", "error"},
 		{"FatalLevel", "fatal"},
-		{"DefaultLevel", "error"}, // Testing default case
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			SetGlobalLogLevel(tt.level)
+			if err := SetGlobalLogLevel(tt.level); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
 
 			// Check if the global log level is set correctly
 			expectedLevel := zerolog.GlobalLevel()
@@ -30,4 +33,14 @@ func TestSetGlobalLogLevel(t *testing.T) {
 			}
 		})
 	}
+
+	t.Run("InvalidLevel", func(t *testing.T) {
+		_ = SetGlobalLogLevel("info")
+		if err := SetGlobalLogLevel("verbose"); err == nil {
+			t.Error("expected an error for an invalid level")
+		}
+		if zerolog.GlobalLevel() != zerolog.InfoLevel {
+			t.Errorf("expected the level to be kept, got %s", zerolog.GlobalLevel())
+		}
+	})
 }
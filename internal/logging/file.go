@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// rotatingFile is a log file rotated once larger than its maximum size and every interval.
+type rotatingFile struct {
+	*lumberjack.Logger
+	done chan struct{}
+	wg   *sync.WaitGroup
+}
+
+// openFile opens the log file of the configuration, creating its directory if needed.
+func openFile(cfg Config) (*rotatingFile, error) {
+	f := &rotatingFile{
+		Logger: &lumberjack.Logger{
+			Filename:   cfg.Output,
+			MaxSize:    cfg.MaxSize,
+			MaxBackups: cfg.MaxBackups,
+		},
+		done: make(chan struct{}),
+		wg:   &sync.WaitGroup{},
+	}
+	// The file is opened on the first write, an empty one reports the errors now.
+	if _, err := f.Write(nil); err != nil {
+		return nil, err
+	}
+
+	if cfg.RotateInterval > 0 {
+		f.wg.Add(1)
+		go f.rotate(cfg.RotateInterval)
+	}
+	return f, nil
+}
+
+// rotate rotates the file every interval until the file is closed.
+func (f *rotatingFile) rotate(interval time.Duration) {
+	defer f.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+			if err := f.Rotate(); err != nil {
+				// The logger writes to this file, the error can only go to stderr.
+				fmt.Fprintf(os.Stderr, "failed to rotate log file %s: %v\n", f.Filename, err)
+			}
+		}
+	}
+}
+
+// Close stops the rotation and closes the file.
+func (f *rotatingFile) Close() error {
+	close(f.done)
+	f.wg.Wait()
+	if err := f.Logger.Close(); err != nil {
+		return fmt.Errorf("failed to close log file %s: %w", f.Filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package logging
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/ospiem/mcollector/internal/helper"
+	"github.com/rs/zerolog"
+)
+
+// level is the body of the log level endpoint.
+type level struct {
+	Level string `json:"level"`
+}
+
+// LevelHandler serves the global log level as {"level":"info"}: GET returns it and PUT changes it
+// until the next restart or the next change of log_level in the config.
+func LevelHandler(log zerolog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var body level
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "invalid body, expected {\"level\":\"debug\"}", http.StatusBadRequest)
+				return
+			}
+			if err := helper.SetGlobalLogLevel(body.Level); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Info().Str("level", body.Level).Str("remote", r.RemoteAddr).Msg("log level changed")
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(level{Level: zerolog.GlobalLevel().String()}); err != nil {
+			log.Error().Err(err).Msg("cannot encode log level")
+		}
+	})
+}
@@ -0,0 +1,146 @@
+// Package logging builds the loggers of the agent and the server from their configuration: the
+// format of the lines, where they are written to, the rotation of the log files and the sampling
+// of repeated messages.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/configload"
+	"github.com/rs/zerolog"
+)
+
+// Formats of the log lines.
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+)
+
+// Outputs other than a file.
+const (
+	OutputStderr = "stderr"
+	OutputStdout = "stdout"
+	OutputSyslog = "syslog"
+)
+
+const defaultMaxSize = 100
+const defaultMaxBackups = 5
+const defaultSamplePeriod = time.Minute
+
+// Config configures a logger.
+type Config struct {
+	// Format is the format of the lines, json or console.
+	Format string
+	// Output is stderr, stdout, syslog, syslog+udp://host:port, syslog+tcp://host:port or the path of a file.
+	Output string
+	// MaxSize is the size in megabytes a log file is rotated at.
+	MaxSize int
+	// MaxBackups is the number of rotated files kept, 0 keeps all of them.
+	MaxBackups int
+	// RotateInterval is the interval a log file is rotated on whatever its size, 0 disables it.
+	RotateInterval time.Duration
+	// SampleBurst is the number of times a message is logged per SamplePeriod, the repeats above
+	// are dropped. 0 disables sampling.
+	SampleBurst int
+	// SamplePeriod is the period SampleBurst applies to.
+	SamplePeriod time.Duration
+}
+
+// Defaults returns the default configuration: JSON lines on stderr, without sampling.
+func Defaults() Config {
+	return Config{
+		Format:       FormatJSON,
+		Output:       OutputStderr,
+		MaxSize:      defaultMaxSize,
+		MaxBackups:   defaultMaxBackups,
+		SamplePeriod: defaultSamplePeriod,
+	}
+}
+
+// Settings declares the settings of the logger in the log section. The current values of c are
+// the defaults.
+func Settings(c *Config) []*configload.Setting {
+	return []*configload.Setting{
+		{Key: "log.format", Flag: "log-format", Env: "LOG_FORMAT", Value: configload.String(&c.Format),
+			Usage: "Configure the format of the logs: json or console",
+			Check: func() error { return configload.OneOf(c.Format, FormatJSON, FormatConsole) }},
+		{Key: "log.output", Flag: "log-output", Env: "LOG_OUTPUT", Value: configload.String(&c.Output),
+			Usage: "Configure where the logs are written: stderr, stdout, syslog, syslog+udp://host:port, " +
+				"syslog+tcp://host:port or the path of a file"},
+		{Key: "log.max_size", Flag: "log-max-size", Env: "LOG_MAX_SIZE", Value: configload.Int(&c.MaxSize),
+			Usage: "Configure the size in megabytes the log file is rotated at",
+			Check: func() error { return configload.Positive(c.MaxSize) }},
+		{Key: "log.max_backups", Flag: "log-max-backups", Env: "LOG_MAX_BACKUPS", Value: configload.Int(&c.MaxBackups),
+			Usage: "Configure the number of rotated log files kept, '0' keeps all of them",
+			Check: func() error { return configload.NotNegative(c.MaxBackups) }},
+		{Key: "log.rotate_interval", Flag: "log-rotate-interval", Env: "LOG_ROTATE_INTERVAL",
+			Value: configload.Duration(&c.RotateInterval, time.Second),
+			Usage: "Configure the interval in seconds the log file is rotated on, '0' rotates it on size only",
+			Check: func() error { return configload.NotNegative(c.RotateInterval) }},
+		{Key: "log.sample_burst", Flag: "log-sample-burst", Env: "LOG_SAMPLE_BURST", Value: configload.Int(&c.SampleBurst),
+			Usage: "Configure the number of times a message is logged per sample period, '0' logs every message",
+			Check: func() error { return configload.NotNegative(c.SampleBurst) }},
+		{Key: "log.sample_period", Flag: "log-sample-period", Env: "LOG_SAMPLE_PERIOD",
+			Value: configload.Duration(&c.SamplePeriod, time.Second),
+			Usage: "Configure the period in seconds of the log sampling",
+			Check: func() error { return configload.Positive(c.SamplePeriod) }},
+	}
+}
+
+// New returns a logger tagged with the name of the program, e.g. for syslog. Close the returned
+// closer to release the output once the logger is no longer used.
+func New(cfg Config, name string) (zerolog.Logger, io.Closer, error) {
+	w, closer, err := open(cfg, name)
+	if err != nil {
+		return zerolog.Nop(), nil, err
+	}
+	if cfg.Format == FormatConsole {
+		w = zerolog.ConsoleWriter{Out: w, TimeFormat: time.RFC3339, NoColor: !isTerminal(cfg.Output)}
+	}
+
+	logger := zerolog.New(w).With().Timestamp().Logger()
+	if cfg.SampleBurst > 0 {
+		logger = logger.Hook(newRepeatSampler(cfg.SampleBurst, cfg.SamplePeriod))
+	}
+	return logger, closer, nil
+}
+
+// open opens the output of the logs.
+func open(cfg Config, name string) (io.Writer, io.Closer, error) {
+	switch {
+	case cfg.Output == OutputStderr || cfg.Output == "":
+		return os.Stderr, nopCloser{}, nil
+	case cfg.Output == OutputStdout:
+		return os.Stdout, nopCloser{}, nil
+	case isSyslog(cfg.Output):
+		w, err := openSyslog(cfg.Output, name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open syslog: %w", err)
+		}
+		return w, w, nil
+	default:
+		f, err := openFile(cfg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open log file: %w", err)
+		}
+		return f, f, nil
+	}
+}
+
+// isSyslog reports whether the output is syslog.
+func isSyslog(output string) bool {
+	return output == OutputSyslog || strings.HasPrefix(output, OutputSyslog+"+")
+}
+
+// isTerminal reports whether the output is the terminal, which gets colored console lines.
+func isTerminal(output string) bool {
+	return output == OutputStderr || output == OutputStdout || output == ""
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
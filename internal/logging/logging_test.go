@@ -0,0 +1,99 @@
+package logging
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFile(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Defaults()
+	cfg.Output = filepath.Join(dir, "logs", "agent.log")
+	cfg.RotateInterval = 50 * time.Millisecond
+
+	logger, closer, err := New(cfg, "agent")
+	require.NoError(t, err)
+	logger.Info().Msg("before rotation")
+	require.Eventually(t, func() bool {
+		files, _ := os.ReadDir(filepath.Join(dir, "logs"))
+		return len(files) > 1
+	}, 5*time.Second, 10*time.Millisecond, "the file is rotated every interval")
+	logger.Info().Msg("after rotation")
+	require.NoError(t, closer.Close())
+
+	data, err := os.ReadFile(cfg.Output)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"message":"after rotation"`)
+	assert.NotContains(t, string(data), "before rotation")
+
+	cfg.Output = filepath.Join(dir, "agent.log", "sub")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "agent.log"), nil, 0600))
+	_, _, err = New(cfg, "agent")
+	assert.Error(t, err, "a file in the way of the directory")
+}
+
+func TestRepeatSampler(t *testing.T) {
+	var out bytes.Buffer
+	now := time.Now()
+	s := newRepeatSampler(2, time.Minute)
+	s.now = func() time.Time { return now }
+	logger := zerolog.New(&out).Hook(s)
+
+	for i := 0; i < 5; i++ {
+		logger.Error().Msg("failed to send metrics")
+	}
+	logger.Info().Msg("failed to send metrics")
+	logger.Error().Msg("cannot get metrics")
+	assert.Equal(t, 4, strings.Count(out.String(), "\n"), "the repeats above the burst are dropped")
+
+	out.Reset()
+	now = now.Add(time.Minute)
+	logger.Error().Msg("failed to send metrics")
+	assert.Equal(t, `{"level":"error","dropped":3,"message":"failed to send metrics"}`+"\n", out.String())
+}
+
+func TestRepeatSamplerIgnoresFields(t *testing.T) {
+	var out bytes.Buffer
+	s := newRepeatSampler(1, time.Minute)
+	logger := zerolog.New(&out).Hook(s)
+
+	for i := 1; i <= 3; i++ {
+		logger.Error().Dur("wait", time.Duration(i)*time.Second).Msg("cannot flush metrics, will retry")
+	}
+	assert.Equal(t, `{"level":"error","wait":1000,"message":"cannot flush metrics, will retry"}`+"\n", out.String())
+}
+
+func TestLevelHandler(t *testing.T) {
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	h := LevelHandler(zerolog.Nop())
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.JSONEq(t, `{"level":"info"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/", strings.NewReader(`{"level":"warn"}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"level":"warn"}`, w.Body.String())
+	assert.Equal(t, zerolog.WarnLevel, zerolog.GlobalLevel())
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/", strings.NewReader(`{"level":"loud"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, zerolog.WarnLevel, zerolog.GlobalLevel())
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
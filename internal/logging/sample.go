@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// maxSampled is the number of distinct messages the sampler tracks, the ones whose period is
+// over are forgotten once it is reached.
+const maxSampled = 1024
+
+// repeatSampler drops a message logged more than burst times in a period, e.g. "failed to write
+// metrics" or "queue is full, dropped the oldest batch" of an agent output for every batch while
+// its server is down. The first one logged in the next period tells how many were dropped in the
+// field "dropped". The messages are told apart by their text only, so the parts that vary
+// between repeats, such as the wait before a retry, go in fields.
+type repeatSampler struct {
+	burst  int
+	period time.Duration
+	now    func() time.Time
+	mux    *sync.Mutex
+	seen   map[repeatKey]*repeats
+}
+
+type repeatKey struct {
+	level zerolog.Level
+	msg   string
+}
+
+type repeats struct {
+	start   time.Time
+	logged  int
+	dropped int
+}
+
+func newRepeatSampler(burst int, period time.Duration) *repeatSampler {
+	return &repeatSampler{
+		burst:  burst,
+		period: period,
+		now:    time.Now,
+		mux:    &sync.Mutex{},
+		seen:   make(map[repeatKey]*repeats),
+	}
+}
+
+// Run drops the event if its message was logged too often in the period.
+func (s *repeatSampler) Run(e *zerolog.Event, level zerolog.Level, msg string) {
+	if level >= zerolog.FatalLevel {
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	now := s.now()
+	key := repeatKey{level: level, msg: msg}
+	r, ok := s.seen[key]
+	if !ok || now.Sub(r.start) >= s.period {
+		if !ok && len(s.seen) >= maxSampled {
+			s.forget(now)
+		}
+		if ok && r.dropped > 0 {
+			e.Int("dropped", r.dropped)
+		}
+		r = &repeats{start: now}
+		s.seen[key] = r
+	}
+
+	if r.logged >= s.burst {
+		r.dropped++
+		e.Discard()
+		return
+	}
+	r.logged++
+}
+
+// forget removes the messages whose period is over.
+func (s *repeatSampler) forget(now time.Time) {
+	for key, r := range s.seen {
+		if now.Sub(r.start) >= s.period {
+			delete(s.seen, key)
+		}
+	}
+}
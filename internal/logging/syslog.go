@@ -0,0 +1,31 @@
+//go:build !windows && !plan9
+
+package logging
+
+import (
+	"io"
+	"log/syslog"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// syslogWriter writes the lines to syslog with the priority of their level.
+type syslogWriter struct {
+	zerolog.LevelWriter
+	io.Closer
+}
+
+// openSyslog connects to the local syslog, or to the remote one of a syslog+udp:// or
+// syslog+tcp:// output.
+func openSyslog(output, tag string) (*syslogWriter, error) {
+	network, addr := "", ""
+	if scheme, rest, ok := strings.Cut(output, "://"); ok {
+		network, addr = strings.TrimPrefix(scheme, OutputSyslog+"+"), rest
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogWriter{LevelWriter: zerolog.SyslogLevelWriter(w), Closer: w}, nil
+}
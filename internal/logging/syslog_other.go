@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package logging
+
+import (
+	"errors"
+	"io"
+)
+
+// openSyslog fails, syslog is not available on this system.
+func openSyslog(_, _ string) (io.WriteCloser, error) {
+	return nil, errors.New("syslog is not supported on this system")
+}
@@ -1,6 +1,11 @@
 // Package models provides structures for working with metrics.
 package models
 
+import "errors"
+
+// ErrNotFound is returned by the storages when the selected metric does not exist.
+var ErrNotFound = errors.New("metric does not exist")
+
 type Metrics struct {
 	Delta *int64   `json:"delta,omitempty"` // metric value in case of counter transfer
 	Value *float64 `json:"value,omitempty"` // metric value in case of gauge transfer
@@ -0,0 +1,90 @@
+// Package reload tells when to reload the configuration: on SIGHUP and when the configuration
+// file changes.
+package reload
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/configload"
+	"github.com/rs/zerolog"
+)
+
+// FileCheckInterval is the interval the configuration file is checked for changes on.
+const FileCheckInterval = 5 * time.Second
+
+// Watch returns a channel receiving a value on SIGHUP and when the file at path changes, checked
+// every interval. An empty path watches the signal only. Reloads asked while the previous one is
+// pending are merged into it. The channel is closed once ctx is done.
+func Watch(ctx context.Context, path string, interval time.Duration, log zerolog.Logger) <-chan struct{} {
+	reloads := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case reloads <- struct{}{}:
+		default:
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var check <-chan time.Time
+	var last os.FileInfo
+	if path != "" {
+		ticker := time.NewTicker(interval)
+		check = ticker.C
+		context.AfterFunc(ctx, ticker.Stop)
+		last, _ = os.Stat(path)
+	}
+
+	go func() {
+		defer close(reloads)
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				log.Info().Msg("got SIGHUP, reloading the config")
+				notify()
+			case <-check:
+				info, err := os.Stat(path)
+				if err != nil {
+					// The file may be being replaced, it is checked again on the next tick.
+					continue
+				}
+				if changed(last, info) {
+					log.Info().Str("file", path).Msg("config file changed, reloading the config")
+					notify()
+				}
+				last = info
+			}
+		}
+	}()
+	return reloads
+}
+
+// changed reports whether the file was modified or replaced.
+func changed(last, cur os.FileInfo) bool {
+	return last == nil || !os.SameFile(last, cur) || !last.ModTime().Equal(cur.ModTime()) || last.Size() != cur.Size()
+}
+
+// LogChanges logs the settings changed by a reload, with a warning for the ones not in live, which
+// only apply after a restart.
+func LogChanges(log zerolog.Logger, changes []configload.Change, live []string) {
+	if len(changes) == 0 {
+		log.Info().Msg("config reloaded, nothing changed")
+	}
+	for _, c := range changes {
+		if slices.Contains(live, c.Key) {
+			log.Info().Str("setting", c.Key).Str("old", c.Old).Str("new", c.New).Msg("setting changed")
+			continue
+		}
+		log.Warn().Str("setting", c.Key).Str("old", c.Old).Str("new", c.New).
+			Msg("setting changed, restart to apply it")
+	}
+}
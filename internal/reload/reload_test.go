@@ -0,0 +1,60 @@
+package reload
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func receive(t *testing.T, reloads <-chan struct{}) bool {
+	t.Helper()
+	select {
+	case _, ok := <-reloads:
+		return ok
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("report_interval: 10s\n"), 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reloads := Watch(ctx, path, 10*time.Millisecond, zerolog.Nop())
+
+	select {
+	case <-reloads:
+		t.Fatal("the unchanged file must not reload")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, os.WriteFile(path, []byte("report_interval: 5s\n"), 0600))
+	assert.True(t, receive(t, reloads), "the changed file reloads")
+
+	// A file replaced by a rename, like editors and Kubernetes do, is a change too.
+	next := path + ".new"
+	require.NoError(t, os.WriteFile(next, []byte("report_interval: 1s\n"), 0600))
+	require.NoError(t, os.Rename(next, path))
+	assert.True(t, receive(t, reloads), "the replaced file reloads")
+
+	cancel()
+	_, ok := <-reloads
+	assert.False(t, ok, "the channel is closed with the context")
+}
+
+func TestWatchSignal(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloads := Watch(ctx, "", time.Hour, zerolog.Nop())
+
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	assert.True(t, receive(t, reloads))
+}
@@ -0,0 +1,96 @@
+// Package requestid ties the log lines of the agent and the server about one request together.
+//
+// The agent sends an ID with every batch in the X-Request-ID header. The server takes it, or
+// generates one, keeps it in the context of the request, adds it to the logs about the request
+// and echoes it in the response.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/rs/zerolog"
+)
+
+// Header is the HTTP header carrying the request ID.
+const Header = "X-Request-ID"
+
+// maxLength is the length of the longest ID accepted from a client.
+const maxLength = 128
+
+// idBytes is the number of random bytes of a generated ID.
+const idBytes = 16
+
+// LogField is the field of the request ID in the logs.
+const LogField = "request_id"
+
+type contextKey struct{}
+
+// New returns a random ID.
+func New() string {
+	b := make([]byte, idBytes)
+	_, _ = rand.Read(b) // Never fails, see crypto/rand.Read.
+	return hex.EncodeToString(b)
+}
+
+// NewContext returns a copy of ctx carrying the ID.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the ID carried by ctx, empty if there is none.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Logger returns log with the ID carried by ctx, log itself if there is none.
+func Logger(ctx context.Context, log zerolog.Logger) zerolog.Logger {
+	if id := FromContext(ctx); id != "" {
+		return log.With().Str(LogField, id).Logger()
+	}
+	return log
+}
+
+// Handler is a middleware taking the ID of the request from its header, or generating one if
+// the header is missing or invalid. The ID is put in the context and in the response header.
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if !valid(id) {
+			id = New()
+		}
+		w.Header().Set(Header, id)
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}
+
+// Error replies like http.Error, naming the request ID in the error message if there is one.
+func Error(w http.ResponseWriter, r *http.Request, error string, code int) {
+	if id := FromContext(r.Context()); id != "" {
+		if error != "" {
+			error += " "
+		}
+		error += "(request ID " + id + ")"
+	}
+	http.Error(w, error, code)
+}
+
+// valid reports whether the ID from a client can be logged as is: not empty, not too long and
+// made of letters, digits and the characters -_.:
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for _, c := range []byte(id) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package requestid
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	var got string
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = FromContext(r.Context())
+		Error(w, r, "Bad request", http.StatusBadRequest)
+	}))
+
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{name: "from the client", header: "0af7651916cd43dd8448eb211c80319c", keep: true},
+		{name: "missing", header: ""},
+		{name: "too long", header: strings.Repeat("a", maxLength+1)},
+		{name: "invalid characters", header: "id\nforged log line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+			req.Header.Set(Header, tt.header)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if tt.keep {
+				assert.Equal(t, tt.header, got)
+			} else {
+				assert.Len(t, got, 2*idBytes)
+			}
+			assert.Equal(t, got, rec.Header().Get(Header))
+			assert.Equal(t, "Bad request (request ID "+got+")\n", rec.Body.String())
+		})
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log := zerolog.New(&buf)
+
+	for _, ctx := range []context.Context{context.Background(), NewContext(context.Background(), "abc")} {
+		l := Logger(ctx, log)
+		l.Info().Msg("")
+	}
+
+	assert.Equal(t, "{\"level\":\"info\"}\n{\"level\":\"info\",\"request_id\":\"abc\"}\n", buf.String())
+}
+
+func TestError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	Error(rec, httptest.NewRequest(http.MethodGet, "/", nil), "Not Found", http.StatusNotFound)
+	assert.Equal(t, "Not Found\n", rec.Body.String())
+}
@@ -0,0 +1,57 @@
+package retry
+
+import (
+	"errors"
+	"net"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// IsNetworkError reports whether err was caused by a network operation.
+func IsNetworkError(err error) bool {
+	var opError *net.OpError
+	return errors.As(err, &opError)
+}
+
+// IsTransientPgError reports whether a postgres error is likely to go away on retry:
+// connection failures, serialization failures, deadlocks and a shutting down or overloaded server.
+// A network error may happen after a write was applied, so it is meant for reads, see
+// IsTransientPgWriteError for writes.
+func IsTransientPgError(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		if pgErr.Code == pgerrcode.QueryCanceled {
+			return false
+		}
+		return pgerrcode.IsConnectionException(pgErr.Code) ||
+			pgerrcode.IsInsufficientResources(pgErr.Code) ||
+			pgerrcode.IsOperatorIntervention(pgErr.Code) ||
+			pgErr.Code == pgerrcode.SerializationFailure ||
+			pgErr.Code == pgerrcode.DeadlockDetected
+	}
+
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return true
+	}
+
+	return pgconn.SafeToRetry(err) || IsNetworkError(err)
+}
+
+// IsTransientPgWriteError reports whether a postgres write failed with a transient error and was
+// not applied, so retrying it never applies it twice: the server rejected it, the connection
+// was never made, or nothing was sent.
+func IsTransientPgWriteError(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return IsTransientPgError(err)
+	}
+
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return true
+	}
+
+	return pgconn.SafeToRetry(err)
+}
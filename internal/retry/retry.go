@@ -0,0 +1,165 @@
+// Package retry provides a context-aware retry policy with exponential backoff and jitter.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Policy describes how an operation is retried.
+type Policy struct {
+	// Retryable reports whether an error may be retried. If nil, every error is retried.
+	Retryable func(err error) bool
+	// OnRetry is called before waiting for the next attempt.
+	OnRetry func(err error, wait time.Duration)
+	// InitialInterval is the wait before the first retry.
+	InitialInterval time.Duration
+	// MaxInterval caps the wait between two attempts.
+	MaxInterval time.Duration
+	// MaxElapsedTime stops retrying once the next attempt would start after it. 0 disables the limit.
+	MaxElapsedTime time.Duration
+	// Multiplier is the factor the interval grows by after each retry.
+	Multiplier float64
+	// RandomizationFactor spreads the wait randomly in [interval*(1-f), interval*(1+f)].
+	RandomizationFactor float64
+	// FullJitter makes the wait random in [0, interval], ignoring RandomizationFactor.
+	FullJitter bool
+	// MaxAttempts is the total number of attempts including the first one. 0 disables the limit.
+	MaxAttempts int
+}
+
+// permanentError wraps an error that must not be retried.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent wraps err so that Do returns it without retrying.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// afterError wraps an error whose retry must not start before a delay, e.g. the one asked
+// by the Retry-After header of an HTTP response.
+type afterError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *afterError) Error() string {
+	return e.err.Error()
+}
+
+func (e *afterError) Unwrap() error {
+	return e.err
+}
+
+// After wraps err so that Do waits at least d before the next attempt.
+func After(err error, d time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return &afterError{err: err, delay: d}
+}
+
+// Do calls op until it succeeds, returns a non-retryable error, or the policy gives up.
+// Waiting between attempts stops as soon as ctx is done. Every retry is an event of the span of ctx.
+func (p Policy) Do(ctx context.Context, op func(ctx context.Context) error) error {
+	start := time.Now()
+	interval := p.InitialInterval
+
+	for attempt := 1; ; attempt++ {
+		err := op(ctx)
+		if err == nil {
+			return nil
+		}
+
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return permanent.err
+		}
+		if p.Retryable != nil && !p.Retryable(err) {
+			return err
+		}
+		if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+			return fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		}
+
+		wait := p.randomize(interval)
+		var after *afterError
+		if errors.As(err, &after) {
+			wait = max(wait, after.delay)
+		}
+		if p.MaxElapsedTime > 0 && time.Since(start)+wait > p.MaxElapsedTime {
+			return fmt.Errorf("gave up after %v: %w", time.Since(start).Round(time.Millisecond), err)
+		}
+
+		if p.OnRetry != nil {
+			p.OnRetry(err, wait)
+		}
+		trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+			attribute.Int("attempt", attempt),
+			attribute.String("wait", wait.String()),
+			attribute.String("error", err.Error()),
+		))
+		if sleepErr := Sleep(ctx, wait); sleepErr != nil {
+			return errors.Join(sleepErr, fmt.Errorf("last attempt failed: %w", err))
+		}
+
+		interval = p.next(interval)
+	}
+}
+
+// Sleep waits for d or until ctx is done, in which case it returns the context error.
+func Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("retry interrupted: %w", ctx.Err())
+	case <-t.C:
+		return nil
+	}
+}
+
+// next returns the interval after the given one.
+func (p Policy) next(interval time.Duration) time.Duration {
+	if p.Multiplier > 0 {
+		interval = time.Duration(float64(interval) * p.Multiplier)
+	}
+	if p.MaxInterval > 0 && interval > p.MaxInterval {
+		interval = p.MaxInterval
+	}
+	return interval
+}
+
+// randomize applies the jitter to the interval.
+func (p Policy) randomize(interval time.Duration) time.Duration {
+	if p.FullJitter && interval > 0 {
+		return time.Duration(rand.Int63n(int64(interval) + 1))
+	}
+	if p.RandomizationFactor <= 0 || interval <= 0 {
+		return interval
+	}
+
+	delta := p.RandomizationFactor * float64(interval)
+	lowest := float64(interval) - delta
+	return time.Duration(lowest + rand.Float64()*(2*delta))
+}
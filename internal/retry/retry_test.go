@@ -0,0 +1,193 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var errTemporary = errors.New("temporary error")
+
+func TestPolicyDo(t *testing.T) {
+	p := Policy{InitialInterval: time.Millisecond, Multiplier: 2, MaxAttempts: 3}
+
+	t.Run("succeeds after retries", func(t *testing.T) {
+		calls := 0
+		err := p.Do(context.Background(), func(ctx context.Context) error {
+			calls++
+			if calls < 3 {
+				return errTemporary
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, calls)
+	})
+
+	t.Run("records the retries on the span", func(t *testing.T) {
+		rec := tracetest.NewSpanRecorder()
+		ctx, span := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)).Tracer("test").
+			Start(context.Background(), "insert")
+		calls := 0
+		_ = p.Do(ctx, func(ctx context.Context) error {
+			if calls++; calls < 2 {
+				return errTemporary
+			}
+			return nil
+		})
+		span.End()
+
+		events := rec.Ended()[0].Events()
+		if assert.Len(t, events, 1) {
+			assert.Equal(t, "retry", events[0].Name)
+		}
+	})
+
+	t.Run("gives up after max attempts", func(t *testing.T) {
+		calls := 0
+		err := p.Do(context.Background(), func(ctx context.Context) error {
+			calls++
+			return errTemporary
+		})
+		assert.ErrorIs(t, err, errTemporary)
+		assert.Equal(t, 3, calls)
+	})
+
+	t.Run("does not retry permanent errors", func(t *testing.T) {
+		calls := 0
+		err := p.Do(context.Background(), func(ctx context.Context) error {
+			calls++
+			return Permanent(errTemporary)
+		})
+		assert.ErrorIs(t, err, errTemporary)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("does not retry unclassified errors", func(t *testing.T) {
+		p := p
+		p.Retryable = func(err error) bool { return false }
+		calls := 0
+		err := p.Do(context.Background(), func(ctx context.Context) error {
+			calls++
+			return errTemporary
+		})
+		assert.ErrorIs(t, err, errTemporary)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("stops waiting when the context is cancelled", func(t *testing.T) {
+		p := Policy{InitialInterval: time.Hour}
+		ctx, cancel := context.WithCancel(context.Background())
+		p.OnRetry = func(err error, wait time.Duration) { cancel() }
+
+		start := time.Now()
+		err := p.Do(ctx, func(ctx context.Context) error { return errTemporary })
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.ErrorIs(t, err, errTemporary)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("waits the delay asked by the error", func(t *testing.T) {
+		p := Policy{InitialInterval: time.Millisecond, MaxAttempts: 2}
+		var waits []time.Duration
+		p.OnRetry = func(err error, wait time.Duration) { waits = append(waits, wait) }
+		calls := 0
+		err := p.Do(context.Background(), func(ctx context.Context) error {
+			if calls++; calls == 1 {
+				return After(errTemporary, 20*time.Millisecond)
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []time.Duration{20 * time.Millisecond}, waits)
+	})
+
+	t.Run("gives up after max elapsed time", func(t *testing.T) {
+		p := Policy{InitialInterval: time.Hour, MaxElapsedTime: time.Minute}
+		calls := 0
+		err := p.Do(context.Background(), func(ctx context.Context) error {
+			calls++
+			return errTemporary
+		})
+		assert.ErrorIs(t, err, errTemporary)
+		assert.Equal(t, 1, calls)
+	})
+}
+
+func TestPolicyBackoff(t *testing.T) {
+	p := Policy{InitialInterval: time.Second, Multiplier: 2, MaxInterval: 5 * time.Second}
+	interval := p.InitialInterval
+	var got []time.Duration
+	for i := 0; i < 4; i++ {
+		got = append(got, interval)
+		interval = p.next(interval)
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}, got)
+
+	p.RandomizationFactor = 0.5
+	for i := 0; i < 100; i++ {
+		wait := p.randomize(time.Second)
+		assert.GreaterOrEqual(t, wait, 500*time.Millisecond)
+		assert.LessOrEqual(t, wait, 1500*time.Millisecond)
+	}
+
+	p.FullJitter = true
+	for i := 0; i < 100; i++ {
+		wait := p.randomize(time.Second)
+		assert.GreaterOrEqual(t, wait, time.Duration(0))
+		assert.LessOrEqual(t, wait, time.Second)
+	}
+}
+
+func TestIsTransientPgError(t *testing.T) {
+	tests := []struct {
+		err  error
+		name string
+		want bool
+	}{
+		{name: "connection failure", err: &pgconn.PgError{Code: pgerrcode.ConnectionFailure}, want: true},
+		{name: "deadlock", err: &pgconn.PgError{Code: pgerrcode.DeadlockDetected}, want: true},
+		{name: "too many connections", err: &pgconn.PgError{Code: pgerrcode.TooManyConnections}, want: true},
+		{name: "wrapped admin shutdown", err: fmt.Errorf("exec: %w", &pgconn.PgError{Code: pgerrcode.AdminShutdown}), want: true},
+		{name: "network error", err: &net.OpError{Op: "dial", Err: errTemporary}, want: true},
+		{name: "check violation", err: &pgconn.PgError{Code: pgerrcode.CheckViolation}, want: false},
+		{name: "query canceled", err: &pgconn.PgError{Code: pgerrcode.QueryCanceled}, want: false},
+		{name: "plain error", err: errTemporary, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsTransientPgError(tt.err))
+		})
+	}
+}
+
+func TestIsTransientPgWriteError(t *testing.T) {
+	tests := []struct {
+		err  error
+		name string
+		want bool
+	}{
+		{name: "deadlock", err: &pgconn.PgError{Code: pgerrcode.DeadlockDetected}, want: true},
+		{name: "wrapped admin shutdown", err: fmt.Errorf("exec: %w", &pgconn.PgError{Code: pgerrcode.AdminShutdown}), want: true},
+		{name: "connect error", err: &pgconn.ConnectError{}, want: true},
+		{name: "network error after the query was sent", err: &net.OpError{Op: "read", Err: errTemporary}, want: false},
+		{name: "check violation", err: &pgconn.PgError{Code: pgerrcode.CheckViolation}, want: false},
+		{name: "plain error", err: errTemporary, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsTransientPgWriteError(tt.err))
+		})
+	}
+}
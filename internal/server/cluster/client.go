@@ -0,0 +1,125 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/ospiem/mcollector/internal/models"
+)
+
+// Paths of the internal API that nodes use to talk to each other.
+const (
+	healthPath  = "/cluster/health"
+	batchPath   = "/cluster/batch"
+	valuePath   = "/cluster/value"
+	metricsPath = "/cluster/metrics"
+)
+
+// hashHeader is the HTTP header with the HMAC-SHA256 of the request body.
+const hashHeader = "HashSHA256"
+
+// handoffHeader is the HTTP header with the ID of a counter handoff.
+const handoffHeader = "X-Cluster-Handoff"
+
+// errNotFound is returned when a peer does not have the requested metric.
+var errNotFound = errors.New("metric not found on peer")
+
+// peerClient calls the internal API of other nodes.
+type peerClient struct {
+	http *http.Client
+	key  string
+}
+
+// health checks that the node is up.
+func (c *peerClient) health(ctx context.Context, node string) error {
+	return c.do(ctx, http.MethodGet, node, healthPath, nil, nil)
+}
+
+// insertBatch stores the metrics on the node without routing them any further.
+func (c *peerClient) insertBatch(ctx context.Context, node string, metrics []models.Metrics) error {
+	return c.do(ctx, http.MethodPost, node, batchPath, metrics, nil)
+}
+
+// handOff stores the metrics on the node once, a retry with the same ID is ignored by the node.
+func (c *peerClient) handOff(ctx context.Context, node, id string, metrics []models.Metrics) error {
+	return c.send(ctx, http.MethodPost, node, batchPath, http.Header{handoffHeader: {id}}, metrics, nil)
+}
+
+// value returns the value of a metric stored on the node.
+func (c *peerClient) value(ctx context.Context, node string, m models.Metrics) (models.Metrics, error) {
+	var res models.Metrics
+	err := c.do(ctx, http.MethodPost, node, valuePath, models.Metrics{ID: m.ID, MType: m.MType}, &res)
+	return res, err
+}
+
+// metrics returns all metrics stored on the node.
+func (c *peerClient) metrics(ctx context.Context, node string) ([]models.Metrics, error) {
+	var res []models.Metrics
+	err := c.do(ctx, http.MethodGet, node, metricsPath, nil, &res)
+	return res, err
+}
+
+// do sends a signed request with an optional JSON body and decodes the JSON response into out.
+func (c *peerClient) do(ctx context.Context, method, node, path string, in, out any) error {
+	return c.send(ctx, method, node, path, nil, in, out)
+}
+
+// send is do with extra request headers.
+func (c *peerClient) send(ctx context.Context, method, node, path string, header http.Header, in, out any) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return fmt.Errorf("failed to marshal request to %s: %w", node, err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+node+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request to %s: %w", node, err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(hashHeader, sign(c.key, body))
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("request to %s failed: %w", node, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound && path == valuePath:
+		return errNotFound
+	case resp.StatusCode != http.StatusOK:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s%s returned %d: %s", node, path, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response from %s: %w", node, err)
+	}
+	return nil
+}
+
+// sign returns the hex-encoded HMAC-SHA256 of data.
+func sign(key string, data []byte) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
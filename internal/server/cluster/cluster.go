@@ -0,0 +1,531 @@
+// Package cluster provides a storage that shards metrics between several server nodes.
+//
+// Every node knows the others from a static peer list. Metric IDs are assigned to nodes
+// with a consistent hash ring built from the nodes that answer health checks. Reads and
+// writes for metrics owned by another node are forwarded to it through the internal API
+// served by Handler. When the set of live nodes changes, every node hands the metrics it
+// no longer owns over to their new owner.
+package cluster
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/rs/zerolog"
+)
+
+// defaultHealthInterval is the interval between two health checks of the peers.
+const defaultHealthInterval = 5 * time.Second
+
+// requestTimeout is the timeout of a request to a peer.
+const requestTimeout = 5 * time.Second
+
+// settlePasses is the number of health passes that hand off metrics after the ring changed,
+// which catches writes routed with the old ring while the nodes converge.
+const settlePasses = 2
+
+// handoffTTL is how long a node remembers the counter handoffs it applied. A sender retries a
+// handoff every health pass, so a retry always comes well within it.
+const handoffTTL = 10 * time.Minute
+
+// Storage is the interface of the local storage of a node.
+type Storage interface {
+	InsertGauge(ctx context.Context, k string, v float64) error
+	InsertCounter(ctx context.Context, k string, v int64) error
+	SelectGauge(ctx context.Context, k string) (float64, error)
+	SelectCounter(ctx context.Context, k string) (int64, error)
+	GetCounters(ctx context.Context) (map[string]int64, error)
+	GetGauges(ctx context.Context) (map[string]float64, error)
+	InsertBatch(ctx context.Context, metrics []models.Metrics) error
+	Ping(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// Config holds the cluster settings of a node.
+type Config struct {
+	Self           string        // Self is the host:port other nodes use to reach this node.
+	Key            string        // Key signs the requests between nodes, it is required.
+	Peers          []string      // Peers lists the host:port of every node, Self may be included.
+	HealthInterval time.Duration // HealthInterval is the interval between two health checks.
+}
+
+// Cluster is a storage that routes every metric to the node owning it.
+type Cluster struct {
+	local     Storage
+	client    *peerClient
+	ring      *Ring
+	mux       *sync.RWMutex
+	handedOff map[string]float64
+	handoffs  map[string]handoff
+	applied   map[string]time.Time
+	appliedMu *sync.Mutex
+	cancel    context.CancelFunc
+	done      chan struct{}
+	log       zerolog.Logger
+	self      string
+	peers     []string
+	interval  time.Duration
+	pending   int
+}
+
+// handoff is a counter sent to its owner and not yet subtracted locally.
+type handoff struct {
+	id    string
+	node  string
+	delta int64
+}
+
+// New creates a Cluster in front of the local storage, checks which peers are up and starts
+// watching the membership until Close is called.
+func New(ctx context.Context, local Storage, cfg Config, log zerolog.Logger) (*Cluster, error) {
+	if cfg.Self == "" {
+		return nil, errors.New("cluster node address is not set")
+	}
+	if cfg.Key == "" {
+		return nil, errors.New("cluster key is not set, the requests between nodes must be signed")
+	}
+
+	c := &Cluster{
+		local:     local,
+		client:    &peerClient{http: &http.Client{Timeout: requestTimeout}, key: cfg.Key},
+		mux:       &sync.RWMutex{},
+		handedOff: make(map[string]float64),
+		handoffs:  make(map[string]handoff),
+		applied:   make(map[string]time.Time),
+		appliedMu: &sync.Mutex{},
+		done:      make(chan struct{}),
+		log:       log.With().Str("component", "cluster").Str("node", cfg.Self).Logger(),
+		self:      cfg.Self,
+		interval:  cfg.HealthInterval,
+	}
+	if c.interval <= 0 {
+		c.interval = defaultHealthInterval
+	}
+	for _, p := range cfg.Peers {
+		p = strings.TrimSpace(p)
+		if p != "" && p != cfg.Self {
+			c.peers = append(c.peers, p)
+		}
+	}
+
+	c.ring = NewRing(append(c.alivePeers(ctx), c.self))
+	c.log.Info().Strs("nodes", c.ring.Nodes()).Msg("joined the cluster")
+
+	loopCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	c.cancel = cancel
+	go c.watchMembership(loopCtx)
+
+	return c, nil
+}
+
+// Nodes returns the nodes of the current ring.
+func (c *Cluster) Nodes() []string {
+	return c.currentRing().Nodes()
+}
+
+func (c *Cluster) InsertGauge(ctx context.Context, k string, v float64) error {
+	if owner := c.owner(k); owner != c.self {
+		return c.client.insertBatch(ctx, owner, []models.Metrics{{ID: k, MType: models.Gauge, Value: &v}})
+	}
+	if err := c.local.InsertGauge(ctx, k, v); err != nil {
+		return fmt.Errorf("cluster insert gauge: %w", err)
+	}
+	return nil
+}
+
+func (c *Cluster) InsertCounter(ctx context.Context, k string, v int64) error {
+	if owner := c.owner(k); owner != c.self {
+		return c.client.insertBatch(ctx, owner, []models.Metrics{{ID: k, MType: models.Counter, Delta: &v}})
+	}
+	if err := c.local.InsertCounter(ctx, k, v); err != nil {
+		return fmt.Errorf("cluster insert counter: %w", err)
+	}
+	return nil
+}
+
+func (c *Cluster) SelectGauge(ctx context.Context, k string) (float64, error) {
+	owner := c.owner(k)
+	if owner == c.self {
+		v, err := c.local.SelectGauge(ctx, k)
+		if err != nil {
+			return 0, fmt.Errorf("cluster select gauge: %w", err)
+		}
+		return v, nil
+	}
+
+	m, err := c.client.value(ctx, owner, models.Metrics{ID: k, MType: models.Gauge})
+	if err != nil {
+		return 0, fmt.Errorf("cluster select gauge: %w", err)
+	}
+	return *m.Value, nil
+}
+
+func (c *Cluster) SelectCounter(ctx context.Context, k string) (int64, error) {
+	owner := c.owner(k)
+	if owner == c.self {
+		v, err := c.local.SelectCounter(ctx, k)
+		if err != nil {
+			return 0, fmt.Errorf("cluster select counter: %w", err)
+		}
+		return v, nil
+	}
+
+	m, err := c.client.value(ctx, owner, models.Metrics{ID: k, MType: models.Counter})
+	if err != nil {
+		return 0, fmt.Errorf("cluster select counter: %w", err)
+	}
+	return *m.Delta, nil
+}
+
+// GetCounters returns the counters of every node. Counters left on several nodes while
+// a handoff is in progress are summed.
+func (c *Cluster) GetCounters(ctx context.Context) (map[string]int64, error) {
+	all, err := c.allMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	counters := make(map[string]int64)
+	for _, nm := range all {
+		for _, m := range nm.metrics {
+			if m.MType == models.Counter {
+				counters[m.ID] += *m.Delta
+			}
+		}
+	}
+	return counters, nil
+}
+
+// GetGauges returns the gauges of every node. If a gauge is found on several nodes,
+// the value of its owner wins.
+func (c *Cluster) GetGauges(ctx context.Context) (map[string]float64, error) {
+	all, err := c.allMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ring := c.currentRing()
+	gauges := make(map[string]float64)
+	fromOwner := make(map[string]bool)
+	for _, nm := range all {
+		for _, m := range nm.metrics {
+			if m.MType != models.Gauge || fromOwner[m.ID] {
+				continue
+			}
+			gauges[m.ID] = *m.Value
+			fromOwner[m.ID] = ring.Owner(m.ID) == nm.node
+		}
+	}
+	return gauges, nil
+}
+
+// InsertBatch splits the batch by owner and writes the parts in parallel.
+func (c *Cluster) InsertBatch(ctx context.Context, metrics []models.Metrics) error {
+	ring := c.currentRing()
+	groups := make(map[string][]models.Metrics)
+	for _, m := range metrics {
+		owner := ring.Owner(m.ID)
+		groups[owner] = append(groups[owner], m)
+	}
+
+	errs := make(chan error, len(groups))
+	wg := &sync.WaitGroup{}
+	for node, group := range groups {
+		wg.Add(1)
+		go func(node string, group []models.Metrics) {
+			defer wg.Done()
+			if node == c.self {
+				errs <- c.local.InsertBatch(ctx, group)
+				return
+			}
+			errs <- c.client.insertBatch(ctx, node, group)
+		}(node, group)
+	}
+	wg.Wait()
+	close(errs)
+
+	var joined error
+	for err := range errs {
+		joined = errors.Join(joined, err)
+	}
+	if joined != nil {
+		return fmt.Errorf("cluster insert batch: %w", joined)
+	}
+	return nil
+}
+
+func (c *Cluster) Ping(ctx context.Context) error {
+	if err := c.local.Ping(ctx); err != nil {
+		return fmt.Errorf("cluster ping: %w", err)
+	}
+	return nil
+}
+
+// Close stops watching the membership and closes the local storage.
+func (c *Cluster) Close(ctx context.Context) error {
+	c.cancel()
+	<-c.done
+
+	if err := c.local.Close(ctx); err != nil {
+		return fmt.Errorf("cluster close: %w", err)
+	}
+	return nil
+}
+
+// owner returns the node owning the metric ID.
+func (c *Cluster) owner(k string) string {
+	return c.currentRing().Owner(k)
+}
+
+func (c *Cluster) currentRing() *Ring {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.ring
+}
+
+// nodeMetrics holds the metrics stored on one node.
+type nodeMetrics struct {
+	node    string
+	metrics []models.Metrics
+}
+
+// allMetrics collects the metrics of every node of the ring, the local node comes first.
+func (c *Cluster) allMetrics(ctx context.Context) ([]nodeMetrics, error) {
+	nodes := c.currentRing().Nodes()
+	res := make([]nodeMetrics, len(nodes))
+	errs := make([]error, len(nodes))
+
+	wg := &sync.WaitGroup{}
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node string) {
+			defer wg.Done()
+			res[i].node = node
+			if node == c.self {
+				res[i].metrics, errs[i] = localMetrics(ctx, c.local)
+				return
+			}
+			res[i].metrics, errs[i] = c.client.metrics(ctx, node)
+		}(i, node)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("cluster failed to collect metrics: %w", err)
+	}
+
+	for i := range res {
+		if res[i].node == c.self {
+			res[0], res[i] = res[i], res[0]
+		}
+	}
+	return res, nil
+}
+
+// watchMembership checks the peers periodically, rebuilds the ring when the set of live
+// nodes changes and hands off the metrics this node no longer owns.
+func (c *Cluster) watchMembership(ctx context.Context) {
+	defer close(c.done)
+
+	t := time.NewTicker(c.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		ring := NewRing(append(c.alivePeers(ctx), c.self))
+		c.mux.Lock()
+		changed := !ring.Equal(c.ring)
+		if changed {
+			c.log.Info().Strs("old", c.ring.Nodes()).Strs("new", ring.Nodes()).Msg("cluster membership changed")
+			c.ring = ring
+			c.pending = settlePasses
+		}
+		pending := c.pending > 0 || len(c.handoffs) > 0
+		if c.pending > 0 {
+			c.pending--
+		}
+		c.mux.Unlock()
+
+		if pending {
+			if err := c.rebalance(ctx); err != nil {
+				c.log.Error().Err(err).Msg("failed to hand off metrics")
+			}
+		}
+	}
+}
+
+// alivePeers returns the peers that answer the health check.
+func (c *Cluster) alivePeers(ctx context.Context) []string {
+	alive := make([]bool, len(c.peers))
+	wg := &sync.WaitGroup{}
+	for i, p := range c.peers {
+		wg.Add(1)
+		go func(i int, p string) {
+			defer wg.Done()
+			if err := c.client.health(ctx, p); err != nil {
+				c.log.Debug().Err(err).Str("peer", p).Msg("peer is down")
+				return
+			}
+			alive[i] = true
+		}(i, p)
+	}
+	wg.Wait()
+
+	var res []string
+	for i, p := range c.peers {
+		if alive[i] {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// rebalance hands the local metrics owned by other nodes over to their owner. A counter is
+// moved by sending its value to the owner and subtracting it locally, so concurrent writes are
+// never lost. The handoff keeps its ID until the local subtraction succeeded and is retried with
+// the same ID to the same node, which applies it only once and hands it on if it no longer owns
+// the counter. Once that node leaves the ring, the handoff is dropped and the counter goes to its
+// current owner. A gauge is only sent if the owner does not have a newer value yet.
+func (c *Cluster) rebalance(ctx context.Context) error {
+	ring := c.currentRing()
+
+	counters, err := c.local.GetCounters(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get local counters: %w", err)
+	}
+	gauges, err := c.local.GetGauges(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get local gauges: %w", err)
+	}
+
+	var errs []error
+	moved := 0
+	for k, v := range counters {
+		h, ok := c.handoffs[k]
+		if ok && !ring.Has(h.node) {
+			c.log.Warn().Str("metric", k).Str("to", h.node).Msg("dropped the handoff to a node that left the cluster")
+			delete(c.handoffs, k)
+			ok = false
+		}
+		if !ok {
+			owner := ring.Owner(k)
+			if owner == c.self || v == 0 {
+				continue
+			}
+			h = handoff{id: newHandoffID(), node: owner, delta: v}
+			c.handoffs[k] = h
+		}
+
+		delta := h.delta
+		metrics := []models.Metrics{{ID: k, MType: models.Counter, Delta: &delta}}
+		if err := c.client.handOff(ctx, h.node, h.id, metrics); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := c.local.InsertCounter(ctx, k, -h.delta); err != nil {
+			errs = append(errs, fmt.Errorf("counter %s was handed off but not cleared locally: %w", k, err))
+			continue
+		}
+		delete(c.handoffs, k)
+		moved++
+	}
+
+	for k, v := range gauges {
+		owner := ring.Owner(k)
+		if owner == c.self {
+			delete(c.handedOff, k)
+			continue
+		}
+		if last, ok := c.handedOff[k]; ok && last == v {
+			continue
+		}
+		_, err := c.client.value(ctx, owner, models.Metrics{ID: k, MType: models.Gauge})
+		if err == nil {
+			c.handedOff[k] = v
+			continue
+		}
+		if !errors.Is(err, errNotFound) {
+			errs = append(errs, err)
+			continue
+		}
+		value := v
+		if err := c.client.insertBatch(ctx, owner, []models.Metrics{{ID: k, MType: models.Gauge, Value: &value}}); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		c.handedOff[k] = v
+		moved++
+	}
+
+	if moved > 0 {
+		c.log.Info().Int("metrics", moved).Msg("handed off metrics to their new owners")
+	}
+	return errors.Join(errs...)
+}
+
+// applyHandoff inserts the metrics of a handoff unless the handoff with this ID was already
+// applied.
+func (c *Cluster) applyHandoff(ctx context.Context, id string, metrics []models.Metrics) error {
+	c.appliedMu.Lock()
+	defer c.appliedMu.Unlock()
+
+	now := time.Now()
+	for k, at := range c.applied {
+		if now.Sub(at) > handoffTTL {
+			delete(c.applied, k)
+		}
+	}
+	if _, ok := c.applied[id]; ok {
+		c.log.Debug().Str("handoff", id).Msg("handoff was already applied")
+		return nil
+	}
+
+	if err := c.local.InsertBatch(ctx, metrics); err != nil {
+		return fmt.Errorf("failed to apply handoff %s: %w", id, err)
+	}
+	c.applied[id] = now
+	return nil
+}
+
+// newHandoffID returns a random ID of a counter handoff.
+func newHandoffID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b) // Never fails, see crypto/rand.Read.
+	return hex.EncodeToString(b)
+}
+
+// localMetrics returns all metrics of the local storage.
+func localMetrics(ctx context.Context, s Storage) ([]models.Metrics, error) {
+	counters, err := s.GetCounters(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get counters: %w", err)
+	}
+	gauges, err := s.GetGauges(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gauges: %w", err)
+	}
+
+	metrics := make([]models.Metrics, 0, len(counters)+len(gauges))
+	for k, v := range counters {
+		delta := v
+		metrics = append(metrics, models.Metrics{ID: k, MType: models.Counter, Delta: &delta})
+	}
+	for k, v := range gauges {
+		value := v
+		metrics = append(metrics, models.Metrics{ID: k, MType: models.Gauge, Value: &value})
+	}
+	return metrics, nil
+}
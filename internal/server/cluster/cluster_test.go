@@ -0,0 +1,334 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/ospiem/mcollector/internal/server/middleware/limit"
+	memorystorage "github.com/ospiem/mcollector/internal/storage/memory"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testKey = "cluster-secret"
+
+// node is a cluster node served on localhost.
+type node struct {
+	cluster *Cluster
+	local   *memorystorage.MemStorage
+	srv     *http.Server
+}
+
+// reserveAddr returns a free localhost address.
+func reserveAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+	return addr
+}
+
+// startNode serves a new node on addr until the test ends.
+func startNode(t *testing.T, addr string, peers []string) *node {
+	t.Helper()
+	ctx := context.Background()
+
+	l, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+
+	n := &node{local: memorystorage.New()}
+	n.cluster, err = New(ctx, n.local, Config{
+		Self:           addr,
+		Peers:          peers,
+		Key:            testKey,
+		HealthInterval: 20 * time.Millisecond,
+	}, zerolog.Nop())
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+	r.Mount("/cluster", n.cluster.Handler())
+	n.srv = &http.Server{Handler: r, ReadHeaderTimeout: time.Second}
+	go func() {
+		_ = n.srv.Serve(l)
+	}()
+
+	t.Cleanup(func() {
+		_ = n.srv.Close()
+		_ = n.cluster.Close(ctx)
+	})
+	return n
+}
+
+func testMetrics(n int) []models.Metrics {
+	metrics := make([]models.Metrics, 0, 2*n)
+	for i := 0; i < n; i++ {
+		delta, value := int64(i+1), float64(i)/2
+		metrics = append(metrics,
+			models.Metrics{ID: fmt.Sprintf("counter%d", i), MType: models.Counter, Delta: &delta},
+			models.Metrics{ID: fmt.Sprintf("gauge%d", i), MType: models.Gauge, Value: &value})
+	}
+	return metrics
+}
+
+func TestClusterShardsAndForwards(t *testing.T) {
+	ctx := context.Background()
+	addrs := []string{reserveAddr(t), reserveAddr(t), reserveAddr(t)}
+	nodes := []*node{startNode(t, addrs[0], addrs), startNode(t, addrs[1], addrs), startNode(t, addrs[2], addrs)}
+
+	require.Eventually(t, func() bool {
+		for _, n := range nodes {
+			if len(n.cluster.Nodes()) != len(addrs) {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+
+	metrics := testMetrics(50)
+	require.NoError(t, nodes[0].cluster.InsertBatch(ctx, metrics))
+	require.NoError(t, nodes[1].cluster.InsertCounter(ctx, "counter0", 10))
+	require.NoError(t, nodes[2].cluster.InsertGauge(ctx, "gauge0", 42))
+
+	// Every node stores a share of the metrics.
+	for _, n := range nodes {
+		local, err := n.local.GetCounters(ctx)
+		require.NoError(t, err)
+		assert.NotEmpty(t, local)
+		assert.Less(t, len(local), 50)
+	}
+
+	// Every node can read every metric.
+	for _, n := range nodes {
+		c, err := n.cluster.SelectCounter(ctx, "counter0")
+		require.NoError(t, err)
+		assert.Equal(t, int64(11), c)
+
+		g, err := n.cluster.SelectGauge(ctx, "gauge0")
+		require.NoError(t, err)
+		assert.Equal(t, float64(42), g)
+
+		_, err = n.cluster.SelectGauge(ctx, "missing")
+		assert.Error(t, err)
+
+		counters, err := n.cluster.GetCounters(ctx)
+		require.NoError(t, err)
+		assert.Len(t, counters, 50)
+		gauges, err := n.cluster.GetGauges(ctx)
+		require.NoError(t, err)
+		assert.Len(t, gauges, 50)
+	}
+}
+
+func TestClusterReadsLimitedRequestsFromEveryNode(t *testing.T) {
+	ctx := context.Background()
+	addrs := []string{reserveAddr(t), reserveAddr(t), reserveAddr(t)}
+	nodes := []*node{startNode(t, addrs[0], addrs), startNode(t, addrs[1], addrs), startNode(t, addrs[2], addrs)}
+	require.Eventually(t, func() bool {
+		for _, n := range nodes {
+			if len(n.cluster.Nodes()) != len(addrs) {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// Every node reports the requests it limited through the cluster, like the server does.
+	id := limit.LimitedMetric + ";reason=client"
+	for i, n := range nodes {
+		delta := int64(i + 1)
+		require.NoError(t, n.cluster.InsertBatch(ctx, []models.Metrics{{ID: id, MType: models.Counter, Delta: &delta}}))
+	}
+
+	// The listing and the single value agree on every node.
+	for _, n := range nodes {
+		v, err := n.cluster.SelectCounter(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, int64(6), v)
+
+		counters, err := n.cluster.GetCounters(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(6), counters[id])
+	}
+}
+
+func TestClusterRebalancesWhenNodeJoins(t *testing.T) {
+	ctx := context.Background()
+	addrs := []string{reserveAddr(t), reserveAddr(t), reserveAddr(t)}
+	first := startNode(t, addrs[0], addrs)
+	second := startNode(t, addrs[1], addrs)
+	require.Eventually(t, func() bool {
+		return len(first.cluster.Nodes()) == 2 && len(second.cluster.Nodes()) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+
+	metrics := testMetrics(50)
+	require.NoError(t, first.cluster.InsertBatch(ctx, metrics))
+
+	third := startNode(t, addrs[2], addrs)
+	require.Len(t, third.cluster.Nodes(), 3)
+	require.Eventually(t, func() bool {
+		return len(first.cluster.Nodes()) == 3 && len(second.cluster.Nodes()) == 3
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// The metrics owned by the new node are handed off to it.
+	require.Eventually(t, func() bool {
+		ring := NewRing(addrs)
+		for _, m := range metrics {
+			if ring.Owner(m.ID) != addrs[2] {
+				continue
+			}
+			if m.MType == models.Counter {
+				if v, err := third.local.SelectCounter(ctx, m.ID); err != nil || v != *m.Delta {
+					return false
+				}
+				continue
+			}
+			if v, err := third.local.SelectGauge(ctx, m.ID); err != nil || v != *m.Value {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+
+	for _, n := range []*node{first, second, third} {
+		for _, m := range metrics {
+			switch m.MType {
+			case models.Counter:
+				v, err := n.cluster.SelectCounter(ctx, m.ID)
+				require.NoError(t, err)
+				assert.Equal(t, *m.Delta, v)
+			case models.Gauge:
+				v, err := n.cluster.SelectGauge(ctx, m.ID)
+				require.NoError(t, err)
+				assert.Equal(t, *m.Value, v)
+			}
+		}
+
+		counters, err := n.cluster.GetCounters(ctx)
+		require.NoError(t, err)
+		assert.Len(t, counters, 50)
+		assert.Equal(t, int64(1), counters["counter0"])
+	}
+}
+
+func TestClusterRejectsUnsignedRequests(t *testing.T) {
+	ctx := context.Background()
+	addr := reserveAddr(t)
+	startNode(t, addr, []string{addr})
+
+	unsigned := &peerClient{http: &http.Client{Timeout: time.Second}}
+	assert.Error(t, unsigned.health(ctx, addr))
+
+	signed := &peerClient{http: &http.Client{Timeout: time.Second}, key: testKey}
+	assert.NoError(t, signed.health(ctx, addr))
+}
+
+// brokenStorage fails to read the gauges.
+type brokenStorage struct {
+	*memorystorage.MemStorage
+}
+
+func (brokenStorage) SelectGauge(context.Context, string) (float64, error) {
+	return 0, errors.New("storage is down")
+}
+
+func TestClusterValueTellsNotFoundFromFailure(t *testing.T) {
+	ctx := context.Background()
+	addr := reserveAddr(t)
+	c, err := New(ctx, brokenStorage{memorystorage.New()}, Config{Self: addr, Key: testKey, HealthInterval: time.Hour}, zerolog.Nop())
+	require.NoError(t, err)
+	defer func() {
+		_ = c.Close(ctx)
+	}()
+	r := chi.NewRouter()
+	r.Mount("/cluster", c.Handler())
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	client := &peerClient{http: &http.Client{Timeout: time.Second}, key: testKey}
+	node := strings.TrimPrefix(srv.URL, "http://")
+	_, err = client.value(ctx, node, models.Metrics{ID: "missing", MType: models.Counter})
+	assert.ErrorIs(t, err, errNotFound)
+
+	// A failed read must not look like a missing metric, which the rebalance would overwrite.
+	_, err = client.value(ctx, node, models.Metrics{ID: "Alloc", MType: models.Gauge})
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, errNotFound)
+	assert.Contains(t, err.Error(), "returned 500")
+}
+
+func TestNewNeedsKey(t *testing.T) {
+	_, err := New(context.Background(), memorystorage.New(), Config{Self: "127.0.0.1:1"}, zerolog.Nop())
+	assert.Error(t, err)
+}
+
+func TestClusterRedirectsHandoffOfLeftNode(t *testing.T) {
+	ctx := context.Background()
+	peer := reserveAddr(t)
+	p := startNode(t, peer, []string{peer})
+
+	self := reserveAddr(t)
+	local := memorystorage.New()
+	c, err := New(ctx, local, Config{Self: self, Peers: []string{peer}, Key: testKey, HealthInterval: time.Hour}, zerolog.Nop())
+	require.NoError(t, err)
+	defer func() {
+		_ = c.Close(ctx)
+	}()
+	require.ElementsMatch(t, []string{peer, self}, c.Nodes())
+
+	var ownedByPeer, ownedBySelf string
+	for i := 0; ownedByPeer == "" || ownedBySelf == ""; i++ {
+		k := fmt.Sprintf("counter%d", i)
+		if c.owner(k) == peer {
+			ownedByPeer = k
+		} else {
+			ownedBySelf = k
+		}
+	}
+	for _, k := range []string{ownedByPeer, ownedBySelf} {
+		require.NoError(t, local.InsertCounter(ctx, k, 5))
+		// The handoff was sent to a node that left before answering.
+		c.handoffs[k] = handoff{id: newHandoffID(), node: "127.0.0.1:1", delta: 5}
+	}
+
+	require.NoError(t, c.rebalance(ctx))
+	assert.Empty(t, c.handoffs)
+	v, err := p.local.SelectCounter(ctx, ownedByPeer)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), v, "the counter goes to its current owner")
+	v, err = local.SelectCounter(ctx, ownedByPeer)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), v)
+	v, err = local.SelectCounter(ctx, ownedBySelf)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), v, "the counter owned by the node stays")
+}
+
+func TestClusterAppliesHandoffOnce(t *testing.T) {
+	ctx := context.Background()
+	addr := reserveAddr(t)
+	n := startNode(t, addr, []string{addr})
+
+	client := &peerClient{http: &http.Client{Timeout: time.Second}, key: testKey}
+	delta := int64(5)
+	metrics := []models.Metrics{{ID: "handed", MType: models.Counter, Delta: &delta}}
+
+	// The second handoff is a retry after a lost response and must not be counted again.
+	require.NoError(t, client.handOff(ctx, addr, "h1", metrics))
+	require.NoError(t, client.handOff(ctx, addr, "h1", metrics))
+	require.NoError(t, client.handOff(ctx, addr, "h2", metrics))
+
+	v, err := n.local.SelectCounter(ctx, "handed")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), v)
+}
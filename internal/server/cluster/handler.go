@@ -0,0 +1,124 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ospiem/mcollector/internal/models"
+)
+
+// Handler returns the internal API that serves requests forwarded by other nodes.
+// Every request is applied to the local storage only and is never routed further.
+func (c *Cluster) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Use(c.verifySignature)
+
+	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Post("/batch", c.handleBatch)
+	r.Post("/value", c.handleValue)
+	r.Get("/metrics", c.handleMetrics)
+
+	return r
+}
+
+// verifySignature rejects requests that are not signed with the cluster key.
+func (c *Cluster) verifySignature(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !hmac.Equal([]byte(r.Header.Get(hashHeader)), []byte(sign(c.client.key, body))) {
+			http.Error(w, "Bad Request, hashes does not matched", http.StatusBadRequest)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *Cluster) handleBatch(w http.ResponseWriter, r *http.Request) {
+	logger := c.log.With().Str("func", "handleBatch").Logger()
+
+	var metrics []models.Metrics
+	if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var err error
+	if id := r.Header.Get(handoffHeader); id != "" {
+		err = c.applyHandoff(r.Context(), id, metrics)
+	} else {
+		err = c.local.InsertBatch(r.Context(), metrics)
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg("cannot insert forwarded batch")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *Cluster) handleValue(w http.ResponseWriter, r *http.Request) {
+	logger := c.log.With().Str("func", "handleValue").Logger()
+
+	var m models.Metrics
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch m.MType {
+	case models.Gauge:
+		var v float64
+		v, err = c.local.SelectGauge(r.Context(), m.ID)
+		m.Value = &v
+	case models.Counter:
+		var v int64
+		v, err = c.local.SelectCounter(r.Context(), m.ID)
+		m.Delta = &v
+	default:
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	// A node answering 404 for a metric it has would make the sender overwrite it.
+	switch {
+	case errors.Is(err, models.ErrNotFound):
+		http.NotFound(w, r)
+		return
+	case err != nil:
+		logger.Error().Err(err).Msg("cannot select forwarded metric")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, m)
+}
+
+func (c *Cluster) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	logger := c.log.With().Str("func", "handleMetrics").Logger()
+
+	metrics, err := localMetrics(r.Context(), c.local)
+	if err != nil {
+		logger.Error().Err(err).Msg("cannot list local metrics")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, metrics)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
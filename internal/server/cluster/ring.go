@@ -0,0 +1,82 @@
+package cluster
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// virtualNodes is the number of points each node gets on the ring, which evens out the key distribution.
+const virtualNodes = 128
+
+// Ring is a consistent hash ring. Adding or removing a node only moves the keys of that node.
+type Ring struct {
+	owners map[uint32]string
+	nodes  []string
+	points []uint32
+}
+
+// NewRing creates a ring with the given nodes.
+func NewRing(nodes []string) *Ring {
+	r := &Ring{owners: make(map[uint32]string, len(nodes)*virtualNodes)}
+
+	r.nodes = append(r.nodes, nodes...)
+	sort.Strings(r.nodes)
+
+	for _, n := range r.nodes {
+		for i := 0; i < virtualNodes; i++ {
+			p := crc32.ChecksumIEEE([]byte(n + "#" + strconv.Itoa(i)))
+			// On the unlikely collision the smallest node name wins, so every node builds the same ring.
+			if owner, ok := r.owners[p]; ok && owner < n {
+				continue
+			}
+			r.owners[p] = n
+		}
+	}
+
+	r.points = make([]uint32, 0, len(r.owners))
+	for p := range r.owners {
+		r.points = append(r.points, p)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+
+	return r
+}
+
+// Owner returns the node owning the key, or an empty string if the ring is empty.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// Nodes returns the sorted nodes of the ring.
+func (r *Ring) Nodes() []string {
+	return append([]string(nil), r.nodes...)
+}
+
+// Has reports whether the node is on the ring.
+func (r *Ring) Has(node string) bool {
+	i := sort.SearchStrings(r.nodes, node)
+	return i < len(r.nodes) && r.nodes[i] == node
+}
+
+// Equal reports whether both rings have the same nodes.
+func (r *Ring) Equal(other *Ring) bool {
+	if len(r.nodes) != len(other.nodes) {
+		return false
+	}
+	for i := range r.nodes {
+		if r.nodes[i] != other.nodes[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,44 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingOwner(t *testing.T) {
+	assert.Equal(t, "", NewRing(nil).Owner("PollCount"))
+
+	nodes := []string{"node1:8080", "node2:8080", "node3:8080"}
+	r := NewRing(nodes)
+	shuffled := NewRing([]string{nodes[2], nodes[0], nodes[1]})
+
+	owned := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		k := fmt.Sprintf("metric%d", i)
+		assert.Equal(t, r.Owner(k), shuffled.Owner(k), "rings with the same nodes must agree")
+		owned[r.Owner(k)]++
+	}
+
+	for _, n := range nodes {
+		assert.Greater(t, owned[n], 600, "node %s owns too few keys", n)
+		assert.True(t, shuffled.Has(n))
+	}
+	assert.False(t, r.Has("node4:8080"))
+}
+
+func TestRingMovesOnlyKeysOfChangedNode(t *testing.T) {
+	before := NewRing([]string{"node1:8080", "node2:8080", "node3:8080"})
+	after := NewRing([]string{"node1:8080", "node2:8080"})
+
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprintf("metric%d", i)
+		if before.Owner(k) != "node3:8080" {
+			assert.Equal(t, before.Owner(k), after.Owner(k))
+		}
+	}
+
+	assert.False(t, before.Equal(after))
+	assert.True(t, after.Equal(NewRing([]string{"node2:8080", "node1:8080"})))
+}
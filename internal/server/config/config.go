@@ -2,129 +2,112 @@
 package config
 
 import (
-	"encoding/json"
-	"fmt"
-	"io"
+	"errors"
+	"flag"
 	"os"
 	"time"
 
-	"github.com/caarlos0/env/v9"
+	"github.com/ospiem/mcollector/internal/configload"
+	"github.com/ospiem/mcollector/internal/logging"
+	"github.com/ospiem/mcollector/internal/server/replication"
 	storeConf "github.com/ospiem/mcollector/internal/storage/config"
-	"github.com/rs/zerolog/log"
+	"github.com/ospiem/mcollector/internal/tracing"
 )
 
 // Config represents the server configuration settings.
 type Config struct {
-	Endpoint    string           `env:"ADDRESS"`    // Endpoint is the server address.
-	Config      string           `env:"CONFIG"`     // Config is path to the config file.
-	CryptoKey   string           `env:"CRYPTO_KEY"` // CryptoKey is used to decrypt the request.
-	LogLevel    string           `env:"LOG_LEVEL"`  // LogLevel is the logging level.
-	Key         string           `env:"KEY"`        // Key is used for hashing func.
+	Endpoint    string           // Endpoint is the server address.
+	Config      string           // Config is path to the config file.
+	CryptoKey   string           // CryptoKey is used to decrypt the request.
+	LogLevel    string           // LogLevel is the logging level.
+	Key         string           // Key is used for hashing func.
 	StoreConfig storeConf.Config // StoreConfig holds configuration for storage.
+	// ClusterNode is the host:port other cluster nodes use to reach this server, defaults to Endpoint.
+	ClusterNode string
+	// ClusterPeers lists the host:port of every cluster node. Empty disables clustering.
+	ClusterPeers []string
+	// ReplicationRole is "primary" or "replica". Empty disables replication.
+	ReplicationRole string
+	// ReplicationPrimary is the host:port of the primary a replica follows.
+	ReplicationPrimary string
+	// ReplicationPromoteAfter promotes a replica once the primary is unreachable for it, 0 disables.
+	ReplicationPromoteAfter time.Duration
+	// RateLimitClient is the number of requests per second a client may send, 0 disables the limit.
+	RateLimitClient float64
+	// RateLimitRoute is the number of requests per second a route may serve, 0 disables the limit.
+	RateLimitRoute float64
+	// RateLimitTrustedProxies lists the proxies whose X-Forwarded-For header identifies the clients.
+	RateLimitTrustedProxies []string
+	// RateLimitBurst is the number of requests above the rates allowed at once, one second of requests by default.
+	RateLimitBurst int
+	// IngestConcurrency is the number of updates served at once, 0 disables the limit.
+	IngestConcurrency int
+	// IngestMaxLatency is the average duration of the updates above which load is shed, 0 disables shedding.
+	IngestMaxLatency time.Duration
+	// DrainDelay is how long the readiness fails before the server stops on shutdown.
+	DrainDelay time.Duration
+	// Log configures the format and the output of the logs.
+	Log logging.Config
+	// Tracing configures the export of the traces.
+	Tracing tracing.Config
+	// PrintConfig asks to print the Report instead of running the server.
+	PrintConfig bool
+	// Report is the effective value of every setting and where it comes from.
+	Report configload.Report
 }
 
-// JSONConfig represents the configuration settings in JSON format.
-type JSONConfig struct {
-	Endpoint      string `json:"address"`
-	StoreInterval string `json:"store_interval"`
-	StoreFile     string `json:"store_file"`
-	DatabaseDsn   string `json:"database_dsn"`
-	CryptoKey     string `json:"crypto_key"`
-	Restore       bool   `json:"restore"`
+// New creates a new instance of Config from the command line, the environment variables and
+// the configuration file (if provided).
+func New() (Config, error) {
+	return load(os.Args[1:], flag.ExitOnError)
 }
 
-// tmpDurations represents temporary durations for parsing environment variables.
-type tmpDurations struct {
-	StoreInterval int `env:"STORE_INTERVAL"`
+// Load creates a new instance of Config like New, from the arguments instead of the command line.
+func Load(args []string) (Config, error) {
+	return load(args, flag.ContinueOnError)
 }
 
-// New creates a new instance of Config by parsing environment variables and command-line flags.
-func New() (Config, error) {
-	tmp := tmpDurations{StoreInterval: -1}
-	var c Config
-	ParseFlag(&c)
-
-	// Parse the environment variables into the temporary and main configuration structs
-	err := env.Parse(&tmp)
-	if err != nil {
-		wrapErr := fmt.Errorf("parse tmp error: %w", err)
-		return c, wrapErr
+func load(args []string, handling flag.ErrorHandling) (Config, error) {
+	c := Config{
+		Endpoint:   "localhost:8080",
+		LogLevel:   "error",
+		DrainDelay: defaultDrainDelay * time.Second,
+		StoreConfig: storeConf.Config{
+			FileStoragePath: "/tmp/metrics-db.json",
+			Restore:         true,
+			StoreInterval:   defaultFlushInterval * time.Second,
+		},
+		Log:     logging.Defaults(),
+		Tracing: tracing.Defaults(),
 	}
 
-	err = env.Parse(&c)
-	if err != nil {
-		wrapErr := fmt.Errorf("new server config error: %w", err)
-		return c, wrapErr
+	l := configload.New("server", handling, c.settings())
+	if err := l.Load(args); err != nil {
+		return Config{}, err
 	}
-
-	// Convert the temporary durations to time.Duration and assign them to the main configuration
-	if tmp.StoreInterval > 0 {
-		c.StoreConfig.StoreInterval = time.Duration(tmp.StoreInterval) * time.Second
-	}
-
-	// Parse the configuration file (if provided)
-	err = c.parseConfigFileJSON()
-	if err != nil {
-		return Config{}, fmt.Errorf("failed to parse config file: %w", err)
+	if err := c.validate(l); err != nil {
+		return Config{}, err
 	}
 
+	c.Config = l.File()
+	c.PrintConfig = l.PrintRequested()
+	c.Report = l.Report()
 	return c, nil
 }
 
-// parseConfigFileJSON parses the configuration file and updates the configuration settings.
-// It only updates a setting if it has not been set by an environment variable.
-func (c *Config) parseConfigFileJSON() error {
-	if c.Config == "" {
-		return nil
+// validate checks the settings depending on each other.
+func (c *Config) validate(l *configload.Loader) error {
+	if c.ReplicationRole != "" && len(c.ClusterPeers) > 0 {
+		return l.Invalid("replication.role", errors.New("replication and clustering cannot be enabled together"))
 	}
-
-	// Open the configuration file
-	f, err := os.Open(c.Config)
-	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+	if c.ReplicationRole == string(replication.RoleReplica) && c.ReplicationPrimary == "" {
+		return l.Invalid("replication.primary", errors.New("a replica needs the primary it follows"))
 	}
-	defer func() {
-		if closeErr := f.Close(); closeErr != nil {
-			log.Printf("failed to close the file: %v", closeErr)
-		}
-	}()
-
-	// Read the configuration file
-	confFile, err := io.ReadAll(f)
-	if err != nil {
-		return fmt.Errorf("failed to read file: %w", err)
+	if c.ReplicationRole != "" && c.Key == "" {
+		return l.Invalid("security.key", errors.New("replication needs a key to sign the requests between servers"))
 	}
-
-	// Parse the configuration file into a temporary JSON configuration struct
-	tmp := JSONConfig{}
-	err = json.Unmarshal(confFile, &tmp)
-	if err != nil {
-		return fmt.Errorf("failed to parse json: %w", err)
+	if len(c.ClusterPeers) > 0 && c.Key == "" {
+		return l.Invalid("security.key", errors.New("clustering needs a key to sign the requests between nodes"))
 	}
-
-	// Update the main configuration settings with the settings from the configuration file
-	if c.Endpoint == "" {
-		c.Endpoint = tmp.Endpoint
-	}
-	if c.CryptoKey == "" {
-		c.CryptoKey = tmp.CryptoKey
-	}
-	if c.StoreConfig.FileStoragePath == "" {
-		c.StoreConfig.FileStoragePath = tmp.StoreFile
-	}
-	if !c.StoreConfig.Restore {
-		c.StoreConfig.Restore = tmp.Restore
-	}
-	if c.StoreConfig.StoreInterval == defaultFlushInterval*time.Second {
-		interval, err := time.ParseDuration(tmp.StoreInterval)
-		if err != nil {
-			return fmt.Errorf("failed to parse store interval: %w", err)
-		}
-		c.StoreConfig.StoreInterval = interval
-	}
-	if c.StoreConfig.DatabaseDsn == "" {
-		c.StoreConfig.DatabaseDsn = tmp.DatabaseDsn
-	}
-
 	return nil
 }
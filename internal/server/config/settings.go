@@ -0,0 +1,104 @@
+package config
+
+import (
+	"time"
+
+	"github.com/ospiem/mcollector/internal/configload"
+	"github.com/ospiem/mcollector/internal/helper"
+	"github.com/ospiem/mcollector/internal/logging"
+	"github.com/ospiem/mcollector/internal/server/middleware/limit"
+	"github.com/ospiem/mcollector/internal/server/replication"
+	"github.com/ospiem/mcollector/internal/tracing"
+)
+
+const defaultFlushInterval = 300
+
+const defaultDrainDelay = 5
+
+// settings declares every setting of the server with its key in the file, its flag and its
+// environment variable. The current values of c are the defaults.
+func (c *Config) settings() []*configload.Setting {
+	store := &c.StoreConfig
+	settings := []*configload.Setting{
+		{Key: "address", Flag: "a", Env: "ADDRESS", Value: configload.String(&c.Endpoint),
+			Usage: "Configure the server's host:port"},
+		{Key: "log_level", Flag: "l", Env: "LOG_LEVEL", Value: configload.String(&c.LogLevel),
+			Usage: "Configure the server's log level: trace, debug, info, warn, error, fatal or panic",
+			Check: func() error { return configload.OneOf(c.LogLevel, helper.LogLevels...) }},
+		{Key: "drain_delay", Flag: "drain-delay", Env: "DRAIN_DELAY", Value: configload.Duration(&c.DrainDelay, time.Second),
+			Usage: "Time interval in seconds the readiness fails on shutdown before the server stops",
+			Check: func() error { return configload.NotNegative(c.DrainDelay) }},
+
+		{Key: "security.key", Flag: "k", Env: "KEY", Value: configload.String(&c.Key), Secret: true,
+			Usage: "Set key for hash function"},
+		{Key: "security.crypto_key", Flag: "crypto-key", Env: "CRYPTO_KEY", Value: configload.String(&c.CryptoKey),
+			Deprecated: []string{"crypto_key"}, Usage: "define the private key"},
+
+		{Key: "storage.file", Flag: "f", Env: "FILE_STORAGE_PATH", Value: configload.String(&store.FileStoragePath),
+			Deprecated: []string{"store_file"}, Usage: "File path to store metrics"},
+		{Key: "storage.interval", Flag: "i", Env: "STORE_INTERVAL",
+			Value: configload.Duration(&store.StoreInterval, time.Second), Deprecated: []string{"store_interval"},
+			Usage: "Time interval in seconds to flush metrics to file, if set to '0' it will flush synchro",
+			Check: func() error { return configload.NotNegative(store.StoreInterval) }},
+		{Key: "storage.restore", Flag: "r", Env: "RESTORE", Value: configload.Bool(&store.Restore),
+			Deprecated: []string{"restore"}, Usage: "If true metrics will be restored from file path"},
+		{Key: "storage.database_dsn", Flag: "d", Env: "DATABASE_DSN", Value: configload.String(&store.DatabaseDsn),
+			Secret: true, Deprecated: []string{"database_dsn"}, Usage: "Set postgres DSN"},
+		{Key: "storage.redis_url", Flag: "redis", Env: "REDIS_URL", Value: configload.String(&store.RedisURL),
+			Secret: true, Usage: "Set redis URL, e.g. redis://localhost:6379/0"},
+		{Key: "storage.cache", Flag: "cache", Env: "STORAGE_CACHE", Value: configload.Bool(&store.Cache),
+			Usage: "If true reads are served from an in-memory cache of the storage"},
+		{Key: "storage.cache_ttl", Flag: "cache-ttl", Env: "STORAGE_CACHE_TTL",
+			Value: configload.Duration(&store.CacheTTL, time.Second),
+			Usage: "Time interval in seconds to reload the storage cache, '0' never reloads it",
+			Check: func() error { return configload.NotNegative(store.CacheTTL) }},
+
+		{Key: "cluster.node", Flag: "cluster-node", Env: "CLUSTER_NODE", Value: configload.String(&c.ClusterNode),
+			Usage: "Set the host:port other cluster nodes use to reach this server"},
+		{Key: "cluster.peers", Flag: "cluster-peers", Env: "CLUSTER_PEERS", Value: configload.List(&c.ClusterPeers),
+			Usage: "Set the comma-separated host:port list of all cluster nodes"},
+
+		{Key: "replication.role", Flag: "replication-role", Env: "REPLICATION_ROLE",
+			Value: configload.String(&c.ReplicationRole),
+			Usage: "Set the replication role, 'primary' or 'replica'",
+			Check: func() error {
+				return configload.OneOf(replication.Role(c.ReplicationRole), "", replication.RolePrimary, replication.RoleReplica)
+			}},
+		{Key: "replication.primary", Flag: "replication-primary", Env: "REPLICATION_PRIMARY",
+			Value: configload.String(&c.ReplicationPrimary),
+			Usage: "Set the host:port of the primary a replica follows"},
+		{Key: "replication.promote_after", Flag: "replication-promote-after", Env: "REPLICATION_PROMOTE_AFTER",
+			Value: configload.Duration(&c.ReplicationPromoteAfter, time.Second),
+			Usage: "Time interval in seconds the primary may be unreachable before the replica is promoted, '0' never promotes it",
+			Check: func() error { return configload.NotNegative(c.ReplicationPromoteAfter) }},
+
+		{Key: "limits.client_rate", Flag: "rate-limit-client", Env: "RATE_LIMIT_CLIENT",
+			Value: configload.Float(&c.RateLimitClient),
+			Usage: "Set the number of requests per second a client may send, '0' disables the limit",
+			Check: func() error { return configload.NotNegative(c.RateLimitClient) }},
+		{Key: "limits.route_rate", Flag: "rate-limit-route", Env: "RATE_LIMIT_ROUTE",
+			Value: configload.Float(&c.RateLimitRoute),
+			Usage: "Set the number of requests per second a route may serve, '0' disables the limit",
+			Check: func() error { return configload.NotNegative(c.RateLimitRoute) }},
+		{Key: "limits.trusted_proxies", Flag: "rate-limit-trusted-proxies", Env: "RATE_LIMIT_TRUSTED_PROXIES",
+			Value: configload.List(&c.RateLimitTrustedProxies),
+			Usage: "Set the comma-separated IP addresses or CIDR ranges of the proxies whose X-Forwarded-For header identifies the clients",
+			Check: func() error {
+				_, err := limit.ParseProxies(c.RateLimitTrustedProxies)
+				return err
+			}},
+		{Key: "limits.burst", Flag: "rate-limit-burst", Env: "RATE_LIMIT_BURST", Value: configload.Int(&c.RateLimitBurst),
+			Usage: "Set the number of requests above the rate limits allowed at once, '0' allows one second of requests",
+			Check: func() error { return configload.NotNegative(c.RateLimitBurst) }},
+		{Key: "limits.ingest_concurrency", Flag: "ingest-concurrency", Env: "INGEST_CONCURRENCY",
+			Value: configload.Int(&c.IngestConcurrency),
+			Usage: "Set the number of metric updates served at once, '0' disables the limit",
+			Check: func() error { return configload.NotNegative(c.IngestConcurrency) }},
+		{Key: "limits.ingest_max_latency", Flag: "ingest-max-latency", Env: "INGEST_MAX_LATENCY_MS",
+			Value: configload.Duration(&c.IngestMaxLatency, time.Millisecond),
+			Usage: "Time in milliseconds the metric updates may take on average before load is shed, '0' never sheds load",
+			Check: func() error { return configload.NotNegative(c.IngestMaxLatency) }},
+	}
+	settings = append(settings, logging.Settings(&c.Log)...)
+	return append(settings, tracing.Settings(&c.Tracing)...)
+}
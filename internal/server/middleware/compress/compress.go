@@ -7,6 +7,7 @@ import (
 	"net/http"
 
 	gzip "github.com/klauspost/compress/gzip"
+	"github.com/ospiem/mcollector/internal/requestid"
 	"github.com/rs/zerolog"
 )
 
@@ -45,6 +46,7 @@ func DecompressRequest(log zerolog.Logger) func(next http.Handler) http.Handler
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			const wrapErr = "middleware compressor"
+			log := requestid.Logger(r.Context(), log)
 
 			// If content type does not match with allowedContentTypes stop processing and return to next handler
 			if !matchContentTypes(r.Header.Values("Content-Type"), allowedContentTypes) {
@@ -64,7 +66,7 @@ func DecompressRequest(log zerolog.Logger) func(next http.Handler) http.Handler
 			decompressed, err := decompressGzip(r.Body, log)
 			if err != nil {
 				log.Error().Err(err).Msg(wrapErr)
-				http.Error(w, "failed to decompress data", http.StatusInternalServerError)
+				requestid.Error(w, r, "failed to decompress data", http.StatusInternalServerError)
 				return
 			}
 
@@ -80,6 +82,7 @@ func CompressResponse(log zerolog.Logger) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			const wrapError = "middleware compressor"
+			log := requestid.Logger(r.Context(), log)
 
 			// If client does not support compressed body stop processing and return to next handler
 			if !matchCompressFunc(r.Header.Values("Accept-Encoding"), compressFunc) {
@@ -9,6 +9,7 @@ import (
 	"io"
 	"net/http"
 
+	"github.com/ospiem/mcollector/internal/requestid"
 	"github.com/rs/zerolog"
 )
 
@@ -22,7 +23,7 @@ const hashHeader = "HashSHA256"
 func VerifyRequestBodyIntegrity(log zerolog.Logger, key string) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			l := log.With().Str("middleware", "VerifyRequestBodyIntegrity").Logger()
+			l := requestid.Logger(r.Context(), log).With().Str("middleware", "VerifyRequestBodyIntegrity").Logger()
 
 			hash := r.Header.Get(hashHeader)
 			if hash == "" {
@@ -32,7 +33,7 @@ func VerifyRequestBodyIntegrity(log zerolog.Logger, key string) func(next http.H
 
 			b, err := io.ReadAll(r.Body)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+				requestid.Error(w, r, err.Error(), http.StatusBadRequest)
 			}
 			r.Body = io.NopCloser(bytes.NewBuffer(b))
 			defer func() {
@@ -44,12 +45,44 @@ func VerifyRequestBodyIntegrity(log zerolog.Logger, key string) func(next http.H
 			h := hmac.New(sha256.New, []byte(key))
 			_, err = h.Write(b)
 			if err != nil {
-				http.Error(w, "", http.StatusInternalServerError)
+				requestid.Error(w, r, "", http.StatusInternalServerError)
 			}
 
 			curHash := hex.EncodeToString(h.Sum(nil))
 			if hash != curHash {
-				http.Error(w, "Bad Request, hashes does not matched", http.StatusBadRequest)
+				requestid.Error(w, r, "Bad Request, hashes does not matched", http.StatusBadRequest)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireSignature returns a middleware that rejects the requests whose body is not signed with
+// the key in the HTTP header, all of them if the key is empty.
+func RequireSignature(log zerolog.Logger, key string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			l := requestid.Logger(r.Context(), log).With().Str("middleware", "RequireSignature").Logger()
+
+			if key == "" {
+				requestid.Error(w, r, "Forbidden, the server has no key to verify the request", http.StatusForbidden)
+				return
+			}
+
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+				requestid.Error(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewBuffer(b))
+
+			h := hmac.New(sha256.New, []byte(key))
+			h.Write(b)
+			if !hmac.Equal([]byte(r.Header.Get(hashHeader)), []byte(hex.EncodeToString(h.Sum(nil)))) {
+				l.Warn().Str("remote", r.RemoteAddr).Msg("rejected a request without a valid signature")
+				requestid.Error(w, r, "Forbidden, the request is not signed", http.StatusForbidden)
 				return
 			}
 
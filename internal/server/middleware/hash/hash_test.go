@@ -65,3 +65,37 @@ func TestVerifyRequestBodyIntegrity(t *testing.T) {
 		})
 	}
 }
+
+func TestRequireSignature(t *testing.T) {
+	body := []byte(`{"level":"trace"}`)
+	tests := []struct {
+		name string
+		key  string
+		hash string
+		want int
+	}{
+		{name: "signed", key: "secret", hash: "1a143ca6752e15e64e36ef0f8633736fb341b877ea9f49de15370588359ba603", want: http.StatusOK},
+		{name: "signed with another key", key: "other", hash: "1a143ca6752e15e64e36ef0f8633736fb341b877ea9f49de15370588359ba603",
+			want: http.StatusForbidden},
+		{name: "unsigned", key: "secret", want: http.StatusForbidden},
+		{name: "no key", want: http.StatusForbidden},
+	}
+
+	l := zerolog.Nop()
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodPut, "/debug/loglevel", bytes.NewReader(body))
+			request.Header.Set(hashHeader, tc.hash)
+
+			handler := RequireSignature(l, tc.key)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			handler.ServeHTTP(w, request)
+
+			if w.Code != tc.want {
+				t.Errorf("expected status code %d, got %d", tc.want, w.Code)
+			}
+		})
+	}
+}
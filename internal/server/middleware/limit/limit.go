@@ -0,0 +1,233 @@
+// Package limit provides middleware protecting the server from clients sending too many requests.
+//
+// RateLimit applies token bucket rate limits, e.g. per client or per route, and Shedder limits
+// the requests served at once and sheds load while they slow down. A limited request gets a
+// 429 response with a Retry-After header right away, and is counted in Counters by reason.
+package limit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/ospiem/mcollector/internal/requestid"
+	"github.com/rs/zerolog"
+)
+
+// Reasons a request is limited for, reported as the reason tag of the limited requests counter.
+const (
+	ReasonClient      = "client"      // ReasonClient is the rate limit of a client.
+	ReasonRoute       = "route"       // ReasonRoute is the rate limit of a route.
+	ReasonConcurrency = "concurrency" // ReasonConcurrency is the limit of the requests served at once.
+	ReasonLatency     = "latency"     // ReasonLatency is the load shed while the requests are slow.
+)
+
+// LimitedMetric is the ID of the counter of the limited requests, tagged with the reason.
+const LimitedMetric = "server.requests_limited"
+
+// pruneInterval is the interval the idle buckets are removed on.
+const pruneInterval = time.Minute
+
+// bucket holds the tokens of a key.
+type bucket struct {
+	last   time.Time
+	tokens float64
+}
+
+// Rate is a set of token buckets, one per key, refilled at the same rate.
+type Rate struct {
+	now     func() time.Time
+	mux     *sync.Mutex
+	buckets map[string]*bucket
+	pruned  time.Time
+	rate    float64
+	burst   float64
+}
+
+// NewRate creates buckets refilled with rate tokens per second and holding up to burst tokens.
+// A burst below 1 holds one second of tokens.
+func NewRate(rate float64, burst int) *Rate {
+	b := float64(burst)
+	if burst < 1 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &Rate{
+		now:     time.Now,
+		mux:     &sync.Mutex{},
+		buckets: make(map[string]*bucket),
+		rate:    rate,
+		burst:   b,
+	}
+}
+
+// Allow takes a token from the bucket of the key. If the bucket is empty, it returns false
+// and the time until the next token.
+func (l *Rate) Allow(key string) (time.Duration, bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{last: now, tokens: l.burst}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// prune removes the buckets refilled to the burst, which are the same as new ones.
+func (l *Rate) prune(now time.Time) {
+	if now.Sub(l.pruned) < pruneInterval {
+		return
+	}
+	l.pruned = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// ClientIP identifies the client of a request by its IP address.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ParseProxies parses the IP addresses and the CIDR ranges of the trusted proxies.
+func ParseProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, p := range proxies {
+		if addr, err := netip.ParseAddr(p); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q, want an IP address or a CIDR range", p)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// ClientIPBehind identifies the client of a request by its IP address like ClientIP. For the
+// requests of the trusted proxies, e.g. a load balancer, it is the last address of the
+// X-Forwarded-For header that is not a trusted proxy.
+func ClientIPBehind(proxies []netip.Prefix) func(r *http.Request) string {
+	trusted := func(ip string) bool {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return false
+		}
+		addr = addr.Unmap()
+		for _, p := range proxies {
+			if p.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(r *http.Request) string {
+		ip := ClientIP(r)
+		if !trusted(ip) {
+			return ip
+		}
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if _, err := netip.ParseAddr(hop); err != nil {
+				// A hop that is not an address cannot be trusted, keep the last known one.
+				return ip
+			}
+			ip = hop
+			if !trusted(ip) {
+				return ip
+			}
+		}
+		return ip
+	}
+}
+
+// Route identifies the route of a request by its method and the first segment of its path,
+// e.g. "POST /update" for all the routes updating a single metric.
+func Route(r *http.Request) string {
+	segment, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	return r.Method + " /" + segment
+}
+
+// RateLimit returns a middleware rejecting the requests whose key has no token left.
+func RateLimit(l *Rate, key func(r *http.Request) string, reason string, c *Counters,
+	log zerolog.Logger) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			k := key(r)
+			if wait, ok := l.Allow(k); !ok {
+				l := requestid.Logger(r.Context(), log)
+				l.Debug().Str("key", k).Str("reason", reason).Msg("request rate limited")
+				reject(w, r, c, reason, wait)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// reject replies 429 with the time to wait before retrying, rounded up to a second.
+func reject(w http.ResponseWriter, r *http.Request, c *Counters, reason string, wait time.Duration) {
+	c.add(reason)
+	seconds := max(1, int(math.Ceil(wait.Seconds())))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	requestid.Error(w, r, "Too Many Requests, limited by "+reason, http.StatusTooManyRequests)
+}
+
+// Counters counts the limited requests by reason.
+type Counters struct {
+	mux    *sync.Mutex
+	counts map[string]int64
+}
+
+// NewCounters creates empty Counters.
+func NewCounters() *Counters {
+	return &Counters{mux: &sync.Mutex{}, counts: make(map[string]int64)}
+}
+
+func (c *Counters) add(reason string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.counts[reason]++
+}
+
+// Flush returns the requests limited since the previous flush as counters named
+// "server.requests_limited;reason=<reason>".
+func (c *Counters) Flush() []models.Metrics {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	metrics := make([]models.Metrics, 0, len(c.counts))
+	for reason, n := range c.counts {
+		metrics = append(metrics, models.Metrics{ID: LimitedMetric + ";reason=" + reason, MType: models.Counter, Delta: &n})
+	}
+	c.counts = make(map[string]int64)
+	return metrics
+}
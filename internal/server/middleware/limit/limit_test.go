@@ -0,0 +1,180 @@
+package limit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRate(t *testing.T) {
+	l := NewRate(2, 3)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		_, ok := l.Allow("a")
+		require.True(t, ok, "the burst is allowed")
+	}
+	wait, ok := l.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	_, ok = l.Allow("b")
+	assert.True(t, ok, "every key has its own bucket")
+
+	now = now.Add(500 * time.Millisecond)
+	_, ok = l.Allow("a")
+	assert.True(t, ok, "the bucket is refilled at the rate")
+
+	now = now.Add(time.Hour)
+	l.prune(now)
+	assert.Empty(t, l.buckets, "the full buckets are removed")
+}
+
+func TestRateDefaultBurst(t *testing.T) {
+	assert.Equal(t, 5.0, NewRate(4.5, 0).burst)
+	assert.Equal(t, 1.0, NewRate(0.1, 0).burst)
+}
+
+func TestRoute(t *testing.T) {
+	tests := []struct {
+		method string
+		target string
+		want   string
+	}{
+		{method: http.MethodPost, target: "/updates/", want: "POST /updates"},
+		{method: http.MethodPost, target: "/update/gauge/Alloc/1", want: "POST /update"},
+		{method: http.MethodGet, target: "/", want: "GET /"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, Route(httptest.NewRequest(tt.method, tt.target, nil)))
+	}
+}
+
+func TestClientIPBehind(t *testing.T) {
+	proxies, err := ParseProxies([]string{"10.0.0.1", "192.168.0.0/24"})
+	require.NoError(t, err)
+	key := ClientIPBehind(proxies)
+
+	tests := []struct {
+		name    string
+		remote  string
+		forward []string
+		want    string
+	}{
+		{name: "direct client", remote: "203.0.113.7:1000", want: "203.0.113.7"},
+		{name: "untrusted forward", remote: "203.0.113.7:1000", forward: []string{"198.51.100.1"}, want: "203.0.113.7"},
+		{name: "trusted proxy", remote: "10.0.0.1:1000", forward: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "chain of proxies", remote: "10.0.0.1:1000", forward: []string{"6.6.6.6, 198.51.100.1", "192.168.0.5"},
+			want: "198.51.100.1"},
+		{name: "invalid hop", remote: "10.0.0.1:1000", forward: []string{"198.51.100.1, unknown"}, want: "10.0.0.1"},
+		{name: "no header", remote: "10.0.0.1:1000", want: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+			req.RemoteAddr = tt.remote
+			for _, f := range tt.forward {
+				req.Header.Add("X-Forwarded-For", f)
+			}
+			assert.Equal(t, tt.want, key(req))
+		})
+	}
+
+	_, err = ParseProxies([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+}
+
+func TestRateLimit(t *testing.T) {
+	c := NewCounters()
+	h := RateLimit(NewRate(1, 1), ClientIP, ReasonClient, c, zerolog.Nop())(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	send := func(remote string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+		req.RemoteAddr = remote
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, send("10.0.0.1:1000").Code)
+	rec := send("10.0.0.1:2000")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code, "the client is limited on all its connections")
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, send("10.0.0.2:1000").Code)
+
+	metrics := c.Flush()
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "server.requests_limited;reason=client", metrics[0].ID)
+	assert.Equal(t, int64(1), *metrics[0].Delta)
+	assert.Empty(t, c.Flush())
+}
+
+func TestShedConcurrency(t *testing.T) {
+	c := NewCounters()
+	release := make(chan struct{})
+	started := &sync.WaitGroup{}
+	started.Add(2)
+	h := Shed(NewShedder(2, 0), c, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started.Done()
+		<-release
+	}))
+
+	done := &sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/updates/", nil))
+		}()
+	}
+	started.Wait()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/updates/", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+
+	close(release)
+	done.Wait()
+	metrics := c.Flush()
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "server.requests_limited;reason=concurrency", metrics[0].ID)
+}
+
+func TestShedLatency(t *testing.T) {
+	s := NewShedder(8, 100*time.Millisecond)
+	for i := 0; i < 20; i++ {
+		_, ok := s.acquire()
+		require.True(t, ok)
+		s.release(time.Second)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, ok := s.acquire()
+		require.True(t, ok, "a quarter of the requests are still served")
+	}
+	reason, ok := s.acquire()
+	assert.False(t, ok)
+	assert.Equal(t, ReasonLatency, reason)
+
+	// The average comes back down as the served requests get faster.
+	s.release(time.Millisecond)
+	s.release(time.Millisecond)
+	for i := 0; i < 20; i++ {
+		_, ok := s.acquire()
+		require.True(t, ok)
+		s.release(time.Millisecond)
+	}
+	for i := 0; i < 8; i++ {
+		_, ok := s.acquire()
+		require.True(t, ok, "all the requests are served again")
+	}
+}
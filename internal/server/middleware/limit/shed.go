@@ -0,0 +1,81 @@
+package limit
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/requestid"
+	"github.com/rs/zerolog"
+)
+
+// shedRetryAfter is the wait asked from the clients of a shed request.
+const shedRetryAfter = time.Second
+
+// latencyWeight is the weight of a request in the average latency.
+const latencyWeight = 0.2
+
+// shedFactor divides the requests served at once while the latency is above the maximum.
+const shedFactor = 4
+
+// Shedder limits the requests served at once and sheds load while they take too long,
+// e.g. because the storage slows down.
+type Shedder struct {
+	mux         *sync.Mutex
+	maxInflight int
+	maxLatency  time.Duration
+	inflight    int
+	// latency is the moving average of the duration of the requests.
+	latency time.Duration
+}
+
+// NewShedder creates a Shedder serving up to maxInflight requests at once, 0 disables the limit.
+// While the average duration of the requests is above maxLatency, only a quarter of them are
+// served at once, or one if the number is not limited. A maxLatency of 0 disables the shedding.
+func NewShedder(maxInflight int, maxLatency time.Duration) *Shedder {
+	return &Shedder{mux: &sync.Mutex{}, maxInflight: maxInflight, maxLatency: maxLatency}
+}
+
+// acquire reserves a place for a request. It returns the reason the request is limited for
+// if there is none.
+func (s *Shedder) acquire() (string, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	limit, reason := s.maxInflight, ReasonConcurrency
+	if s.maxLatency > 0 && s.latency > s.maxLatency {
+		limit, reason = max(1, s.maxInflight/shedFactor), ReasonLatency
+	}
+	if limit > 0 && s.inflight >= limit {
+		return reason, false
+	}
+	s.inflight++
+	return "", true
+}
+
+// release frees the place of a request that took d.
+func (s *Shedder) release(d time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.inflight--
+	s.latency += time.Duration(latencyWeight * float64(d-s.latency))
+}
+
+// Shed returns a middleware rejecting the requests the shedder has no place for.
+func Shed(s *Shedder, c *Counters, log zerolog.Logger) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reason, ok := s.acquire()
+			if !ok {
+				l := requestid.Logger(r.Context(), log)
+				l.Debug().Str("reason", reason).Msg("request shed")
+				reject(w, r, c, reason, shedRetryAfter)
+				return
+			}
+
+			start := time.Now()
+			defer func() { s.release(time.Since(start)) }()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
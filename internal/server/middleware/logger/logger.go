@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/ospiem/mcollector/internal/requestid"
 	"github.com/rs/zerolog"
 
 	"github.com/go-chi/chi/v5/middleware"
@@ -22,7 +23,8 @@ func RequestLogger(log zerolog.Logger) func(next http.Handler) http.Handler {
 			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
 
 			defer func() {
-				log.Info().
+				l := requestid.Logger(r.Context(), log)
+				l.Info().
 					Str("URI", uri).
 					Str("Method", method).
 					Str("Duration", time.Since(start).String()).
@@ -3,14 +3,17 @@ package ssl
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 
 	"github.com/ethereum/go-ethereum/crypto/ecies"
+	"github.com/ospiem/mcollector/internal/requestid"
 	"github.com/rs/zerolog"
 )
 
@@ -41,24 +44,45 @@ func ParsePrivateKey(path string) (*ecies.PrivateKey, error) {
 	return privatekeyECIES, nil
 }
 
+// CheckPrivateKey checks that the private key decrypts what is encrypted with its public key.
+func CheckPrivateKey(privkey *ecies.PrivateKey) error {
+	if privkey == nil {
+		return errors.New("private key is not loaded")
+	}
+
+	probe := []byte("probe")
+	cyphertext, err := ecies.Encrypt(rand.Reader, &privkey.PublicKey, probe, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt with the public key: %w", err)
+	}
+	plaintext, err := privkey.Decrypt(cyphertext, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt with the private key: %w", err)
+	}
+	if !bytes.Equal(plaintext, probe) {
+		return errors.New("private key does not decrypt what its public key encrypts")
+	}
+	return nil
+}
+
 // Terminate is a middleware function that decrypts the body of incoming HTTP requests.
 // It reads the body of the request, decrypts it using the provided private key,
 // and then replaces the original body with the decrypted data.
 func Terminate(log zerolog.Logger, privkey *ecies.PrivateKey) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			l := log.With().Str("middleware", "TerminateSSL").Logger()
+			l := requestid.Logger(r.Context(), log).With().Str("middleware", "TerminateSSL").Logger()
 
 			cyphertext, err := io.ReadAll(r.Body)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+				requestid.Error(w, r, err.Error(), http.StatusBadRequest)
 				l.Debug().Msg("failed to read the body")
 				return
 			}
 
 			plaintext, err := privkey.Decrypt(cyphertext, nil, nil)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+				requestid.Error(w, r, err.Error(), http.StatusBadRequest)
 				l.Debug().Msg("failed to decrypt the body")
 				return
 			}
@@ -27,6 +27,19 @@ dIm8OZfjEa610lCZyPcBBKVLZHfwIGw=
 	os.Remove("/tmp/key.pem")
 }
 
+func TestCheckPrivateKey(t *testing.T) {
+	privkey, err := ecies.GenerateKey(rand.Reader, ecies.DefaultCurve, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, CheckPrivateKey(privkey))
+	assert.Error(t, CheckPrivateKey(nil))
+
+	other, err := ecies.GenerateKey(rand.Reader, ecies.DefaultCurve, nil)
+	assert.NoError(t, err)
+	mismatched := *privkey
+	mismatched.PublicKey = other.PublicKey
+	assert.Error(t, CheckPrivateKey(&mismatched))
+}
+
 func TestTerminateMiddlewareWithInvalidBody(t *testing.T) {
 	log := zerolog.Nop()
 	privkey, _ := ecies.GenerateKey(rand.Reader, ecies.DefaultCurve, nil)
@@ -0,0 +1,64 @@
+package tracing_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/ospiem/mcollector/internal/server/middleware/tracing"
+)
+
+func TestTracing(t *testing.T) {
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	defer otel.SetTextMapPropagator(otel.GetTextMapPropagator())
+	rec := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	pass := func(next http.Handler) http.Handler { return next }
+	reject := func(http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "bad hash", http.StatusBadRequest)
+		})
+	}
+	r := chi.NewRouter()
+	r.Use(tracing.Handler)
+	r.With(tracing.Middleware("pass", pass)).Post("/update/{mType}", func(w http.ResponseWriter, r *http.Request) {
+		_, span := otel.Tracer("test").Start(r.Context(), "handler")
+		span.End()
+	})
+	r.With(tracing.Middleware("reject", reject)).Post("/updates/", func(w http.ResponseWriter, r *http.Request) {})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodPost, "/update/gauge", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := rec.Ended()
+	require.Len(t, spans, 3)
+	byName := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range spans {
+		byName[s.Name()] = s
+	}
+	request := byName["POST /update/{mType}"]
+	require.NotNil(t, request)
+	assert.Equal(t, traceID, request.SpanContext().TraceID().String(), "the trace of the caller goes on")
+	assert.Equal(t, request.SpanContext().SpanID(), byName["pass"].Parent().SpanID())
+	assert.Equal(t, request.SpanContext().SpanID(), byName["handler"].Parent().SpanID(),
+		"the handler runs in the span of the request, not of the middleware")
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/updates/", nil))
+	spans = rec.Ended()
+	require.Len(t, spans, 5)
+	assert.Equal(t, "reject", spans[3].Name())
+	assert.Equal(t, codes.Error, spans[3].Status().Code)
+}
@@ -0,0 +1,192 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/ospiem/mcollector/internal/retry"
+)
+
+// missedHeartbeats is the number of heartbeats a replica waits for before it drops the stream.
+const missedHeartbeats = 3
+
+// follow streams the writes of the primary and reconnects when the stream breaks, until ctx is done.
+// It returns true if the replica has to be promoted because the primary is unreachable for too long.
+func (r *Replicator) follow(ctx context.Context) bool {
+	for {
+		err := r.stream(ctx)
+		if ctx.Err() != nil {
+			return false
+		}
+
+		r.mux.Lock()
+		wasConnected, contactAt := r.connected, r.contactAt
+		r.connected = false
+		r.mux.Unlock()
+
+		if wasConnected {
+			r.log.Error().Err(err).Msg("lost the primary")
+		} else {
+			r.log.Debug().Err(err).Msg("primary is unreachable")
+		}
+
+		if r.cfg.PromoteAfter > 0 && time.Since(contactAt) >= r.cfg.PromoteAfter {
+			r.log.Warn().Dur("since", time.Since(contactAt)).Msg("primary is gone, promoting the replica")
+			return true
+		}
+		if err := retry.Sleep(ctx, r.cfg.HeartbeatInterval); err != nil {
+			return false
+		}
+	}
+}
+
+// stream applies the frames sent by the primary until the stream breaks or the primary stays silent.
+func (r *Replicator) stream(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	timeout := missedHeartbeats * r.cfg.HeartbeatInterval
+	watchdog := time.AfterFunc(timeout, cancel)
+	defer watchdog.Stop()
+
+	r.mux.RLock()
+	run, after := r.appliedRun, r.applied
+	r.mux.RUnlock()
+
+	q := url.Values{}
+	q.Set("run", run)
+	q.Set("after", fmt.Sprint(after))
+	q.Set("node", r.cfg.Self)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+r.cfg.Primary+streamPath+"?"+q.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create stream request: %w", err)
+	}
+	signRequest(req, r.cfg.Key, nil)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("stream request failed: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("primary returned %d: %s", resp.StatusCode, msg)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var f frame
+		if err := dec.Decode(&f); err != nil {
+			return fmt.Errorf("stream from the primary broke: %w", err)
+		}
+		watchdog.Reset(timeout)
+
+		if err := r.apply(ctx, f); err != nil {
+			return err
+		}
+		watchdog.Reset(timeout)
+	}
+}
+
+// apply applies a frame of the stream to the local storage.
+func (r *Replicator) apply(ctx context.Context, f frame) error {
+	r.mux.RLock()
+	run, applied := r.appliedRun, r.applied
+	r.mux.RUnlock()
+
+	switch f.Type {
+	case frameSnapshot:
+		if err := r.restore(ctx, f.Metrics); err != nil {
+			return fmt.Errorf("failed to apply snapshot: %w", err)
+		}
+		r.log.Info().Str("run", f.Run).Uint64("seq", f.Seq).Int("metrics", len(f.Metrics)).
+			Msg("applied snapshot of the primary")
+		run, applied = f.Run, f.Seq
+	case frameEntry:
+		if f.Run != run {
+			return fmt.Errorf("got write %d of run %s from the primary, applied run %s", f.Seq, f.Run, run)
+		}
+		if f.Seq <= applied {
+			break
+		}
+		if f.Seq != applied+1 {
+			return fmt.Errorf("expected write %d from the primary, got %d", applied+1, f.Seq)
+		}
+		if err := r.local.InsertBatch(ctx, f.Metrics); err != nil {
+			return fmt.Errorf("failed to apply write %d: %w", f.Seq, err)
+		}
+		applied = f.Seq
+	case frameHeartbeat:
+	default:
+		return fmt.Errorf("unknown frame type %q", f.Type)
+	}
+
+	now := time.Now()
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.appliedRun, r.applied = run, applied
+	r.primaryHead = f.Head
+	r.contactAt = now
+	r.connected = true
+	if applied >= f.Head {
+		r.syncedAt = now
+	}
+	return nil
+}
+
+// restore makes the local storage match the snapshot. Counters are corrected by their difference
+// to the snapshot, the metrics missing from it are deleted.
+func (r *Replicator) restore(ctx context.Context, snapshot []models.Metrics) error {
+	counters, err := r.local.GetCounters(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get counters: %w", err)
+	}
+	gauges, err := r.local.GetGauges(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get gauges: %w", err)
+	}
+
+	batch := make([]models.Metrics, 0, len(snapshot))
+	for _, m := range snapshot {
+		switch m.MType {
+		case models.Counter:
+			delta := *m.Delta - counters[m.ID]
+			delete(counters, m.ID)
+			if delta != 0 {
+				batch = append(batch, models.Metrics{ID: m.ID, MType: models.Counter, Delta: &delta})
+			}
+		case models.Gauge:
+			delete(gauges, m.ID)
+			batch = append(batch, m)
+		}
+	}
+
+	stale := make([]models.Metrics, 0, len(counters)+len(gauges))
+	for k := range counters {
+		stale = append(stale, models.Metrics{ID: k, MType: models.Counter})
+	}
+	for k := range gauges {
+		stale = append(stale, models.Metrics{ID: k, MType: models.Gauge})
+	}
+	if len(stale) > 0 {
+		if err := r.local.DeleteMetrics(ctx, stale); err != nil {
+			return fmt.Errorf("failed to delete metrics: %w", err)
+		}
+	}
+
+	if len(batch) == 0 {
+		return nil
+	}
+	if err := r.local.InsertBatch(ctx, batch); err != nil {
+		return fmt.Errorf("failed to insert batch: %w", err)
+	}
+	return nil
+}
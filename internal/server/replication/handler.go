@@ -0,0 +1,240 @@
+package replication
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ospiem/mcollector/internal/models"
+)
+
+// Paths of the replication API.
+const (
+	streamPath  = "/replication/stream"
+	statusPath  = "/replication/status"
+	promotePath = "/replication/promote"
+)
+
+// hashHeader is the HTTP header with the HMAC-SHA256 of the request.
+const hashHeader = "HashSHA256"
+
+// timestampHeader is the HTTP header with the time the request was signed at, in Unix seconds.
+const timestampHeader = "X-Replication-Timestamp"
+
+// maxRequestAge is the age of the oldest signed request accepted, a captured request cannot be
+// replayed once it is older.
+const maxRequestAge = 30 * time.Second
+
+// Types of the frames sent on the stream.
+const (
+	frameSnapshot  = "snapshot"
+	frameEntry     = "entry"
+	frameHeartbeat = "heartbeat"
+)
+
+// frame is a JSON line of the stream. Run is the run of the primary the sequence numbers belong
+// to, Seq is the sequence number of the write the frame brings the replica to, Head is the last
+// sequence number written on the primary.
+type frame struct {
+	Type    string           `json:"type"`
+	Run     string           `json:"run"`
+	Seq     uint64           `json:"seq"`
+	Head    uint64           `json:"head"`
+	Metrics []models.Metrics `json:"metrics,omitempty"`
+}
+
+// replicaConn is a replica streaming from the primary.
+type replicaConn struct {
+	connectedAt time.Time
+	node        string
+	sent        uint64
+}
+
+// Handler returns the replication API. The stream and promote endpoints require requests
+// signed with the replication key in the last maxRequestAge, the status endpoint is open for
+// monitoring.
+func (r *Replicator) Handler() http.Handler {
+	rt := chi.NewRouter()
+
+	rt.Get("/status", r.handleStatus)
+	rt.Group(func(rt chi.Router) {
+		rt.Use(r.verifySignature)
+		rt.Get("/stream", r.handleStream)
+		rt.Post("/promote", r.handlePromote)
+	})
+
+	return rt
+}
+
+// verifySignature rejects requests that are not signed with the replication key, or were signed
+// too long ago.
+func (r *Replicator) verifySignature(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		timestamp := req.Header.Get(timestampHeader)
+		signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			http.Error(w, "Bad Request, invalid timestamp", http.StatusBadRequest)
+			return
+		}
+		if age := time.Since(time.Unix(signedAt, 0)); age > maxRequestAge || age < -maxRequestAge {
+			http.Error(w, "Bad Request, request expired", http.StatusBadRequest)
+			return
+		}
+		want := sign(r.cfg.Key, req.Method, req.URL.RequestURI(), timestamp, body)
+		if !hmac.Equal([]byte(req.Header.Get(hashHeader)), []byte(want)) {
+			http.Error(w, "Bad Request, hashes does not matched", http.StatusBadRequest)
+			return
+		}
+
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, req)
+	})
+}
+
+// handleStream sends the writes after the sequence number in the after parameter as JSON lines,
+// preceded by a snapshot if they are no longer in the log or belong to another run than the
+// one in the run parameter. It sends a heartbeat when idle.
+func (r *Replicator) handleStream(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	logger := r.log.With().Str("func", "handleStream").Logger()
+
+	if r.Role() != RolePrimary {
+		http.Error(w, "Conflict, the server is not the primary", http.StatusConflict)
+		return
+	}
+	pos, err := strconv.ParseUint(req.URL.Query().Get("after"), 10, 64)
+	if err != nil {
+		http.Error(w, "Bad request, invalid after parameter", http.StatusBadRequest)
+		return
+	}
+
+	run := req.URL.Query().Get("run")
+
+	conn := &replicaConn{node: req.URL.Query().Get("node"), sent: pos, connectedAt: time.Now()}
+	if conn.node == "" {
+		conn.node = req.RemoteAddr
+	}
+	r.addReplica(conn)
+	defer r.removeReplica(conn)
+	logger.Info().Str("replica", conn.node).Uint64("after", pos).Msg("replica connected")
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	send := func(f frame) error {
+		if err := enc.Encode(f); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	heartbeat := time.NewTicker(r.cfg.HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		entries, head, notify, ok := r.since(run, pos)
+		if !ok {
+			metrics, snapshotRun, seq, err := r.snapshot(ctx)
+			if err != nil {
+				logger.Error().Err(err).Msg("cannot take a snapshot")
+				return
+			}
+			if err := send(frame{Type: frameSnapshot, Run: snapshotRun, Seq: seq, Head: seq, Metrics: metrics}); err != nil {
+				logger.Debug().Err(err).Str("replica", conn.node).Msg("stream closed")
+				return
+			}
+			run, pos = snapshotRun, seq
+			r.setSent(conn, pos)
+			continue
+		}
+
+		for _, e := range entries {
+			if err := send(frame{Type: frameEntry, Run: run, Seq: e.Seq, Head: head, Metrics: e.Metrics}); err != nil {
+				logger.Debug().Err(err).Str("replica", conn.node).Msg("stream closed")
+				return
+			}
+			pos = e.Seq
+		}
+		if len(entries) > 0 {
+			r.setSent(conn, pos)
+			continue
+		}
+
+		select {
+		case <-notify:
+		case <-heartbeat.C:
+			if err := send(frame{Type: frameHeartbeat, Run: run, Seq: pos, Head: head}); err != nil {
+				logger.Debug().Err(err).Str("replica", conn.node).Msg("stream closed")
+				return
+			}
+		case <-ctx.Done():
+			return
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+func (r *Replicator) handleStatus(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, r.Status())
+}
+
+func (r *Replicator) handlePromote(w http.ResponseWriter, req *http.Request) {
+	r.Promote()
+	writeJSON(w, r.Status())
+}
+
+func (r *Replicator) addReplica(c *replicaConn) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.replicas[c] = struct{}{}
+}
+
+func (r *Replicator) removeReplica(c *replicaConn) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	delete(r.replicas, c)
+}
+
+func (r *Replicator) setSent(c *replicaConn, seq uint64) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	c.sent = seq
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// signRequest signs the request with its body at the current time.
+func signRequest(req *http.Request, key string, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(hashHeader, sign(key, req.Method, req.URL.RequestURI(), timestamp, body))
+}
+
+// sign returns the hex-encoded HMAC-SHA256 of the method, the path with its query, the
+// timestamp and the body of a request.
+func sign(key, method, uri, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(h, "%s\n%s\n%s\n", method, uri, timestamp)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
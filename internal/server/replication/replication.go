@@ -0,0 +1,328 @@
+// Package replication provides a storage that replicates the writes of a primary server to replicas.
+//
+// The primary applies every write to its local storage and appends it to an in-memory log
+// with a sequence number. The sequence numbers only make sense within a run of the primary, a
+// random ID changed on every start and promotion: a replica resuming from another run gets a
+// snapshot. Replicas follow the primary through the stream served by Handler:
+// they receive a snapshot of the primary state when they cannot catch up from the log, then
+// every new write in order. Replicas serve reads from their local copy and reject writes until
+// they are promoted, either by the promote endpoint or automatically once the primary has been
+// unreachable for Config.PromoteAfter.
+package replication
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/rs/zerolog"
+)
+
+// Role is the replication role of a server.
+type Role string
+
+const (
+	RolePrimary Role = "primary" // RolePrimary accepts writes and streams them to the replicas.
+	RoleReplica Role = "replica" // RoleReplica follows the primary and serves reads only.
+)
+
+// defaultLogSize is the number of writes kept for replicas that reconnect.
+const defaultLogSize = 10000
+
+// defaultHeartbeatInterval is the interval between two heartbeats of the primary.
+const defaultHeartbeatInterval = time.Second
+
+// ErrReadOnly is returned when a replica is asked to write.
+var ErrReadOnly = errors.New("replica is read-only, write to the primary")
+
+// Storage is the interface of the local storage of a server.
+type Storage interface {
+	InsertGauge(ctx context.Context, k string, v float64) error
+	InsertCounter(ctx context.Context, k string, v int64) error
+	SelectGauge(ctx context.Context, k string) (float64, error)
+	SelectCounter(ctx context.Context, k string) (int64, error)
+	GetCounters(ctx context.Context) (map[string]int64, error)
+	GetGauges(ctx context.Context) (map[string]float64, error)
+	InsertBatch(ctx context.Context, metrics []models.Metrics) error
+	// DeleteMetrics deletes the metrics missing from a snapshot of the primary.
+	DeleteMetrics(ctx context.Context, metrics []models.Metrics) error
+	Ping(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// Config holds the replication settings of a server.
+type Config struct {
+	Role              Role          // Role is the role the server starts with.
+	Self              string        // Self is the name the replica reports to the primary.
+	Primary           string        // Primary is the host:port of the primary, required for replicas.
+	Key               string        // Key signs the requests between servers.
+	PromoteAfter      time.Duration // PromoteAfter promotes a replica once the primary is unreachable for it, 0 disables.
+	HeartbeatInterval time.Duration // HeartbeatInterval is the interval between two heartbeats of the primary.
+	LogSize           int           // LogSize is the number of writes kept for replicas that reconnect.
+}
+
+// Replicator is a storage that replicates writes from the primary to the replicas.
+type Replicator struct {
+	local  Storage
+	client *http.Client
+	log    zerolog.Logger
+	cfg    Config
+
+	// wmux serializes the writes of the primary, so the log order is the order they were applied in.
+	wmux    *sync.Mutex
+	run     string
+	entries []entry
+	head    uint64
+	notify  chan struct{}
+
+	// mux guards the fields below.
+	mux         *sync.RWMutex
+	role        Role
+	appliedRun  string
+	applied     uint64
+	primaryHead uint64
+	syncedAt    time.Time
+	contactAt   time.Time
+	connected   bool
+	replicas    map[*replicaConn]struct{}
+
+	stopFollow context.CancelFunc
+	promote    *sync.Once
+	closed     chan struct{}
+	done       chan struct{}
+}
+
+// entry is a write of the primary.
+type entry struct {
+	Seq     uint64
+	Metrics []models.Metrics
+}
+
+// New creates a Replicator in front of the local storage. A replica starts following the primary
+// until it is promoted or Close is called.
+func New(ctx context.Context, local Storage, cfg Config, log zerolog.Logger) (*Replicator, error) {
+	if cfg.Role != RolePrimary && cfg.Role != RoleReplica {
+		return nil, fmt.Errorf("unknown replication role %q", cfg.Role)
+	}
+	if cfg.Role == RoleReplica && cfg.Primary == "" {
+		return nil, errors.New("replica needs the address of the primary")
+	}
+	if cfg.Key == "" {
+		return nil, errors.New("replication needs a key to sign the requests between servers")
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if cfg.LogSize <= 0 {
+		cfg.LogSize = defaultLogSize
+	}
+
+	now := time.Now()
+	r := &Replicator{
+		local:     local,
+		client:    &http.Client{},
+		log:       log.With().Str("component", "replication").Logger(),
+		cfg:       cfg,
+		wmux:      &sync.Mutex{},
+		notify:    make(chan struct{}),
+		mux:       &sync.RWMutex{},
+		run:       newRunID(),
+		role:      cfg.Role,
+		syncedAt:  now,
+		contactAt: now,
+		replicas:  make(map[*replicaConn]struct{}),
+		promote:   &sync.Once{},
+		closed:    make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	if r.role == RolePrimary {
+		close(r.done)
+		return r, nil
+	}
+
+	followCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	r.stopFollow = cancel
+	go func() {
+		promote := r.follow(followCtx)
+		close(r.done)
+		if promote {
+			r.Promote()
+		}
+	}()
+
+	r.log.Info().Str("primary", cfg.Primary).Msg("following the primary")
+	return r, nil
+}
+
+// Role returns the current role of the server.
+func (r *Replicator) Role() Role {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return r.role
+}
+
+// Promote turns a replica into the primary. The sequence numbers continue from the last
+// applied write in a new run, the other replicas may have applied writes this one has not,
+// so they get a snapshot when they switch to the new primary.
+func (r *Replicator) Promote() {
+	r.promote.Do(func() {
+		if r.stopFollow == nil {
+			return
+		}
+		r.stopFollow()
+		<-r.done
+
+		r.wmux.Lock()
+		r.mux.Lock()
+		seq := r.applied
+		r.run = newRunID()
+		r.head = seq
+		r.entries = nil
+		r.role = RolePrimary
+		r.connected = false
+		r.mux.Unlock()
+		r.wmux.Unlock()
+
+		r.log.Warn().Uint64("seq", seq).Str("run", r.run).Msg("promoted to primary")
+	})
+}
+
+func (r *Replicator) InsertGauge(ctx context.Context, k string, v float64) error {
+	return r.write(ctx, []models.Metrics{{ID: k, MType: models.Gauge, Value: &v}})
+}
+
+func (r *Replicator) InsertCounter(ctx context.Context, k string, v int64) error {
+	return r.write(ctx, []models.Metrics{{ID: k, MType: models.Counter, Delta: &v}})
+}
+
+func (r *Replicator) InsertBatch(ctx context.Context, metrics []models.Metrics) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	return r.write(ctx, metrics)
+}
+
+func (r *Replicator) SelectGauge(ctx context.Context, k string) (float64, error) {
+	return r.local.SelectGauge(ctx, k)
+}
+
+func (r *Replicator) SelectCounter(ctx context.Context, k string) (int64, error) {
+	return r.local.SelectCounter(ctx, k)
+}
+
+func (r *Replicator) GetCounters(ctx context.Context) (map[string]int64, error) {
+	return r.local.GetCounters(ctx)
+}
+
+func (r *Replicator) GetGauges(ctx context.Context) (map[string]float64, error) {
+	return r.local.GetGauges(ctx)
+}
+
+func (r *Replicator) Ping(ctx context.Context) error {
+	if err := r.local.Ping(ctx); err != nil {
+		return fmt.Errorf("replication ping: %w", err)
+	}
+	return nil
+}
+
+// Close stops following the primary, ends the streams to the replicas and closes the local storage.
+func (r *Replicator) Close(ctx context.Context) error {
+	close(r.closed)
+
+	if r.stopFollow != nil {
+		r.stopFollow()
+	}
+	<-r.done
+
+	if err := r.local.Close(ctx); err != nil {
+		return fmt.Errorf("replication close: %w", err)
+	}
+	return nil
+}
+
+// write applies the metrics locally and appends them to the log.
+func (r *Replicator) write(ctx context.Context, metrics []models.Metrics) error {
+	if r.Role() != RolePrimary {
+		return ErrReadOnly
+	}
+
+	r.wmux.Lock()
+	defer r.wmux.Unlock()
+
+	if err := r.local.InsertBatch(ctx, metrics); err != nil {
+		return fmt.Errorf("replication write: %w", err)
+	}
+
+	r.head++
+	r.entries = append(r.entries, entry{Seq: r.head, Metrics: metrics})
+	// Trim in halves, so the log is not copied on every write.
+	if len(r.entries) >= 2*r.cfg.LogSize {
+		r.entries = append([]entry(nil), r.entries[len(r.entries)-r.cfg.LogSize:]...)
+	}
+
+	close(r.notify)
+	r.notify = make(chan struct{})
+	return nil
+}
+
+// since returns the writes of the run after the sequence number and a channel closed on the
+// next write. ok is false if the run is not the current one or the writes are no longer in the
+// log, and the replica needs a snapshot.
+func (r *Replicator) since(run string, after uint64) (entries []entry, head uint64, notify <-chan struct{}, ok bool) {
+	r.wmux.Lock()
+	defer r.wmux.Unlock()
+
+	if run != r.run || after > r.head {
+		return nil, r.head, r.notify, false
+	}
+	if after == r.head {
+		return nil, r.head, r.notify, true
+	}
+	if len(r.entries) == 0 || r.entries[0].Seq > after+1 {
+		return nil, r.head, r.notify, false
+	}
+
+	first := r.entries[0].Seq
+	return append([]entry(nil), r.entries[after+1-first:]...), r.head, r.notify, true
+}
+
+// snapshot returns every metric of the local storage with the run and the sequence number of
+// the last write in it.
+func (r *Replicator) snapshot(ctx context.Context) ([]models.Metrics, string, uint64, error) {
+	r.wmux.Lock()
+	defer r.wmux.Unlock()
+
+	counters, err := r.local.GetCounters(ctx)
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("failed to get counters: %w", err)
+	}
+	gauges, err := r.local.GetGauges(ctx)
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("failed to get gauges: %w", err)
+	}
+
+	metrics := make([]models.Metrics, 0, len(counters)+len(gauges))
+	for k, v := range counters {
+		delta := v
+		metrics = append(metrics, models.Metrics{ID: k, MType: models.Counter, Delta: &delta})
+	}
+	for k, v := range gauges {
+		value := v
+		metrics = append(metrics, models.Metrics{ID: k, MType: models.Gauge, Value: &value})
+	}
+	return metrics, r.run, r.head, nil
+}
+
+// newRunID returns a random ID of a run of the primary.
+func newRunID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b) // Never fails, see crypto/rand.Read.
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,309 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/ospiem/mcollector/internal/server/middleware/limit"
+	memorystorage "github.com/ospiem/mcollector/internal/storage/memory"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testKey = "replication-secret"
+
+// server is a replicated server served by httptest.
+type server struct {
+	repl  *Replicator
+	local *memorystorage.MemStorage
+	srv   *httptest.Server
+	addr  string
+}
+
+// startServer serves a new replicated server until the test ends.
+func startServer(t *testing.T, cfg Config) *server {
+	t.Helper()
+	ctx := context.Background()
+
+	cfg.Key = testKey
+	if cfg.HeartbeatInterval == 0 {
+		cfg.HeartbeatInterval = 20 * time.Millisecond
+	}
+
+	s := &server{local: memorystorage.New()}
+	var err error
+	s.repl, err = New(ctx, s.local, cfg, zerolog.Nop())
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+	r.Mount("/replication", s.repl.Handler())
+	s.srv = httptest.NewServer(r)
+	s.addr = strings.TrimPrefix(s.srv.URL, "http://")
+
+	t.Cleanup(func() {
+		_ = s.repl.Close(ctx)
+		s.srv.Close()
+	})
+	return s
+}
+
+func insertMetrics(t *testing.T, s interface {
+	InsertBatch(ctx context.Context, metrics []models.Metrics) error
+}, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		delta, value := int64(i+1), float64(i)/2
+		require.NoError(t, s.InsertBatch(context.Background(), []models.Metrics{
+			{ID: "requests", MType: models.Counter, Delta: &delta},
+			{ID: fmt.Sprintf("gauge%d", i), MType: models.Gauge, Value: &value},
+		}))
+	}
+}
+
+// inSync reports whether both storages hold the same metrics.
+func inSync(t *testing.T, a, b Storage) bool {
+	t.Helper()
+	ctx := context.Background()
+	ac, err := a.GetCounters(ctx)
+	require.NoError(t, err)
+	bc, err := b.GetCounters(ctx)
+	require.NoError(t, err)
+	ag, err := a.GetGauges(ctx)
+	require.NoError(t, err)
+	bg, err := b.GetGauges(ctx)
+	require.NoError(t, err)
+	return assert.ObjectsAreEqual(ac, bc) && assert.ObjectsAreEqual(ag, bg)
+}
+
+func TestRestoreDeletesMetricsMissingFromSnapshot(t *testing.T) {
+	ctx := context.Background()
+	local := memorystorage.New()
+	insertMetrics(t, local, 0, 3)
+	r := &Replicator{local: local}
+
+	requests, kept := int64(7), 1.5
+	require.NoError(t, r.restore(ctx, []models.Metrics{
+		{ID: "requests", MType: models.Counter, Delta: &requests},
+		{ID: "gauge1", MType: models.Gauge, Value: &kept},
+	}))
+
+	counters, err := local.GetCounters(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"requests": 7}, counters)
+	gauges, err := local.GetGauges(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"gauge1": 1.5}, gauges, "the gauges the primary no longer has are deleted")
+}
+
+func TestReplicaFollowsPrimary(t *testing.T) {
+	ctx := context.Background()
+	// The small log makes the replica start from a snapshot.
+	primary := startServer(t, Config{Role: RolePrimary, LogSize: 2})
+	insertMetrics(t, primary.repl, 0, 10)
+
+	replica := startServer(t, Config{Role: RoleReplica, Primary: primary.addr, Self: "replica-1"})
+	require.Eventually(t, func() bool {
+		return inSync(t, primary.local, replica.local)
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// New writes are streamed.
+	insertMetrics(t, primary.repl, 10, 20)
+	require.NoError(t, primary.repl.InsertCounter(ctx, "requests", 5))
+	require.NoError(t, primary.repl.InsertGauge(ctx, "gauge0", 42))
+	require.Eventually(t, func() bool {
+		return inSync(t, primary.local, replica.local)
+	}, 2*time.Second, 10*time.Millisecond)
+
+	v, err := replica.repl.SelectCounter(ctx, "requests")
+	require.NoError(t, err)
+	assert.Equal(t, int64(215), v)
+
+	// Replicas are read-only.
+	assert.ErrorIs(t, replica.repl.InsertGauge(ctx, "gauge0", 1), ErrReadOnly)
+
+	require.Eventually(t, func() bool {
+		s := replica.repl.Status()
+		return s.Connected && s.LagWrites == 0 && s.Applied == 22
+	}, 2*time.Second, 10*time.Millisecond)
+
+	s := primary.repl.Status()
+	assert.Equal(t, RolePrimary, s.Role)
+	assert.Equal(t, uint64(22), s.Head)
+	require.Len(t, s.Replicas, 1)
+	assert.Equal(t, "replica-1", s.Replicas[0].Node)
+}
+
+func TestReplicaReadsLimitedRequests(t *testing.T) {
+	ctx := context.Background()
+	id := limit.LimitedMetric + ";reason=client"
+	limited := func(n int64) []models.Metrics {
+		return []models.Metrics{{ID: id, MType: models.Counter, Delta: &n}}
+	}
+
+	// The small log makes the replica start from a snapshot holding the limited requests.
+	primary := startServer(t, Config{Role: RolePrimary, LogSize: 2})
+	require.NoError(t, primary.repl.InsertBatch(ctx, limited(2)))
+	insertMetrics(t, primary.repl, 0, 5)
+
+	replica := startServer(t, Config{Role: RoleReplica, Primary: primary.addr})
+	require.NoError(t, primary.repl.InsertBatch(ctx, limited(3)))
+	require.Eventually(t, func() bool {
+		v, err := replica.repl.SelectCounter(ctx, id)
+		return err == nil && v == 5
+	}, 2*time.Second, 10*time.Millisecond)
+
+	counters, err := replica.repl.GetCounters(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), counters[id])
+
+	// A replica cannot write the requests it limited itself.
+	assert.ErrorIs(t, replica.repl.InsertBatch(ctx, limited(1)), ErrReadOnly)
+}
+
+func TestReplicaPromotedWhenPrimaryGone(t *testing.T) {
+	ctx := context.Background()
+	primary := startServer(t, Config{Role: RolePrimary})
+	insertMetrics(t, primary.repl, 0, 5)
+
+	replica := startServer(t, Config{Role: RoleReplica, Primary: primary.addr, PromoteAfter: 100 * time.Millisecond})
+	require.Eventually(t, func() bool {
+		return replica.repl.Status().Applied == 5
+	}, 2*time.Second, 10*time.Millisecond)
+
+	primary.srv.CloseClientConnections()
+	primary.srv.Close()
+
+	require.Eventually(t, func() bool {
+		return replica.repl.Role() == RolePrimary
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// The promoted replica keeps the data and continues the sequence.
+	require.NoError(t, replica.repl.InsertCounter(ctx, "requests", 1))
+	v, err := replica.repl.SelectCounter(ctx, "requests")
+	require.NoError(t, err)
+	assert.Equal(t, int64(16), v)
+	assert.Equal(t, uint64(6), replica.repl.Status().Head)
+
+	// Another replica can follow the promoted one.
+	next := startServer(t, Config{Role: RoleReplica, Primary: replica.addr})
+	require.Eventually(t, func() bool {
+		return inSync(t, replica.local, next.local)
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestPromoteEndpoint(t *testing.T) {
+	primary := startServer(t, Config{Role: RolePrimary})
+	replica := startServer(t, Config{Role: RoleReplica, Primary: primary.addr})
+
+	resp, err := http.Post(replica.srv.URL+promotePath, "application/json", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, RoleReplica, replica.repl.Role())
+
+	// A request signed too long ago is refused, it could be a replay.
+	req, err := http.NewRequest(http.MethodPost, replica.srv.URL+promotePath, nil)
+	require.NoError(t, err)
+	old := strconv.FormatInt(time.Now().Add(-2*maxRequestAge).Unix(), 10)
+	req.Header.Set(timestampHeader, old)
+	req.Header.Set(hashHeader, sign(testKey, http.MethodPost, promotePath, old, nil))
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, RoleReplica, replica.repl.Role())
+
+	req, err = http.NewRequest(http.MethodPost, replica.srv.URL+promotePath, nil)
+	require.NoError(t, err)
+	signRequest(req, testKey, nil)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var s Status
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&s))
+	assert.Equal(t, RolePrimary, s.Role)
+	assert.Equal(t, RolePrimary, replica.repl.Role())
+}
+
+func TestNewNeedsKey(t *testing.T) {
+	_, err := New(context.Background(), memorystorage.New(), Config{Role: RolePrimary}, zerolog.Nop())
+	assert.Error(t, err)
+}
+
+func TestReplicaResyncsAfterPrimaryRestart(t *testing.T) {
+	// The replica reaches the primaries through the same address, like a primary restarting.
+	var current atomic.Pointer[server]
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		current.Load().srv.Config.Handler.ServeHTTP(w, req)
+	}))
+	// Closed after the servers, which end their streams.
+	t.Cleanup(front.Close)
+
+	first := startServer(t, Config{Role: RolePrimary})
+	insertMetrics(t, first.repl, 0, 3)
+	current.Store(first)
+
+	replica := startServer(t, Config{Role: RoleReplica, Primary: strings.TrimPrefix(front.URL, "http://")})
+	require.Eventually(t, func() bool {
+		return inSync(t, first.local, replica.local)
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// The restarted primary has other data and more writes than the replica applied.
+	restarted := startServer(t, Config{Role: RolePrimary})
+	insertMetrics(t, restarted.repl, 10, 15)
+	current.Store(restarted)
+	front.CloseClientConnections()
+
+	// The replica gets a snapshot instead of the writes after its position in the other run.
+	// Gauges cannot be deleted, so only the counters are compared.
+	want, err := restarted.local.GetCounters(context.Background())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		got, err := replica.local.GetCounters(context.Background())
+		require.NoError(t, err)
+		return assert.ObjectsAreEqual(want, got) && replica.repl.Status().Run == restarted.repl.Status().Run
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestSince(t *testing.T) {
+	r, err := New(context.Background(), memorystorage.New(), Config{Role: RolePrimary, Key: testKey, LogSize: 3},
+		zerolog.Nop())
+	require.NoError(t, err)
+	insertMetrics(t, r, 0, 7)
+	run := r.Status().Run
+
+	entries, head, _, ok := r.since(run, 5)
+	require.True(t, ok)
+	assert.Equal(t, uint64(7), head)
+	require.Len(t, entries, 2)
+	assert.Equal(t, uint64(6), entries[0].Seq)
+
+	entries, _, _, ok = r.since(run, 7)
+	assert.True(t, ok)
+	assert.Empty(t, entries)
+
+	// Trimmed writes and unknown positions need a snapshot.
+	_, _, _, ok = r.since(run, 1)
+	assert.False(t, ok)
+	_, _, _, ok = r.since(run, 8)
+	assert.False(t, ok)
+
+	// The positions of another run mean nothing in this one.
+	_, _, _, ok = r.since("another run", 5)
+	assert.False(t, ok)
+}
@@ -0,0 +1,75 @@
+package replication
+
+import (
+	"sort"
+	"time"
+)
+
+// Status is the replication state of a server.
+type Status struct {
+	Role       Role            `json:"role"`
+	Run        string          `json:"run"`                // Run is the run of the primary the sequence numbers belong to.
+	Primary    string          `json:"primary,omitempty"`  // Primary is the primary a replica follows.
+	Connected  bool            `json:"connected"`          // Connected is true while a replica streams from the primary.
+	Head       uint64          `json:"head"`               // Head is the last sequence number written on the primary.
+	Applied    uint64          `json:"applied"`            // Applied is the last sequence number applied locally.
+	LagWrites  uint64          `json:"lag_writes"`         // LagWrites is the number of writes not applied yet.
+	LagSeconds float64         `json:"lag_seconds"`        // LagSeconds is the time since the replica was last in sync.
+	Replicas   []ReplicaStatus `json:"replicas,omitempty"` // Replicas lists the replicas streaming from the primary.
+	CheckedAt  time.Time       `json:"checked_at"`         // CheckedAt is the time the status was taken.
+}
+
+// ReplicaStatus is the state of a replica as seen by the primary.
+type ReplicaStatus struct {
+	ConnectedAt time.Time `json:"connected_at"`
+	Node        string    `json:"node"`
+	Sent        uint64    `json:"sent"`       // Sent is the last sequence number sent to the replica.
+	LagWrites   uint64    `json:"lag_writes"` // LagWrites is the number of writes not sent yet.
+}
+
+// Status returns the replication state of the server.
+func (r *Replicator) Status() Status {
+	now := time.Now()
+
+	if r.Role() == RolePrimary {
+		r.wmux.Lock()
+		head, run := r.head, r.run
+		r.wmux.Unlock()
+
+		r.mux.RLock()
+		defer r.mux.RUnlock()
+
+		s := Status{Role: RolePrimary, Run: run, Head: head, Applied: head, CheckedAt: now}
+		for c := range r.replicas {
+			s.Replicas = append(s.Replicas, ReplicaStatus{
+				ConnectedAt: c.connectedAt,
+				Node:        c.node,
+				Sent:        c.sent,
+				LagWrites:   lag(head, c.sent),
+			})
+		}
+		sort.Slice(s.Replicas, func(i, j int) bool { return s.Replicas[i].Node < s.Replicas[j].Node })
+		return s
+	}
+
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return Status{
+		Role:       RoleReplica,
+		Run:        r.appliedRun,
+		Primary:    r.cfg.Primary,
+		Connected:  r.connected,
+		Head:       r.primaryHead,
+		Applied:    r.applied,
+		LagWrites:  lag(r.primaryHead, r.applied),
+		LagSeconds: now.Sub(r.syncedAt).Seconds(),
+		CheckedAt:  now,
+	}
+}
+
+func lag(head, pos uint64) uint64 {
+	if pos >= head {
+		return 0
+	}
+	return head - pos
+}
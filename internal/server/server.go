@@ -7,14 +7,23 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/ospiem/mcollector/internal/configload"
 	"github.com/ospiem/mcollector/internal/helper"
+	"github.com/ospiem/mcollector/internal/logging"
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/ospiem/mcollector/internal/reload"
+	"github.com/ospiem/mcollector/internal/server/cluster"
 	"github.com/ospiem/mcollector/internal/server/config"
+	"github.com/ospiem/mcollector/internal/server/replication"
 	"github.com/ospiem/mcollector/internal/server/transport"
 	"github.com/ospiem/mcollector/internal/storage"
+	"github.com/ospiem/mcollector/internal/tracing"
 	"github.com/rs/zerolog"
 )
 
@@ -27,22 +36,25 @@ var buildCommit string = "N/A"
 // timeoutShutdown is the duration to wait for the server to shut down gracefully.
 const timeoutShutdown = 5 * time.Second
 
+// liveSettings are the settings a reload applies while the server runs, the others need a restart.
+var liveSettings = []string{
+	"log_level", "security.key", "security.crypto_key", "limits.client_rate", "limits.route_rate",
+	"limits.trusted_proxies", "limits.burst", "limits.ingest_concurrency", "limits.ingest_max_latency",
+}
+
+// selfMetricsInterval is the interval the server's own metrics are written to the storage on.
+const selfMetricsInterval = 10 * time.Second
+
 // Run is the main function of the server. It initializes the server and its components,
 // and manages their lifecycle.
 func Run(logger zerolog.Logger) error {
-	// Create a context that is cancelled when an interrupt signal is received.
-	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	// Create a context that is cancelled when an interrupt signal is received, once the server
+	// is drained if it already serves.
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	ctx, cancelCtx := context.WithCancel(context.Background())
 	defer cancelCtx()
 
-	// If the service fails to shut down gracefully, log a fatal error.
-	context.AfterFunc(ctx, func() {
-		ctx, cancelCtx := context.WithTimeout(context.Background(), timeoutShutdown)
-		defer cancelCtx()
-
-		<-ctx.Done()
-		logger.Fatal().Msg("failed to gracefully shutdown the service")
-	})
-
 	// Log the build information.
 	logger.Log().
 		Str("Build version", buildVersion).
@@ -55,9 +67,57 @@ func Run(logger zerolog.Logger) error {
 	if err != nil {
 		return fmt.Errorf("failed to initialize config: %w", err)
 	}
+	if cfg.PrintConfig {
+		return cfg.Report.Print(os.Stdout)
+	}
+
+	// Stop on an interrupt signal, the server is set once it serves.
+	serving := &atomic.Pointer[transport.API]{}
+	go stopOnSignal(signalCtx, cancelCtx, serving, cfg.DrainDelay, &logger)
+
+	// If the service fails to shut down gracefully, log a fatal error. The timer starts with the
+	// drain, so it always leaves the server the drain delay and the shutdown timeout.
+	context.AfterFunc(signalCtx, func() {
+		ctx, cancelCtx := context.WithTimeout(context.Background(), cfg.DrainDelay+timeoutShutdown)
+		defer cancelCtx()
+
+		<-ctx.Done()
+		logger.Fatal().Msg("failed to gracefully shutdown the service")
+	})
+
+	// Write the logs to the configured output.
+	logger, logs, err := logging.New(cfg.Log, "mcollector-server")
+	if err != nil {
+		return fmt.Errorf("failed to open log output: %w", err)
+	}
+	defer func() {
+		if err := logs.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
 
 	// Set the global log level.
-	helper.SetGlobalLogLevel(cfg.LogLevel)
+	if err := helper.SetGlobalLogLevel(cfg.LogLevel); err != nil {
+		return err
+	}
+
+	// Log the warnings of the configuration whatever the log level, e.g. the deprecated keys.
+	for _, w := range cfg.Report.Warnings {
+		logger.Log().Str("warning", w).Msg("configuration warning")
+	}
+
+	// Export the traces of the requests, flushing the last ones on shutdown.
+	shutdownTracing, err := tracing.Start(ctx, cfg.Tracing, "mcollector-server")
+	if err != nil {
+		return fmt.Errorf("failed to start tracing: %w", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeoutShutdown)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error().Err(err).Send()
+		}
+	}()
 
 	// Initialize a WaitGroup to wait for the completion of application components.
 	wg := &sync.WaitGroup{}
@@ -67,19 +127,59 @@ func Run(logger zerolog.Logger) error {
 	}()
 
 	// Initialize the s.
-	s, err := storage.New(ctx, cfg.StoreConfig)
+	local, err := storage.New(ctx, cfg.StoreConfig)
 	if err != nil {
 		fmt.Println(err)
 		return fmt.Errorf("failed to initialize s: %w", err)
 	}
+	var s transport.Storage = local
+	checks := storage.Checks(local)
+	// The server's own metrics written to the storage, the statistics of the local storage first.
+	var selfMetrics []func() []models.Metrics
+	if r, ok := local.(storage.Reporter); ok {
+		selfMetrics = append(selfMetrics, r.Flush)
+	}
+
+	// Replicate the storage if a replication role is configured.
+	var replicationAPI http.Handler
+	if cfg.ReplicationRole != "" {
+		r, err := newReplicator(ctx, cfg, local, logger)
+		if err != nil {
+			return fmt.Errorf("failed to start replication: %w", err)
+		}
+		s, replicationAPI = r, r.Handler()
+	}
+
+	// Shard the storage between the cluster nodes if peers are configured.
+	var clusterAPI http.Handler
+	if len(cfg.ClusterPeers) > 0 {
+		c, err := newCluster(ctx, cfg, s, logger)
+		if err != nil {
+			return fmt.Errorf("failed to join the cluster: %w", err)
+		}
+		s, clusterAPI = c, c.Handler()
+	}
 
 	// Watch the s for closure.
 	watchStorage(ctx, wg, s, &logger)
 	// Initialize the API and the server.
 	componentsErrs := make(chan error, 1)
 	api := transport.New(&cfg, s, &logger)
+	api.Cluster = clusterAPI
+	api.Replication = replicationAPI
+	api.Checks = checks
 	srv := api.InitServer()
 
+	// Drain the server before stopping it on an interrupt signal.
+	serving.Store(api)
+
+	// Report the requests rejected by the limits along with the statistics of the storage.
+	selfMetrics = append(selfMetrics, api.Limited.Flush)
+	reportSelfMetrics(ctx, wg, s, selfMetrics, &logger)
+
+	// Apply the config changed on SIGHUP or in the config file while running.
+	reloadConfig(ctx, wg, cfg, api, &logger)
+
 	// Manage the server lifecycle.
 	manageServer(ctx, wg, srv, componentsErrs, &logger)
 
@@ -94,6 +194,94 @@ func Run(logger zerolog.Logger) error {
 	return nil
 }
 
+// newCluster creates the cluster storage in front of the local storage.
+func newCluster(ctx context.Context, cfg config.Config, s transport.Storage, l zerolog.Logger) (*cluster.Cluster, error) {
+	self := cfg.ClusterNode
+	if self == "" {
+		self = cfg.Endpoint
+	}
+
+	c, err := cluster.New(ctx, s, cluster.Config{
+		Self:  self,
+		Peers: cfg.ClusterPeers,
+		Key:   cfg.Key,
+	}, l)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cluster: %w", err)
+	}
+	return c, nil
+}
+
+// newReplicator creates the replicated storage in front of the local storage.
+func newReplicator(ctx context.Context, cfg config.Config, s storage.Storage, l zerolog.Logger) (*replication.Replicator, error) {
+	r, err := replication.New(ctx, s, replication.Config{
+		Role:         replication.Role(cfg.ReplicationRole),
+		Self:         cfg.Endpoint,
+		Primary:      cfg.ReplicationPrimary,
+		Key:          cfg.Key,
+		PromoteAfter: cfg.ReplicationPromoteAfter,
+	}, l)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create replicator: %w", err)
+	}
+	return r, nil
+}
+
+// reloadConfig loads the config again on SIGHUP and when the config file changes, and applies
+// its live settings. An invalid config is rejected and the running one is kept.
+func reloadConfig(ctx context.Context, wg *sync.WaitGroup, cfg config.Config, api *transport.API, l *zerolog.Logger) {
+	live := slices.Clone(liveSettings)
+	if len(cfg.ClusterPeers) > 0 || cfg.ReplicationRole != "" {
+		// The other nodes keep authenticating with the key the server started with.
+		live = slices.DeleteFunc(live, func(key string) bool { return key == "security.key" })
+	}
+	reloads := reload.Watch(ctx, cfg.Config, reload.FileCheckInterval, *l)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range reloads {
+			cfg = applyConfig(cfg, live, api, l)
+		}
+	}()
+}
+
+// applyConfig applies the live settings of the config loaded again, returning the running config.
+func applyConfig(running config.Config, live []string, api *transport.API, l *zerolog.Logger) config.Config {
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		l.Error().Err(err).Msg("invalid config, keeping the running one")
+		return running
+	}
+
+	applied := running
+	applied.LogLevel = cfg.LogLevel
+	if slices.Contains(live, "security.key") {
+		applied.Key = cfg.Key
+	}
+	applied.CryptoKey = cfg.CryptoKey
+	applied.RateLimitClient = cfg.RateLimitClient
+	applied.RateLimitRoute = cfg.RateLimitRoute
+	applied.RateLimitTrustedProxies = cfg.RateLimitTrustedProxies
+	applied.RateLimitBurst = cfg.RateLimitBurst
+	applied.IngestConcurrency = cfg.IngestConcurrency
+	applied.IngestMaxLatency = cfg.IngestMaxLatency
+	applied.Report = configload.Merge(running.Report, cfg.Report, live)
+	if err := api.Reload(applied); err != nil {
+		l.Error().Err(err).Msg("invalid config, keeping the running one")
+		return running
+	}
+
+	if applied.LogLevel != running.LogLevel {
+		// Unchanged, it keeps the level set on the log level endpoint.
+		if err := helper.SetGlobalLogLevel(applied.LogLevel); err != nil {
+			l.Error().Err(err).Msg("failed to set log level")
+		}
+	}
+	reload.LogChanges(*l, configload.Diff(running.Report, cfg.Report), live)
+	return applied
+}
+
 // watchStorage watches the storage for closure and logs any errors that occur during closure.
 func watchStorage(ctx context.Context, wg *sync.WaitGroup, s transport.Storage, l *zerolog.Logger) {
 	wg.Add(1)
@@ -109,6 +297,59 @@ func watchStorage(ctx context.Context, wg *sync.WaitGroup, s transport.Storage,
 	}()
 }
 
+// reportSelfMetrics periodically writes the server's own metrics flushed from the sources to the
+// storage, e.g. the counters of the limited requests. They go through the cluster or the
+// replication like any other metric, so every node reads the same value.
+func reportSelfMetrics(ctx context.Context, wg *sync.WaitGroup, s transport.Storage, sources []func() []models.Metrics,
+	l *zerolog.Logger) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(selfMetricsInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				var metrics []models.Metrics
+				for _, flush := range sources {
+					metrics = append(metrics, flush()...)
+				}
+				if len(metrics) == 0 {
+					continue
+				}
+				err := s.InsertBatch(ctx, metrics)
+				switch {
+				case errors.Is(err, replication.ErrReadOnly):
+					// A replica serves the reads of its primary, it cannot write its own counts.
+					l.Debug().Msg("dropped the self metrics of a replica")
+				case err != nil:
+					l.Error().Err(err).Msg("failed to write the self metrics")
+				}
+			}
+		}
+	}()
+}
+
+// stopOnSignal cancels the context of the server on an interrupt signal. Once the server serves,
+// its readiness fails first for the drain delay, so the load balancers route the traffic away
+// before the listener closes.
+func stopOnSignal(signalCtx context.Context, cancel context.CancelFunc, serving *atomic.Pointer[transport.API],
+	delay time.Duration, l *zerolog.Logger) {
+	<-signalCtx.Done()
+	defer cancel()
+
+	api := serving.Load()
+	if api == nil {
+		return
+	}
+	api.Drain()
+	l.Info().Dur("delay", delay).Msg("draining the server before shutdown")
+	time.Sleep(delay)
+}
+
 // manageServer manages the lifecycle of the server. It starts the server and handles shutdown.
 func manageServer(ctx context.Context, wg *sync.WaitGroup, srv *http.Server, errs chan error, l *zerolog.Logger) {
 	// Start the server in a separate goroutine.
@@ -128,7 +369,7 @@ func manageServer(ctx context.Context, wg *sync.WaitGroup, srv *http.Server, err
 		defer wg.Done()
 		<-ctx.Done()
 
-		shutDownTimeoutCtx, cancelShutdownTimeCancel := context.WithTimeout(ctx, timeoutShutdown)
+		shutDownTimeoutCtx, cancelShutdownTimeCancel := context.WithTimeout(context.Background(), timeoutShutdown)
 		defer cancelShutdownTimeCancel()
 		if err := srv.Shutdown(shutDownTimeoutCtx); err != nil {
 			l.Error().Err(err).Msg("an error occurred during server shutdown")
@@ -16,7 +16,7 @@ import (
 func Example() {
 	logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
 
-	cfg, err := config.New()
+	cfg, err := config.Load(nil)
 	if err != nil {
 		logger.Fatal().Err(err).Send()
 	}
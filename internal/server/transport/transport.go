@@ -4,19 +4,27 @@ package transport
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
 	"strconv"
+	"sync/atomic"
 
+	"github.com/ethereum/go-ethereum/crypto/ecies"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/ospiem/mcollector/internal/health"
+	"github.com/ospiem/mcollector/internal/logging"
 	"github.com/ospiem/mcollector/internal/models"
+	"github.com/ospiem/mcollector/internal/requestid"
 	"github.com/ospiem/mcollector/internal/server/config"
 	"github.com/ospiem/mcollector/internal/server/middleware/compress"
 	"github.com/ospiem/mcollector/internal/server/middleware/hash"
+	"github.com/ospiem/mcollector/internal/server/middleware/limit"
 	"github.com/ospiem/mcollector/internal/server/middleware/logger"
 	"github.com/ospiem/mcollector/internal/server/middleware/ssl"
+	"github.com/ospiem/mcollector/internal/server/middleware/tracing"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -67,9 +75,24 @@ type Storage interface {
 
 // API represents an HTTP API server. It includes a storage interface, a logger, and a server configuration.
 type API struct {
-	Storage Storage        // Storage is the storage interface implemention.
-	Log     zerolog.Logger // Log is the logger instance.
-	Cfg     config.Config  // Cfg is the server configuration.
+	Storage     Storage         // Storage is the storage interface implemention.
+	Cluster     http.Handler    // Cluster serves the internal cluster API, nil if clustering is disabled.
+	Replication http.Handler    // Replication serves the replication API, nil if replication is disabled.
+	Limited     *limit.Counters // Limited counts the requests rejected by the rate limits and the load shedding.
+	Checks      []health.Check  // Checks are the readiness checks of the storage besides Ping.
+	Log         zerolog.Logger  // Log is the logger instance.
+	Cfg         config.Config   // Cfg is the server configuration.
+	// router serves the requests, Reload replaces it.
+	router atomic.Pointer[chi.Mux]
+	// keys is the result of checking the keys the router is registered with.
+	keys atomic.Pointer[keyCheck]
+	// draining fails the readiness once the server shuts down.
+	draining atomic.Bool
+}
+
+// keyCheck is the result of checking the keys once they are loaded, err is nil if they are usable.
+type keyCheck struct {
+	err error
 }
 
 // New creates a new instance of the API server.
@@ -78,36 +101,88 @@ func New(cfg *config.Config, s Storage, l *zerolog.Logger) *API {
 	return &API{
 		Cfg:     *cfg,
 		Storage: s,
+		Limited: limit.NewCounters(),
 		Log:     *l,
 	}
 }
 
-// registerAPI registers the API routes and their corresponding handlers.
-// It also sets up the necessary middleware for each route.
-func (a *API) registerAPI() chi.Router {
+// rateLimits returns the middleware applying the configured rate limits of the clients and the
+// routes. The clients behind the trusted proxies are told apart by their X-Forwarded-For header.
+func (a *API) rateLimits(cfg config.Config) ([]func(http.Handler) http.Handler, error) {
+	var mws []func(http.Handler) http.Handler
+	if cfg.RateLimitClient > 0 {
+		proxies, err := limit.ParseProxies(cfg.RateLimitTrustedProxies)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse trusted proxies: %w", err)
+		}
+		rate := limit.NewRate(cfg.RateLimitClient, cfg.RateLimitBurst)
+		mws = append(mws, limit.RateLimit(rate, limit.ClientIPBehind(proxies), limit.ReasonClient, a.Limited, a.Log))
+	}
+	if cfg.RateLimitRoute > 0 {
+		rate := limit.NewRate(cfg.RateLimitRoute, cfg.RateLimitBurst)
+		mws = append(mws, limit.RateLimit(rate, limit.Route, limit.ReasonRoute, a.Limited, a.Log))
+	}
+	return mws, nil
+}
+
+// registerAPI registers the API routes and their corresponding handlers, returning them with
+// the check of the keys they use. It also sets up the necessary middleware for each route.
+func (a *API) registerAPI(cfg config.Config) (*chi.Mux, *keyCheck, error) {
 	// Parse the private key from the server configuration.
-	privateKey, err := ssl.ParsePrivateKey(a.Cfg.CryptoKey)
+	privateKey, err := ssl.ParsePrivateKey(cfg.CryptoKey)
 	if err != nil {
-		a.Log.Fatal().Msg("failed to parse private key")
+		return nil, nil, fmt.Errorf("failed to parse private key: %w", err)
 	}
+	k := &keyCheck{err: checkKeys(cfg, privateKey)}
 
 	// Create a new router.
 	r := chi.NewRouter()
 
-	// Set up the middleware for the router.
+	// Set up the middleware for the router, the request ID first so every response carries it.
+	r.Use(requestid.Handler)
 	r.Use(middleware.Recoverer)
+	r.Use(tracing.Handler)
 	r.Use(logger.RequestLogger(a.Log))
 
 	// Mount the profiler endpoint for debugging purposes.
 	r.Mount("/debug", middleware.Profiler())
+	// Serve the log level, to change it while debugging. Changing it needs a request signed with
+	// the HMAC key, so a client cannot flood the logs.
+	levelHandler := logging.LevelHandler(a.Log)
+	r.Get("/debug/loglevel", levelHandler.ServeHTTP)
+	r.With(hash.RequireSignature(a.Log, cfg.Key)).Put("/debug/loglevel", levelHandler.ServeHTTP)
+
+	// Serve the liveness and the readiness, never limited so they answer under load.
+	r.Get("/healthz", health.Handler(func() []health.Check { return nil }, health.DefaultTimeout, a.Log))
+	r.Get("/readyz", health.Handler(a.readiness, health.DefaultTimeout, a.Log))
+
+	// Mount the internal API used by the other cluster nodes.
+	if a.Cluster != nil {
+		r.Mount("/cluster", a.Cluster)
+	}
+
+	// Mount the replication API used by the replicas and for monitoring.
+	if a.Replication != nil {
+		r.Mount("/replication", a.Replication)
+	}
+
+	// Limit the requests of the clients to the metrics API.
+	rateLimits, err := a.rateLimits(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	shedder := limit.NewShedder(cfg.IngestConcurrency, cfg.IngestMaxLatency)
 
 	// Define the routes for updating metrics.
 	r.Route("/", func(r chi.Router) {
 		r.Group(func(r chi.Router) {
-			// Set up the middleware for updating metrics.
-			r.Use(compress.DecompressRequest(a.Log))
-			r.Use(hash.VerifyRequestBodyIntegrity(a.Log, a.Cfg.Key))
-			r.Use(ssl.Terminate(a.Log, privateKey))
+			// Set up the middleware for updating metrics, rejecting the requests over the limits
+			// before doing any work on them.
+			r.Use(rateLimits...)
+			r.Use(limit.Shed(shedder, a.Limited, a.Log))
+			r.Use(tracing.Middleware("DecompressRequest", compress.DecompressRequest(a.Log)))
+			r.Use(tracing.Middleware("VerifyRequestBodyIntegrity", hash.VerifyRequestBodyIntegrity(a.Log, cfg.Key)))
+			r.Use(tracing.Middleware("Terminate", ssl.Terminate(a.Log, privateKey)))
 			r.Use(compress.CompressResponse(a.Log))
 
 			// Define the routes for updating a single metric.
@@ -124,7 +199,8 @@ func (a *API) registerAPI() chi.Router {
 	// Define the routes for getting metrics.
 	r.Group(func(r chi.Router) {
 		// Set up the middleware for getting metrics.
-		r.Use(compress.DecompressRequest(a.Log))
+		r.Use(rateLimits...)
+		r.Use(tracing.Middleware("DecompressRequest", compress.DecompressRequest(a.Log)))
 
 		// Define the route for listing all metrics.
 		r.Get("/", ListAllMetrics(a))
@@ -139,7 +215,7 @@ func (a *API) registerAPI() chi.Router {
 		r.Get("/ping", PingDB(a))
 	})
 
-	return r
+	return r, k, nil
 }
 
 // InitServer initializes the server with the registered API routes. It returns an HTTP server.
@@ -147,31 +223,97 @@ func (a *API) InitServer() *http.Server {
 	a.Log.Info().Msgf("Starting server on %s", a.Cfg.Endpoint)
 
 	// Register the API routes.
-	r := a.registerAPI()
+	r, k, err := a.registerAPI(a.Cfg)
+	if err != nil {
+		a.Log.Fatal().Err(err).Msg("failed to register the API")
+	}
+	a.router.Store(r)
+	a.keys.Store(k)
 
 	// Return a new HTTP server.
 	return &http.Server{
-		Addr:    a.Cfg.Endpoint,
-		Handler: r,
+		Addr: a.Cfg.Endpoint,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			a.router.Load().ServeHTTP(w, r)
+		}),
 	}
 }
 
+// Reload applies the keys and the limits of the configuration to the next requests. The rate
+// limits and the load shedding start over. An invalid configuration is rejected and the running
+// one is kept.
+func (a *API) Reload(cfg config.Config) error {
+	r, k, err := a.registerAPI(cfg)
+	if err != nil {
+		return err
+	}
+	a.router.Store(r)
+	a.keys.Store(k)
+	a.Cfg = cfg
+	return nil
+}
+
+// Drain makes the readiness fail, so the traffic is routed to other servers while this one
+// shuts down.
+func (a *API) Drain() {
+	a.draining.Store(true)
+}
+
+// readiness returns the checks of the dependencies the server needs to serve the requests.
+func (a *API) readiness() []health.Check {
+	checks := []health.Check{{Name: "storage", Run: a.Storage.Ping}}
+	checks = append(checks, a.Checks...)
+	return append(checks,
+		health.Check{Name: "keys", Run: a.keysReady},
+		health.Check{Name: "shutdown", Run: a.checkDraining},
+	)
+}
+
+// checkKeys returns an error unless the private key decrypts the requests and the HMAC key is set
+// when the config requires one, e.g. for clustering.
+func checkKeys(cfg config.Config, privateKey *ecies.PrivateKey) error {
+	if err := ssl.CheckPrivateKey(privateKey); err != nil {
+		return fmt.Errorf("unusable private key: %w", err)
+	}
+	if (len(cfg.ClusterPeers) > 0 || cfg.ReplicationRole != "") && cfg.Key == "" {
+		return errors.New("HMAC key is not set")
+	}
+	return nil
+}
+
+// keysReady reports the result of checking the keys when they were loaded.
+func (a *API) keysReady(context.Context) error {
+	k := a.keys.Load()
+	if k == nil {
+		return errors.New("keys are not loaded")
+	}
+	return k.err
+}
+
+// checkDraining returns an error once the server shuts down.
+func (a *API) checkDraining(context.Context) error {
+	if a.draining.Load() {
+		return errors.New("server is shutting down")
+	}
+	return nil
+}
+
 // UpdateTheMetric handles updating a metric based on the HTTP request.
 func UpdateTheMetric(a *API) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		logger := a.Log.With().Str("func", "UpdateTheMetric").Logger()
+		logger := requestid.Logger(r.Context(), a.Log).With().Str("func", "UpdateTheMetric").Logger()
 		mType, mName, mValue := chi.URLParam(r, "mType"), chi.URLParam(r, "mName"), chi.URLParam(r, "mValue")
 		switch mType {
 		case models.Gauge:
 			{
 				v, err := strconv.ParseFloat(mValue, 64)
 				if err != nil {
-					http.Error(w, "Bad request to update gauge", http.StatusBadRequest)
+					requestid.Error(w, r, "Bad request to update gauge", http.StatusBadRequest)
 				}
 				err = a.Storage.InsertGauge(ctx, mName, v)
 				if err != nil {
-					http.Error(w, "Not Found", http.StatusBadRequest)
+					requestid.Error(w, r, "Not Found", http.StatusBadRequest)
 				}
 
 				w.WriteHeader(http.StatusOK)
@@ -182,12 +324,12 @@ func UpdateTheMetric(a *API) http.HandlerFunc {
 				v, err := strconv.ParseInt(mValue, 10, 64)
 				if err != nil {
 					logger.Error().Err(err).Msg("cannot parse counter")
-					http.Error(w, "Bad request to update counter", http.StatusBadRequest)
+					requestid.Error(w, r, "Bad request to update counter", http.StatusBadRequest)
 				}
 				err = a.Storage.InsertCounter(ctx, mName, v)
 
 				if err != nil {
-					http.Error(w, "Not Found", http.StatusBadRequest)
+					requestid.Error(w, r, "Not Found", http.StatusBadRequest)
 				}
 
 				w.WriteHeader(http.StatusOK)
@@ -202,7 +344,7 @@ func UpdateTheMetric(a *API) http.HandlerFunc {
 func GetTheMetric(a *API) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		logger := a.Log.With().Str("func", "UpdateTheMetric").Logger()
+		logger := requestid.Logger(r.Context(), a.Log).With().Str("func", "UpdateTheMetric").Logger()
 		mType, mName := chi.URLParam(r, "mType"), chi.URLParam(r, "mName")
 
 		switch mType {
@@ -239,24 +381,24 @@ func GetTheMetric(a *API) http.HandlerFunc {
 func ListAllMetrics(a *API) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		logger := a.Log.With().Str("func", "ListAllMetrics").Logger()
+		logger := requestid.Logger(r.Context(), a.Log).With().Str("func", "ListAllMetrics").Logger()
 		tmpl, err := template.New("index").Parse(htmlTemplate)
 		if err != nil {
 			logger.Error().Err(err).Msg("cannot create template")
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			requestid.Error(w, r, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		c, err := a.Storage.GetCounters(ctx)
 		if err != nil {
 			logger.Error().Err(err).Msg("cannot get counters")
-			http.Error(w, "", http.StatusInternalServerError)
+			requestid.Error(w, r, "", http.StatusInternalServerError)
 			return
 		}
 		g, err := a.Storage.GetGauges(ctx)
 		if err != nil {
 			logger.Error().Err(err).Msg("cannot get gauges")
-			http.Error(w, "", http.StatusInternalServerError)
+			requestid.Error(w, r, "", http.StatusInternalServerError)
 			return
 		}
 
@@ -271,7 +413,7 @@ func ListAllMetrics(a *API) http.HandlerFunc {
 		err = tmpl.Execute(w, data)
 		if err != nil {
 			logger.Error().Err(err).Msg("cannot execute template")
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			requestid.Error(w, r, err.Error(), http.StatusInternalServerError)
 		}
 	}
 }
@@ -280,15 +422,15 @@ func ListAllMetrics(a *API) http.HandlerFunc {
 func UpdateTheMetricWithJSON(a *API) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		logger := a.Log.With().Str("func", "UpdateTheMetricWithJSON").Logger()
+		logger := requestid.Logger(r.Context(), a.Log).With().Str("func", "UpdateTheMetricWithJSON").Logger()
 		if r.Header.Get(contentType) != applicationJSON {
-			http.Error(w, invalitContentTypeNotJSON, http.StatusBadRequest)
+			requestid.Error(w, r, invalitContentTypeNotJSON, http.StatusBadRequest)
 			logger.Debug().Msg(invalidContentType)
 			return
 		}
 		var m models.Metrics
 		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			requestid.Error(w, r, err.Error(), http.StatusBadRequest)
 			return
 		}
 		switch m.MType {
@@ -296,7 +438,7 @@ func UpdateTheMetricWithJSON(a *API) http.HandlerFunc {
 			err := a.Storage.InsertGauge(ctx, m.ID, *m.Value)
 			if err != nil {
 				logger.Error().Err(err).Msg("cannot insert gauge")
-				http.Error(w, internalServerError, http.StatusInternalServerError)
+				requestid.Error(w, r, internalServerError, http.StatusInternalServerError)
 				return
 			}
 			*m.Value, err = a.Storage.SelectGauge(ctx, m.ID)
@@ -318,7 +460,7 @@ func UpdateTheMetricWithJSON(a *API) http.HandlerFunc {
 			err := a.Storage.InsertCounter(ctx, m.ID, *m.Delta)
 			if err != nil {
 				logger.Error().Err(err).Msg("cannot insert counter")
-				http.Error(w, internalServerError, http.StatusInternalServerError)
+				requestid.Error(w, r, internalServerError, http.StatusInternalServerError)
 				return
 			}
 
@@ -337,7 +479,7 @@ func UpdateTheMetricWithJSON(a *API) http.HandlerFunc {
 			w.WriteHeader(http.StatusOK)
 			logger.Debug().Msg(sending200OK)
 		default:
-			http.Error(w, "Bad request", http.StatusBadRequest)
+			requestid.Error(w, r, "Bad request", http.StatusBadRequest)
 		}
 	}
 }
@@ -346,16 +488,16 @@ func UpdateTheMetricWithJSON(a *API) http.HandlerFunc {
 func GetTheMetricWithJSON(a *API) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		logger := a.Log.With().Str("func", "GetTheMetricWithJSON").Logger()
+		logger := requestid.Logger(r.Context(), a.Log).With().Str("func", "GetTheMetricWithJSON").Logger()
 		if r.Header.Get(contentType) != applicationJSON {
-			http.Error(w, invalitContentTypeNotJSON, http.StatusBadRequest)
+			requestid.Error(w, r, invalitContentTypeNotJSON, http.StatusBadRequest)
 			logger.Debug().Msg(invalidContentType)
 			return
 		}
 		var m models.Metrics
 		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
 			logger.Error().Err(err).Msg("cannot decode metric")
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			requestid.Error(w, r, err.Error(), http.StatusBadRequest)
 			return
 		}
 		switch m.MType {
@@ -395,7 +537,7 @@ func GetTheMetricWithJSON(a *API) http.HandlerFunc {
 			w.WriteHeader(http.StatusOK)
 			logger.Debug().Msg("GetTheMetricWithJSON: sending HTTP 200 response")
 		default:
-			http.Error(w, "Bad request", http.StatusBadRequest)
+			requestid.Error(w, r, "Bad request", http.StatusBadRequest)
 		}
 	}
 }
@@ -404,28 +546,28 @@ func GetTheMetricWithJSON(a *API) http.HandlerFunc {
 func UpdateSliceOfMetrics(a *API) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		logger := a.Log.With().Str("func", "UpdateSliceOfMetrics").Logger()
+		logger := requestid.Logger(r.Context(), a.Log).With().Str("func", "UpdateSliceOfMetrics").Logger()
 		if r.Header.Get(contentType) != applicationJSON {
-			http.Error(w, invalitContentTypeNotJSON, http.StatusBadRequest)
+			requestid.Error(w, r, invalitContentTypeNotJSON, http.StatusBadRequest)
 			logger.Debug().Msg(invalidContentType)
 			return
 		}
 		var metrics []models.Metrics
 		if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
 			logger.Error().Err(err).Msg("cannot decode slice of metrics")
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			requestid.Error(w, r, err.Error(), http.StatusBadRequest)
 			return
 		}
 		for _, m := range metrics {
 			if !(m.MType == models.Gauge || m.MType == models.Counter) {
 				fmt.Println(m.MType)
-				http.Error(w, "Invalid metric type", http.StatusBadRequest)
+				requestid.Error(w, r, "Invalid metric type", http.StatusBadRequest)
 				return
 			}
 		}
 		if err := a.Storage.InsertBatch(ctx, metrics); err != nil {
 			logger.Error().Err(err).Msg("cannot insert batch in handler")
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			requestid.Error(w, r, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
@@ -437,10 +579,12 @@ func UpdateSliceOfMetrics(a *API) http.HandlerFunc {
 func PingDB(a *API) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		logger := a.Log.With().Str("func", "PingDB").Logger()
+		logger := requestid.Logger(r.Context(), a.Log).With().Str("func", "PingDB").Logger()
 		if err := a.Storage.Ping(ctx); err != nil {
-			logger.Error().Err(err)
-			http.Error(w, internalServerError, http.StatusInternalServerError)
+			logger.Error().Err(err).Msg("cannot ping storage")
+			requestid.Error(w, r, internalServerError, http.StatusInternalServerError)
+			return
 		}
+		_, _ = w.Write([]byte("ok\n"))
 	}
 }
@@ -2,18 +2,30 @@ package transport
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
 	"testing"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/ospiem/mcollector/internal/health"
 	mock_transport "github.com/ospiem/mcollector/internal/mock"
 	"github.com/ospiem/mcollector/internal/models"
+	"github.com/ospiem/mcollector/internal/requestid"
+	"github.com/ospiem/mcollector/internal/server/config"
+	"github.com/rs/zerolog"
 	"go.uber.org/mock/gomock"
 )
 
@@ -873,3 +885,187 @@ func TestUpdateSliceOfMetrics(t *testing.T) {
 		})
 	}
 }
+
+// writeTestKey writes an EC private key, returning its path.
+func writeTestKey(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return keyPath
+}
+
+func TestLogLevelRoute(t *testing.T) {
+	l := zerolog.Nop()
+	a := New(&config.Config{CryptoKey: writeTestKey(t)}, nil, &l)
+	srv := a.InitServer()
+
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/loglevel", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"level"`) {
+		t.Errorf("got %v %q, want the log level", w.Code, w.Body.String())
+	}
+
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/debug/loglevel", strings.NewReader(`{"level":"trace"}`)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got %v for an unsigned change, want %v", w.Code, http.StatusForbidden)
+	}
+	if zerolog.GlobalLevel() != zerolog.InfoLevel {
+		t.Error("an unsigned request changed the log level")
+	}
+}
+
+func TestReload(t *testing.T) {
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+
+	s := mock_transport.NewMockStorage(mockCtl)
+	s.EXPECT().Ping(gomock.Any()).Return(nil).AnyTimes()
+	cfg := config.Config{CryptoKey: writeTestKey(t)}
+	l := zerolog.Nop()
+	a := New(&cfg, s, &l)
+	srv := a.InitServer()
+
+	ping := func() int {
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ping", nil))
+		return w.Code
+	}
+	for i := 0; i < 3; i++ {
+		if code := ping(); code != http.StatusOK {
+			t.Fatalf("got %v before the reload, want %v", code, http.StatusOK)
+		}
+	}
+
+	limited := cfg
+	limited.RateLimitClient, limited.RateLimitBurst = 0.001, 1
+	if err := a.Reload(limited); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if code := ping(); code != http.StatusOK {
+		t.Errorf("got %v for the first request, want %v", code, http.StatusOK)
+	}
+	if code := ping(); code != http.StatusTooManyRequests {
+		t.Errorf("got %v over the reloaded rate limit, want %v", code, http.StatusTooManyRequests)
+	}
+
+	invalid := cfg
+	invalid.CryptoKey = filepath.Join(t.TempDir(), "missing.pem")
+	if err := a.Reload(invalid); err == nil {
+		t.Error("reloaded a config without a private key")
+	}
+	if code := ping(); code != http.StatusTooManyRequests {
+		t.Errorf("got %v after the rejected reload, want %v", code, http.StatusTooManyRequests)
+	}
+}
+
+func TestHealthRoutes(t *testing.T) {
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+
+	s := mock_transport.NewMockStorage(mockCtl)
+	l := zerolog.Nop()
+	a := New(&config.Config{CryptoKey: writeTestKey(t)}, s, &l)
+	a.Checks = []health.Check{{Name: "migrations", Run: func(context.Context) error { return nil }}}
+	srv := a.InitServer()
+
+	get := func(path string) (int, health.Report) {
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var report health.Report
+		if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+			t.Fatalf("cannot decode the report of %s: %v", path, err)
+		}
+		return w.Code, report
+	}
+	statuses := func(report health.Report) map[string]string {
+		got := make(map[string]string)
+		for _, c := range report.Checks {
+			got[c.Name] = c.Status
+		}
+		return got
+	}
+
+	s.EXPECT().Ping(gomock.Any()).Return(nil)
+	code, report := get("/readyz")
+	want := map[string]string{"storage": "ok", "migrations": "ok", "keys": "ok", "shutdown": "ok"}
+	if code != http.StatusOK || !reflect.DeepEqual(statuses(report), want) {
+		t.Errorf("got %v %v, want %v %v", code, statuses(report), http.StatusOK, want)
+	}
+
+	s.EXPECT().Ping(gomock.Any()).Return(errors.New("connection refused"))
+	if code, report := get("/readyz"); code != http.StatusServiceUnavailable || statuses(report)["storage"] != "fail" {
+		t.Errorf("got %v %v with the storage down, want %v", code, statuses(report), http.StatusServiceUnavailable)
+	}
+
+	a.Drain()
+	s.EXPECT().Ping(gomock.Any()).Return(nil)
+	if code, report := get("/readyz"); code != http.StatusServiceUnavailable || statuses(report)["shutdown"] != "fail" {
+		t.Errorf("got %v %v while shutting down, want %v", code, statuses(report), http.StatusServiceUnavailable)
+	}
+	if code, report := get("/healthz"); code != http.StatusOK || report.Status != health.StatusOK {
+		t.Errorf("got %v %v for the liveness while shutting down, want %v", code, report.Status, http.StatusOK)
+	}
+}
+
+func TestCheckKeys(t *testing.T) {
+	l := zerolog.Nop()
+	a := New(&config.Config{CryptoKey: writeTestKey(t), ClusterPeers: []string{"a:8080"}}, nil, &l)
+	if err := a.keysReady(context.Background()); err == nil {
+		t.Error("keys are ready before they are loaded")
+	}
+
+	a.InitServer()
+	if err := a.keysReady(context.Background()); err == nil {
+		t.Error("keys are ready without the HMAC key the cluster needs")
+	}
+
+	cfg := a.Cfg
+	cfg.Key = "secret"
+	if err := a.Reload(cfg); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if err := a.keysReady(context.Background()); err != nil {
+		t.Errorf("got %v with the keys loaded, want them ready", err)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var logs strings.Builder
+	l := zerolog.New(&logs)
+	a := New(&config.Config{CryptoKey: writeTestKey(t)}, nil, &l)
+	srv := a.InitServer()
+
+	r := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader("not encrypted"))
+	r.Header.Set(requestid.Header, "batch-1")
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, r)
+
+	if got := w.Header().Get(requestid.Header); got != "batch-1" {
+		t.Errorf("got request ID %q in the response, want %q", got, "batch-1")
+	}
+	if w.Code != http.StatusBadRequest || !strings.HasSuffix(w.Body.String(), "(request ID batch-1)\n") {
+		t.Errorf("got %v %q, want the request ID in the error", w.Code, w.Body.String())
+	}
+	if !strings.Contains(logs.String(), `"request_id":"batch-1"`) {
+		t.Errorf("got logs %q, want the request ID in them", logs.String())
+	}
+
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Header().Get(requestid.Header) == "" {
+		t.Error("got no request ID for a request without one")
+	}
+}
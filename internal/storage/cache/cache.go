@@ -0,0 +1,459 @@
+// Package cache provides a read-through caching decorator for any storage backend.
+package cache
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/health"
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+// Storage is the interface of the decorated backend.
+type Storage interface {
+	InsertGauge(ctx context.Context, k string, v float64) error
+	InsertCounter(ctx context.Context, k string, v int64) error
+	SelectGauge(ctx context.Context, k string) (float64, error)
+	SelectCounter(ctx context.Context, k string) (int64, error)
+	GetCounters(ctx context.Context) (map[string]int64, error)
+	GetGauges(ctx context.Context) (map[string]float64, error)
+	InsertBatch(ctx context.Context, metrics []models.Metrics) error
+	DeleteMetrics(ctx context.Context, metrics []models.Metrics) error
+	Ping(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// IDs of the counters the statistics are flushed as.
+const (
+	HitsMetric   = "server.cache_hits"
+	MissesMetric = "server.cache_misses"
+	DirtyMetric  = "server.cache_dirty"
+)
+
+// Stats holds the hit and miss statistics of the cache.
+type Stats struct {
+	Hits   int64
+	Misses int64
+	// Dirty is the number of gauge writes dropped from the cache because they overlapped another
+	// write to the same gauge.
+	Dirty int64
+}
+
+// key identifies a cached metric.
+type key struct {
+	mType string
+	id    string
+}
+
+// Cache keeps the current values of the backend in memory and serves reads from them.
+// Writes go to the backend first and update the cache only when they succeed.
+// A value is never cached while a write to it is in flight, so a concurrent read cannot
+// store a value that is older than the one in the backend.
+type Cache struct {
+	s        Storage
+	mux      *sync.Mutex
+	counters map[string]int64
+	gauges   map[string]float64
+	// writing counts the in-flight writes per metric.
+	writing map[key]int
+	// dirty marks metrics with overlapping writes whose order in the backend is unknown.
+	dirty map[key]bool
+	// loadedAt is the time the cache was last reset.
+	loadedAt time.Time
+	hits     atomic.Int64
+	misses   atomic.Int64
+	dirtied  atomic.Int64
+	// flushed is the statistics at the previous flush.
+	flushed Stats
+	ttl     time.Duration
+	// gen is incremented after every write, reads only fill the cache if it did not change.
+	gen uint64
+	// inflight is the total number of in-flight writes.
+	inflight         int
+	countersComplete bool
+	gaugesComplete   bool
+}
+
+// New returns a Cache in front of s. If ttl is positive, the cache is dropped and reloaded
+// from the backend after ttl, which picks up changes made by other writers.
+func New(s Storage, ttl time.Duration) *Cache {
+	return &Cache{
+		s:        s,
+		ttl:      ttl,
+		mux:      &sync.Mutex{},
+		counters: make(map[string]int64),
+		gauges:   make(map[string]float64),
+		writing:  make(map[key]int),
+		dirty:    make(map[key]bool),
+		loadedAt: time.Now(),
+	}
+}
+
+// Stats returns the hit and miss statistics of the cache.
+func (c *Cache) Stats() Stats {
+	return Stats{Hits: c.hits.Load(), Misses: c.misses.Load(), Dirty: c.dirtied.Load()}
+}
+
+// Flush returns the statistics changed since the previous flush as the counters HitsMetric,
+// MissesMetric and DirtyMetric.
+func (c *Cache) Flush() []models.Metrics {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	stats := c.Stats()
+	deltas := []struct {
+		id string
+		n  int64
+	}{
+		{id: HitsMetric, n: stats.Hits - c.flushed.Hits},
+		{id: MissesMetric, n: stats.Misses - c.flushed.Misses},
+		{id: DirtyMetric, n: stats.Dirty - c.flushed.Dirty},
+	}
+	c.flushed = stats
+
+	metrics := make([]models.Metrics, 0, len(deltas))
+	for _, d := range deltas {
+		if d.n > 0 {
+			metrics = append(metrics, models.Metrics{ID: d.id, MType: models.Counter, Delta: &d.n})
+		}
+	}
+	return metrics
+}
+
+func (c *Cache) InsertGauge(ctx context.Context, k string, v float64) error {
+	mk := key{mType: models.Gauge, id: k}
+	c.beginWrite(mk)
+	err := c.s.InsertGauge(ctx, k, v)
+	c.endWrite(err, func() { c.applyGauge(mk, v) }, mk)
+	if err != nil {
+		return fmt.Errorf("cache insert gauge: %w", err)
+	}
+	return nil
+}
+
+func (c *Cache) InsertCounter(ctx context.Context, k string, v int64) error {
+	mk := key{mType: models.Counter, id: k}
+	c.beginWrite(mk)
+	err := c.s.InsertCounter(ctx, k, v)
+	c.endWrite(err, func() { c.applyCounter(mk, v) }, mk)
+	if err != nil {
+		return fmt.Errorf("cache insert counter: %w", err)
+	}
+	return nil
+}
+
+func (c *Cache) InsertBatch(ctx context.Context, metrics []models.Metrics) error {
+	// Aggregate the batch so every metric is written to the cache once.
+	counters := make(map[string]int64)
+	gauges := make(map[string]float64)
+	keys := make([]key, 0, len(metrics))
+	for _, m := range metrics {
+		switch m.MType {
+		case models.Counter:
+			if _, ok := counters[m.ID]; !ok {
+				keys = append(keys, key{mType: models.Counter, id: m.ID})
+			}
+			counters[m.ID] += *m.Delta
+		case models.Gauge:
+			if _, ok := gauges[m.ID]; !ok {
+				keys = append(keys, key{mType: models.Gauge, id: m.ID})
+			}
+			gauges[m.ID] = *m.Value
+		}
+	}
+
+	c.beginWrite(keys...)
+	err := c.s.InsertBatch(ctx, metrics)
+	c.endWrite(err, func() {
+		for _, k := range keys {
+			if k.mType == models.Counter {
+				c.applyCounter(k, counters[k.id])
+			} else {
+				c.applyGauge(k, gauges[k.id])
+			}
+		}
+	}, keys...)
+	if err != nil {
+		return fmt.Errorf("cache insert batch: %w", err)
+	}
+	return nil
+}
+
+func (c *Cache) DeleteMetrics(ctx context.Context, metrics []models.Metrics) error {
+	keys := make([]key, 0, len(metrics))
+	for _, m := range metrics {
+		keys = append(keys, key{mType: m.MType, id: m.ID})
+	}
+
+	c.beginWrite(keys...)
+	err := c.s.DeleteMetrics(ctx, metrics)
+	c.endWrite(err, func() {
+		for _, k := range keys {
+			c.applyDelete(k)
+		}
+	}, keys...)
+	if err != nil {
+		return fmt.Errorf("cache delete metrics: %w", err)
+	}
+	return nil
+}
+
+func (c *Cache) SelectGauge(ctx context.Context, k string) (float64, error) {
+	mk := key{mType: models.Gauge, id: k}
+
+	c.mux.Lock()
+	c.expire()
+	if v, ok := c.gauges[k]; ok {
+		c.mux.Unlock()
+		c.hits.Add(1)
+		return v, nil
+	}
+	if c.gaugesComplete && c.writing[mk] == 0 {
+		c.mux.Unlock()
+		c.hits.Add(1)
+		return 0, fmt.Errorf("gauge: %w", models.ErrNotFound)
+	}
+	gen := c.gen
+	c.mux.Unlock()
+	c.misses.Add(1)
+
+	v, err := c.s.SelectGauge(ctx, k)
+	if err != nil {
+		return 0, fmt.Errorf("cache select gauge: %w", err)
+	}
+
+	c.mux.Lock()
+	if c.canFill(gen, mk) {
+		c.gauges[k] = v
+	}
+	c.mux.Unlock()
+
+	return v, nil
+}
+
+func (c *Cache) SelectCounter(ctx context.Context, k string) (int64, error) {
+	mk := key{mType: models.Counter, id: k}
+
+	c.mux.Lock()
+	c.expire()
+	if v, ok := c.counters[k]; ok {
+		c.mux.Unlock()
+		c.hits.Add(1)
+		return v, nil
+	}
+	if c.countersComplete && c.writing[mk] == 0 {
+		c.mux.Unlock()
+		c.hits.Add(1)
+		return 0, fmt.Errorf("counter: %w", models.ErrNotFound)
+	}
+	gen := c.gen
+	c.mux.Unlock()
+	c.misses.Add(1)
+
+	v, err := c.s.SelectCounter(ctx, k)
+	if err != nil {
+		return 0, fmt.Errorf("cache select counter: %w", err)
+	}
+
+	c.mux.Lock()
+	if c.canFill(gen, mk) {
+		c.counters[k] = v
+	}
+	c.mux.Unlock()
+
+	return v, nil
+}
+
+func (c *Cache) GetCounters(ctx context.Context) (map[string]int64, error) {
+	c.mux.Lock()
+	c.expire()
+	if c.countersComplete {
+		m := maps.Clone(c.counters)
+		c.mux.Unlock()
+		c.hits.Add(1)
+		return m, nil
+	}
+	gen := c.gen
+	c.mux.Unlock()
+	c.misses.Add(1)
+
+	m, err := c.s.GetCounters(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cache get counters: %w", err)
+	}
+	m = maps.Clone(m)
+
+	c.mux.Lock()
+	if c.gen == gen && c.inflight == 0 {
+		c.counters = maps.Clone(m)
+		c.countersComplete = true
+	}
+	c.mux.Unlock()
+
+	return m, nil
+}
+
+func (c *Cache) GetGauges(ctx context.Context) (map[string]float64, error) {
+	c.mux.Lock()
+	c.expire()
+	if c.gaugesComplete {
+		m := maps.Clone(c.gauges)
+		c.mux.Unlock()
+		c.hits.Add(1)
+		return m, nil
+	}
+	gen := c.gen
+	c.mux.Unlock()
+	c.misses.Add(1)
+
+	m, err := c.s.GetGauges(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cache get gauges: %w", err)
+	}
+	m = maps.Clone(m)
+
+	c.mux.Lock()
+	if c.gen == gen && c.inflight == 0 {
+		c.gauges = maps.Clone(m)
+		c.gaugesComplete = true
+	}
+	c.mux.Unlock()
+
+	return m, nil
+}
+
+func (c *Cache) Ping(ctx context.Context) error {
+	if err := c.s.Ping(ctx); err != nil {
+		return fmt.Errorf("cache ping: %w", err)
+	}
+	return nil
+}
+
+// Checks returns the readiness checks of the backend besides Ping.
+func (c *Cache) Checks() []health.Check {
+	if ch, ok := c.s.(interface{ Checks() []health.Check }); ok {
+		return ch.Checks()
+	}
+	return nil
+}
+
+func (c *Cache) Close(ctx context.Context) error {
+	stats := c.Stats()
+	log.Info().Int64("hits", stats.Hits).Int64("misses", stats.Misses).Int64("dirty", stats.Dirty).
+		Msg("cache statistics")
+
+	if err := c.s.Close(ctx); err != nil {
+		return fmt.Errorf("cache close: %w", err)
+	}
+	return nil
+}
+
+// beginWrite registers in-flight writes to the given metrics.
+func (c *Cache) beginWrite(keys ...key) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for _, k := range keys {
+		c.writing[k]++
+		if c.writing[k] > 1 {
+			c.dirty[k] = true
+		}
+	}
+	c.inflight++
+}
+
+// endWrite finishes in-flight writes to the given metrics. If the write succeeded, apply
+// updates the cached values, otherwise the metrics are dropped from the cache.
+func (c *Cache) endWrite(err error, apply func(), keys ...key) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.gen++
+	c.inflight--
+	if err != nil {
+		for _, k := range keys {
+			c.invalidate(k)
+		}
+	} else {
+		apply()
+	}
+
+	for _, k := range keys {
+		c.writing[k]--
+		if c.writing[k] == 0 {
+			delete(c.writing, k)
+			delete(c.dirty, k)
+		}
+	}
+}
+
+// applyCounter adds a successfully written delta to the cached counter.
+// Counter updates commute, so overlapping writes do not need to be invalidated.
+func (c *Cache) applyCounter(k key, delta int64) {
+	if v, ok := c.counters[k.id]; ok {
+		c.counters[k.id] = v + delta
+		return
+	}
+	// A complete set without the counter means the backend did not have it either.
+	if c.countersComplete {
+		c.counters[k.id] = delta
+	}
+}
+
+// applyGauge stores a successfully written gauge unless another write to it overlapped.
+func (c *Cache) applyGauge(k key, v float64) {
+	if c.dirty[k] {
+		c.dirtied.Add(1)
+		c.invalidate(k)
+		return
+	}
+	c.gauges[k.id] = v
+}
+
+// applyDelete drops a successfully deleted metric from the cache. A complete set stays complete,
+// unless another write to the metric overlapped and its order with the delete is unknown.
+func (c *Cache) applyDelete(k key) {
+	if c.dirty[k] {
+		c.invalidate(k)
+		return
+	}
+	if k.mType == models.Counter {
+		delete(c.counters, k.id)
+		return
+	}
+	delete(c.gauges, k.id)
+}
+
+// invalidate drops a metric from the cache.
+func (c *Cache) invalidate(k key) {
+	if k.mType == models.Counter {
+		delete(c.counters, k.id)
+		c.countersComplete = false
+		return
+	}
+	delete(c.gauges, k.id)
+	c.gaugesComplete = false
+}
+
+// canFill reports whether a value read from the backend at generation gen may be cached.
+func (c *Cache) canFill(gen uint64, k key) bool {
+	return c.gen == gen && c.writing[k] == 0
+}
+
+// expire drops the whole cache once the ttl has passed.
+func (c *Cache) expire() {
+	if c.ttl <= 0 || time.Since(c.loadedAt) < c.ttl {
+		return
+	}
+
+	c.counters = make(map[string]int64)
+	c.gauges = make(map[string]float64)
+	c.countersComplete = false
+	c.gaugesComplete = false
+	c.loadedAt = time.Now()
+}
@@ -0,0 +1,185 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ospiem/mcollector/internal/models"
+	memorystorage "github.com/ospiem/mcollector/internal/storage/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errBackend = errors.New("backend is down")
+
+// countingStorage counts the reads that reach the backend and can fail writes on demand.
+type countingStorage struct {
+	*memorystorage.MemStorage
+	failWrites bool
+	reads      int
+}
+
+func (s *countingStorage) InsertGauge(ctx context.Context, k string, v float64) error {
+	if s.failWrites {
+		return errBackend
+	}
+	return s.MemStorage.InsertGauge(ctx, k, v)
+}
+
+func (s *countingStorage) InsertCounter(ctx context.Context, k string, v int64) error {
+	if s.failWrites {
+		return errBackend
+	}
+	return s.MemStorage.InsertCounter(ctx, k, v)
+}
+
+func (s *countingStorage) SelectGauge(ctx context.Context, k string) (float64, error) {
+	s.reads++
+	return s.MemStorage.SelectGauge(ctx, k)
+}
+
+func (s *countingStorage) SelectCounter(ctx context.Context, k string) (int64, error) {
+	s.reads++
+	return s.MemStorage.SelectCounter(ctx, k)
+}
+
+func (s *countingStorage) GetCounters(ctx context.Context) (map[string]int64, error) {
+	s.reads++
+	return s.MemStorage.GetCounters(ctx)
+}
+
+func (s *countingStorage) GetGauges(ctx context.Context) (map[string]float64, error) {
+	s.reads++
+	return s.MemStorage.GetGauges(ctx)
+}
+
+func newBackend() *countingStorage {
+	return &countingStorage{MemStorage: memorystorage.New()}
+}
+
+func TestCacheServesReadsAfterWrites(t *testing.T) {
+	ctx := context.Background()
+	b := newBackend()
+	c := New(b, 0)
+
+	require.NoError(t, c.InsertGauge(ctx, "Alloc", 1.5))
+	v, err := c.SelectGauge(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, v)
+	assert.Equal(t, 0, b.reads)
+
+	require.NoError(t, c.InsertCounter(ctx, "PollCount", 2))
+	_, err = c.SelectCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	require.NoError(t, c.InsertCounter(ctx, "PollCount", 3))
+
+	d, err := c.SelectCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), d)
+	assert.Equal(t, 1, b.reads)
+	assert.Equal(t, Stats{Hits: 2, Misses: 1}, c.Stats())
+}
+
+func TestCacheGetAll(t *testing.T) {
+	ctx := context.Background()
+	b := newBackend()
+	require.NoError(t, b.InsertCounter(ctx, "PollCount", 1))
+	c := New(b, 0)
+
+	counters, err := c.GetCounters(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"PollCount": 1}, counters)
+
+	require.NoError(t, c.InsertBatch(ctx, []models.Metrics{
+		{ID: "PollCount", MType: models.Counter, Delta: ptr(int64(1))},
+		{ID: "PollCount", MType: models.Counter, Delta: ptr(int64(1))},
+		{ID: "NewCounter", MType: models.Counter, Delta: ptr(int64(4))},
+	}))
+
+	counters, err = c.GetCounters(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"PollCount": 3, "NewCounter": 4}, counters)
+
+	_, err = c.SelectCounter(ctx, "Missing")
+	assert.Error(t, err)
+	assert.Equal(t, 1, b.reads)
+}
+
+func TestCacheInvalidatesOnFailedWrite(t *testing.T) {
+	ctx := context.Background()
+	b := newBackend()
+	c := New(b, 0)
+
+	require.NoError(t, c.InsertGauge(ctx, "Alloc", 1))
+	b.failWrites = true
+	assert.ErrorIs(t, c.InsertGauge(ctx, "Alloc", 2), errBackend)
+	b.failWrites = false
+
+	v, err := c.SelectGauge(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, float64(1), v)
+	assert.Equal(t, 1, b.reads)
+}
+
+func TestCacheDeletes(t *testing.T) {
+	ctx := context.Background()
+	b := newBackend()
+	require.NoError(t, b.InsertGauge(ctx, "Alloc", 1))
+	require.NoError(t, b.InsertGauge(ctx, "Stale", 2))
+	c := New(b, 0)
+
+	_, err := c.GetGauges(ctx)
+	require.NoError(t, err)
+	require.NoError(t, c.DeleteMetrics(ctx, []models.Metrics{{ID: "Stale", MType: models.Gauge}}))
+
+	gauges, err := c.GetGauges(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"Alloc": 1}, gauges)
+	_, err = c.SelectGauge(ctx, "Stale")
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	assert.Equal(t, 1, b.reads, "the cached set stays complete")
+}
+
+func TestCacheExpires(t *testing.T) {
+	ctx := context.Background()
+	b := newBackend()
+	c := New(b, time.Millisecond)
+
+	require.NoError(t, c.InsertGauge(ctx, "Alloc", 1))
+	require.NoError(t, b.MemStorage.InsertGauge(ctx, "Alloc", 2))
+	time.Sleep(2 * time.Millisecond)
+
+	v, err := c.SelectGauge(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, float64(2), v)
+}
+
+func TestCacheFlush(t *testing.T) {
+	ctx := context.Background()
+	c := New(newBackend(), 0)
+
+	require.NoError(t, c.InsertGauge(ctx, "Alloc", 1))
+	_, err := c.SelectCounter(ctx, "PollCount")
+	require.Error(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = c.SelectGauge(ctx, "Alloc")
+		require.NoError(t, err)
+	}
+
+	assert.ElementsMatch(t, []models.Metrics{
+		{ID: HitsMetric, MType: models.Counter, Delta: ptr(int64(2))},
+		{ID: MissesMetric, MType: models.Counter, Delta: ptr(int64(1))},
+	}, c.Flush())
+	assert.Empty(t, c.Flush(), "the statistics are flushed once")
+
+	_, err = c.SelectGauge(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, []models.Metrics{{ID: HitsMetric, MType: models.Counter, Delta: ptr(int64(1))}}, c.Flush())
+	assert.Equal(t, Stats{Hits: 3, Misses: 1}, c.Stats())
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -4,8 +4,13 @@ package config
 import "time"
 
 type Config struct {
-	FileStoragePath string `env:"FILE_STORAGE_PATH"`
-	DatabaseDsn     string `env:"DATABASE_DSN"`
-	Restore         bool   `env:"RESTORE"`
+	FileStoragePath string
+	DatabaseDsn     string
+	RedisURL        string
+	Restore         bool
 	StoreInterval   time.Duration
+	// Cache enables the read-through cache in front of the storage.
+	Cache bool
+	// CacheTTL is the time after which the cache is reloaded from the storage, 0 never reloads it.
+	CacheTTL time.Duration
 }
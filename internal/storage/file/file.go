@@ -10,7 +10,11 @@ import (
 	"os"
 	"time"
 
+	"github.com/ospiem/mcollector/internal/health"
+	"github.com/ospiem/mcollector/internal/requestid"
+	"github.com/ospiem/mcollector/internal/retry"
 	memorystorage "github.com/ospiem/mcollector/internal/storage/memory"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
 	"github.com/ospiem/mcollector/internal/models"
@@ -18,6 +22,28 @@ import (
 
 const filePermission = 0644
 
+// Retry settings for flushing metrics to the file.
+const (
+	flushRetryAttempts        = 3
+	flushRetryInitialInterval = 100 * time.Millisecond
+	flushRetryMultiplier      = 2
+	flushRetryRandomization   = 0.2
+	closeFlushTimeout         = 5 * time.Second
+)
+
+// flushRetryPolicy returns the policy used to retry a failed flush, the retries are logged to l.
+func flushRetryPolicy(l zerolog.Logger) retry.Policy {
+	return retry.Policy{
+		InitialInterval:     flushRetryInitialInterval,
+		Multiplier:          flushRetryMultiplier,
+		RandomizationFactor: flushRetryRandomization,
+		MaxAttempts:         flushRetryAttempts,
+		OnRetry: func(err error, wait time.Duration) {
+			l.Error().Err(err).Dur("wait", wait).Msg("cannot flush metrics, will retry")
+		},
+	}
+}
+
 type FileStorage struct {
 	m               *memorystorage.MemStorage
 	FileStoragePath string
@@ -53,9 +79,15 @@ func New(ctx context.Context, fileStoragePath string,
 			t := time.NewTicker(f.StoreInterval)
 			defer t.Stop()
 
-			for range t.C {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-t.C:
+				}
+
 				log.Debug().Msg("attempt to flush metrics by ticker")
-				err := f.flushMetrics(ctx)
+				err := f.flush(ctx)
 				if err != nil {
 					log.Error().Err(err).Msg("cannot flush metrics in time")
 				}
@@ -71,8 +103,9 @@ func (f *FileStorage) InsertGauge(ctx context.Context, k string, v float64) erro
 		return fmt.Errorf("InsertGauge: %w", err)
 	}
 	if f.StoreInterval == 0 {
-		log.Debug().Msg("attempt to flush metrics in handler")
-		err := f.flushMetrics(ctx)
+		l := requestid.Logger(ctx, log.Logger)
+		l.Debug().Msg("attempt to flush metrics in handler")
+		err := f.flush(ctx)
 		if err != nil {
 			return fmt.Errorf("cannot flush metrics in handler: %w", err)
 		}
@@ -85,8 +118,9 @@ func (f *FileStorage) InsertCounter(ctx context.Context, k string, v int64) erro
 		return fmt.Errorf("InsertCounter: %w", err)
 	}
 	if f.StoreInterval == 0 {
-		log.Debug().Msg("attempt to flush metrics in handler")
-		err := f.flushMetrics(ctx)
+		l := requestid.Logger(ctx, log.Logger)
+		l.Debug().Msg("attempt to flush metrics in handler")
+		err := f.flush(ctx)
 		if err != nil {
 			return fmt.Errorf("cannot flush metrics in handler: %w", err)
 		}
@@ -142,17 +176,50 @@ func (f *FileStorage) InsertBatch(ctx context.Context, metrics []models.Metrics)
 	return nil
 }
 
+// DeleteMetrics deletes the metrics with the IDs and types of metrics, the missing ones are ignored.
+func (f *FileStorage) DeleteMetrics(ctx context.Context, metrics []models.Metrics) error {
+	if err := f.m.DeleteMetrics(ctx, metrics); err != nil {
+		return fmt.Errorf("DeleteMetrics: %w", err)
+	}
+	if f.StoreInterval == 0 {
+		l := requestid.Logger(ctx, log.Logger)
+		l.Debug().Msg("attempt to flush metrics in handler")
+		if err := f.flush(ctx); err != nil {
+			return fmt.Errorf("cannot flush metrics in handler: %w", err)
+		}
+	}
+	return nil
+}
+
 func (f *FileStorage) Ping(ctx context.Context) error {
 	return nil
 }
 
+// CheckWritable returns an error if the metrics cannot be flushed to the file. The file is
+// created if it does not exist, its content is left untouched.
+func (f *FileStorage) CheckWritable(ctx context.Context) error {
+	file, err := os.OpenFile(f.FileStoragePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, filePermission)
+	if err != nil {
+		return fmt.Errorf("file is not writable: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("cannot close file: %w", err)
+	}
+	return nil
+}
+
+// Checks returns the readiness checks of the file besides Ping.
+func (f *FileStorage) Checks() []health.Check {
+	return []health.Check{{Name: "file", Run: f.CheckWritable}}
+}
+
 type producer struct {
 	file    *os.File
 	encoder *json.Encoder
 }
 
 func newProducer(filename string) (*producer, error) {
-	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, filePermission)
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, filePermission)
 	if err != nil {
 		return nil, fmt.Errorf("newProduce: %w", err)
 	}
@@ -209,8 +276,15 @@ func (p *producer) writeMetric(metric models.Metrics) error {
 	return nil
 }
 
+// flush writes all metrics to the file, retrying on failure until ctx is done. The logs carry the
+// request ID of ctx.
+func (f *FileStorage) flush(ctx context.Context) error {
+	return flushRetryPolicy(requestid.Logger(ctx, log.Logger)).Do(ctx, f.flushMetrics)
+}
+
 func (f *FileStorage) flushMetrics(ctx context.Context) error {
 	const wrapError = "flush metrics error"
+	l := requestid.Logger(ctx, log.Logger)
 
 	p, err := newProducer(f.FileStoragePath)
 	if err != nil {
@@ -219,7 +293,7 @@ func (f *FileStorage) flushMetrics(ctx context.Context) error {
 
 	defer func() {
 		if err := p.close(); err != nil {
-			log.Error().Err(err).Msg("cannot close gzip in compress response")
+			l.Error().Err(err).Msg("cannot close gzip in compress response")
 		}
 	}()
 
@@ -230,7 +304,7 @@ func (f *FileStorage) flushMetrics(ctx context.Context) error {
 	if err = flushCounters(p, counters); err != nil {
 		return fmt.Errorf("%s: %w", wrapError, err)
 	}
-	log.Debug().Msg("flushed counters")
+	l.Debug().Msg("flushed counters")
 
 	gauges, err := f.m.GetGauges(ctx)
 	if err != nil {
@@ -239,7 +313,7 @@ func (f *FileStorage) flushMetrics(ctx context.Context) error {
 	if err = flushGauges(p, gauges); err != nil {
 		return fmt.Errorf("%s: %w", wrapError, err)
 	}
-	log.Debug().Msg("flushed gauges")
+	l.Debug().Msg("flushed gauges")
 
 	return nil
 }
@@ -307,6 +381,11 @@ func flushGauges(p *producer, c map[string]float64) error {
 	return nil
 }
 
+// Close flushes the metrics to the file. The flush is retried even if ctx is already
+// cancelled, since Close is usually called during shutdown.
 func (f *FileStorage) Close(ctx context.Context) error {
-	return f.flushMetrics(ctx)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), closeFlushTimeout)
+	defer cancel()
+
+	return f.flush(ctx)
 }
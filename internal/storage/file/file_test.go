@@ -2,6 +2,7 @@ package file
 
 import (
 	"context"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -81,3 +82,13 @@ func TestSelectCounterWithNonExistingKey(t *testing.T) {
 
 	assert.Error(t, err)
 }
+
+func TestCheckWritable(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := New(context.Background(), filepath.Join(dir, "metrics.json"), false, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fs.CheckWritable(context.Background()))
+
+	fs.FileStoragePath = filepath.Join(dir, "missing", "metrics.json")
+	assert.Error(t, fs.CheckWritable(context.Background()))
+}
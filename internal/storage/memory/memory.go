@@ -3,7 +3,8 @@ package memorystorage
 
 import (
 	"context"
-	"errors"
+	"fmt"
+	"maps"
 	"sync"
 
 	"github.com/ospiem/mcollector/internal/models"
@@ -39,7 +40,7 @@ func (mem *MemStorage) SelectGauge(ctx context.Context, k string) (float64, erro
 	if v, ok := mem.gauge[k]; ok {
 		return v, nil
 	}
-	return 0, errors.New("gauge does not exist")
+	return 0, fmt.Errorf("gauge: %w", models.ErrNotFound)
 }
 
 func (mem *MemStorage) SelectCounter(ctx context.Context, k string) (int64, error) {
@@ -48,16 +49,33 @@ func (mem *MemStorage) SelectCounter(ctx context.Context, k string) (int64, erro
 	if v, ok := mem.counter[k]; ok {
 		return v, nil
 	}
-	return 0, errors.New("counter does not exist")
+	return 0, fmt.Errorf("counter: %w", models.ErrNotFound)
+}
+
+// DeleteMetrics deletes the metrics with the IDs and types of metrics, the missing ones are ignored.
+func (mem *MemStorage) DeleteMetrics(ctx context.Context, metrics []models.Metrics) error {
+	mem.mux.Lock()
+	defer mem.mux.Unlock()
+	for _, m := range metrics {
+		switch m.MType {
+		case models.Counter:
+			delete(mem.counter, m.ID)
+		case models.Gauge:
+			delete(mem.gauge, m.ID)
+		}
+	}
+	return nil
 }
 
 func (mem *MemStorage) GetCounters(ctx context.Context) (map[string]int64, error) {
-	m := mem.counter
-	return m, nil
+	mem.mux.RLock()
+	defer mem.mux.RUnlock()
+	return maps.Clone(mem.counter), nil
 }
 func (mem *MemStorage) GetGauges(ctx context.Context) (map[string]float64, error) {
-	m := mem.gauge
-	return m, nil
+	mem.mux.RLock()
+	defer mem.mux.RUnlock()
+	return maps.Clone(mem.gauge), nil
 }
 
 func (mem *MemStorage) InsertBatch(ctx context.Context, metrics []models.Metrics) error {
@@ -35,12 +35,12 @@ func TestMemStorage(t *testing.T) {
 
 	t.Run("SelectNonExistingGauge", func(t *testing.T) {
 		_, err := mem.SelectGauge(context.Background(), "non_existing")
-		assert.Error(t, err)
+		assert.ErrorIs(t, err, models.ErrNotFound)
 	})
 
 	t.Run("SelectNonExistingCounter", func(t *testing.T) {
 		_, err := mem.SelectCounter(context.Background(), "non_existing")
-		assert.Error(t, err)
+		assert.ErrorIs(t, err, models.ErrNotFound)
 	})
 
 	t.Run("GetCounters", func(t *testing.T) {
@@ -63,6 +63,18 @@ func TestMemStorage(t *testing.T) {
 		assert.NoError(t, err)
 	})
 
+	t.Run("DeleteMetrics", func(t *testing.T) {
+		err := mem.DeleteMetrics(context.Background(), []models.Metrics{
+			{ID: "test", MType: models.Gauge},
+			{ID: "missing", MType: models.Counter},
+		})
+		assert.NoError(t, err)
+		_, err = mem.SelectGauge(context.Background(), "test")
+		assert.ErrorIs(t, err, models.ErrNotFound)
+		_, err = mem.SelectCounter(context.Background(), "test")
+		assert.NoError(t, err)
+	})
+
 	t.Run("Ping", func(t *testing.T) {
 		err := mem.Ping(context.Background())
 		assert.NoError(t, err)
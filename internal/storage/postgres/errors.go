@@ -1,17 +0,0 @@
-package postgres
-
-import (
-	"errors"
-
-	"github.com/jackc/pgerrcode"
-	"github.com/jackc/pgx/v5/pgconn"
-)
-
-var pgErr *pgconn.PgError
-
-func isConnExp(err error) bool {
-	if errors.As(err, &pgErr) {
-		return pgerrcode.IsConnectionException(pgErr.Code)
-	}
-	return false
-}
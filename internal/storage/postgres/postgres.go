@@ -6,6 +6,8 @@ import (
 	"embed"
 	"errors"
 	"fmt"
+	"io/fs"
+	"sort"
 	"time"
 
 	"github.com/golang-migrate/migrate/v4"
@@ -13,13 +15,24 @@ import (
 	"github.com/golang-migrate/migrate/v4/source/iofs"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/ospiem/mcollector/internal/health"
 	"github.com/ospiem/mcollector/internal/models"
+	"github.com/ospiem/mcollector/internal/requestid"
+	"github.com/ospiem/mcollector/internal/retry"
 	"github.com/rs/zerolog/log"
 )
 
-const connPGError = "cannot connect to postgres, will retry in"
-const retryAttempts = 3
-const repeatFactor = 2
+const connPGError = "transient postgres error, will retry"
+
+// Retry settings for transient postgres errors.
+const (
+	retryAttempts        = 4
+	retryInitialInterval = 1 * time.Second
+	retryMaxInterval     = 5 * time.Second
+	retryMaxElapsedTime  = 15 * time.Second
+	retryMultiplier      = 2
+	retryRandomization   = 0.2
+)
 
 type DB struct {
 	pool *pgxpool.Pool
@@ -79,11 +92,58 @@ func runMigrations(dsn string) error {
 	return nil
 }
 
-func (db DB) InsertGauge(ctx context.Context, k string, v float64) error {
-	sleepTime := 1 * time.Second
-	attempt := 0
+// latestMigration returns the version of the last embedded migration.
+func latestMigration() (uint, error) {
+	d, err := iofs.New(migrationsDir, "migrations")
+	if err != nil {
+		return 0, fmt.Errorf("failed to return an iofs driver: %w", err)
+	}
+	defer d.Close()
 
+	version, err := d.First()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the first migration: %w", err)
+	}
 	for {
+		next, err := d.Next(version)
+		if errors.Is(err, fs.ErrNotExist) {
+			return version, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read the migration after %d: %w", version, err)
+		}
+		version = next
+	}
+}
+
+// CheckMigrations returns an error unless the last embedded migration is applied cleanly.
+func (db DB) CheckMigrations(ctx context.Context) error {
+	want, err := latestMigration()
+	if err != nil {
+		return err
+	}
+
+	var version int64
+	var dirty bool
+	if err := db.pool.QueryRow(ctx, "SELECT version, dirty FROM schema_migrations").Scan(&version, &dirty); err != nil {
+		return fmt.Errorf("cannot read the migration version: %w", err)
+	}
+	if dirty {
+		return fmt.Errorf("migration %d failed and left the schema dirty", version)
+	}
+	if version < int64(want) {
+		return fmt.Errorf("schema is at migration %d, want %d", version, want)
+	}
+	return nil
+}
+
+// Checks returns the readiness checks of the database besides Ping.
+func (db DB) Checks() []health.Check {
+	return []health.Check{{Name: "migrations", Run: db.CheckMigrations}}
+}
+
+func (db DB) InsertGauge(ctx context.Context, k string, v float64) error {
+	err := db.retryPolicy(ctx).Do(ctx, func(ctx context.Context) error {
 		tag, err := db.pool.Exec(
 			ctx,
 			`INSERT INTO gauges (id, gauge) VALUES ($1, $2)
@@ -91,30 +151,23 @@ func (db DB) InsertGauge(ctx context.Context, k string, v float64) error {
 			k, v,
 		)
 		if err != nil {
-			if attempt < retryAttempts {
-				log.Error().Err(err).Msgf("%s %v", connPGError, sleepTime)
-				time.Sleep(sleepTime)
-				sleepTime += repeatFactor * time.Second
-				attempt++
-				continue
-			}
-			return fmt.Errorf("failed to store gauge: %w", err)
+			return err
 		}
-		rowsAffectedCount := tag.RowsAffected()
-		if rowsAffectedCount != 1 {
-			return fmt.Errorf("insertGauge expected one row to be affected, actually affected %d", rowsAffectedCount)
+		if rowsAffectedCount := tag.RowsAffected(); rowsAffectedCount != 1 {
+			return retry.Permanent(fmt.Errorf("insertGauge expected one row to be affected, actually affected %d",
+				rowsAffectedCount))
 		}
-		break
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store gauge: %w", err)
 	}
 
 	return nil
 }
 
 func (db DB) InsertCounter(ctx context.Context, k string, v int64) error {
-	sleepTime := 1 * time.Second
-	attempt := 0
-
-	for {
+	err := db.retryPolicy(ctx).Do(ctx, func(ctx context.Context) error {
 		tag, err := db.pool.Exec(
 			ctx,
 			`INSERT INTO counters (id, counter) VALUES ($1, $2)
@@ -122,20 +175,16 @@ func (db DB) InsertCounter(ctx context.Context, k string, v int64) error {
 			k, v,
 		)
 		if err != nil {
-			if attempt < retryAttempts {
-				log.Error().Err(err).Msgf("%s %v", connPGError, sleepTime)
-				time.Sleep(sleepTime)
-				sleepTime += repeatFactor * time.Second
-				attempt++
-				continue
-			}
-			return fmt.Errorf("failed to store counter: %w", err)
+			return err
 		}
-		rowsAffectedCount := tag.RowsAffected()
-		if rowsAffectedCount != 1 {
-			return fmt.Errorf("insertCounter expected one row to be affected, actually affected %d", rowsAffectedCount)
+		if rowsAffectedCount := tag.RowsAffected(); rowsAffectedCount != 1 {
+			return retry.Permanent(fmt.Errorf("insertCounter expected one row to be affected, actually affected %d",
+				rowsAffectedCount))
 		}
-		break
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store counter: %w", err)
 	}
 
 	return nil
@@ -149,6 +198,9 @@ func (db DB) SelectGauge(ctx context.Context, k string) (float64, error) {
 		k,
 	)
 	if err := row.Scan(&g); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, fmt.Errorf("gauge: %w", models.ErrNotFound)
+		}
 		return 0, fmt.Errorf("failed to select gauge: %w", err)
 	}
 	return g, nil
@@ -162,6 +214,9 @@ func (db DB) SelectCounter(ctx context.Context, k string) (int64, error) {
 		k,
 	)
 	if err := row.Scan(&c); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, fmt.Errorf("counter: %w", models.ErrNotFound)
+		}
 		return 0, fmt.Errorf("failed to select counter: %w", err)
 	}
 	return c, nil
@@ -210,49 +265,91 @@ func (db DB) GetGauges(ctx context.Context) (map[string]float64, error) {
 }
 
 func (db DB) InsertBatch(ctx context.Context, metrics []models.Metrics) error {
-	sleepTime := 1 * time.Second
-	attempt := 0
+	return insertBatch(ctx, db.retryPolicy(ctx), aggregate(metrics), db.sendBatch)
+}
 
-	for {
-		tx, err := db.pool.Begin(ctx)
-		defer func() {
-			if err := tx.Rollback(ctx); err != nil {
-				log.Error().Err(err).Str("func", "InsertBatch").Msg("cannot rollback tx")
-			}
-		}()
-		if err != nil {
-			if !isConnExp(err) {
-				return fmt.Errorf("failed to open transaction: %w", err)
-			}
-			if attempt < retryAttempts {
-				log.Error().Err(err).Msgf("%s %v", connPGError, sleepTime)
-				time.Sleep(sleepTime)
-				sleepTime += repeatFactor * time.Second
-				attempt++
-				continue
-			}
-			break
-		}
+// insertBatch sends the batch with the retry policy. The batch is built again for every attempt:
+// pgx keeps the statements it prepared in the queued queries, and a retry may run on another
+// connection where they are not prepared.
+func insertBatch(ctx context.Context, p retry.Policy, ab aggregatedBatch,
+	send func(ctx context.Context, b *pgx.Batch) error) error {
+	if len(ab.counterIDs) == 0 && len(ab.gaugeIDs) == 0 {
+		return nil
+	}
 
-		b := createBatch(metrics)
-		batchResults := tx.SendBatch(ctx, b)
-		_, err = batchResults.Exec()
-		if err != nil {
-			return fmt.Errorf("cannot exec batch: %w", err)
-		}
+	return p.Do(ctx, func(ctx context.Context) error {
+		return send(ctx, createBatch(ab))
+	})
+}
 
-		if err := batchResults.Close(); err != nil {
-			return fmt.Errorf("insert batch cannot close batchResult: %w", err)
+// DeleteMetrics deletes the metrics with the IDs and types of metrics, the missing ones are ignored.
+func (db DB) DeleteMetrics(ctx context.Context, metrics []models.Metrics) error {
+	var counters, gauges []string
+	for _, m := range metrics {
+		switch m.MType {
+		case models.Counter:
+			counters = append(counters, m.ID)
+		case models.Gauge:
+			gauges = append(gauges, m.ID)
 		}
-		if err := tx.Commit(ctx); err != nil {
-			return fmt.Errorf("cannot commit transaction: %w", err)
+	}
+	if len(counters) == 0 && len(gauges) == 0 {
+		return nil
+	}
+
+	err := db.retryPolicy(ctx).Do(ctx, func(ctx context.Context) error {
+		b := &pgx.Batch{}
+		b.Queue(`DELETE FROM counters WHERE id = ANY($1)`, counters)
+		b.Queue(`DELETE FROM gauges WHERE id = ANY($1)`, gauges)
+		return db.sendBatch(ctx, b)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete metrics: %w", err)
+	}
+	return nil
+}
+
+// sendBatch sends the batch in a single transaction.
+func (db DB) sendBatch(ctx context.Context, b *pgx.Batch) error {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			l := requestid.Logger(ctx, log.Logger)
+			l.Error().Err(err).Str("func", "sendBatch").Msg("cannot rollback tx")
 		}
+	}()
 
-		break
+	if err := tx.SendBatch(ctx, b).Close(); err != nil {
+		return fmt.Errorf("cannot exec batch: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("cannot commit transaction: %w", err)
 	}
 	return nil
 }
 
+// retryPolicy returns the policy used to retry the writes failed with transient postgres errors.
+// The counter upserts add to the stored value, so only the writes known not to be applied are
+// retried. The retries are logged with the request ID of ctx.
+func (db DB) retryPolicy(ctx context.Context) retry.Policy {
+	l := requestid.Logger(ctx, log.Logger)
+	return retry.Policy{
+		InitialInterval:     retryInitialInterval,
+		MaxInterval:         retryMaxInterval,
+		MaxElapsedTime:      retryMaxElapsedTime,
+		Multiplier:          retryMultiplier,
+		RandomizationFactor: retryRandomization,
+		MaxAttempts:         retryAttempts,
+		Retryable:           retry.IsTransientPgWriteError,
+		OnRetry: func(err error, wait time.Duration) {
+			l.Error().Err(err).Dur("wait", wait).Msg(connPGError)
+		},
+	}
+}
+
 func (db DB) Ping(ctx context.Context) error {
 	if err := db.pool.Ping(ctx); err != nil {
 		return fmt.Errorf("cannot ping db: %w", err)
@@ -265,22 +362,67 @@ func (db *DB) Close(ctx context.Context) error {
 	return nil
 }
 
-func createBatch(metrics []models.Metrics) *pgx.Batch {
-	b := &pgx.Batch{}
-	for _, m := range metrics {
-		if m.MType == "counter" {
-			sqlStatement := `INSERT INTO counters (id, counter) VALUES ($1, $2)
-            		 ON CONFLICT (id) DO UPDATE SET counter = counters.counter + EXCLUDED.counter`
+// aggregatedBatch holds a batch of metrics with one entry per metric ID.
+// The IDs are sorted so concurrent batches lock rows in the same order.
+type aggregatedBatch struct {
+	counterIDs  []string
+	deltas      []int64
+	gaugeIDs    []string
+	gaugeValues []float64
+}
 
-			b.Queue(sqlStatement, m.ID, *m.Delta)
+// aggregate sums the counter deltas and keeps the last gauge value for each metric ID.
+func aggregate(metrics []models.Metrics) aggregatedBatch {
+	counters := make(map[string]int64)
+	gauges := make(map[string]float64)
+	for _, m := range metrics {
+		switch m.MType {
+		case models.Counter:
+			counters[m.ID] += *m.Delta
+		case models.Gauge:
+			gauges[m.ID] = *m.Value
 		}
+	}
 
-		if m.MType == "gauge" {
-			sqlStatement := `INSERT INTO gauges (id, gauge) VALUES ($1, $2)
-			 ON CONFLICT (id) DO UPDATE SET gauge = EXCLUDED.gauge`
+	ab := aggregatedBatch{
+		counterIDs:  make([]string, 0, len(counters)),
+		deltas:      make([]int64, 0, len(counters)),
+		gaugeIDs:    make([]string, 0, len(gauges)),
+		gaugeValues: make([]float64, 0, len(gauges)),
+	}
+	for id := range counters {
+		ab.counterIDs = append(ab.counterIDs, id)
+	}
+	sort.Strings(ab.counterIDs)
+	for _, id := range ab.counterIDs {
+		ab.deltas = append(ab.deltas, counters[id])
+	}
 
-			b.Queue(sqlStatement, m.ID, *m.Value)
-		}
+	for id := range gauges {
+		ab.gaugeIDs = append(ab.gaugeIDs, id)
+	}
+	sort.Strings(ab.gaugeIDs)
+	for _, id := range ab.gaugeIDs {
+		ab.gaugeValues = append(ab.gaugeValues, gauges[id])
+	}
+
+	return ab
+}
+
+// createBatch creates a batch with at most one unnest-based upsert per table.
+func createBatch(ab aggregatedBatch) *pgx.Batch {
+	b := &pgx.Batch{}
+	if len(ab.counterIDs) > 0 {
+		b.Queue(`INSERT INTO counters (id, counter)
+			 SELECT * FROM unnest($1::varchar[], $2::bigint[])
+			 ON CONFLICT (id) DO UPDATE SET counter = counters.counter + EXCLUDED.counter`,
+			ab.counterIDs, ab.deltas)
+	}
+	if len(ab.gaugeIDs) > 0 {
+		b.Queue(`INSERT INTO gauges (id, gauge)
+			 SELECT * FROM unnest($1::varchar[], $2::double precision[])
+			 ON CONFLICT (id) DO UPDATE SET gauge = EXCLUDED.gauge`,
+			ab.gaugeIDs, ab.gaugeValues)
 	}
 	return b
 }
@@ -0,0 +1,172 @@
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/ospiem/mcollector/internal/requestid"
+	"github.com/ospiem/mcollector/internal/retry"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDSNEnv names the environment variable with the DSN of a disposable database for benchmarks.
+const testDSNEnv = "TEST_DATABASE_DSN"
+
+func TestAggregate(t *testing.T) {
+	one, two, five := int64(1), int64(2), int64(5)
+	first, last := 1.5, 2.5
+
+	ab := aggregate([]models.Metrics{
+		{ID: "PollCount", MType: models.Counter, Delta: &one},
+		{ID: "Alloc", MType: models.Gauge, Value: &first},
+		{ID: "PollCount", MType: models.Counter, Delta: &two},
+		{ID: "Errors", MType: models.Counter, Delta: &five},
+		{ID: "Alloc", MType: models.Gauge, Value: &last},
+	})
+
+	assert.Equal(t, []string{"Errors", "PollCount"}, ab.counterIDs)
+	assert.Equal(t, []int64{5, 3}, ab.deltas)
+	assert.Equal(t, []string{"Alloc"}, ab.gaugeIDs)
+	assert.Equal(t, []float64{2.5}, ab.gaugeValues)
+}
+
+func TestCreateBatch(t *testing.T) {
+	assert.Equal(t, 0, createBatch(aggregate(nil)).Len())
+
+	v := 1.0
+	metrics := make([]models.Metrics, 0, 100)
+	for i := 0; i < 100; i++ {
+		metrics = append(metrics, models.Metrics{ID: fmt.Sprintf("g%d", i%10), MType: models.Gauge, Value: &v})
+	}
+	assert.Equal(t, 1, createBatch(aggregate(metrics)).Len())
+}
+
+func TestInsertBatchBuildsBatchPerAttempt(t *testing.T) {
+	v := 1.0
+	ab := aggregate([]models.Metrics{{ID: "Alloc", MType: models.Gauge, Value: &v}})
+	p := retry.Policy{InitialInterval: time.Millisecond, MaxInterval: time.Millisecond, Multiplier: 1, MaxAttempts: 3}
+
+	var sent []*pgx.Batch
+	err := insertBatch(context.Background(), p, ab, func(ctx context.Context, b *pgx.Batch) error {
+		sent = append(sent, b)
+		if len(sent) < 3 {
+			return errors.New("connection reset by peer")
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, sent, 3)
+	assert.NotSame(t, sent[0], sent[1])
+	assert.NotSame(t, sent[1], sent[2])
+	assert.Equal(t, 1, sent[2].Len())
+
+	err = insertBatch(context.Background(), p, aggregate(nil), func(ctx context.Context, b *pgx.Batch) error {
+		t.Error("an empty batch was sent")
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+// createBatchPerMetric is the previous implementation that queued one upsert per metric.
+// It is kept to compare the two approaches in benchmarks.
+func createBatchPerMetric(metrics []models.Metrics) *pgx.Batch {
+	b := &pgx.Batch{}
+	for _, m := range metrics {
+		if m.MType == models.Counter {
+			b.Queue(`INSERT INTO counters (id, counter) VALUES ($1, $2)
+			 ON CONFLICT (id) DO UPDATE SET counter = counters.counter + EXCLUDED.counter`, m.ID, *m.Delta)
+		}
+		if m.MType == models.Gauge {
+			b.Queue(`INSERT INTO gauges (id, gauge) VALUES ($1, $2)
+			 ON CONFLICT (id) DO UPDATE SET gauge = EXCLUDED.gauge`, m.ID, *m.Value)
+		}
+	}
+	return b
+}
+
+// benchMetrics returns n metrics spread over a fleet where every metric ID appears several times.
+func benchMetrics(n int) []models.Metrics {
+	metrics := make([]models.Metrics, 0, n)
+	for i := 0; i < n; i++ {
+		delta, value := int64(1), float64(i)
+		if i%2 == 0 {
+			metrics = append(metrics, models.Metrics{ID: fmt.Sprintf("counter%d", i%50), MType: models.Counter, Delta: &delta})
+			continue
+		}
+		metrics = append(metrics, models.Metrics{ID: fmt.Sprintf("gauge%d", i%50), MType: models.Gauge, Value: &value})
+	}
+	return metrics
+}
+
+func BenchmarkInsertBatch(b *testing.B) {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		b.Skipf("%s is not set", testDSNEnv)
+	}
+
+	ctx := context.Background()
+	db, err := NewDB(ctx, dsn)
+	require.NoError(b, err)
+	defer func() {
+		_ = db.Close(ctx)
+	}()
+
+	for _, n := range []int{100, 1000, 10000} {
+		metrics := benchMetrics(n)
+
+		b.Run(fmt.Sprintf("per-metric/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, db.sendBatch(ctx, createBatchPerMetric(metrics)))
+			}
+		})
+
+		b.Run(fmt.Sprintf("unnest/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, db.InsertBatch(ctx, metrics))
+			}
+		})
+	}
+}
+
+func BenchmarkCreateBatch(b *testing.B) {
+	metrics := benchMetrics(10000)
+
+	b.Run("per-metric", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			createBatchPerMetric(metrics)
+		}
+	})
+
+	b.Run("aggregated", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			createBatch(aggregate(metrics))
+		}
+	})
+}
+
+func TestRetryPolicyLogsRequestID(t *testing.T) {
+	var out bytes.Buffer
+	defer func(l zerolog.Logger) { log.Logger = l }(log.Logger)
+	log.Logger = zerolog.New(&out)
+
+	ctx := requestid.NewContext(context.Background(), "req-1")
+	DB{}.retryPolicy(ctx).OnRetry(errors.New("conn reset"), time.Second)
+	assert.JSONEq(t, `{"level":"error","request_id":"req-1","error":"conn reset","wait":1000,"message":"`+connPGError+`"}`,
+		out.String())
+}
+
+func TestLatestMigration(t *testing.T) {
+	version, err := latestMigration()
+	require.NoError(t, err)
+	assert.Equal(t, uint(1), version)
+}
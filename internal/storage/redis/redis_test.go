@@ -0,0 +1,125 @@
+package redis
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/ospiem/mcollector/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStorage(t *testing.T) (*Storage, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+
+	s, err := New(context.Background(), "redis://"+mr.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = s.Close(context.Background())
+	})
+
+	return s, mr
+}
+
+func TestStorage(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestStorage(t)
+
+	t.Run("InsertGauge", func(t *testing.T) {
+		assert.NoError(t, s.InsertGauge(ctx, "Alloc", 0.1))
+		assert.NoError(t, s.InsertGauge(ctx, "Alloc", 1024.5))
+	})
+
+	t.Run("InsertCounter", func(t *testing.T) {
+		assert.NoError(t, s.InsertCounter(ctx, "PollCount", 2))
+		assert.NoError(t, s.InsertCounter(ctx, "PollCount", 3))
+	})
+
+	t.Run("SelectGauge", func(t *testing.T) {
+		v, err := s.SelectGauge(ctx, "Alloc")
+		assert.NoError(t, err)
+		assert.Equal(t, 1024.5, v)
+	})
+
+	t.Run("SelectCounter", func(t *testing.T) {
+		v, err := s.SelectCounter(ctx, "PollCount")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(5), v)
+	})
+
+	t.Run("SelectNonExistingMetrics", func(t *testing.T) {
+		_, err := s.SelectGauge(ctx, "non_existing")
+		assert.ErrorIs(t, err, models.ErrNotFound)
+		_, err = s.SelectCounter(ctx, "non_existing")
+		assert.ErrorIs(t, err, models.ErrNotFound)
+	})
+
+	t.Run("InsertBatch", func(t *testing.T) {
+		delta, value := int64(10), 3.14
+		err := s.InsertBatch(ctx, []models.Metrics{
+			{ID: "PollCount", MType: models.Counter, Delta: &delta},
+			{ID: "PollCount", MType: models.Counter, Delta: &delta},
+			{ID: "Pi", MType: models.Gauge, Value: &value},
+		})
+		assert.NoError(t, err)
+	})
+
+	t.Run("GetCounters", func(t *testing.T) {
+		counters, err := s.GetCounters(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int64{"PollCount": 25}, counters)
+	})
+
+	t.Run("GetGauges", func(t *testing.T) {
+		gauges, err := s.GetGauges(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]float64{"Alloc": 1024.5, "Pi": 3.14}, gauges)
+	})
+
+	t.Run("DeleteMetrics", func(t *testing.T) {
+		assert.NoError(t, s.DeleteMetrics(ctx, []models.Metrics{
+			{ID: "Pi", MType: models.Gauge},
+			{ID: "Missing", MType: models.Counter},
+		}))
+		gauges, err := s.GetGauges(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]float64{"Alloc": 1024.5}, gauges)
+	})
+
+	t.Run("Ping", func(t *testing.T) {
+		assert.NoError(t, s.Ping(ctx))
+	})
+}
+
+func TestStorageSharedBetweenReplicas(t *testing.T) {
+	ctx := context.Background()
+	first, mr := newTestStorage(t)
+
+	second, err := New(ctx, "redis://"+mr.Addr())
+	require.NoError(t, err)
+	defer func() {
+		_ = second.Close(ctx)
+	}()
+
+	require.NoError(t, first.InsertCounter(ctx, "PollCount", 1))
+	require.NoError(t, second.InsertCounter(ctx, "PollCount", 1))
+
+	v, err := first.SelectCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), v)
+}
+
+func TestPingFailsWhenServerIsDown(t *testing.T) {
+	ctx := context.Background()
+	s, mr := newTestStorage(t)
+
+	mr.Close()
+	assert.Error(t, s.Ping(ctx))
+}
+
+func TestNewWithInvalidURL(t *testing.T) {
+	_, err := New(context.Background(), "not-a-url")
+	assert.Error(t, err)
+}
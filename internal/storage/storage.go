@@ -5,11 +5,14 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/ospiem/mcollector/internal/health"
 	"github.com/ospiem/mcollector/internal/models"
+	"github.com/ospiem/mcollector/internal/storage/cache"
 	"github.com/ospiem/mcollector/internal/storage/config"
 	"github.com/ospiem/mcollector/internal/storage/file"
 	memorystorage "github.com/ospiem/mcollector/internal/storage/memory"
 	"github.com/ospiem/mcollector/internal/storage/postgres"
+	"github.com/ospiem/mcollector/internal/storage/redis"
 )
 
 type Storage interface {
@@ -20,15 +23,51 @@ type Storage interface {
 	GetCounters(ctx context.Context) (map[string]int64, error)
 	GetGauges(ctx context.Context) (map[string]float64, error)
 	InsertBatch(ctx context.Context, metrics []models.Metrics) error
+	DeleteMetrics(ctx context.Context, metrics []models.Metrics) error
 	Ping(ctx context.Context) error
 	Close(ctx context.Context) error
 }
 
+// Checker is implemented by the storages with readiness checks besides Ping, e.g. the
+// migrations of the database.
+type Checker interface {
+	Checks() []health.Check
+}
+
+// Checks returns the readiness checks of s besides Ping, none if it has no other.
+func Checks(s Storage) []health.Check {
+	if c, ok := s.(Checker); ok {
+		return c.Checks()
+	}
+	return nil
+}
+
+// Reporter is implemented by the storages with statistics of their own, e.g. the hits of the cache.
+type Reporter interface {
+	// Flush returns the statistics changed since the previous flush as counters.
+	Flush() []models.Metrics
+}
+
 type Config struct {
 	//TODO: implement
 }
 
+// New creates the storage selected by cfg. The calls to the backend are traced. If cfg.Cache
+// is set, it is wrapped in a read-through cache.
 func New(ctx context.Context, cfg config.Config) (Storage, error) {
+	s, err := newBackend(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	s = traced{s: s, backend: backendName(cfg)}
+
+	if cfg.Cache {
+		return cache.New(s, cfg.CacheTTL), nil
+	}
+	return s, nil
+}
+
+func newBackend(ctx context.Context, cfg config.Config) (Storage, error) {
 	if cfg.DatabaseDsn != "" {
 		db, err := postgres.NewDB(ctx, cfg.DatabaseDsn)
 		if err != nil {
@@ -37,6 +76,14 @@ func New(ctx context.Context, cfg config.Config) (Storage, error) {
 		return db, nil
 	}
 
+	if cfg.RedisURL != "" {
+		r, err := redis.New(ctx, cfg.RedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init redis client: %w", err)
+		}
+		return r, nil
+	}
+
 	if cfg.FileStoragePath != "" {
 		f, err := file.New(ctx, cfg.FileStoragePath, cfg.Restore, cfg.StoreInterval)
 		if err != nil {
@@ -47,3 +94,17 @@ func New(ctx context.Context, cfg config.Config) (Storage, error) {
 
 	return memorystorage.New(), nil
 }
+
+// backendName returns the name of the backend selected by cfg, in the same order as newBackend.
+func backendName(cfg config.Config) string {
+	switch {
+	case cfg.DatabaseDsn != "":
+		return "postgresql"
+	case cfg.RedisURL != "":
+		return "redis"
+	case cfg.FileStoragePath != "":
+		return "file"
+	default:
+		return "memory"
+	}
+}
@@ -0,0 +1,28 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/ospiem/mcollector/internal/storage/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := New(ctx, config.Config{})
+	require.NoError(t, err)
+	assert.Empty(t, Checks(s))
+
+	s, err = New(ctx, config.Config{FileStoragePath: filepath.Join(t.TempDir(), "metrics.json"), Cache: true})
+	require.NoError(t, err)
+	checks := Checks(s)
+	require.Len(t, checks, 1)
+	assert.Equal(t, "file", checks[0].Name)
+	assert.NoError(t, checks[0].Run(ctx))
+	assert.Implements(t, (*Reporter)(nil), s, "the cache reports its statistics")
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/ospiem/mcollector/internal/health"
+	"github.com/ospiem/mcollector/internal/models"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/ospiem/mcollector/internal/storage"
+
+// traced records a span for every call to the backend, with its retries as events.
+type traced struct {
+	s       Storage
+	backend string
+}
+
+// start starts the span of a call, ended by the returned function with the error of the call.
+func (t traced) start(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "storage."+op, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(append(attrs, attribute.String("db.system", t.backend))...))
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+func (t traced) InsertGauge(ctx context.Context, k string, v float64) (err error) {
+	ctx, end := t.start(ctx, "InsertGauge", attribute.String("metric.id", k))
+	defer func() { end(err) }()
+	return t.s.InsertGauge(ctx, k, v)
+}
+
+func (t traced) InsertCounter(ctx context.Context, k string, v int64) (err error) {
+	ctx, end := t.start(ctx, "InsertCounter", attribute.String("metric.id", k))
+	defer func() { end(err) }()
+	return t.s.InsertCounter(ctx, k, v)
+}
+
+func (t traced) SelectGauge(ctx context.Context, k string) (_ float64, err error) {
+	ctx, end := t.start(ctx, "SelectGauge", attribute.String("metric.id", k))
+	defer func() { end(err) }()
+	return t.s.SelectGauge(ctx, k)
+}
+
+func (t traced) SelectCounter(ctx context.Context, k string) (_ int64, err error) {
+	ctx, end := t.start(ctx, "SelectCounter", attribute.String("metric.id", k))
+	defer func() { end(err) }()
+	return t.s.SelectCounter(ctx, k)
+}
+
+func (t traced) GetCounters(ctx context.Context) (_ map[string]int64, err error) {
+	ctx, end := t.start(ctx, "GetCounters")
+	defer func() { end(err) }()
+	return t.s.GetCounters(ctx)
+}
+
+func (t traced) GetGauges(ctx context.Context) (_ map[string]float64, err error) {
+	ctx, end := t.start(ctx, "GetGauges")
+	defer func() { end(err) }()
+	return t.s.GetGauges(ctx)
+}
+
+func (t traced) InsertBatch(ctx context.Context, metrics []models.Metrics) (err error) {
+	ctx, end := t.start(ctx, "InsertBatch", attribute.Int("metrics", len(metrics)))
+	defer func() { end(err) }()
+	return t.s.InsertBatch(ctx, metrics)
+}
+
+func (t traced) DeleteMetrics(ctx context.Context, metrics []models.Metrics) (err error) {
+	ctx, end := t.start(ctx, "DeleteMetrics", attribute.Int("metrics", len(metrics)))
+	defer func() { end(err) }()
+	return t.s.DeleteMetrics(ctx, metrics)
+}
+
+func (t traced) Ping(ctx context.Context) (err error) {
+	ctx, end := t.start(ctx, "Ping")
+	defer func() { end(err) }()
+	return t.s.Ping(ctx)
+}
+
+func (t traced) Close(ctx context.Context) error {
+	return t.s.Close(ctx)
+}
+
+// Checks returns the readiness checks of the backend.
+func (t traced) Checks() []health.Check {
+	return Checks(t.s)
+}
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ospiem/mcollector/internal/storage/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTraced(t *testing.T) {
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	rec := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+
+	s, err := New(context.Background(), config.Config{})
+	require.NoError(t, err)
+	require.NoError(t, s.InsertGauge(context.Background(), "Alloc", 1))
+	_, err = s.SelectCounter(context.Background(), "PollCount")
+	require.Error(t, err)
+
+	spans := rec.Ended()
+	require.Len(t, spans, 2)
+	assert.Equal(t, "storage.InsertGauge", spans[0].Name())
+	assert.Contains(t, spans[0].Attributes(), attribute.String("db.system", "memory"))
+	assert.Contains(t, spans[0].Attributes(), attribute.String("metric.id", "Alloc"))
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+}
@@ -0,0 +1,412 @@
+// Package transfer provides functionality for moving metrics between storage backends
+// and for dumping and restoring them as portable snapshots.
+//
+// The storages return all their metrics at once, so the source, or the snapshot, is held in
+// memory while it is transferred: the memory used grows with the number of metrics. Only the
+// writes to the destination are done in batches.
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/ospiem/mcollector/internal/models"
+)
+
+// snapshotVersion is the version of the snapshot format written by Dump.
+const snapshotVersion = 1
+
+// defaultBatchSize is the number of metrics sent to the destination in one InsertBatch call.
+const defaultBatchSize = 500
+
+// ErrChecksumMismatch is returned when a snapshot does not match its checksum.
+var ErrChecksumMismatch = errors.New("snapshot checksum mismatch")
+
+// Storage is the subset of the storage interface needed to read and write metrics.
+type Storage interface {
+	GetCounters(ctx context.Context) (map[string]int64, error)
+	GetGauges(ctx context.Context) (map[string]float64, error)
+	InsertBatch(ctx context.Context, metrics []models.Metrics) error
+}
+
+// Options configures Copy and Restore.
+type Options struct {
+	BatchSize int  // BatchSize is the number of metrics written per InsertBatch call.
+	DryRun    bool // DryRun reads the source but does not write to the destination.
+}
+
+// Stats holds the number of metrics processed by Copy, Dump or Restore.
+type Stats struct {
+	Counters int
+	Gauges   int
+}
+
+// header is the first line of a snapshot.
+type header struct {
+	Created time.Time `json:"created"`
+	Version int       `json:"version"`
+}
+
+// trailer is the last line of a snapshot. Checksum is the SHA-256 of all metric lines.
+type trailer struct {
+	Checksum string `json:"sha256"`
+	Count    int    `json:"count"`
+}
+
+// record is one line of a snapshot: exactly one of its fields is set.
+type record struct {
+	Header  *header         `json:"header,omitempty"`
+	Metric  *models.Metrics `json:"metric,omitempty"`
+	Trailer *trailer        `json:"trailer,omitempty"`
+}
+
+// Copy reads all metrics from src and writes them to dst in batches. The counters of dst end
+// up with the values of src whatever they held before, so copying again changes nothing.
+func Copy(ctx context.Context, src, dst Storage, opts Options) (Stats, error) {
+	metrics, err := readAll(ctx, src)
+	if err != nil {
+		return Stats{}, fmt.Errorf("failed to read source: %w", err)
+	}
+
+	return writeAll(ctx, dst, metrics, opts)
+}
+
+// Dump writes all metrics from src to w as a gzip-compressed snapshot with a checksum.
+func Dump(ctx context.Context, src Storage, w io.Writer) (Stats, error) {
+	metrics, err := readAll(ctx, src)
+	if err != nil {
+		return Stats{}, fmt.Errorf("failed to read source: %w", err)
+	}
+
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+
+	if err = enc.Encode(record{Header: &header{Version: snapshotVersion, Created: time.Now().UTC()}}); err != nil {
+		return Stats{}, fmt.Errorf("failed to write header: %w", err)
+	}
+
+	h := sha256.New()
+	var stats Stats
+	for i := range metrics {
+		line, err := encodeMetric(h, &metrics[i])
+		if err != nil {
+			return Stats{}, err
+		}
+		if _, err = gz.Write(line); err != nil {
+			return Stats{}, fmt.Errorf("failed to write metric %s: %w", metrics[i].ID, err)
+		}
+		stats.add(metrics[i])
+	}
+
+	t := trailer{Count: len(metrics), Checksum: hex.EncodeToString(h.Sum(nil))}
+	if err = enc.Encode(record{Trailer: &t}); err != nil {
+		return Stats{}, fmt.Errorf("failed to write trailer: %w", err)
+	}
+	if err = gz.Close(); err != nil {
+		return Stats{}, fmt.Errorf("failed to close gzip: %w", err)
+	}
+
+	return stats, nil
+}
+
+// Restore reads a snapshot from r, validates its checksum and writes the metrics to dst like Copy.
+// Nothing is written unless the whole snapshot is valid.
+func Restore(ctx context.Context, r io.Reader, dst Storage, opts Options) (Stats, error) {
+	metrics, err := ReadSnapshot(r)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	return writeAll(ctx, dst, metrics, opts)
+}
+
+// ReadSnapshot reads and validates a snapshot written by Dump.
+func ReadSnapshot(r io.Reader) ([]models.Metrics, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open gzip: %w", err)
+	}
+	defer func() {
+		_ = gz.Close()
+	}()
+
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), 1<<20)
+
+	var hdr *header
+	var tr *trailer
+	var metrics []models.Metrics
+	h := sha256.New()
+
+	for scanner.Scan() {
+		if tr != nil {
+			return nil, errors.New("unexpected data after snapshot trailer")
+		}
+
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("failed to parse snapshot line: %w", err)
+		}
+
+		switch {
+		case rec.Header != nil:
+			if hdr != nil {
+				return nil, errors.New("duplicate snapshot header")
+			}
+			hdr = rec.Header
+			if hdr.Version != snapshotVersion {
+				return nil, fmt.Errorf("unsupported snapshot version %d", hdr.Version)
+			}
+		case rec.Metric != nil:
+			if hdr == nil {
+				return nil, errors.New("snapshot header is missing")
+			}
+			if err := validateMetric(rec.Metric); err != nil {
+				return nil, err
+			}
+			if _, err := encodeMetric(h, rec.Metric); err != nil {
+				return nil, err
+			}
+			metrics = append(metrics, *rec.Metric)
+		case rec.Trailer != nil:
+			tr = rec.Trailer
+		default:
+			return nil, errors.New("empty snapshot line")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	if hdr == nil {
+		return nil, errors.New("snapshot header is missing")
+	}
+	if tr == nil {
+		return nil, errors.New("snapshot trailer is missing, the file may be truncated")
+	}
+	if tr.Count != len(metrics) {
+		return nil, fmt.Errorf("%w: expected %d metrics, got %d", ErrChecksumMismatch, tr.Count, len(metrics))
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != tr.Checksum {
+		return nil, fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, tr.Checksum, sum)
+	}
+
+	return metrics, nil
+}
+
+// Diff describes a metric that differs between two storages.
+type Diff struct {
+	ID    string
+	MType string
+	Left  string
+	Right string
+}
+
+// Verify compares the metrics of two storages and returns every difference.
+func Verify(ctx context.Context, left, right Storage) ([]Diff, error) {
+	lc, err := left.GetCounters(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get counters from the left side: %w", err)
+	}
+	rc, err := right.GetCounters(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get counters from the right side: %w", err)
+	}
+	lg, err := left.GetGauges(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gauges from the left side: %w", err)
+	}
+	rg, err := right.GetGauges(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gauges from the right side: %w", err)
+	}
+
+	diffs := diffMaps(models.Counter, lc, rc)
+	diffs = append(diffs, diffMaps(models.Gauge, lg, rg)...)
+
+	return diffs, nil
+}
+
+// diffMaps returns the differences between two maps of metrics of the same type.
+func diffMaps[T int64 | float64](mType string, left, right map[string]T) []Diff {
+	var diffs []Diff
+	for k, lv := range left {
+		rv, ok := right[k]
+		switch {
+		case !ok:
+			diffs = append(diffs, Diff{ID: k, MType: mType, Left: fmt.Sprint(lv), Right: "<missing>"})
+		case lv != rv && !(isNaN(lv) && isNaN(rv)):
+			diffs = append(diffs, Diff{ID: k, MType: mType, Left: fmt.Sprint(lv), Right: fmt.Sprint(rv)})
+		}
+	}
+	for k, rv := range right {
+		if _, ok := left[k]; !ok {
+			diffs = append(diffs, Diff{ID: k, MType: mType, Left: "<missing>", Right: fmt.Sprint(rv)})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].ID < diffs[j].ID })
+	return diffs
+}
+
+// isNaN reports whether v is a NaN gauge, which is never equal to itself.
+func isNaN[T int64 | float64](v T) bool {
+	return math.IsNaN(float64(v))
+}
+
+// readAll reads every metric from s and returns them sorted by type and ID.
+func readAll(ctx context.Context, s Storage) ([]models.Metrics, error) {
+	counters, err := s.GetCounters(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get counters: %w", err)
+	}
+	gauges, err := s.GetGauges(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gauges: %w", err)
+	}
+
+	metrics := make([]models.Metrics, 0, len(counters)+len(gauges))
+	for id, v := range counters {
+		delta := v
+		metrics = append(metrics, models.Metrics{ID: id, MType: models.Counter, Delta: &delta})
+	}
+	for id, v := range gauges {
+		value := v
+		metrics = append(metrics, models.Metrics{ID: id, MType: models.Gauge, Value: &value})
+	}
+
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].MType != metrics[j].MType {
+			return metrics[i].MType < metrics[j].MType
+		}
+		return metrics[i].ID < metrics[j].ID
+	})
+
+	return metrics, nil
+}
+
+// writeAll writes metrics to dst in batches of opts.BatchSize. The storages add the counters up,
+// so every counter is written as its difference to the value in dst.
+func writeAll(ctx context.Context, dst Storage, metrics []models.Metrics, opts Options) (Stats, error) {
+	size := opts.BatchSize
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+
+	current, err := dst.GetCounters(ctx)
+	if err != nil {
+		return Stats{}, fmt.Errorf("failed to get the counters of the destination: %w", err)
+	}
+
+	var stats Stats
+	batch := make([]models.Metrics, 0, size)
+	flush := func() error {
+		if len(batch) == 0 || opts.DryRun {
+			batch = batch[:0]
+			return nil
+		}
+		if err := dst.InsertBatch(ctx, batch); err != nil {
+			return fmt.Errorf("failed to write batch of %d metrics: %w", len(batch), err)
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	for _, m := range metrics {
+		stats.add(m)
+		if m.MType == models.Counter {
+			delta := *m.Delta - current[m.ID]
+			if delta == 0 {
+				continue
+			}
+			m.Delta = &delta
+		}
+		if batch = append(batch, m); len(batch) == size {
+			if err := flush(); err != nil {
+				return stats, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+// encodeMetric encodes a metric as one snapshot line and adds it to the checksum.
+func encodeMetric(h hash.Hash, m *models.Metrics) ([]byte, error) {
+	line, err := json.Marshal(record{Metric: m})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode metric %s: %w", m.ID, err)
+	}
+	line = append(line, '\n')
+	h.Write(line)
+
+	return line, nil
+}
+
+// validateMetric checks that a metric read from a snapshot can be written to a storage.
+func validateMetric(m *models.Metrics) error {
+	switch m.MType {
+	case models.Counter:
+		if m.Delta == nil {
+			return fmt.Errorf("counter %s has no delta", m.ID)
+		}
+	case models.Gauge:
+		if m.Value == nil {
+			return fmt.Errorf("gauge %s has no value", m.ID)
+		}
+	default:
+		return fmt.Errorf("metric %s has invalid type %q", m.ID, m.MType)
+	}
+	return nil
+}
+
+func (s *Stats) add(m models.Metrics) {
+	switch m.MType {
+	case models.Counter:
+		s.Counters++
+	case models.Gauge:
+		s.Gauges++
+	}
+}
+
+// SnapshotStorage is a read-only Storage backed by the metrics of a snapshot.
+// It lets a snapshot be used as the source of Copy or one side of Verify.
+type SnapshotStorage []models.Metrics
+
+func (s SnapshotStorage) GetCounters(ctx context.Context) (map[string]int64, error) {
+	c := make(map[string]int64)
+	for _, m := range s {
+		if m.MType == models.Counter {
+			c[m.ID] += *m.Delta
+		}
+	}
+	return c, nil
+}
+
+func (s SnapshotStorage) GetGauges(ctx context.Context) (map[string]float64, error) {
+	g := make(map[string]float64)
+	for _, m := range s {
+		if m.MType == models.Gauge {
+			g[m.ID] = *m.Value
+		}
+	}
+	return g, nil
+}
+
+func (s SnapshotStorage) InsertBatch(ctx context.Context, metrics []models.Metrics) error {
+	return errors.New("snapshot is read-only")
+}
@@ -0,0 +1,139 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/ospiem/mcollector/internal/models"
+	memorystorage "github.com/ospiem/mcollector/internal/storage/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSource(t *testing.T) *memorystorage.MemStorage {
+	t.Helper()
+	ctx := context.Background()
+	src := memorystorage.New()
+	require.NoError(t, src.InsertCounter(ctx, "PollCount", 42))
+	require.NoError(t, src.InsertCounter(ctx, "Requests", 7))
+	require.NoError(t, src.InsertGauge(ctx, "Alloc", 1024.5))
+	return src
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	src := newSource(t)
+
+	t.Run("copies every metric", func(t *testing.T) {
+		dst := memorystorage.New()
+		stats, err := Copy(ctx, src, dst, Options{BatchSize: 1})
+		require.NoError(t, err)
+		assert.Equal(t, Stats{Counters: 2, Gauges: 1}, stats)
+
+		diffs, err := Verify(ctx, src, dst)
+		require.NoError(t, err)
+		assert.Empty(t, diffs)
+	})
+
+	t.Run("sets the counters of a populated destination", func(t *testing.T) {
+		dst := memorystorage.New()
+		require.NoError(t, dst.InsertCounter(ctx, "PollCount", 100))
+		require.NoError(t, dst.InsertCounter(ctx, "Other", 3))
+
+		// Copying twice does not count the counters twice.
+		for i := 0; i < 2; i++ {
+			_, err := Copy(ctx, src, dst, Options{BatchSize: 2})
+			require.NoError(t, err)
+		}
+
+		diffs, err := Verify(ctx, src, dst)
+		require.NoError(t, err)
+		assert.Equal(t, []Diff{{ID: "Other", MType: models.Counter, Left: "<missing>", Right: "3"}}, diffs)
+	})
+
+	t.Run("dry run does not write", func(t *testing.T) {
+		dst := memorystorage.New()
+		stats, err := Copy(ctx, src, dst, Options{DryRun: true})
+		require.NoError(t, err)
+		assert.Equal(t, Stats{Counters: 2, Gauges: 1}, stats)
+
+		diffs, err := Verify(ctx, src, dst)
+		require.NoError(t, err)
+		assert.Len(t, diffs, 3)
+	})
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	left := newSource(t)
+	right := memorystorage.New()
+	require.NoError(t, right.InsertCounter(ctx, "PollCount", 41))
+	require.NoError(t, right.InsertGauge(ctx, "Alloc", 1024.5))
+	require.NoError(t, right.InsertGauge(ctx, "Extra", 1))
+
+	diffs, err := Verify(ctx, left, right)
+	require.NoError(t, err)
+	assert.Equal(t, []Diff{
+		{ID: "PollCount", MType: models.Counter, Left: "42", Right: "41"},
+		{ID: "Requests", MType: models.Counter, Left: "7", Right: "<missing>"},
+		{ID: "Extra", MType: models.Gauge, Left: "<missing>", Right: "1"},
+	}, diffs)
+}
+
+func TestDumpAndRestore(t *testing.T) {
+	ctx := context.Background()
+	src := newSource(t)
+
+	var buf bytes.Buffer
+	stats, err := Dump(ctx, src, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, Stats{Counters: 2, Gauges: 1}, stats)
+
+	dst := memorystorage.New()
+	stats, err = Restore(ctx, bytes.NewReader(buf.Bytes()), dst, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, Stats{Counters: 2, Gauges: 1}, stats)
+
+	diffs, err := Verify(ctx, src, dst)
+	require.NoError(t, err)
+	assert.Empty(t, diffs)
+}
+
+func TestReadSnapshotWithCorruptedData(t *testing.T) {
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	_, err := Dump(ctx, newSource(t), &buf)
+	require.NoError(t, err)
+
+	gz, err := gzip.NewReader(&buf)
+	require.NoError(t, err)
+	var plain bytes.Buffer
+	_, err = plain.ReadFrom(gz)
+	require.NoError(t, err)
+
+	t.Run("tampered value", func(t *testing.T) {
+		tampered := bytes.Replace(plain.Bytes(), []byte(`"delta":42`), []byte(`"delta":43`), 1)
+		_, err := ReadSnapshot(compress(t, tampered))
+		assert.ErrorIs(t, err, ErrChecksumMismatch)
+	})
+
+	t.Run("truncated snapshot", func(t *testing.T) {
+		lines := bytes.SplitAfter(plain.Bytes(), []byte("\n"))
+		truncated := bytes.Join(lines[:len(lines)-2], nil)
+		_, err := ReadSnapshot(compress(t, truncated))
+		assert.Error(t, err)
+	})
+}
+
+func compress(t *testing.T, data []byte) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	return &buf
+}
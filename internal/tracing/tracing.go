@@ -0,0 +1,142 @@
+// Package tracing sets up the OpenTelemetry tracing of the agent and the server: the exporter the
+// spans are sent to and the propagation of the trace context in the HTTP headers.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ospiem/mcollector/internal/configload"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Exporters of the spans.
+const (
+	ExporterNone   = ""
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+const defaultEndpoint = "http://localhost:4318"
+
+// Config configures the tracing.
+type Config struct {
+	// Exporter is where the spans are sent: otlp, stdout or file. Empty disables tracing.
+	Exporter string
+	// Endpoint is the URL of the OTLP/HTTP collector.
+	Endpoint string
+	// File is the path of the file the spans are appended to as JSON by the file exporter.
+	File string
+	// SampleRatio is the fraction of the traces started here that are recorded, the ones
+	// started by a caller follow its decision.
+	SampleRatio float64
+}
+
+// Defaults returns the default configuration, with tracing disabled.
+func Defaults() Config {
+	return Config{Endpoint: defaultEndpoint, SampleRatio: 1}
+}
+
+// Settings declares the settings of the tracing in the tracing section. The current values of c
+// are the defaults.
+func Settings(c *Config) []*configload.Setting {
+	return []*configload.Setting{
+		{Key: "tracing.exporter", Flag: "trace-exporter", Env: "TRACE_EXPORTER", Value: configload.String(&c.Exporter),
+			Usage: "Configure where the traces are sent: otlp, stdout or file, tracing is disabled by default",
+			Check: func() error {
+				return configload.OneOf(c.Exporter, ExporterNone, ExporterOTLP, ExporterStdout, ExporterFile)
+			}},
+		{Key: "tracing.endpoint", Flag: "trace-endpoint", Env: "TRACE_ENDPOINT", Value: configload.String(&c.Endpoint),
+			Usage: "Configure the URL of the OTLP/HTTP collector receiving the traces"},
+		{Key: "tracing.file", Flag: "trace-file", Env: "TRACE_FILE", Value: configload.String(&c.File),
+			Usage: "Configure the file the file exporter appends the traces to",
+			Check: func() error {
+				if c.Exporter == ExporterFile && c.File == "" {
+					return errors.New("the file exporter needs a file")
+				}
+				return nil
+			}},
+		{Key: "tracing.sample_ratio", Flag: "trace-sample-ratio", Env: "TRACE_SAMPLE_RATIO",
+			Value: configload.Float(&c.SampleRatio),
+			Usage: "Configure the fraction of the traces recorded, from 0 to 1",
+			Check: func() error {
+				if c.SampleRatio < 0 || c.SampleRatio > 1 {
+					return fmt.Errorf("must be between 0 and 1, got %v", c.SampleRatio)
+				}
+				return nil
+			}},
+	}
+}
+
+// Start installs the propagation of the trace context and, unless tracing is disabled, the tracer
+// provider exporting the spans of the service. Call the returned function to flush the spans
+// left on shutdown.
+func Start(ctx context.Context, cfg Config, service string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if cfg.Exporter == ExporterNone {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exp, closeExp, err := newExporter(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %w", cfg.Exporter, err)
+	}
+	res, err := resource.Merge(resource.Default(),
+		resource.NewSchemaless(attribute.String("service.name", service)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe the service: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if closeErr := closeExp(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to flush traces: %w", err)
+		}
+		return nil
+	}, nil
+}
+
+// newExporter creates the exporter of the configuration and the function releasing it once
+// the tracer provider is shut down.
+func newExporter(ctx context.Context, cfg Config) (sdktrace.SpanExporter, func() error, error) {
+	nop := func() error { return nil }
+	switch cfg.Exporter {
+	case ExporterOTLP:
+		exp, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		return exp, nop, err
+	case ExporterStdout:
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		return exp, nop, err
+	case ExporterFile:
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, nil, err
+		}
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			return nil, nil, errors.Join(err, f.Close())
+		}
+		return exp, f.Close, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown exporter %q", cfg.Exporter)
+	}
+}
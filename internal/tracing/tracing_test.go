@@ -0,0 +1,38 @@
+package tracing
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+)
+
+func TestStartFile(t *testing.T) {
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+
+	cfg := Defaults()
+	cfg.Exporter = ExporterFile
+	cfg.File = filepath.Join(t.TempDir(), "traces.jsonl")
+	shutdown, err := Start(context.Background(), cfg, "mcollector-test")
+	require.NoError(t, err)
+
+	_, span := otel.Tracer("test").Start(context.Background(), "send metrics")
+	span.End()
+	require.NoError(t, shutdown(context.Background()))
+
+	data, err := os.ReadFile(cfg.File)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"Name":"send metrics"`)
+	assert.Contains(t, string(data), "mcollector-test")
+}
+
+func TestStartDisabled(t *testing.T) {
+	shutdown, err := Start(context.Background(), Defaults(), "mcollector-test")
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+	assert.Contains(t, otel.GetTextMapPropagator().Fields(), "traceparent")
+}